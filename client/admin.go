@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// readTokenFile reads the admin token from path, as given by -token-file,
+// so that it stays out of the process list. Surrounding whitespace, such as
+// the trailing newline an editor adds, is not part of the token.
+func readTokenFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+	return token, nil
+}
+
+// authenticate logs in with token, which decides what the session may do:
+// read-only, read-write or admin.
+func authenticate(session quic.Connection, token string) {
+	response, err := sendCommand(context.Background(), session, "auth "+token)
+	if err != nil {
+		log.Printf("Error authenticating: %v\n", err)
+		return
+	}
+	if strings.HasPrefix(response, "Error:") {
+		fmt.Println(colorError("Login failed: " + strings.TrimSpace(strings.TrimPrefix(response, "Error:"))))
+		return
+	}
+	// Servers from before tokens carried permissions answer a bare "OK",
+	// and only for admin tokens.
+	perm := strings.TrimSpace(strings.TrimPrefix(response, "OK"))
+	if perm == "" {
+		perm = "admin"
+	}
+	fmt.Printf("Logged in with %s access.\n", perm)
+}
+
+func listClients(ctx context.Context, session quic.Connection) {
+	response, err := sendCommand(ctx, session, "clients")
+	if err != nil {
+		log.Printf("Error listing clients: %v\n", err)
+		return
+	}
+	if strings.HasPrefix(response, "Error:") {
+		fmt.Println(colorError(response))
+		return
+	}
+	fmt.Println("Connected clients:")
+	fmt.Println(response)
+}
+
+// showInfo prints the server's uptime and activity counters.
+func showInfo(ctx context.Context, session quic.Connection) {
+	response, err := sendCommand(ctx, session, "info")
+	if err != nil {
+		log.Printf("Error fetching server info: %v\n", err)
+		return
+	}
+	if strings.HasPrefix(response, "Error:") {
+		fmt.Println(colorError(response))
+		return
+	}
+	fmt.Println(response)
+}
+
+// kickClient asks the server to disconnect another client. args is the
+// remote address, optionally followed by a reason.
+func kickClient(ctx context.Context, session quic.Connection, args string) {
+	response, err := sendCommand(ctx, session, "kick "+args)
+	if err != nil {
+		log.Printf("Error kicking client: %v\n", err)
+		return
+	}
+	fmt.Println(colorReply(response))
+}
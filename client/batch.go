@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// batchUploads is set by -batch-upload.
+var batchUploads = true
+
+// batchFile is one file of an upload batch, opened and ready to send.
+type batchFile struct {
+	index int // in the command's file list
+	name  string
+	file  *os.File
+	size  int64 // on disk
+	sent  int64 // on the wire, larger when encrypted
+}
+
+// uploadBatch sends fileNames on a single stream with upd-batch, so that a
+// command with many small files costs one round trip rather than one per
+// file:
+//
+//	upd-batch <count>
+//	<name> <size>     followed by exactly size bytes, count times
+//
+// The server answers each file with "OK <name>" or "Error: <name>: <reason>"
+// once it has stored or refused it. ok is false if the server does not know
+// upd-batch, in which case the caller uploads the files one at a time.
+func uploadBatch(ctx context.Context, session quic.Connection, fileNames []string) (results []fileResult, ok bool) {
+	results = failAll(fileNames, errNotAttempted)
+	var files []batchFile
+	for i, fileName := range fileNames {
+		file, err := os.Open(sourcePath(fileName))
+		if err != nil {
+			results[i].err = fmt.Errorf("could not open: %v", err)
+			continue
+		}
+		defer file.Close()
+		info, err := file.Stat()
+		if err != nil {
+			results[i].err = fmt.Errorf("could not stat: %v", err)
+			continue
+		}
+		sent := info.Size()
+		if encryptFiles {
+			sent = encryptedSize(sent)
+		}
+		files = append(files, batchFile{index: i, name: fileName, file: file, size: info.Size(), sent: sent})
+	}
+	if len(files) == 0 {
+		return results, true
+	}
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		for _, f := range files {
+			results[f.index].err = fmt.Errorf("could not open stream: %v", err)
+		}
+		return results, true
+	}
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+
+	fmt.Printf("Uploading %d files in one batch\n", len(files))
+	sent := 0
+	_, sendErr := stream.Write([]byte(tagged(fmt.Sprintf("upd-batch %d\n", len(files)))))
+	for sendErr == nil && sent < len(files) {
+		if sendErr = sendBatchFile(stream, files[sent]); sendErr == nil {
+			sent++
+		}
+	}
+	if sendErr != nil {
+		// Whatever was cut short leaves the stream out of step, so the
+		// server is told to drop the rest and still answers for the files
+		// it already has.
+		stream.CancelWrite(streamCancelled)
+	} else {
+		stream.Close()
+	}
+
+	reader := bufio.NewReader(stream)
+	for i, f := range files {
+		if i > sent || (i == sent && sendErr == nil) {
+			break
+		}
+		extendDeadline(stream)
+		line, err := reader.ReadString('\n')
+		if abortIfTimedOut(stream, f.name, err) {
+			results[f.index].err = errTimedOut
+			break
+		}
+		line = strings.TrimSpace(line)
+		if i == 0 && line == "Unknown command" {
+			return nil, false
+		}
+		if line == "OK "+f.name {
+			results[f.index] = fileResult{name: f.name, size: f.size}
+			continue
+		}
+		if reason, found := strings.CutPrefix(line, "Error: "+f.name+": "); found {
+			results[f.index].err = errors.New(reason)
+			continue
+		}
+		// Anything else explains why the batch ended here.
+		switch {
+		case ctx.Err() != nil:
+			results[f.index].err = errors.New("cancelled")
+		case strings.HasPrefix(line, "Error: "):
+			results[f.index].err = errors.New(strings.TrimPrefix(line, "Error: "))
+		case i == sent && sendErr != nil:
+			results[f.index].err = sendErr
+		default:
+			results[f.index].err = errors.New("no status from the server")
+		}
+		break
+	}
+	return results, true
+}
+
+// sendBatchFile writes the header and bytes of one file of a batch. An
+// error leaves the stream out of step with the batch.
+func sendBatchFile(stream quic.Stream, f batchFile) error {
+	extendDeadline(stream)
+	if _, err := stream.Write([]byte(fmt.Sprintf("%s %d\n", f.name, f.sent))); err != nil {
+		return err
+	}
+	var body io.WriteCloser = nopWriteCloser{stream}
+	if encryptFiles {
+		enc, err := newEncryptWriter(stream)
+		if err != nil {
+			return err
+		}
+		body = enc
+	}
+	report := newProgress(f.name, 0, f.size, true)
+	buffer := make([]byte, 32*1024)
+	var done int64
+	for done < f.size {
+		n, err := f.file.Read(buffer[:min(int64(len(buffer)), f.size-done)])
+		if n > 0 {
+			extendDeadline(stream)
+			if _, werr := body.Write(buffer[:n]); werr != nil {
+				return werr
+			}
+			done += int64(n)
+			report.update(done)
+		}
+		if err == io.EOF && done < f.size {
+			return fmt.Errorf("file shrank to %d bytes while being sent", done)
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("could not read file: %v", err)
+		}
+	}
+	if f.size == 0 {
+		report.update(0)
+	}
+	if progressMode == "bar" {
+		fmt.Println()
+	}
+	return body.Close()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkUploadMany uploads 1000 files of 512 bytes with one upd, in a
+// batch on one stream and with one stream per file as -batch-upload=false
+// does. Over loopback the difference is the per-file round trips; on a real
+// network it grows with the RTT.
+func BenchmarkUploadMany(b *testing.B) {
+	const files, size = 1000, 512
+	storage := startServer(b)
+	session := connect(b)
+	var names []string
+	for i := range files {
+		name := fmt.Sprintf("small-%04d.bin", i)
+		if err := os.WriteFile(filepath.Join(sourceDir, name), make([]byte, size), 0o644); err != nil {
+			b.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	command := "upd " + strings.Join(names, " ")
+	prevBatch := batchUploads
+	b.Cleanup(func() { batchUploads = prevBatch })
+
+	for _, tc := range []struct {
+		name  string
+		batch bool
+	}{
+		{"batch", true},
+		{"per-file", false},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			batchUploads = tc.batch
+			b.SetBytes(files * size)
+			for range b.N {
+				out := captureOutput(b, func() { runCommand(context.Background(), session, nil, command) })
+				if i := strings.Index(out, "Error"); i >= 0 {
+					b.Fatalf("upd: %s", out[i:min(len(out), i+500)])
+				}
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(storage); len(entries) < files {
+		b.Errorf("storage holds %d files, want %d", len(entries), files)
+	}
+}
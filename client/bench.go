@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// benchPings is how many round trips bench times to report the RTT.
+const benchPings = 5
+
+// runBench measures the connection: the round-trip time of a few "ping"
+// commands, then the throughput of sending and receiving generated data
+// through the server's bench command. Nothing is read from or written to
+// disk on either side. Both directions are measured unless -up or -down
+// picks one.
+//
+// Usage: bench [-size <bytes>] [-up] [-down]
+func runBench(ctx context.Context, session quic.Connection, args []string) {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	size := fs.Int64("size", 16<<20, "")
+	up := fs.Bool("up", false, "")
+	down := fs.Bool("down", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *size <= 0 {
+		printUsage("bench")
+		return
+	}
+	if !*up && !*down {
+		*up, *down = true, true
+	}
+
+	var best, total time.Duration
+	for i := 0; i < benchPings; i++ {
+		start := time.Now()
+		if _, err := sendCommand(ctx, session, "ping"); err != nil {
+			log.Printf("Error measuring round-trip time: %v\n", err)
+			return
+		}
+		rtt := time.Since(start)
+		total += rtt
+		if best == 0 || rtt < best {
+			best = rtt
+		}
+	}
+	fmt.Printf("RTT: %s min, %s average over %d pings\n", best.Round(time.Microsecond), (total / benchPings).Round(time.Microsecond), benchPings)
+
+	for _, dir := range []string{"up", "down"} {
+		if (dir == "up" && !*up) || (dir == "down" && !*down) || ctx.Err() != nil {
+			continue
+		}
+		elapsed, err := benchTransfer(ctx, session, dir, *size)
+		if err != nil {
+			fmt.Println(colorError(fmt.Sprintf("Error: bench %s: %v", dir, err)))
+			continue
+		}
+		label := map[string]string{"up": "Upload", "down": "Download"}[dir]
+		fmt.Println(colorSuccess(fmt.Sprintf("%s: %d bytes in %s, %s", label, *size, elapsed.Round(time.Millisecond), formatRate(*size, elapsed))))
+	}
+}
+
+// benchTransfer runs one "bench up" or "bench down" of size bytes on a
+// stream of its own and returns how long it took from sending the command
+// to the last byte being confirmed or received.
+func benchTransfer(ctx context.Context, session quic.Connection, dir string, size int64) (time.Duration, error) {
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+
+	start := time.Now()
+	if _, err := stream.Write([]byte(tagged(fmt.Sprintf("bench %s %d\n", dir, size)))); err != nil {
+		return 0, err
+	}
+	reader := bufio.NewReader(stream)
+	// A refused upload stops the writes; the reply then says why.
+	var writeErr error
+	if dir == "up" {
+		block := make([]byte, 32*1024)
+		rand.Read(block)
+		for sent := int64(0); sent < size && writeErr == nil; {
+			extendDeadline(stream)
+			var n int
+			n, writeErr = stream.Write(block[:min(int64(len(block)), size-sent)])
+			if abortIfTimedOut(stream, "bench data", writeErr) {
+				return 0, writeErr
+			}
+			sent += int64(n)
+		}
+	}
+	extendDeadline(stream)
+	reply, err := reader.ReadString('\n')
+	if abortIfTimedOut(stream, "bench data", err) {
+		return 0, err
+	}
+	reply = strings.TrimSpace(reply)
+	if strings.HasPrefix(reply, "Error:") {
+		return 0, fmt.Errorf("%s", strings.TrimSpace(strings.TrimPrefix(reply, "Error:")))
+	}
+	if n, perr := strconv.ParseInt(strings.TrimPrefix(reply, "OK "), 10, 64); perr != nil || n != size {
+		if writeErr != nil {
+			return 0, writeErr
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("unexpected response %q", reply)
+	}
+	if dir == "down" {
+		extendDeadline(stream)
+		received, err := io.Copy(io.Discard, &deadlineReader{reader, stream})
+		if abortIfTimedOut(stream, "bench data", err) {
+			return 0, err
+		}
+		if err != nil {
+			return 0, err
+		}
+		if received != size {
+			return 0, fmt.Errorf("received %d of %d bytes", received, size)
+		}
+	}
+	return time.Since(start), nil
+}
+
+// deadlineReader extends the stream's deadline before every read, so that
+// only a stalled transfer times out.
+type deadlineReader struct {
+	r      io.Reader
+	stream quic.Stream
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	extendDeadline(d.stream)
+	return d.r.Read(p)
+}
+
+// formatRate gives the throughput of n bytes in elapsed both in megabytes
+// and megabits per second.
+func formatRate(n int64, elapsed time.Duration) string {
+	seconds := max(elapsed.Seconds(), 1e-9)
+	bytesPerSecond := float64(n) / seconds
+	return fmt.Sprintf("%.1f MB/s (%.1f Mbit/s)", bytesPerSecond/1e6, bytesPerSecond*8/1e6)
+}
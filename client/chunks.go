@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// verifyChunks is set by -verify-chunks: downloads use authenticated
+// frames, so corruption is caught at the chunk it happens in rather than
+// after the whole file.
+var verifyChunks bool
+
+// macChunkSize is the largest payload the server puts in one frame.
+const macChunkSize = 64 * 1024
+
+// chunkMACLabel names the TLS exporter the chunk MAC key is derived from;
+// the server derives the same key from its end of the connection.
+const chunkMACLabel = "EXPORTER-quic-scp chunk mac"
+
+// errBadChunk is returned when a frame fails verification.
+var errBadChunk = errors.New("chunk failed verification")
+
+func chunkMACKey(session quic.Connection) ([]byte, error) {
+	state := session.ConnectionState().TLS
+	return state.ExportKeyingMaterial(chunkMACLabel, nil, sha256.Size)
+}
+
+// chunkMAC authenticates a frame's payload together with its offset in the
+// file.
+func chunkMAC(key []byte, offset int64, payload []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	binary.Write(mac, binary.BigEndian, offset)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// downloadChunked downloads fileName on its own stream through
+// "dwd --chunks" into its partialPath and returns its size, or why not
+// every chunk verified.
+func downloadChunked(ctx context.Context, session quic.Connection, fileName string) (int64, error) {
+	filePath := partialPath(fileName)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return 0, fmt.Errorf("could not create directory for %s: %v", filePath, err)
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		return 0, fmt.Errorf("could not create %s: %v", filePath, err)
+	}
+	defer file.Close()
+
+	var out io.Writer = file
+	var decrypt *decryptWriter
+	if encryptFiles {
+		decrypt = newDecryptWriter(file)
+		out = decrypt
+	}
+	// Everything before a bad chunk verified, so a retry only asks for the
+	// rest.
+	var received int64
+	for attempt := 0; ; attempt++ {
+		received, err = receiveChunks(ctx, session, fileName, received, nil, out)
+		if !errors.Is(err, errBadChunk) || attempt >= downloadRetries {
+			break
+		}
+		fmt.Println("\n" + colorError(fmt.Sprintf("Error: %s: chunk at offset %d failed verification; requesting it again (retry %d/%d)", fileName, received, attempt+1, downloadRetries)))
+	}
+	if err == nil && decrypt != nil {
+		err = decrypt.Close()
+	}
+	if errors.Is(err, errBadChunk) {
+		err = fmt.Errorf("chunk at offset %d failed verification", received)
+	}
+	if err != nil {
+		fmt.Println()
+		// Only verified data was written, but not all of it.
+		file.Close()
+		os.Remove(filePath)
+		return received, err
+	}
+	fmt.Println()
+	return received, nil
+}
+
+// receiveChunks asks for fileName from offset and writes each verified
+// payload to out. want, unless nil, is the size and modification time the
+// file must still have. It returns the offset up to which everything
+// verified, which is where a retry can pick up.
+func receiveChunks(ctx context.Context, session quic.Connection, fileName string, offset int64, want *pendingDownload, out io.Writer) (int64, error) {
+	key, err := chunkMACKey(session)
+	if err != nil {
+		return offset, err
+	}
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return offset, err
+	}
+	defer stream.Close()
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+
+	if _, err := stream.Write([]byte(tagged(fmt.Sprintf("dwd --chunks %s %d\n", fileName, offset)))); err != nil {
+		return offset, err
+	}
+	reader := bufio.NewReader(stream)
+	extendDeadline(stream)
+	header, err := reader.ReadString('\n')
+	if abortIfTimedOut(stream, fileName, err) {
+		return offset, err
+	}
+	header = strings.TrimSpace(header)
+	if strings.HasPrefix(header, "Error") {
+		return offset, errors.New(strings.TrimSpace(strings.TrimPrefix(header, "Error:")))
+	}
+	fields := strings.Fields(strings.TrimPrefix(header, "OK "))
+	if err != nil || len(fields) != 2 {
+		return offset, fmt.Errorf("unexpected response %q", header)
+	}
+	size, perr := strconv.ParseInt(fields[0], 10, 64)
+	modTime, merr := strconv.ParseInt(fields[1], 10, 64)
+	if perr != nil || merr != nil || size < offset {
+		return offset, fmt.Errorf("unexpected response %q", header)
+	}
+	if want != nil && (size != want.Size || modTime != want.ModTime) {
+		stream.CancelRead(streamCancelled)
+		return offset, errRemoteChanged
+	}
+
+	fmt.Printf("Downloading file: %s (%d bytes)\n", fileName, size)
+	report := newProgress(fileName, offset, size, true)
+	frame := make([]byte, macChunkSize+sha256.Size)
+	var length [4]byte
+	for {
+		extendDeadline(stream)
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			abortIfTimedOut(stream, fileName, err)
+			return offset, err
+		}
+		n := int(binary.BigEndian.Uint32(length[:]))
+		if n > macChunkSize || offset+int64(n) > size {
+			stream.CancelRead(streamCancelled)
+			return offset, fmt.Errorf("invalid frame of %d bytes at offset %d", n, offset)
+		}
+		if _, err := io.ReadFull(reader, frame[:n+sha256.Size]); err != nil {
+			abortIfTimedOut(stream, fileName, err)
+			return offset, err
+		}
+		payload, tag := frame[:n], frame[n:n+sha256.Size]
+		if !hmac.Equal(tag, chunkMAC(key, offset, payload)) {
+			stream.CancelRead(streamCancelled)
+			return offset, errBadChunk
+		}
+		if n == 0 {
+			if offset != size {
+				return offset, fmt.Errorf("transfer ended at %d of %d bytes", offset, size)
+			}
+			return offset, nil
+		}
+		if _, err := out.Write(payload); err != nil {
+			stream.CancelRead(streamCancelled)
+			return offset, err
+		}
+		offset += int64(n)
+		report.update(offset)
+	}
+}
+
+// downloadEachChunked is downloadBatch for -verify-chunks, with one stream
+// per file.
+func downloadEachChunked(ctx context.Context, session quic.Connection, fileNames []string) []fileResult {
+	var results []fileResult
+	for i, fileName := range fileNames {
+		if ctx.Err() != nil {
+			fmt.Println("Download cancelled.")
+			break
+		}
+		fetch := func(int) (int64, error) { return downloadChunked(ctx, session, fileName) }
+		size, err := fetchVerified(fileName, fetch)
+		results = append(results, fileResult{name: fileName, size: size, err: err})
+		if session.Context().Err() != nil && ctx.Err() == nil {
+			rest := fileNames[i+1:]
+			fmt.Println(colorError(fmt.Sprintf("Error: connection lost at %s: %v; %d remaining files not attempted", fileName, err, len(rest))))
+			results = append(results, failAll(rest, errNotAttempted)...)
+			break
+		}
+	}
+	return results
+}
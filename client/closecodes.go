@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Application error codes a connection is closed with; the same table as
+// the server's:
+//
+//	code  name              meaning
+//	0     errCodeNone       closed normally, by whichever side was done
+//	1     errCodeKicked     an admin disconnected the client; the message is
+//	                        the reason they gave
+//	2     errCodeShutdown   the server is shutting down
+//	3     errCodeThrottled  the client's address opened more connections
+//	                        than -conn-rate allows
+const (
+	errCodeNone      quic.ApplicationErrorCode = 0
+	errCodeKicked    quic.ApplicationErrorCode = 1
+	errCodeShutdown  quic.ApplicationErrorCode = 2
+	errCodeThrottled quic.ApplicationErrorCode = 3
+)
+
+// closeReason explains err, which ended a connection, to the user. A close
+// by the server is described by its code rather than as the raw
+// "Application error 0x2 (remote)".
+func closeReason(err error) string {
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) || !appErr.Remote {
+		return err.Error()
+	}
+	switch appErr.ErrorCode {
+	case errCodeNone:
+		return "closed by the server"
+	case errCodeKicked:
+		if appErr.ErrorMessage != "" {
+			return "disconnected by an admin: " + appErr.ErrorMessage
+		}
+		return "disconnected by an admin"
+	case errCodeShutdown:
+		return "the server is shutting down"
+	case errCodeThrottled:
+		return "too many connections from this address; try again later"
+	}
+	return err.Error()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	ansiReset = "\x1b[0m"
+	ansiRed   = "\x1b[31m"
+	ansiGreen = "\x1b[32m"
+	ansiCyan  = "\x1b[36m"
+)
+
+// useColor is decided once at startup so piped output stays free of escape
+// codes.
+var useColor bool
+
+// initColor enables color only when stdout is a terminal and neither
+// -no-color nor the NO_COLOR convention (https://no-color.org) says otherwise.
+func initColor(noColor bool) {
+	useColor = !noColor && os.Getenv("NO_COLOR") == "" && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+func colorize(code, s string) string {
+	if !useColor || s == "" {
+		return s
+	}
+	return code + s + ansiReset
+}
+
+func colorSuccess(s string) string { return colorize(ansiGreen, s) }
+
+// colorError also names the request the error belongs to, for looking it up
+// in the server log.
+func colorError(s string) string {
+	if requestID != "" {
+		s += " (request " + requestID + ")"
+	}
+	return colorize(ansiRed, s)
+}
+
+// colorReply colors a server reply red if it reports an error.
+func colorReply(reply string) string {
+	if strings.HasPrefix(reply, "Error:") {
+		return colorError(reply)
+	}
+	return reply
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/quic-go/quic-go"
+)
+
+// compressCodec is the -compress algorithm, gzip or zstd; empty disables
+// compression.
+var compressCodec string
+
+// noCompressExts is the -no-compress-ext list. Files with these extensions
+// are already compressed and are sent as they are.
+var noCompressExts = ".jpg,.jpeg,.png,.gif,.webp,.zip,.gz,.tgz,.bz2,.xz,.zst,.7z,.rar,.mp3,.mp4,.mkv,.mov,.avi,.webm"
+
+// sampleSize is how much of a file is inspected to judge whether it is
+// worth compressing.
+const sampleSize = 64 * 1024
+
+// maxEntropy is the Shannon entropy, in bits per byte, above which a sample
+// is taken to be incompressible. Random or already compressed data comes out
+// very close to 8.
+const maxEntropy = 7.5
+
+// validateCodec checks a -compress value.
+func validateCodec(codec string) error {
+	switch codec {
+	case "", "gzip", "zstd":
+		return nil
+	}
+	return fmt.Errorf("unknown compression algorithm %q", codec)
+}
+
+// negotiateCodec asks the server which algorithms it decodes and settles
+// compressCodec accordingly: the requested one if the server has it, gzip
+// otherwise, or no compression against a server that has neither.
+func negotiateCodec(ctx context.Context, session quic.Connection) {
+	if compressCodec == "" {
+		return
+	}
+	response, err := sendCommand(ctx, session, "codecs")
+	if err != nil || strings.HasPrefix(response, "Unknown command") {
+		// Servers that predate the query still know gzip.
+		response = "gzip"
+	}
+	supported := strings.Fields(response)
+	switch {
+	case slices.Contains(supported, compressCodec):
+	case slices.Contains(supported, "gzip"):
+		fmt.Printf("Server does not support %s compression, using gzip\n", compressCodec)
+		compressCodec = "gzip"
+	default:
+		fmt.Printf("Server does not support %s compression, sending uncompressed\n", compressCodec)
+		compressCodec = ""
+	}
+}
+
+// chooseCodec decides whether file is compressed on the way to the server
+// and returns the codec to announce in the upload header, or "" to send it
+// as is. Encrypted uploads are never compressed: the server would otherwise
+// have to decode them, and ciphertext does not shrink anyway.
+func chooseCodec(file *os.File, fileName string) string {
+	if compressCodec == "" || encryptFiles {
+		return ""
+	}
+	ext := strings.ToLower(filepath.Ext(fileName))
+	for _, skip := range strings.Split(noCompressExts, ",") {
+		if ext != "" && ext == strings.ToLower(strings.TrimSpace(skip)) {
+			return ""
+		}
+	}
+	sample := make([]byte, sampleSize)
+	n, _ := file.ReadAt(sample, 0)
+	if n == 0 || entropy(sample[:n]) > maxEntropy {
+		return ""
+	}
+	return compressCodec
+}
+
+// entropy returns the Shannon entropy of b in bits per byte.
+func entropy(b []byte) float64 {
+	var counts [256]int
+	for _, c := range b {
+		counts[c]++
+	}
+	total := float64(len(b))
+	var bits float64
+	for _, n := range counts {
+		if n > 0 {
+			p := float64(n) / total
+			bits -= p * math.Log2(p)
+		}
+	}
+	return bits
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// newEncoder wraps w in the encoder for codec. Closing the encoder flushes
+// it without closing w.
+func newEncoder(codec string, w io.Writer) io.WriteCloser {
+	switch codec {
+	case "gzip":
+		return gzip.NewWriter(w)
+	case "zstd":
+		enc, err := zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		if err == nil {
+			return enc
+		}
+	}
+	return nopWriteCloser{w}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// textCorpus returns the Go source of the client and server, about 400 KB,
+// as a stand-in for the text files compression pays off on. It is not
+// repeated to make it bigger: zstd's window would find the copies, which
+// gzip's cannot, and the ratios would say more about that than about text.
+func textCorpus(b *testing.B) []byte {
+	b.Helper()
+	sources, _ := filepath.Glob("../*/*.go")
+	var source []byte
+	for _, name := range sources {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		source = append(source, data...)
+	}
+	if len(source) == 0 {
+		b.Fatal("no source files to compress")
+	}
+	return source
+}
+
+// BenchmarkCodec compresses the same text with each -compress codec, as an
+// upload does, and reports the size it came to as a share of the original.
+func BenchmarkCodec(b *testing.B) {
+	corpus := textCorpus(b)
+	for _, tc := range []struct {
+		codec     string
+		newReader func(io.Reader) (io.Reader, error)
+	}{
+		{"gzip", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"zstd", func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) }},
+	} {
+		b.Run(tc.codec, func(b *testing.B) {
+			var compressed bytes.Buffer
+			compress := func() {
+				compressed.Reset()
+				enc := newEncoder(tc.codec, &compressed)
+				if _, err := enc.Write(corpus); err != nil {
+					b.Fatal(err)
+				}
+				if err := enc.Close(); err != nil {
+					b.Fatal(err)
+				}
+			}
+			compress()
+			r, err := tc.newReader(bytes.NewReader(compressed.Bytes()))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if data, err := io.ReadAll(r); err != nil || !bytes.Equal(data, corpus) {
+				b.Fatalf("the %s stream did not decode to the original: %v", tc.codec, err)
+			}
+
+			b.SetBytes(int64(len(corpus)))
+			b.ResetTimer()
+			for range b.N {
+				compress()
+			}
+			b.ReportMetric(float64(compressed.Len())/float64(len(corpus)), "ratio")
+		})
+	}
+}
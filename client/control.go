@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// keepaliveInterval is how often the client pings an otherwise idle
+// connection, well within the 30 second idle timeout.
+const keepaliveInterval = 15 * time.Second
+
+// controlSession is the connection control datagrams are sent on, or nil if
+// the server did not negotiate datagrams.
+var controlSession quic.Connection
+
+// startControl sets up the control messages of session: a keepalive ping,
+// and cancel messages for aborted transfers (see sendCancel). Both travel as
+// datagrams when the server supports them, since neither needs to arrive
+// reliably or in order; otherwise pings use the "ping" command and cancels
+// rely on the stream reset alone. File data always stays on streams.
+func startControl(session quic.Connection) {
+	if session.ConnectionState().SupportsDatagrams {
+		controlSession = session
+		go receiveControl(session)
+	}
+	go keepalive(session)
+}
+
+// keepalive pings the server every keepaliveInterval until session ends.
+func keepalive(session quic.Connection) {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	var seq uint64
+	for {
+		select {
+		case <-session.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		seq++
+		if controlSession != nil {
+			if err := session.SendDatagram([]byte(fmt.Sprintf("ping %d", seq))); err != nil {
+				log.Printf("Error sending keepalive: %v", err)
+			}
+			continue
+		}
+		ctx, cancel := context.WithTimeout(session.Context(), keepaliveInterval)
+		if _, err := sendCommand(ctx, session, "ping"); err != nil && session.Context().Err() == nil {
+			log.Printf("Error sending keepalive: %v", err)
+		}
+		cancel()
+	}
+}
+
+// receiveControl drains the datagrams the server sends back. Pongs need no
+// handling beyond having arrived.
+func receiveControl(session quic.Connection) {
+	for {
+		if _, err := session.ReceiveDatagram(session.Context()); err != nil {
+			return
+		}
+	}
+}
+
+// sendCancel asks the server to abort the command on stream id right away.
+// It is best effort: the caller resets the stream as well.
+func sendCancel(id quic.StreamID) {
+	if controlSession == nil {
+		return
+	}
+	controlSession.SendDatagram([]byte(fmt.Sprintf("cancel %d", id)))
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/quic-go/quic-go"
+)
+
+// downloadStateFile remembers downloads that are under way, so that when
+// one breaks off, even because the client itself was killed, the next dwd
+// of the same file, on whatever connection and in whichever run of the
+// client, only asks for the rest.
+const downloadStateFile = ".quicscp-downloads.json"
+
+// resumeMinSize is the smallest download that is tracked for resuming;
+// anything smaller is quicker to fetch again than to keep track of.
+const resumeMinSize = 1 << 20
+
+// errRemoteChanged is returned when a file being resumed no longer has the
+// size or modification time it had when its download started.
+var errRemoteChanged = errors.New("the file changed on the server")
+
+// pendingDownload is a partial download, keyed in downloadStateFile by its
+// partialPath, which holds the first bytes of it.
+type pendingDownload struct {
+	Remote  string `json:"remote"`
+	Size    int64  `json:"size"`     // of the whole file, as the server announced it
+	ModTime int64  `json:"mod_time"` // on the server, in Unix nanoseconds
+}
+
+// resumable reports whether a download of size bytes can be continued
+// later. An encrypted one cannot, since it cannot be decrypted from the
+// middle.
+func resumable(size int64) bool {
+	return !encryptFiles && size >= resumeMinSize
+}
+
+// notePartial records that the partialPath of fileName is receiving a file
+// of size bytes last modified at modTime, when that download is resumable.
+func notePartial(fileName string, size, modTime int64) {
+	if resumable(size) {
+		updateState(downloadStateFile, partialPath(fileName), &pendingDownload{Remote: fileName, Size: size, ModTime: modTime})
+	}
+}
+
+// forgetPartial drops whatever downloadStateFile says about fileName.
+func forgetPartial(fileName string) {
+	if _, ok := loadState[pendingDownload](downloadStateFile)[partialPath(fileName)]; ok {
+		updateState[pendingDownload](downloadStateFile, partialPath(fileName), nil)
+	}
+}
+
+// resumeDownloads continues every file of fileNames that a broken download
+// left partly fetched, and returns the files still to download from the
+// start, with what became of the resumed ones.
+func resumeDownloads(ctx context.Context, session quic.Connection, fileNames []string) ([]string, []fileResult) {
+	if encryptFiles {
+		return fileNames, nil
+	}
+	pending := loadState[pendingDownload](downloadStateFile)
+	var rest []string
+	var results []fileResult
+	for _, fileName := range fileNames {
+		p, ok := pending[partialPath(fileName)]
+		info, err := os.Stat(partialPath(fileName))
+		if !ok || p.Remote != fileName || err != nil || info.Size() >= p.Size || ctx.Err() != nil {
+			rest = append(rest, fileName)
+			continue
+		}
+		fetch := func(attempt int) (int64, error) {
+			if attempt == 0 {
+				return continueDownload(ctx, session, fileName, info.Size(), p)
+			}
+			return redownloadFile(ctx, session, fileName)
+		}
+		size, err := fetchVerified(fileName, fetch)
+		results = append(results, fileResult{name: fileName, size: size, err: err})
+	}
+	return rest, results
+}
+
+// continueDownload fetches fileName from offset onwards, in verified chunks,
+// onto the end of its partialPath. If the file no longer has the size and
+// modification time recorded in p the partial copy is of something else,
+// and the whole file is downloaded again instead. When the transfer breaks
+// off again, what did arrive is kept for the next attempt.
+func continueDownload(ctx context.Context, session quic.Connection, fileName string, offset int64, p pendingDownload) (int64, error) {
+	size := p.Size
+	fmt.Printf("Resuming download of %s at byte %d of %d\n", fileName, offset, size)
+	file, err := os.OpenFile(partialPath(fileName), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return size, fmt.Errorf("could not open %s: %v", partialPath(fileName), err)
+	}
+	_, err = receiveChunks(ctx, session, fileName, offset, &p, file)
+	file.Close()
+	fmt.Println()
+	if errors.Is(err, errRemoteChanged) {
+		printLine(colorError(fmt.Sprintf("Error: %s: %v; downloading it again", fileName, err)))
+		os.Remove(partialPath(fileName))
+		forgetPartial(fileName)
+		return redownloadFile(ctx, session, fileName)
+	}
+	return size, err
+}
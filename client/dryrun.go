@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// dryRun makes upd and dwd report what they would transfer instead of
+// opening any transfer streams.
+var dryRun bool
+
+// remoteEntries lists the remote working directory as "ls" reports it, with
+// directories carrying a trailing "/".
+func remoteEntries(ctx context.Context, session quic.Connection) ([]string, error) {
+	response, err := sendCommand(ctx, session, "ls")
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(response, "Error:") {
+		return nil, fmt.Errorf("%s", strings.TrimPrefix(response, "Error: "))
+	}
+	if response == "" || response == "No files available." {
+		return nil, nil
+	}
+	return strings.Split(response, "\n"), nil
+}
+
+// remoteSet returns the names listed in the remote working directory, or nil
+// if they could not be fetched, in which case every decision is reported as
+// unknown.
+func remoteSet(ctx context.Context, session quic.Connection) map[string]bool {
+	entries, err := remoteEntries(ctx, session)
+	if err != nil {
+		fmt.Printf("Could not list the remote directory: %v\n", err)
+		return nil
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		names[entry] = true
+	}
+	return names
+}
+
+// planUploads prints what "upd fileNames" would do.
+func planUploads(ctx context.Context, session quic.Connection, fileNames []string, links []localLink) {
+	remote := remoteSet(ctx, session)
+	fmt.Printf("Dry run: upload of %d files to %s\n", len(fileNames), remoteCwd)
+	var total int64
+	for _, fileName := range fileNames {
+		info, err := os.Stat(sourcePath(fileName))
+		if err != nil || !info.Mode().IsRegular() {
+			fmt.Printf("  skip      %s (not a local file)\n", fileName)
+			continue
+		}
+		action := "overwrite"
+		switch {
+		case remote == nil || strings.Contains(fileName, "/"):
+			action = "upload"
+		case remote[fileName+"/"]:
+			fmt.Printf("  skip      %s (a directory of that name exists on the server)\n", fileName)
+			continue
+		case !remote[fileName]:
+			action = "new"
+		}
+		fmt.Printf("  %-9s %s (%d bytes)\n", action, fileName, info.Size())
+		total += info.Size()
+	}
+	for _, link := range links {
+		fmt.Printf("  %-9s %s -> %s\n", "symlink", link.Name, link.Target)
+	}
+	fmt.Printf("Would send %d bytes. Nothing was transferred.\n", total)
+}
+
+// planDownloads prints what "dwd fileNames" would do. The server does not
+// report sizes before a transfer, so only the local side is described.
+func planDownloads(ctx context.Context, session quic.Connection, fileNames []string) {
+	remote := remoteSet(ctx, session)
+	fmt.Printf("Dry run: download of %d files from %s\n", len(fileNames), remoteCwd)
+	for _, fileName := range fileNames {
+		if remote != nil && !strings.Contains(fileName, "/") && !remote[fileName] {
+			fmt.Printf("  skip      %s (not on the server)\n", fileName)
+			continue
+		}
+		action := "new"
+		if info, err := os.Stat(localPath(fileName)); err == nil {
+			action = "overwrite"
+			fmt.Printf("  %-9s %s (local copy is %d bytes)\n", action, fileName, info.Size())
+			continue
+		}
+		fmt.Printf("  %-9s %s\n", action, fileName)
+	}
+	fmt.Println("Nothing was transferred.")
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// encryptFiles is set by -encrypt: uploads are encrypted before they leave
+// the client and downloads are decrypted after they arrive, so the server
+// only ever stores ciphertext.
+var encryptFiles bool
+
+// passphraseEnv can hold the passphrase for non-interactive use.
+const passphraseEnv = "QUICSCP_PASSPHRASE"
+
+// An encrypted file is a header followed by sealed chunks:
+//
+//	magic (8) | salt (16) | nonce prefix (7)
+//	chunk 0 | chunk 1 | ... | final chunk
+//
+// Every chunk holds encChunkSize bytes of plaintext and a GCM tag, except the
+// final one, which is shorter (possibly empty) and sealed with the last-chunk
+// flag set in its nonce. A chunk's nonce is the prefix, its big-endian index
+// and that flag, so chunks cannot be reordered, dropped or truncated without
+// failing authentication.
+const (
+	encMagic       = "QSCPENC1"
+	encSaltSize    = 16
+	encPrefixSize  = 7
+	encHeaderSize  = len(encMagic) + encSaltSize + encPrefixSize
+	encChunkSize   = 64 * 1024
+	encTagSize     = 16
+	encSealedChunk = encChunkSize + encTagSize
+)
+
+// Argon2id parameters for turning the passphrase into an AES-256 key.
+const (
+	kdfTime    = 1
+	kdfMemory  = 64 * 1024 // KiB
+	kdfThreads = 4
+	kdfKeySize = 32
+)
+
+var (
+	passphrase []byte
+	// uploadSalt is shared by every upload in a run, so the costly key
+	// derivation happens once; each file still gets its own nonce prefix.
+	uploadSalt []byte
+	// derivedKeys caches keys by salt. Parallel downloads look keys up
+	// from several goroutines, so it is guarded by derivedKeysMu.
+	derivedKeys   = make(map[string]cipher.AEAD)
+	derivedKeysMu sync.Mutex
+)
+
+// setupEncryption reads the passphrase and derives the upload key. It is a
+// no-op unless -encrypt is set.
+func setupEncryption() error {
+	if !encryptFiles {
+		return nil
+	}
+	if resumableUploads {
+		return errors.New("-encrypt cannot be combined with -resumable")
+	}
+	secret, err := readPassphrase()
+	if err != nil {
+		return err
+	}
+	passphrase = secret
+	uploadSalt = make([]byte, encSaltSize)
+	if _, err := rand.Read(uploadSalt); err != nil {
+		return err
+	}
+	_, err = keyForSalt(uploadSalt)
+	return err
+}
+
+// readPassphrase takes the passphrase from the environment, or asks for it
+// on the terminal without echoing it.
+func readPassphrase() ([]byte, error) {
+	if secret := os.Getenv(passphraseEnv); secret != "" {
+		return []byte(secret), nil
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("set %s or run on a terminal to enter a passphrase", passphraseEnv)
+	}
+	fmt.Print("Encryption passphrase: ")
+	secret, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(string(secret)) == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	return secret, nil
+}
+
+// keyForSalt returns the key for salt, deriving it the first time. The lock
+// is held while deriving, so downloads of files sharing a salt wait for the
+// one derivation instead of each running Argon2id.
+func keyForSalt(salt []byte) (cipher.AEAD, error) {
+	derivedKeysMu.Lock()
+	defer derivedKeysMu.Unlock()
+	if aead, ok := derivedKeys[string(salt)]; ok {
+		return aead, nil
+	}
+	key := argon2.IDKey(passphrase, salt, kdfTime, kdfMemory, kdfThreads, kdfKeySize)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	derivedKeys[string(salt)] = aead
+	return aead, nil
+}
+
+// encryptedSize returns how many bytes a plaintext of size bytes takes once
+// encrypted, which is what the upload header has to announce.
+func encryptedSize(size int64) int64 {
+	return int64(encHeaderSize) + size + (size/encChunkSize+1)*encTagSize
+}
+
+// chunkNonce builds the nonce for chunk index of a file.
+func chunkNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, encPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// encryptWriter seals everything written to it onto w. Close writes the
+// final chunk without closing w.
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+	header []byte // written before the first chunk, then nil
+}
+
+func newEncryptWriter(w io.Writer) (*encryptWriter, error) {
+	aead, err := keyForSalt(uploadSalt)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, encPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append([]byte(encMagic), uploadSalt...)
+	header = append(header, prefix...)
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encChunkSize), header: header}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(e.buf[len(e.buf):encChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+		if len(e.buf) == encChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	out := e.aead.Seal(e.header, chunkNonce(e.prefix, e.index, last), e.buf, nil)
+	e.header = nil
+	e.index++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(out)
+	return err
+}
+
+// decryptWriter opens the encrypted file written to it and passes the
+// plaintext on to w, one authenticated chunk at a time. Close fails if the
+// final chunk never arrived.
+type decryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+func newDecryptWriter(w io.Writer) *decryptWriter {
+	return &decryptWriter{w: w}
+}
+
+var errNotEncrypted = errors.New("file was not uploaded with -encrypt")
+
+func (d *decryptWriter) Write(p []byte) (int, error) {
+	d.buf = append(d.buf, p...)
+	if d.aead == nil {
+		if len(d.buf) < encHeaderSize {
+			return len(p), nil
+		}
+		if !bytes.HasPrefix(d.buf, []byte(encMagic)) {
+			return 0, errNotEncrypted
+		}
+		salt := d.buf[len(encMagic) : len(encMagic)+encSaltSize]
+		aead, err := keyForSalt(salt)
+		if err != nil {
+			return 0, err
+		}
+		d.aead = aead
+		d.prefix = bytes.Clone(d.buf[len(encMagic)+encSaltSize : encHeaderSize])
+		d.buf = d.buf[encHeaderSize:]
+	}
+	// A full chunk is only opened once more data follows it, since the
+	// final chunk is always shorter.
+	for len(d.buf) > encSealedChunk {
+		if err := d.open(d.buf[:encSealedChunk], false); err != nil {
+			return 0, err
+		}
+		d.buf = d.buf[encSealedChunk:]
+	}
+	return len(p), nil
+}
+
+func (d *decryptWriter) Close() error {
+	if d.aead == nil {
+		if len(d.buf) > 0 && !bytes.HasPrefix([]byte(encMagic), d.buf[:min(len(d.buf), len(encMagic))]) {
+			return errNotEncrypted
+		}
+		return errors.New("encrypted file is truncated")
+	}
+	if len(d.buf) < encTagSize || len(d.buf) == encSealedChunk {
+		return errors.New("encrypted file is truncated")
+	}
+	err := d.open(d.buf, true)
+	d.buf = nil
+	return err
+}
+
+func (d *decryptWriter) open(chunk []byte, last bool) error {
+	plain, err := d.aead.Open(nil, chunkNonce(d.prefix, d.index, last), chunk, nil)
+	if err != nil {
+		return errors.New("decryption failed: wrong passphrase or corrupted file")
+	}
+	d.index++
+	_, err = d.w.Write(plain)
+	return err
+}
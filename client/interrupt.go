@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// interruptWindow is how soon a second Ctrl-C must follow the first one for
+// the client to exit instead of just cancelling.
+const interruptWindow = 2 * time.Second
+
+// streamCancelled is the stream error code used when the user aborts a
+// transfer, so the server can tell a deliberate reset from a network failure.
+const streamCancelled quic.StreamErrorCode = 1
+
+// interruptHandler turns SIGINT into cancellation of the command currently
+// running in the REPL. Two interrupts within interruptWindow call onExit.
+type interruptHandler struct {
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	last   time.Time
+}
+
+func newInterruptHandler(onExit func()) *interruptHandler {
+	h := &interruptHandler{}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		for range sigs {
+			if h.interrupt() {
+				onExit()
+			}
+		}
+	}()
+	return h
+}
+
+// begin returns the context for one REPL command. The returned func must be
+// called once the command has finished.
+func (h *interruptHandler) begin() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h.mu.Lock()
+	h.cancel = cancel
+	h.mu.Unlock()
+	return ctx, func() {
+		h.mu.Lock()
+		h.cancel = nil
+		h.mu.Unlock()
+		cancel()
+	}
+}
+
+// interrupt handles one SIGINT and reports whether the client should exit.
+func (h *interruptHandler) interrupt() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.last) < interruptWindow {
+		return true
+	}
+	h.last = now
+
+	if h.cancel != nil {
+		h.cancel()
+		h.cancel = nil
+		fmt.Println("\nCancelling... (press Ctrl-C again to exit)")
+		return false
+	}
+	fmt.Println("\n(press Ctrl-C again to exit)")
+	printPrompt()
+	return false
+}
+
+// resetOnCancel aborts both directions of stream as soon as ctx is cancelled,
+// which tells the server to discard whatever it has received. A cancel
+// datagram goes out first where datagrams are available, since it is not
+// queued behind the stream's data; the reset still follows in case it is
+// lost. The returned func detaches the hook once the transfer has finished
+// normally.
+func resetOnCancel(ctx context.Context, stream quic.Stream) func() bool {
+	return context.AfterFunc(ctx, func() {
+		sendCancel(stream.StreamID())
+		stream.CancelWrite(streamCancelled)
+		stream.CancelRead(streamCancelled)
+	})
+}
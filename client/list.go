@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// listWithOptions runs ls with flags, which the server applies: sorting,
+// filtering and paging. When the listing is paged and there is more, it
+// prints the command for the next page.
+func listWithOptions(ctx context.Context, session quic.Connection, args []string) {
+	fs := flag.NewFlagSet("ls", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	page := fs.Int("page", 0, "")
+	size := fs.Int("size", 0, "")
+	sortBy := fs.String("sort", "", "")
+	reverse := fs.Bool("reverse", false, "")
+	filter := fs.String("filter", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *page < 0 || *size < 0 {
+		printUsage("ls")
+		return
+	}
+	var opts []string
+	if *sortBy != "" {
+		opts = append(opts, "--sort="+*sortBy)
+	}
+	if *reverse {
+		opts = append(opts, "--reverse")
+	}
+	if *filter != "" {
+		opts = append(opts, "--filter="+*filter)
+	}
+	if *size > 0 {
+		opts = append(opts, fmt.Sprintf("--size=%d", *size))
+	}
+	paged := *page > 0 || *size > 0
+	pageOpt := ""
+	if paged {
+		pageOpt = fmt.Sprintf(" --page=%d", max(*page, 1))
+	}
+
+	response, err := sendCommand(ctx, session, "ls "+strings.Join(opts, " ")+pageOpt)
+	if err != nil {
+		fmt.Println(colorError(fmt.Sprintf("Error: ls: %v", err)))
+		return
+	}
+	if strings.HasPrefix(response, "Error") {
+		fmt.Println(colorError(response))
+		return
+	}
+	entries, next := splitPage(response)
+	if paged {
+		fmt.Printf("Files available on the server (page %d):\n", max(*page, 1))
+	} else {
+		fmt.Println("Files available on the server:")
+	}
+	fmt.Println(entries)
+	if next > 0 {
+		fmt.Printf("More files: ls %s --page=%d\n", strings.Join(opts, " "), next)
+	}
+}
+
+// splitPage separates a page of ls output from the "/next <page>" line the
+// server ends it with when more entries remain.
+func splitPage(response string) (string, int) {
+	i := strings.LastIndex(response, "/next ")
+	if i < 0 || (i > 0 && response[i-1] != '\n') {
+		return response, 0
+	}
+	next, err := strconv.Atoi(strings.TrimSpace(response[i+len("/next "):]))
+	if err != nil {
+		return response, 0
+	}
+	return strings.TrimSpace(response[:i]), next
+}
+
+// findFiles prints the remote files below the working directory that match
+// pattern, a glob or a substring of their path.
+func findFiles(ctx context.Context, session quic.Connection, pattern string) {
+	if pattern == "" {
+		printUsage("find")
+		return
+	}
+	response, err := sendCommand(ctx, session, "find "+pattern)
+	if err != nil {
+		fmt.Println(colorError(fmt.Sprintf("Error: find: %v", err)))
+		return
+	}
+	// The server may fail part way through, after some matches were sent.
+	if i := strings.Index("\n"+response, "\nError:"); i >= 0 {
+		if i > 0 {
+			fmt.Println(response[:i-1])
+		}
+		fmt.Println(colorError(response[i:]))
+		return
+	}
+	fmt.Println(response)
+}
+
+// listVolumes prints the storage volumes the server offers.
+func listVolumes(ctx context.Context, session quic.Connection) {
+	response, err := sendCommand(ctx, session, "volumes")
+	if err != nil {
+		fmt.Println(colorError(fmt.Sprintf("Error: volumes: %v", err)))
+		return
+	}
+	fmt.Println("Volumes (cd into one, or prefix names with it):")
+	fmt.Println(response)
+}
+
+// listVersions prints the earlier versions the server keeps of fileName,
+// each of which can be fetched with "dwd <file>@<version>".
+func listVersions(ctx context.Context, session quic.Connection, fileName string) {
+	if fileName == "" {
+		printUsage("versions")
+		return
+	}
+	response, err := sendCommand(ctx, session, "versions "+fileName)
+	if err != nil {
+		fmt.Println(colorError(fmt.Sprintf("Error: versions: %v", err)))
+		return
+	}
+	if strings.HasPrefix(response, "Error") {
+		fmt.Println(colorError(response))
+		return
+	}
+	fmt.Println(response)
+}
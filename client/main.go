@@ -2,7 +2,7 @@ package main
 import (
 	"bufio"
 	"context"
-	"crypto/tls"
+	"flag"
 	"fmt"
 	"io"
 	"log"
@@ -13,68 +13,348 @@ import (
 
 )
 
+// remoteCwd mirrors the server-side working directory for the prompt.
+var remoteCwd = "/"
+
 //132.235.1.17
 func main() {
-	tlsConfig := &tls.Config{InsecureSkipVerify: true}
-	//session, err := quic.DialAddr(context.Background(), "127.0.0.1:4242", tlsConfig, nil)
-	session, err := quic.DialAddr(context.Background(), "132.235.1.17:4242", tlsConfig, nil)
+	adminToken := flag.String("admin-token", "", "token to log in to the server with; what it allows (read-only, read-write or admin) is up to the server")
+	tokenFile := flag.String("token-file", "", "read the -admin-token from this file instead, keeping it out of the process list")
+	flag.DurationVar(&transferTimeout, "transfer-timeout", 0, "abort a transfer that makes no progress for this long (0 = never)")
+	flag.BoolVar(&resumableUploads, "resumable", false, "upload through server-side transfer IDs so interrupted uploads can be resumed")
+	noColor := flag.Bool("no-color", false, "disable colored output")
+	flag.BoolVar(&dryRun, "dry-run", false, "show what upd and dwd would transfer without transferring anything")
+	flag.Var(&includePatterns, "include", "when uploading a directory, only send files matching this glob (repeatable)")
+	flag.Var(&excludePatterns, "exclude", "when uploading a directory, skip paths matching this glob; wins over -include (repeatable)")
+	flag.Var(&symlinkMode, "symlinks", "what to do with symlinks when uploading a directory: skip, follow or copy")
+	noHistory := flag.Bool("no-history", false, "do not load or save command history in ~/"+historyFileName)
+	flag.StringVar(&sourceDir, "src", sourceDir, "local directory that upd and mirror take files from")
+	flag.BoolVar(&preflightDownloads, "preflight", true, "list the remote directory before dwd and skip, with a warning, files it does not have; -preflight=false saves the round trip on large batches")
+	flag.BoolVar(&flatDownloads, "flat", false, "save downloads directly in downloadedFiles without their remote directories; clashing names get -2, -3, ... added")
+	flag.IntVar(&downloadStreams, "parallel", 1, "split each download batch across up to this many streams, as far as the server allows")
+	flag.BoolVar(&batchUploads, "batch-upload", true, "send the files of one upd on a single stream; off, or with -resumable or -compress, each file gets its own")
+	flag.StringVar(&compressCodec, "compress", "", "compress uploads with this algorithm: gzip or zstd (default: off)")
+	flag.StringVar(&noCompressExts, "no-compress-ext", noCompressExts, "comma-separated extensions that are never compressed")
+	manifestPath := flag.String("manifest", "", "verify downloads against this sha256sum-style manifest; mismatches make the client exit non-zero")
+	flag.IntVar(&downloadRetries, "retries", 0, "download a file again up to this many times when it fails verification")
+	flag.BoolVar(&verifyChunks, "verify-chunks", false, "download in authenticated chunks, stopping at the first corrupted one")
+	fallbackList := flag.String("fallback-ports", "", "comma-separated UDP ports to try, in order, if the server's port gets no answer")
+	flag.BoolVar(&encryptFiles, "encrypt", false, "encrypt uploads and decrypt downloads with a passphrase (from $"+passphraseEnv+" or the terminal); the server only sees ciphertext")
+	flag.IntVar(&progressWidth, "progress-width", 0, "segments in the progress bar (0 = fit the terminal, or 10 when it cannot be measured)")
+	tlsVersion := flag.String("tls-min-version", "1.3", "lowest TLS version to accept from the server (QUIC requires 1.3)")
+	tlsCurves := flag.String("tls-curves", "", "comma-separated key exchange groups to offer, most preferred first: X25519, X25519MLKEM768, P256, P384, P521 (default: Go's)")
+	flag.Int64Var(&initialConnWindow, "initial-conn-window", initialConnWindow, "bytes the server may have in flight to the client across a connection before it must wait, at first")
+	flag.Int64Var(&maxConnWindow, "max-conn-window", maxConnWindow, "bytes the connection flow control window may grow to; raise it for downloads over fast links with a long round trip")
+	flag.BoolVar(&noMTUDiscovery, "no-mtu-discovery", false, "do not probe for packets larger than QUIC's minimum; try it if transfers stall on some networks")
+	flag.Int64Var(&udpBuffer, "udp-buffer", udpBuffer, "receive and send buffer size, in bytes, to ask for on the UDP socket; a warning says how to raise the system limit if it is lower")
+	flag.BoolVar(&verbose, "verbose", false, "print the UDP buffer sizes obtained, and quic-go's own warnings about them")
+	flag.StringVar(&progressMode, "progress", progressMode, "how transfers report progress: bar, or json for one event per line on stderr")
+	flag.StringVar(&persistPath, "persist", "", "stay connected and read commands from this FIFO, reopened for each writer, or - for stdin; exit no longer disconnects")
+	flag.Parse()
+	initColor(*noColor)
+	if downloadRetries < 0 {
+		log.Fatalf("Invalid -retries: must not be negative")
+	}
+	ports, err := parsePorts(*fallbackList)
+	if err != nil {
+		log.Fatalf("Invalid -fallback-ports: %v", err)
+	}
+	fallbackPorts = ports
+	if err := validateCodec(compressCodec); err != nil {
+		log.Fatalf("Invalid -compress: %v", err)
+	}
+	if err := validateProgressMode(progressMode); err != nil {
+		log.Fatalf("Invalid -progress: %v", err)
+	}
+	if progressWidth < 0 {
+		log.Fatalf("Invalid -progress-width: must not be negative")
+	}
+	if tlsMinVersion, err = parseTLSVersion(*tlsVersion); err != nil {
+		log.Fatalf("Invalid -tls-min-version: %v", err)
+	}
+	if tlsCurvePreferences, err = parseTLSCurves(*tlsCurves); err != nil {
+		log.Fatalf("Invalid -tls-curves: %v", err)
+	}
+	if initialConnWindow < 1 {
+		log.Fatalf("Invalid -initial-conn-window: must be at least 1")
+	}
+	if maxConnWindow < initialConnWindow {
+		log.Fatalf("Invalid -max-conn-window: must be at least -initial-conn-window (%d)", initialConnWindow)
+	}
+	if udpBuffer < minUDPBuffer {
+		log.Fatalf("Invalid -udp-buffer: must be at least %d, what quic-go asks for itself", minUDPBuffer)
+	}
+	if progressWidth == 0 {
+		progressWidth = terminalBarWidth()
+	}
+	if *manifestPath != "" {
+		hashes, err := loadManifest(*manifestPath)
+		if err != nil {
+			log.Fatalf("Failed to read manifest: %v", err)
+		}
+		expectedHashes = hashes
+	}
+	if err := setupEncryption(); err != nil {
+		log.Fatalf("Failed to set up encryption: %v", err)
+	}
+	if *tokenFile != "" {
+		if *adminToken != "" {
+			log.Fatalf("-admin-token and -token-file cannot be used together")
+		}
+		if *adminToken, err = readTokenFile(*tokenFile); err != nil {
+			log.Fatalf("Invalid -token-file: %v", err)
+		}
+	}
+	var persistent *commandReader
+	if persistPath != "" {
+		if persistent, err = newPersistentReader(); err != nil {
+			log.Fatalf("Invalid -persist: %v", err)
+		}
+	}
+
+	session, err := dialServer()
 	if err != nil {
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
-	defer session.CloseWithError(0, "Client closed")
+	// session is replaced if the connection is lost and dialled again.
+	defer func() { session.CloseWithError(errCodeNone, "Client closed") }()
 
 	fmt.Println("================= CLIENT =================")
 	fmt.Println("Connected to the server!")
 	fmt.Println("\nAvailable Commands:")
-	fmt.Println("  - upd <file1> <file2> ... : Upload files")
+	fmt.Println("  - upd <file1> <dir> ...   : Upload files and directories")
+	fmt.Println("  - upd /path/to/file[:name]: Upload from any local path, as its base name or as name")
+	fmt.Println("  - upd -d <dir> <file> ... : Upload into a remote directory, created if missing")
 	fmt.Println("  - dwd <file1> <file2> ... : Download files")
+	fmt.Println("  - dwd --move <file> ...   : Download files and delete them on the server")
+	fmt.Println("  - rm <file1> <file2> ...  : Delete files on the server")
+	fmt.Println("  - mirror [-delete] <dir> : Upload a directory, optionally deleting remote extras")
 	fmt.Println("  - ls                     : List files on the server")
+	fmt.Println("  - ls --page=N [--size=N] : List one page of a large directory")
+	fmt.Println("  - ls --sort=size|mtime [--reverse] [--filter=glob]: Sort and filter the listing")
+	fmt.Println("  - find <pattern>         : Find remote files by glob or part of their path")
+	fmt.Println("  - manifest [-o file] [dir]: Print or save SHA-256 sums of remote files")
+	fmt.Println("  - cd <dir>               : Change the remote directory")
+	fmt.Println("  - pwd                    : Print the remote directory")
+	fmt.Println("  - volumes                : List storage volumes (vol:name/...)")
+	fmt.Println("  - versions <file>        : List kept versions; fetch one with dwd <file>@<n>")
+	fmt.Println("  - bench [-size N] [-up|-down]: Measure RTT and throughput without touching files")
+	if *adminToken != "" {
+		fmt.Println("  - admin clients          : List connected clients")
+		fmt.Println("  - admin info             : Show server uptime and counters")
+		fmt.Println("  - admin kick <addr> [why]: Disconnect a client")
+	}
 	fmt.Println("  - exit                   : Terminate connection")
-	fmt.Println("==========================================\n")
+	fmt.Println("==========================================")
+	fmt.Println()
 
-	reader := bufio.NewReader(os.Stdin)
+	setupSession(session, *adminToken)
+
+	onExit := func() {
+		fmt.Println("Connection terminated.")
+		session.CloseWithError(errCodeNone, "Client closed")
+		os.Exit(130)
+	}
+	interrupts := newInterruptHandler(onExit)
+
+	commands := persistent
+	if commands != nil {
+		closeOnTerm(onExit)
+		source := persistPath
+		if source == "-" {
+			source = "stdin"
+		}
+		fmt.Printf("Reading commands from %s; the connection stays open until the client is stopped or its input ends.\n", source)
+	} else {
+		historyFile := ""
+		if !*noHistory {
+			historyFile = historyPath()
+		}
+		commands = newCommandReader(func() quic.Connection { return session }, historyFile)
+	}
+	defer commands.close()
 
 	for {
-		fmt.Print("Enter command: ")
-		command, _ := reader.ReadString('\n')
-		command = strings.TrimSpace(command)
+		command, err := commands.readCommand()
+		if err == errPromptInterrupted {
+			if interrupts.interrupt() {
+				onExit()
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Println("Connection terminated.")
+			break
+		}
 
 		if command == "exit" {
+			if persistPath != "" {
+				fmt.Println("Staying connected (-persist); stop the client to disconnect.")
+				continue
+			}
 			fmt.Println("Connection terminated.")
 			break
 		}
-		if command == "ls" {
-			listFiles(session)
-		} else if strings.HasPrefix(command, "upd ") {
-			fileNames := strings.Fields(strings.TrimPrefix(command, "upd "))
-			uploadFiles(session, fileNames)
-		} else if strings.HasPrefix(command, "dwd ") {
-			fileNames := strings.Fields(strings.TrimPrefix(command, "dwd "))
-			downloadFiles(session, fileNames)
-		} else {
-			fmt.Println("Unknown command. Use 'upd <file>' to upload, 'dwd <file>' to download, or 'ls' to list files.")
+		if session.Context().Err() != nil {
+			if session, err = reconnect(session, *adminToken); err != nil {
+				fmt.Println(colorError(fmt.Sprintf("Error: reconnecting: %v", err)))
+				continue
+			}
 		}
+		ctx, done := interrupts.begin()
+		requestID = newRequestID()
+		runCommand(ctx, session, commands, command)
+		done()
+		requestID = ""
+	}
+
+	if manifestFailures.Load() > 0 {
+		fmt.Println(colorError(fmt.Sprintf("%d downloads did not match the manifest.", manifestFailures.Load())))
+		commands.close()
+		session.CloseWithError(errCodeNone, "Client closed")
+		os.Exit(1)
+	}
+}
+
+// runCommand carries out one REPL command on session. Whatever goes wrong
+// is reported and the REPL carries on with the next command.
+func runCommand(ctx context.Context, session quic.Connection, commands *commandReader, command string) {
+	if needsArguments[command] {
+		printUsage(command)
+	} else if command == "ls" {
+		listFiles(ctx, session)
+	} else if strings.HasPrefix(command, "ls --") {
+		listWithOptions(ctx, session, strings.Fields(strings.TrimPrefix(command, "ls")))
+	} else if command == "cd" || strings.HasPrefix(command, "cd ") {
+		changeDir(ctx, session, strings.TrimSpace(strings.TrimPrefix(command, "cd")))
+	} else if command == "versions" || strings.HasPrefix(command, "versions ") {
+		listVersions(ctx, session, strings.TrimSpace(strings.TrimPrefix(command, "versions")))
+	} else if command == "volumes" {
+		listVolumes(ctx, session)
+	} else if command == "pwd" {
+		printWorkingDir(ctx, session)
+	} else if command == "bench" || strings.HasPrefix(command, "bench ") {
+		runBench(ctx, session, strings.Fields(strings.TrimPrefix(command, "bench")))
+	} else if command == "admin clients" {
+		listClients(ctx, session)
+	} else if command == "admin info" {
+		showInfo(ctx, session)
+	} else if strings.HasPrefix(command, "admin kick ") {
+		kickClient(ctx, session, strings.TrimSpace(strings.TrimPrefix(command, "admin kick ")))
+	} else if strings.HasPrefix(command, "upd ") {
+		fileNames := strings.Fields(strings.TrimPrefix(command, "upd "))
+		uploadFiles(ctx, session, fileNames)
+	} else if command == "find" || strings.HasPrefix(command, "find ") {
+		findFiles(ctx, session, strings.TrimSpace(strings.TrimPrefix(command, "find")))
+	} else if command == "manifest" || strings.HasPrefix(command, "manifest ") {
+		fetchManifest(ctx, session, strings.Fields(strings.TrimPrefix(command, "manifest")))
+	} else if strings.HasPrefix(command, "rm ") {
+		removeFiles(ctx, session, strings.Fields(strings.TrimPrefix(command, "rm ")))
+	} else if command == "mirror" || strings.HasPrefix(command, "mirror ") {
+		mirrorDir(ctx, session, commands, strings.Fields(strings.TrimPrefix(command, "mirror")))
+	} else if strings.HasPrefix(command, "dwd --move ") {
+		moveFiles(ctx, session, strings.Fields(strings.TrimPrefix(command, "dwd --move ")))
+	} else if strings.HasPrefix(command, "dwd ") {
+		fileNames := strings.Fields(strings.TrimPrefix(command, "dwd "))
+		downloadFiles(ctx, session, fileNames)
+	} else if name, ok := usageOf(command); ok {
+		printUsage(name)
+	} else {
+		fmt.Println("Unknown command. Use 'upd <file>' to upload, 'dwd <file>' to download, 'ls' to list files, or 'cd <dir>' to navigate.")
+	}
+}
+
+// printPrompt shows the prompt when stdin is not driven by the line editor,
+// which draws its own.
+func printPrompt() {
+	if lineEditor != nil {
+		return
 	}
+	fmt.Print(promptText())
 }
 
-// Generate a progress bar for given percentage
+// Generate a progress bar for given percentage, progressWidth segments
+// wide; percentages outside 0-100 are drawn as those.
 func generateProgressBar(percentage int) string {
-	completed := percentage / 10
-	remaining := 10 - completed
-	return fmt.Sprintf("[%s%s] %d%%", strings.Repeat("#", completed), strings.Repeat("-", remaining), percentage)
+	percentage = max(0, min(percentage, 100))
+	completed := percentage * progressWidth / 100
+	remaining := progressWidth - completed
+	return fmt.Sprintf("[%s%s] %d%%", colorize(ansiCyan, strings.Repeat("#", completed)), strings.Repeat("-", remaining), percentage)
 }
 
 // Handle uploading multiple files
-func uploadFiles(session quic.Connection, fileNames []string) {
+//
+// Usage: upd [-d <remote dir>] <file|dir|path>[:<remote name>]...
+//
+// With -d (or -remote-dir) every remote name is placed under that
+// directory, relative to the remote working directory; the server creates
+// it as needed.
+func uploadFiles(ctx context.Context, session quic.Connection, args []string) {
+	fs := flag.NewFlagSet("upd", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var remoteDir string
+	fs.StringVar(&remoteDir, "d", "", "")
+	fs.StringVar(&remoteDir, "remote-dir", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+		printUsage("upd")
+		return
+	}
+	fileNames := fs.Args()
+	for _, arg := range fileNames {
+		if _, _, fromSource := parseUploadArg(arg); fromSource && !checkSourceDir() {
+			return
+		}
+	}
+	files, links := expandUploads(uniqueNames(fileNames), strings.Trim(filepath.ToSlash(remoteDir), "/"))
+	sendUploads(ctx, session, files, links)
+}
+
+// uniqueNames drops repeated names from a command's file list, keeping the
+// first of each and warning about the rest, so that no file is transferred
+// twice in one go.
+func uniqueNames(fileNames []string) []string {
+	seen := make(map[string]bool, len(fileNames))
+	unique := fileNames[:0:0]
+	for _, name := range fileNames {
+		if seen[name] {
+			fmt.Printf("Warning: %s is listed more than once, transferring it once\n", name)
+			continue
+		}
+		seen[name] = true
+		unique = append(unique, name)
+	}
+	return unique
+}
+
+// sendUploads uploads files, which expandUploads has already produced, and
+// then creates links.
+func sendUploads(ctx context.Context, session quic.Connection, fileNames []string, links []localLink) {
+	if dryRun {
+		planUploads(ctx, session, fileNames, links)
+		return
+	}
+	if batchUploads && len(fileNames) > 1 && !resumableUploads && compressCodec == "" {
+		if results, ok := uploadBatch(ctx, session, fileNames); ok {
+			printResults(results, len(fileNames), "Uploaded")
+			createLinks(ctx, session, links)
+			return
+		}
+		fmt.Println("Server does not support batch uploads, uploading one file at a time")
+	}
 	for _, fileName := range fileNames {
+		if ctx.Err() != nil {
+			fmt.Println("Remaining uploads skipped.")
+			return
+		}
 		fmt.Printf("Uploading file: %s\n", fileName)
-		uploadFile(session, fileName)
+		uploadFile(ctx, session, fileName)
 	}
+	createLinks(ctx, session, links)
 }
 
 // Upload a single file
-func uploadFile(session quic.Connection, fileName string) {
-	filePath := filepath.Join("filesToUpload", fileName)
+func uploadFile(ctx context.Context, session quic.Connection, fileName string) {
+	filePath := sourcePath(fileName)
 
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -90,147 +370,379 @@ func uploadFile(session quic.Connection, fileName string) {
 	}
 	fileSize := fileInfo.Size()
 
-	stream, err := session.OpenStreamSync(context.Background())
+	if resumableUploads {
+		uploadResumable(ctx, session, file, filePath, fileName, fileInfo)
+		return
+	}
+
+	stream, err := session.OpenStreamSync(ctx)
 	if err != nil {
-		log.Fatalf("Failed to open stream: %v", err)
+		log.Printf("Failed to open stream for %s: %v\n", fileName, err)
+		return
 	}
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
 
-	header := fmt.Sprintf("upd %s\n", fileName)
-	_, err = stream.Write([]byte(header))
+	codec := chooseCodec(file, fileName)
+	sentSize := fileSize
+	if encryptFiles {
+		sentSize = encryptedSize(fileSize)
+	}
+	header := fmt.Sprintf("upd %s %d\n", fileName, sentSize)
+	if codec != "" {
+		header = fmt.Sprintf("upd %s %d %s\n", fileName, sentSize, codec)
+	}
+	_, err = stream.Write([]byte(tagged(header)))
 	if err != nil {
 		log.Printf("Error writing upload header: %v\n", err)
 		return
 	}
 
-	fmt.Printf("Uploading file: %s (%d bytes)\n", fileName, fileSize)
+	if codec != "" {
+		fmt.Printf("Uploading file: %s (%d bytes, %s compressed)\n", fileName, fileSize, codec)
+	} else if encryptFiles {
+		fmt.Printf("Uploading file: %s (%d bytes, encrypted)\n", fileName, fileSize)
+	} else {
+		fmt.Printf("Uploading file: %s (%d bytes)\n", fileName, fileSize)
+	}
+	if sendFileBody(ctx, stream, file, fileName, codec, 0, fileSize) {
+		fmt.Println("\n" + colorSuccess("Upload completed successfully!"))
+	}
+}
+
+// sendFileBody streams the rest of file, which is already positioned at
+// offset, through the encoder for codec, then half-closes the stream and
+// waits for the server to confirm that it stored the data. It reports
+// whether the upload was accepted. Exactly the fileSize announced to the
+// server is sent: a file that shrinks meanwhile resets the stream rather
+// than ending it early, so the server never takes it for complete.
+func sendFileBody(ctx context.Context, stream quic.Stream, file *os.File, fileName, codec string, offset, fileSize int64) bool {
 	buffer := make([]byte, 1024)
-	totalWritten := 0
+	totalWritten := offset
+	report := newProgress(fileName, offset, fileSize, true)
+	body := newEncoder(codec, stream)
+	if encryptFiles {
+		enc, err := newEncryptWriter(stream)
+		if err != nil {
+			log.Printf("Error encrypting %s: %v\n", fileName, err)
+			return false
+		}
+		body = enc
+	}
 
-	for {
-		bytesRead, err := file.Read(buffer)
+	for totalWritten < fileSize {
+		bytesRead, err := file.Read(buffer[:min(int64(len(buffer)), fileSize-totalWritten)])
 		if err != nil && err != io.EOF {
 			log.Printf("Error reading file %s: %v\n", fileName, err)
-			return
+			stream.CancelWrite(streamCancelled)
+			return false
 		}
 		if bytesRead == 0 {
-			break
+			log.Printf("\nError: %s shrank to %d bytes while being sent\n", fileName, totalWritten)
+			stream.CancelWrite(streamCancelled)
+			return false
 		}
 
-		bytesWritten, err := stream.Write(buffer[:bytesRead])
+		extendDeadline(stream)
+		bytesWritten, err := body.Write(buffer[:bytesRead])
+		if ctx.Err() != nil {
+			fmt.Printf("\nUpload of %s cancelled.\n", fileName)
+			return false
+		}
+		if abortIfTimedOut(stream, fileName, err) {
+			return false
+		}
 		if err != nil {
+			// The server stops reading when it refuses a file; its reply
+			// explains why.
+			if reply := readReply(stream); strings.HasPrefix(reply, "Error:") {
+				fmt.Printf("\n%s\n", colorError(reply))
+				return false
+			}
 			log.Printf("Error writing to stream for file %s: %v\n", fileName, err)
-			return
+			return false
 		}
 
-		totalWritten += bytesWritten
-		percentage := int(float64(totalWritten) / float64(fileSize) * 100)
-		fmt.Printf("\r  - %s: %s (%d/%d bytes)", fileName, generateProgressBar(percentage), totalWritten, fileSize)
+		totalWritten += int64(bytesWritten)
+		report.update(totalWritten)
 	}
 
-	fmt.Println("\nUpload completed successfully!")
+	// Closing our side marks the end of the file for the server, which
+	// closes its side once the file is safely stored.
+	closeErr := body.Close()
+	if err := stream.Close(); closeErr == nil {
+		closeErr = err
+	}
+	extendDeadline(stream)
+	response, err := io.ReadAll(stream)
+	if abortIfTimedOut(stream, fileName, err) {
+		return false
+	}
+	if reply := strings.TrimSpace(string(response)); strings.HasPrefix(reply, "Error:") {
+		fmt.Printf("\n%s\n", colorError(reply))
+		return false
+	}
+	if closeErr != nil {
+		log.Printf("\nError finishing upload of %s: %v\n", fileName, closeErr)
+		return false
+	}
+	if err != nil {
+		log.Printf("\nError waiting for server to store %s: %v\n", fileName, err)
+		return false
+	}
+	return true
 }
 
-func downloadFiles(session quic.Connection, fileNames []string) {
+// readReply returns whatever the server wrote on stream before closing it.
+func readReply(stream quic.Stream) string {
+	response, _ := io.ReadAll(stream)
+	return strings.TrimSpace(string(response))
+}
+
+func downloadFiles(ctx context.Context, session quic.Connection, fileNames []string) {
+    fileNames = uniqueNames(fileNames)
+    assignFlatNames(fileNames)
+    if dryRun {
+        planDownloads(ctx, session, fileNames)
+        return
+    }
     totalFiles := len(fileNames)
-    fmt.Printf("Downloading %d files...\n", totalFiles)
+    var missing []fileResult
+    if preflightDownloads {
+        fileNames, missing = checkRemote(ctx, session, fileNames)
+    }
+    fmt.Printf("Downloading %d files...\n", len(fileNames))
+    fileNames, results := resumeDownloads(ctx, session, fileNames)
+    switch {
+    case len(fileNames) == 0:
+    case verifyChunks:
+        results = append(results, downloadEachChunked(ctx, session, fileNames)...)
+    default:
+        results = append(results, downloadParallel(ctx, session, fileNames)...)
+    }
+    endBarLines()
+    printResults(append(results, missing...), totalFiles, "Downloaded")
+}
 
-    stream, err := session.OpenStreamSync(context.Background())
+
+// downloadBatch fetches fileNames with a single dwd command on one stream
+// and returns what became of each, in order. Files after a cancel are left
+// out; once the stream or the connection breaks, the files still to come
+// are reported as not attempted.
+func downloadBatch(ctx context.Context, session quic.Connection, fileNames []string) []fileResult {
+    stream, err := session.OpenStreamSync(ctx)
     if err != nil {
-        log.Fatalf("Failed to open stream: %v", err)
+        log.Printf("Failed to open stream for download: %v\n", err)
+        return failAll(fileNames, err)
     }
     defer stream.Close()
+    stop := resetOnCancel(ctx, stream)
+    defer stop()
 
-    // Send a single dwd command with all file names
+    // Send a single dwd command with all file names; the files come back
+    // one after another, each behind its own header
     command := "dwd " + strings.Join(fileNames, " ")
-    stream.Write([]byte(command + "\n"))
-
-    filesDownloaded := 0
-    for _, fileName := range fileNames {
-        if downloadFile(stream, fileName) { // Pass the same stream
-            filesDownloaded++
+    stream.Write([]byte(tagged(command + "\n")))
+    reader := bufio.NewReader(stream)
+    // Batches running side by side show their bars on lines of their own
+    line := newBarLine()
+
+    var results []fileResult
+    for i, fileName := range fileNames {
+        if ctx.Err() != nil {
+            printLine("Download cancelled.")
+            break
+        }
+        broken := false
+        fetch := func(attempt int) (int64, error) {
+            if attempt == 0 {
+                size, err := downloadFile(stream, reader, fileName, line) // Pass the same stream
+                broken = isStreamBroken(err)
+                return size, err
+            }
+            return redownloadFile(ctx, session, fileName)
+        }
+        size, err := fetchVerified(fileName, fetch)
+        results = append(results, fileResult{name: fileName, size: size, err: err})
+        // Once the stream or the connection is gone the rest of the batch
+        // cannot arrive, so stop here rather than fail every file in turn
+        if (broken || session.Context().Err() != nil) && ctx.Err() == nil {
+            rest := fileNames[i+1:]
+            printLine(colorError(fmt.Sprintf("Error: download stopped at %s: %v; %d remaining files not attempted", fileName, err, len(rest))))
+            results = append(results, failAll(rest, errNotAttempted)...)
+            break
         }
     }
-    fmt.Printf("Downloaded %d/%d successfully.\n", filesDownloaded, totalFiles)
+    return results
 }
 
-
-func downloadFile(stream quic.Stream, fileName string) bool {
-    // Send the download request
-    stream.Write([]byte("dwd " + fileName + "\n"))
-
-    // Read the server's response
-    buffer := make([]byte, 4096)
-    bytesRead, err := stream.Read(buffer)
-    if err != nil && err != io.EOF {
-        log.Printf("Error reading server response: %v", err)
-        return false
-    }
-
-    response := strings.TrimSpace(string(buffer[:bytesRead]))
-    if strings.HasPrefix(response, "Error:") {
-        fmt.Println(response) // Display the server's error message
-        return false
+// downloadFile receives the next file of a dwd batch from reader, which
+// reads stream, into its partialPath, and returns its size. The server
+// announces each file with a status line, see readFileStatus, and a file is
+// only complete once exactly size bytes arrived; a shorter one is removed.
+// Its progress bar is drawn on line, or not at all if that is nil.
+func downloadFile(stream quic.Stream, reader *bufio.Reader, fileName string, line *barLine) (int64, error) {
+    size, modTime, err := readFileStatus(stream, reader, fileName)
+    if err != nil {
+        return 0, err
     }
 
     // If the response is OK, proceed with the download
-    filePath := filepath.Join("downloadedFiles", fileName)
-    downloadDir := "downloadedFiles"
-    if _, err := os.Stat(downloadDir); os.IsNotExist(err) {
-        if err := os.Mkdir(downloadDir, os.ModePerm); err != nil {
-            log.Printf("Error creating 'downloadedFiles' directory: %v", err)
-            return false
-        }
+    filePath := partialPath(fileName)
+    // Nested remote paths keep their directories under downloadedFiles
+    if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+        return size, skipFile(reader, size, fmt.Errorf("could not create %s: %v", filepath.Dir(filePath), err))
     }
 
     file, err := os.Create(filePath)
     if err != nil {
-        log.Printf("Error creating file %s: %v", filePath, err)
-        return false
+        return size, skipFile(reader, size, fmt.Errorf("could not create %s: %v", filePath, err))
     }
-    defer file.Close()
+    // A download cut short by the connection is kept for the next dwd of
+    // the file to finish (see resumeDownloads)
+    notePartial(fileName, size, modTime)
+    complete, keep := false, false
+    defer func() {
+        file.Close()
+        if !complete && !keep {
+            os.Remove(filePath)
+            forgetPartial(fileName)
+        }
+    }()
 
-    for {
-        bytesRead, err := stream.Read(buffer)
-        if err != nil && err != io.EOF {
-            log.Printf("Error reading from stream for file %s: %v\n", fileName, err)
-            return false
+    var out io.Writer = file
+    var decrypt *decryptWriter
+    if encryptFiles {
+        decrypt = newDecryptWriter(file)
+        out = decrypt
+    }
+
+    buffer := make([]byte, 4096)
+    var received int64
+    var readErr error
+    report := newProgress(fileName, 0, size, line != nil)
+    report.line = line
+    for received < size {
+        extendDeadline(stream)
+        bytesRead, err := reader.Read(buffer[:min(int64(len(buffer)), size-received)])
+        if abortIfTimedOut(stream, fileName, err) {
+            keep = received > 0 && resumable(size)
+            return size, brokenStream(errTimedOut)
         }
-        if bytesRead == 0 {
+        if _, werr := out.Write(buffer[:bytesRead]); werr != nil {
+            return size, skipFile(reader, size-received-int64(bytesRead), fmt.Errorf("could not write %s: %v", filePath, werr))
+        }
+        received += int64(bytesRead)
+        report.update(received)
+        if err != nil {
+            readErr = err
             break
         }
-
-        if _, err := file.Write(buffer[:bytesRead]); err != nil {
-            log.Printf("Error writing to file %s: %v", fileName, err)
-            return false
+    }
+    if received < size {
+        keep = received > 0 && resumable(size)
+        if readErr != nil && readErr != io.EOF {
+            return size, brokenStream(fmt.Errorf("download truncated at %d of %d bytes: %v", received, size, readErr))
+        }
+        return size, brokenStream(fmt.Errorf("download truncated at %d of %d bytes", received, size))
+    }
+    if decrypt != nil {
+        if err := decrypt.Close(); err != nil {
+            return size, err
         }
     }
 
-    return true
+    complete = true
+    return size, nil
 }
 
-func listFiles(session quic.Connection) {
-    stream, err := session.OpenStreamSync(context.Background())
+func listFiles(ctx context.Context, session quic.Connection) {
+    stream, err := session.OpenStreamSync(ctx)
     if err != nil {
-        log.Fatalf("Failed to open stream: %v", err)
+        log.Printf("Failed to open stream for ls: %v\n", err)
+        return
     }
     defer stream.Close()
+    stop := resetOnCancel(ctx, stream)
+    defer stop()
 
     // Send the ls command to the server
-    stream.Write([]byte("ls\n"))
+    stream.Write([]byte(tagged("ls\n")))
 
-    // Read the server's response
-    buffer := make([]byte, 4096)
-    bytesRead, err := stream.Read(buffer)
-    if err != nil && err != io.EOF {
-        log.Printf("Error reading response: %v\n", err)
-        return
+    // Print the response line by line as it arrives, however long it is,
+    // rather than holding it all first
+    reader := bufio.NewReader(stream)
+    printed := 0
+    for {
+        line, err := reader.ReadString('\n')
+        if line = strings.TrimSpace(line); strings.HasPrefix(line, "Error:") {
+            fmt.Println(colorError(line))
+            return
+        } else if line != "" {
+            if printed == 0 {
+                fmt.Println("Files available on the server:")
+            }
+            fmt.Println(line)
+            printed++
+        }
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            if ctx.Err() == nil {
+                log.Printf("Error reading response: %v\n", err)
+            }
+            return
+        }
     }
-
-    response := strings.TrimSpace(string(buffer[:bytesRead]))
-    if response == "" {
+    if printed == 0 {
         fmt.Println("No files available on the server.")
-    } else {
-        fmt.Println("Files available on the server:")
-        fmt.Println(response)
     }
-}
\ No newline at end of file
+}
+
+// sendCommand runs a single-line command on its own stream and returns the
+// server's complete response.
+func sendCommand(ctx context.Context, session quic.Connection, command string) (string, error) {
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to open stream: %w", err)
+	}
+	defer stream.Close()
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+
+	if _, err := stream.Write([]byte(tagged(command + "\n"))); err != nil {
+		return "", fmt.Errorf("failed to send command: %w", err)
+	}
+	response, err := io.ReadAll(stream)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	return strings.TrimSpace(string(response)), nil
+}
+
+// changeDir asks the server to switch the remote working directory.
+func changeDir(ctx context.Context, session quic.Connection, dir string) {
+	response, err := sendCommand(ctx, session, strings.TrimSpace("cd "+dir))
+	if err != nil {
+		log.Printf("Error changing directory: %v\n", err)
+		return
+	}
+	if strings.HasPrefix(response, "Error:") {
+		fmt.Println(colorError(response))
+		return
+	}
+	remoteCwd = response
+}
+
+func printWorkingDir(ctx context.Context, session quic.Connection) {
+	response, err := sendCommand(ctx, session, "pwd")
+	if err != nil {
+		log.Printf("Error reading remote directory: %v\n", err)
+		return
+	}
+	if !strings.HasPrefix(response, "Error:") {
+		remoteCwd = response
+	}
+	fmt.Println(colorReply(response))
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// serverBinary is the server built from ../server, once for all tests.
+var serverBinary struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if serverBinary.path != "" {
+		os.RemoveAll(filepath.Dir(serverBinary.path))
+	}
+	os.Exit(code)
+}
+
+func buildServer(t testing.TB) string {
+	t.Helper()
+	serverBinary.once.Do(func() {
+		dir, err := os.MkdirTemp("", "quicscp-server")
+		if err != nil {
+			serverBinary.err = err
+			return
+		}
+		serverBinary.path = filepath.Join(dir, "server")
+		out, err := exec.Command("go", "build", "-o", serverBinary.path, "../server").CombinedOutput()
+		if err != nil {
+			serverBinary.err = fmt.Errorf("building the server: %v\n%s", err, out)
+		}
+	})
+	if serverBinary.err != nil {
+		t.Fatal(serverBinary.err)
+	}
+	return serverBinary.path
+}
+
+// startServer runs the server on a free loopback port with its storage in a
+// fresh directory, which it returns, and points serverAddr at it. The
+// server stops when the test ends.
+func startServer(t testing.TB, args ...string) string {
+	t.Helper()
+	binary := buildServer(t)
+	dir := t.TempDir()
+	storage := filepath.Join(dir, "storage")
+	certFile, keyFile := writeTestCert(t, dir)
+	addr := freeUDPAddr(t)
+	cmd := exec.Command(binary, append([]string{"-addr", addr, "-storage", storage, "-cert", certFile, "-key", keyFile, "-conn-rate", "0"}, args...)...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	listening := make(chan bool)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if strings.HasPrefix(scanner.Text(), "Server listening") {
+				listening <- true
+			}
+		}
+		close(listening)
+	}()
+	select {
+	case ok := <-listening:
+		if !ok {
+			t.Fatal("the server exited before it was listening")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server did not start listening")
+	}
+	serverAddr = addr
+	return storage
+}
+
+func freeUDPAddr(t testing.TB) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String()
+}
+
+// writeTestCert writes a self-signed certificate and its key to dir.
+func writeTestCert(t testing.TB, dir string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// connect dials the server at serverAddr as the client does at startup,
+// from a fresh working directory with an empty sourceDir in it.
+func connect(t testing.TB) quic.Connection {
+	t.Helper()
+	t.Chdir(t.TempDir())
+	if err := os.Mkdir(sourceDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	session, err := dialServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.CloseWithError(errCodeNone, "test over") })
+	setupSession(session, "")
+	return session
+}
+
+// captureOutput runs fn and returns everything it printed or logged.
+func captureOutput(t testing.TB, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	log.SetOutput(w)
+	var out bytes.Buffer
+	copied := make(chan struct{})
+	go func() {
+		io.Copy(&out, r)
+		close(copied)
+	}()
+	func() {
+		defer func() {
+			os.Stdout = stdout
+			log.SetOutput(os.Stderr)
+			w.Close()
+			<-copied
+			r.Close()
+		}()
+		fn()
+	}()
+	return out.String()
+}
+
+// flakyConn fails the next failures calls to OpenStreamSync, as a
+// connection out of stream credit or being torn down would, and passes
+// everything else through to the real connection.
+type flakyConn struct {
+	quic.Connection
+	failures int
+}
+
+var errNoStream = errors.New("injected stream failure")
+
+func (c *flakyConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	if c.failures > 0 {
+		c.failures--
+		return nil, errNoStream
+	}
+	return c.Connection.OpenStreamSync(ctx)
+}
+
+// TestREPLSurvivesStreamFailure runs each command once with stream opening
+// failing, which must be reported without ending the client, and then again
+// on the same connection, which must work.
+func TestREPLSurvivesStreamFailure(t *testing.T) {
+	storage := startServer(t)
+	session := &flakyConn{Connection: connect(t)}
+	os.WriteFile(filepath.Join(sourceDir, "up.txt"), []byte("uploaded"), 0o644)
+	os.MkdirAll(filepath.Join(storage, "dir"), 0o755)
+	os.WriteFile(filepath.Join(storage, "down.txt"), []byte("downloaded"), 0o644)
+
+	for _, tc := range []struct {
+		command string
+		worked  func() bool
+	}{
+		{"ls", nil},
+		{"upd up.txt", func() bool {
+			data, err := os.ReadFile(filepath.Join(storage, "up.txt"))
+			return err == nil && string(data) == "uploaded"
+		}},
+		{"dwd down.txt", func() bool {
+			data, err := os.ReadFile(filepath.Join("downloadedFiles", "down.txt"))
+			return err == nil && string(data) == "downloaded"
+		}},
+		{"cd dir", func() bool { return remoteCwd == "/dir" }},
+		{"pwd", nil},
+		{"find txt", nil},
+		{"rm /up.txt", func() bool {
+			_, err := os.Stat(filepath.Join(storage, "up.txt"))
+			return errors.Is(err, fs.ErrNotExist)
+		}},
+	} {
+		session.failures = 1
+		out := captureOutput(t, func() { runCommand(context.Background(), session, nil, tc.command) })
+		if !strings.Contains(out, errNoStream.Error()) {
+			t.Errorf("%s with no stream: the failure was not reported:\n%s", tc.command, out)
+		}
+		if session.Context().Err() != nil {
+			t.Fatalf("%s with no stream: the connection was closed", tc.command)
+		}
+		out = captureOutput(t, func() { runCommand(context.Background(), session, nil, tc.command) })
+		if strings.Contains(out, "Error") || tc.worked != nil && !tc.worked() {
+			t.Errorf("%s again, on the same connection: did not work:\n%s", tc.command, out)
+		}
+	}
+}
+
+// cuttingConn passes dwd streams through a cutStream that ends them keep
+// bytes into the first file, as a server dying mid-transfer would, and
+// leaves every other stream alone.
+type cuttingConn struct {
+	quic.Connection
+	keep int
+}
+
+func (c *cuttingConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	stream, err := c.Connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cutStream{Stream: stream, keep: c.keep}, nil
+}
+
+type cutStream struct {
+	quic.Stream
+	keep   int  // body bytes to let through
+	armed  bool // a dwd was sent
+	header bool // its status line has been read
+	cut    bool
+}
+
+func (s *cutStream) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "dwd ") {
+		s.armed = true
+	}
+	return s.Stream.Write(p)
+}
+
+func (s *cutStream) Read(p []byte) (int, error) {
+	if s.cut {
+		return 0, io.EOF
+	}
+	n, err := s.Stream.Read(p)
+	if !s.armed {
+		return n, err
+	}
+	body := p[:n]
+	if !s.header {
+		i := bytes.IndexByte(body, '\n')
+		if i < 0 {
+			return n, err
+		}
+		s.header = true
+		body = body[i+1:]
+	}
+	if len(body) >= s.keep {
+		n -= len(body) - s.keep
+		s.cut = true
+		s.Stream.CancelRead(streamCancelled)
+		return n, nil
+	}
+	s.keep -= len(body)
+	return n, err
+}
+
+// TestTruncatedDownload cuts downloads short and checks that the client
+// reports the failure instead of keeping the file as if it were complete. A
+// small file is thrown away; a large one is kept aside and finished by the
+// next dwd.
+func TestTruncatedDownload(t *testing.T) {
+	storage := startServer(t)
+	session := connect(t)
+	small := bytes.Repeat([]byte("small file "), 1000)
+	large := bytes.Repeat([]byte("large file "), resumeMinSize/5)
+	os.WriteFile(filepath.Join(storage, "small.txt"), small, 0o644)
+	os.WriteFile(filepath.Join(storage, "large.txt"), large, 0o644)
+
+	dwd := func(conn quic.Connection, name string) string {
+		return captureOutput(t, func() { runCommand(context.Background(), conn, nil, "dwd "+name) })
+	}
+	for _, tc := range []struct {
+		name    string
+		content []byte
+		kept    bool // the partial download is kept for resuming
+	}{
+		{"small.txt", small, false},
+		{"large.txt", large, true},
+	} {
+		keep := len(tc.content) / 3
+		out := dwd(&cuttingConn{Connection: session, keep: keep}, tc.name)
+		if !strings.Contains(out, fmt.Sprintf("truncated at %d of %d bytes", keep, len(tc.content))) || !strings.Contains(out, "Downloaded 0/1") {
+			t.Errorf("%s cut short: the failure was not reported:\n%s", tc.name, out)
+		}
+		if _, err := os.Stat(localPath(tc.name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s cut short: it was saved as complete (%v)", tc.name, err)
+		}
+		partial, err := os.ReadFile(partialPath(tc.name))
+		if tc.kept && (err != nil || !bytes.Equal(partial, tc.content[:keep])) {
+			t.Errorf("%s cut short: kept %d bytes for resuming, %v; want the %d received", tc.name, len(partial), err, keep)
+		}
+		if !tc.kept && err == nil {
+			t.Errorf("%s cut short: its partial download was left behind", tc.name)
+		}
+
+		out = dwd(session, tc.name)
+		data, err := os.ReadFile(localPath(tc.name))
+		if err != nil || !bytes.Equal(data, tc.content) {
+			t.Errorf("%s again: got %d bytes, %v; want %d:\n%s", tc.name, len(data), err, len(tc.content), out)
+		}
+	}
+}
+
+// TestListingLongerThanOneRead lists a directory with far more than the
+// 4096 bytes of names once read in one go, and checks every name is printed.
+func TestListingLongerThanOneRead(t *testing.T) {
+	storage := startServer(t)
+	session := connect(t)
+	var want []string
+	for i := range 400 {
+		name := fmt.Sprintf("file-%03d-%s.txt", i, strings.Repeat("n", 30))
+		if err := os.WriteFile(filepath.Join(storage, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	if size := len(strings.Join(want, "\n")); size <= 4*4096 {
+		t.Fatalf("only %d bytes of names", size)
+	}
+
+	out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "ls") })
+	printed := make(map[string]bool)
+	for _, line := range strings.Split(out, "\n") {
+		printed[strings.TrimSpace(line)] = true
+	}
+	for _, name := range want {
+		if !printed[name] {
+			t.Errorf("%s was not listed", name)
+		}
+	}
+	if t.Failed() {
+		t.Logf("ls printed:\n%s", out)
+	}
+}
+
+// TestTransfersAroundBufferSize uploads and then downloads, in one batch,
+// files sized around the 4096 bytes the client reads at a time, so status
+// lines and file boundaries fall on both sides of a read. A missing file in
+// the middle of the batch must cost only itself.
+func TestTransfersAroundBufferSize(t *testing.T) {
+	storage := startServer(t)
+	session := connect(t)
+	prevPreflight := preflightDownloads
+	preflightDownloads = false // let the server answer for the missing file
+	t.Cleanup(func() { preflightDownloads = prevPreflight })
+
+	want := make(map[string][]byte)
+	var names []string
+	for _, size := range []int{0, 1, 4095, 4096, 4097, 2 * 4096, 3 * 4096, 3*4096 - 1, 3*4096 + 1, 16 * 4096} {
+		name := fmt.Sprintf("size-%d.bin", size)
+		data := make([]byte, size)
+		rand.Read(data)
+		if err := os.WriteFile(filepath.Join(sourceDir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want[name] = data
+		names = append(names, name)
+	}
+
+	out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "upd "+strings.Join(names, " ")) })
+	for _, name := range names {
+		if data, err := os.ReadFile(filepath.Join(storage, name)); err != nil || !bytes.Equal(data, want[name]) {
+			t.Errorf("upd %s: stored %d bytes, %v; want %d:\n%s", name, len(data), err, len(want[name]), out)
+		}
+	}
+
+	batch := append(names[:4:4], append([]string{"missing.bin"}, names[4:]...)...)
+	out = captureOutput(t, func() { runCommand(context.Background(), session, nil, "dwd "+strings.Join(batch, " ")) })
+	for _, name := range names {
+		if data, err := os.ReadFile(localPath(name)); err != nil || !bytes.Equal(data, want[name]) {
+			t.Errorf("dwd %s: got %d bytes, %v; want %d", name, len(data), err, len(want[name]))
+		}
+	}
+	if !strings.Contains(out, fmt.Sprintf("Downloaded %d/%d", len(names), len(batch))) {
+		t.Errorf("dwd: want every file but the missing one downloaded:\n%s", out)
+	}
+	if _, err := os.Stat(localPath("missing.bin")); err == nil {
+		t.Error("a file the server does not have was saved")
+	}
+}
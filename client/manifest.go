@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+)
+
+// expectedHashes maps file names to the SHA-256 the -manifest file lists
+// for them. It is nil when no manifest was given.
+var expectedHashes map[string]string
+
+// manifestFailures counts downloads that did not match the manifest. The
+// client exits non-zero if any did.
+var manifestFailures atomic.Int64
+
+// loadManifest reads a manifest in the format sha256sum writes: the hex
+// digest, two spaces (or a space and "*"), then the file name.
+func loadManifest(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		sum, name, ok := strings.Cut(text, " ")
+		name = strings.TrimPrefix(strings.TrimLeft(name, " "), "*")
+		if _, err := hex.DecodeString(sum); !ok || err != nil || len(sum) != sha256.Size*2 || name == "" {
+			return nil, fmt.Errorf("%s:%d: expected \"<sha256>  <name>\"", path, line)
+		}
+		hashes[filepath.ToSlash(name)] = strings.ToLower(sum)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verifyDownload checks the downloaded copy of fileName against the
+// manifest and reports whether it may be kept as good. Files the manifest
+// does not list are accepted with a warning.
+func verifyDownload(fileName string) bool {
+	if err := checkManifest(fileName, localPath(fileName)); err != nil {
+		fmt.Println(colorError("Error: " + err.Error()))
+		manifestFailures.Add(1)
+		return false
+	}
+	return true
+}
+
+// checkManifest is verifyDownload without the bookkeeping, for callers that
+// may try again, checking the copy of fileName at path.
+func checkManifest(fileName, path string) error {
+	if expectedHashes == nil {
+		return nil
+	}
+	want, ok := expectedHashes[fileName]
+	if !ok {
+		printLine(fmt.Sprintf("Warning: %s is not listed in the manifest", fileName))
+		return nil
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return fmt.Errorf("could not verify %s: %v", fileName, err)
+	}
+	if got != want {
+		return fmt.Errorf("%s does not match the manifest (got %s, want %s)", fileName, got, want)
+	}
+	printLine(colorSuccess(fmt.Sprintf("Verified %s against the manifest.", fileName)))
+	return nil
+}
+
+// fetchManifest asks the server for the checksums of every file below a
+// remote directory and writes them to stdout or, with -o, to a local file
+// that -manifest can later verify downloads against.
+//
+// Usage: manifest [-o <file>] [dir]
+func fetchManifest(ctx context.Context, session quic.Connection, args []string) {
+	fs := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	output := fs.String("o", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 1 {
+		printUsage("manifest")
+		return
+	}
+	response, err := sendCommand(ctx, session, strings.TrimSpace("manifest "+fs.Arg(0)))
+	if err != nil {
+		log.Printf("Error fetching manifest: %v\n", err)
+		return
+	}
+	// The server may fail part way through, after some lines were sent.
+	if i := strings.Index("\n"+response, "\nError:"); i >= 0 {
+		fmt.Println(colorError(response[i:]))
+		return
+	}
+	if response == "" {
+		fmt.Println("No files available on the server.")
+		return
+	}
+	if *output == "" {
+		fmt.Println(response)
+		return
+	}
+	if err := os.WriteFile(*output, []byte(response+"\n"), 0o644); err != nil {
+		log.Printf("Error writing manifest: %v\n", err)
+		return
+	}
+	fmt.Println(colorSuccess(fmt.Sprintf("Wrote manifest of %d files to %s.", strings.Count(response, "\n")+1, *output)))
+}
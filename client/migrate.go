@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// networkPollInterval is how often the client looks for a change of its
+// local addresses, such as a move from Wi-Fi to cellular.
+const networkPollInterval = 2 * time.Second
+
+// migrateTimeout bounds how long the server has to answer on a new path.
+const migrateTimeout = 5 * time.Second
+
+// localAddrs lists the addresses of the machine's network interfaces, in a
+// form that changes whenever one of them does.
+func localAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	list := make([]string, len(addrs))
+	for i, addr := range addrs {
+		list[i] = addr.String()
+	}
+	slices.Sort(list)
+	return strings.Join(list, " ")
+}
+
+// watchNetwork moves session to a new socket whenever the local addresses
+// change, until session ends. The old socket may be bound to an address
+// that has gone away, and a NAT along the new route may not know it.
+func watchNetwork(session quic.Connection) {
+	ticker := time.NewTicker(networkPollInterval)
+	defer ticker.Stop()
+	addrs := localAddrs()
+	for {
+		select {
+		case <-session.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		if next := localAddrs(); next != addrs {
+			addrs = next
+			ctx, cancel := context.WithTimeout(session.Context(), migrateTimeout)
+			if err := migrate(ctx, session); err != nil && session.Context().Err() == nil {
+				printLine(colorError(fmt.Sprintf("Error: the network changed, but the connection could not move to it: %v", err)))
+			}
+			cancel()
+		}
+	}
+}
+
+// migrate moves session onto a new UDP socket, keeping the connection and
+// every transfer running on it. The server must answer on the new path
+// before the client switches to it; until then, and if it never does, the
+// old path stays in use.
+//
+// Both sockets carry the connection once the new path has been probed, and
+// closing either would close it, so they are only closed when session ends.
+func migrate(ctx context.Context, session quic.Connection) error {
+	tr, err := newTransport()
+	if err != nil {
+		return err
+	}
+	path, err := session.AddPath(tr)
+	if err != nil {
+		tr.Close()
+		return err
+	}
+	go func() {
+		<-session.Context().Done()
+		tr.Close()
+	}()
+	if err := path.Probe(ctx); err != nil {
+		path.Close()
+		return err
+	}
+	if err := path.Switch(); err != nil {
+		path.Close()
+		return err
+	}
+	if old := transport; old != nil {
+		go func() {
+			<-session.Context().Done()
+			old.Close()
+		}()
+	}
+	transport = tr
+	return nil
+}
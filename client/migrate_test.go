@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestMigrateMidDownload moves the connection to a new socket while a
+// download is running on it. The same connection must carry on, with the
+// download finishing intact and the session still in its remote directory.
+func TestMigrateMidDownload(t *testing.T) {
+	storage := startServer(t, "-server-rate", "2000000")
+	data := make([]byte, 2<<20)
+	rand.Read(data)
+	os.MkdirAll(filepath.Join(storage, "dir"), 0o755)
+	if err := os.WriteFile(filepath.Join(storage, "dir", "big.bin"), data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	session := connect(t)
+	t.Cleanup(func() { remoteCwd = "/" })
+	if out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "cd dir") }); remoteCwd != "/dir" {
+		t.Fatalf("cd dir:\n%s", out)
+	}
+
+	before := session.LocalAddr().String()
+	var migrateErr error
+	out := captureOutput(t, func() {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			runCommand(context.Background(), session, nil, "dwd big.bin")
+		}()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if info, err := os.Stat(partialPath("big.bin")); err == nil && info.Size() > 0 {
+				break
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		migrateErr = migrate(ctx, session)
+		<-done
+	})
+	if migrateErr != nil {
+		t.Fatalf("migrate: %v\n%s", migrateErr, out)
+	}
+	if after := session.LocalAddr().String(); after == before {
+		t.Errorf("still on %s after migrating", before)
+	}
+	if got, err := os.ReadFile(localPath("big.bin")); err != nil || !bytes.Equal(got, data) || strings.Contains(out, "Error") {
+		t.Fatalf("the download did not survive the migration (%d of %d bytes, %v):\n%s", len(got), len(data), err, out)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if response, err := sendCommand(ctx, session, "pwd"); err != nil || response != "/dir" {
+		t.Errorf("pwd after migrating: %q, %v; want /dir", response, err)
+	}
+	if err := session.Context().Err(); err != nil {
+		t.Errorf("the connection ended: %v", context.Cause(session.Context()))
+	}
+}
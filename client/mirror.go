@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// removeFiles deletes each of fileNames on the server.
+func removeFiles(ctx context.Context, session quic.Connection, fileNames []string) int {
+	removed := 0
+	for _, fileName := range fileNames {
+		if ctx.Err() != nil {
+			fmt.Println("Remaining deletions skipped.")
+			break
+		}
+		response, err := sendCommand(ctx, session, "rm "+fileName)
+		if err != nil {
+			log.Printf("Error removing %s: %v\n", fileName, err)
+			continue
+		}
+		if strings.HasPrefix(response, "Error") {
+			fmt.Println(colorError(response))
+			continue
+		}
+		fmt.Printf("Removed %s\n", fileName)
+		removed++
+	}
+	return removed
+}
+
+// mirrorDir uploads the directory dir from sourceDir and, with -delete,
+// then removes every remote file below it that has no local counterpart, so
+// the remote tree ends up matching the local one. Remote files that the
+// -include/-exclude filters would not have uploaded are left alone.
+//
+// Usage: mirror [-delete] [-yes] <dir>
+func mirrorDir(ctx context.Context, session quic.Connection, commands *commandReader, args []string) {
+	fs := flag.NewFlagSet("mirror", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	deleteExtra := fs.Bool("delete", false, "")
+	assumeYes := fs.Bool("yes", false, "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		printUsage("mirror")
+		return
+	}
+	dir := strings.TrimSuffix(filepath.ToSlash(fs.Arg(0)), "/")
+	if !checkSourceDir() {
+		return
+	}
+
+	local, links := expandUploads([]string{dir}, "")
+	sendUploads(ctx, session, local, links)
+	if !*deleteExtra || ctx.Err() != nil {
+		return
+	}
+
+	keep := make(map[string]bool, len(local)+len(links))
+	for _, name := range local {
+		keep[strings.TrimPrefix(name, dir+"/")] = true
+	}
+	for _, link := range links {
+		keep[strings.TrimPrefix(link.Name, dir+"/")] = true
+	}
+	response, err := sendCommand(ctx, session, "ls -R "+dir)
+	if err != nil {
+		log.Printf("Error listing remote %s: %v\n", dir, err)
+		return
+	}
+	// An error can end a listing part way through; deleting on the strength
+	// of part of it would remove files the listing never got to.
+	if i := strings.Index("\n"+response, "\nError:"); i >= 0 {
+		fmt.Println(colorError(response[i:]))
+		return
+	}
+	var extra []string
+	if response != "No files available." {
+		for _, rel := range strings.Split(response, "\n") {
+			if !keep[rel] && selected(rel) {
+				extra = append(extra, path.Join(dir, rel))
+			}
+		}
+	}
+	if len(extra) == 0 {
+		fmt.Println("No remote files to delete.")
+		return
+	}
+
+	fmt.Printf("%d remote files are not present locally:\n", len(extra))
+	for _, name := range extra {
+		fmt.Printf("  %s\n", name)
+	}
+	if dryRun {
+		fmt.Println("Dry run: nothing was deleted.")
+		return
+	}
+	if !*assumeYes && !commands.confirm(fmt.Sprintf("Delete %d remote files? [y/N]: ", len(extra))) {
+		fmt.Println("Deletion skipped.")
+		return
+	}
+	removed := removeFiles(ctx, session, extra)
+	fmt.Printf("Deleted %d/%d remote files.\n", removed, len(extra))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// moveFiles downloads each file and has the server delete it once the copy
+// has been verified, like taking items off a queue.
+func moveFiles(ctx context.Context, session quic.Connection, fileNames []string) {
+	fileNames = uniqueNames(fileNames)
+	assignFlatNames(fileNames)
+	if dryRun {
+		planDownloads(ctx, session, fileNames)
+		fmt.Println("Files would be deleted from the server after downloading.")
+		return
+	}
+	moved := 0
+	for _, fileName := range fileNames {
+		if ctx.Err() != nil {
+			fmt.Println("Remaining moves skipped.")
+			break
+		}
+		if moveFile(ctx, session, fileName) {
+			moved++
+		}
+	}
+	summary := fmt.Sprintf("Moved %d/%d successfully.", moved, len(fileNames))
+	if moved == len(fileNames) {
+		fmt.Println(colorSuccess(summary))
+	} else {
+		fmt.Println(colorError(summary))
+	}
+}
+
+// moveFile runs one "dwd --move" exchange on its own stream. The local copy
+// is only kept, and the server only told to delete its copy, when the bytes
+// received match the checksum the server sent after them.
+func moveFile(ctx context.Context, session quic.Connection, fileName string) bool {
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		log.Printf("Failed to open stream for %s: %v\n", fileName, err)
+		return false
+	}
+	defer stream.Close()
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+
+	if _, err := stream.Write([]byte(tagged("dwd --move " + fileName + "\n"))); err != nil {
+		log.Printf("Error sending move request: %v\n", err)
+		return false
+	}
+	reader := bufio.NewReader(stream)
+	extendDeadline(stream)
+	header, err := reader.ReadString('\n')
+	if abortIfTimedOut(stream, fileName, err) {
+		return false
+	}
+	header = strings.TrimSpace(header)
+	if strings.HasPrefix(header, "Error") || err != nil {
+		if header == "" {
+			header = fmt.Sprintf("Error: no response for %s", fileName)
+		}
+		fmt.Println(colorError(header))
+		return false
+	}
+	size, err := strconv.ParseInt(strings.TrimPrefix(header, "OK "), 10, 64)
+	if err != nil || size < 0 {
+		fmt.Println(colorError("Error: unexpected response: " + header))
+		return false
+	}
+
+	filePath := partialPath(fileName)
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		log.Printf("Error creating directory for %s: %v", filePath, err)
+		return false
+	}
+	file, err := os.Create(filePath)
+	if err != nil {
+		log.Printf("Error creating file %s: %v", filePath, err)
+		return false
+	}
+	defer file.Close()
+
+	fmt.Printf("Moving file: %s (%d bytes)\n", fileName, size)
+	// h covers the bytes as the server stores them; plain covers what ends
+	// up on disk, which differs when -encrypt is set.
+	h := sha256.New()
+	plain := h
+	var out io.Writer = file
+	var decrypt *decryptWriter
+	if encryptFiles {
+		plain = sha256.New()
+		decrypt = newDecryptWriter(io.MultiWriter(file, plain))
+		out = decrypt
+	}
+	var received int64
+	report := newProgress(fileName, 0, size, true)
+	buffer := make([]byte, 32*1024)
+	for received < size {
+		extendDeadline(stream)
+		chunk := buffer
+		if remaining := size - received; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := reader.Read(chunk)
+		if n > 0 {
+			if _, werr := out.Write(chunk[:n]); werr != nil {
+				log.Printf("\nError saving %s: %v", fileName, werr)
+				return discardMoved(file, filePath)
+			}
+			h.Write(chunk[:n])
+			received += int64(n)
+			report.update(received)
+		}
+		if abortIfTimedOut(stream, fileName, err) {
+			return discardMoved(file, filePath)
+		}
+		if err != nil {
+			log.Printf("\nError receiving %s after %d of %d bytes: %v\n", fileName, received, size, err)
+			return discardMoved(file, filePath)
+		}
+	}
+	fmt.Println()
+
+	extendDeadline(stream)
+	checksum, err := reader.ReadString('\n')
+	if abortIfTimedOut(stream, fileName, err) {
+		return discardMoved(file, filePath)
+	}
+	if strings.TrimSpace(checksum) != hex.EncodeToString(h.Sum(nil)) {
+		fmt.Println(colorError(fmt.Sprintf("Error: checksum mismatch for %s, it stays on the server", fileName)))
+		return discardMoved(file, filePath)
+	}
+	if decrypt != nil {
+		if err := decrypt.Close(); err != nil {
+			fmt.Println(colorError(fmt.Sprintf("Error: %s: %v, it stays on the server", fileName, err)))
+			return discardMoved(file, filePath)
+		}
+	}
+	if expected, ok := expectedHashes[fileName]; ok && expected != hex.EncodeToString(plain.Sum(nil)) {
+		fmt.Println(colorError(fmt.Sprintf("Error: %s does not match the manifest, it stays on the server", fileName)))
+		manifestFailures.Add(1)
+		return discardMoved(file, filePath)
+	}
+	if err := file.Sync(); err != nil {
+		log.Printf("Error flushing %s, it stays on the server: %v\n", filePath, err)
+		return discardMoved(file, filePath)
+	}
+	file.Close()
+	if err := finishDownload(fileName); err != nil {
+		fmt.Println(colorError(fmt.Sprintf("Error: %v, it stays on the server", err)))
+		return false
+	}
+
+	if _, err := stream.Write([]byte("ack\n")); err != nil {
+		log.Printf("Error confirming move of %s: %v\n", fileName, err)
+		return false
+	}
+	stream.Close()
+	rest, _ := io.ReadAll(reader)
+	reply := strings.TrimSpace(string(rest))
+	if reply != "OK" {
+		fmt.Println(colorError(fmt.Sprintf("Downloaded %s but the server kept its copy: %s", fileName, reply)))
+		return false
+	}
+	fmt.Println(colorSuccess(fmt.Sprintf("Moved %s from the server.", fileName)))
+	return true
+}
+
+// discardMoved removes the local copy of a move that did not complete; the
+// server still has the file.
+func discardMoved(file *os.File, filePath string) bool {
+	file.Close()
+	os.Remove(filePath)
+	return false
+}
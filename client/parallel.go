@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// downloadStreams is set by -parallel: how many streams the client would
+// like to split a download batch across.
+var downloadStreams int
+
+// batchStreams is how many it may use on the current connection, the
+// smaller of downloadStreams and what the server allows.
+var batchStreams = 1
+
+// negotiateDownloadStreams asks the server how many streams one download
+// batch may use. Servers that predate the query get a single stream.
+func negotiateDownloadStreams(ctx context.Context, session quic.Connection) {
+	batchStreams = 1
+	if downloadStreams <= 1 {
+		return
+	}
+	response, err := sendCommand(ctx, session, "download-streams")
+	allowed, perr := strconv.Atoi(response)
+	if err != nil || perr != nil || allowed < 1 {
+		fmt.Println("Server does not support parallel downloads, using one stream")
+		return
+	}
+	if allowed < downloadStreams {
+		fmt.Printf("Server allows %d download streams, using %d instead of %d\n", allowed, allowed, downloadStreams)
+	}
+	batchStreams = min(downloadStreams, allowed)
+}
+
+// downloadParallel downloads fileNames in up to batchStreams batches at
+// once, each a dwd command on a stream of its own, and returns what became
+// of each file, in the order they were asked for. Files are dealt out in turn, so that large and
+// small ones mix, and every stream knows which files it asked for and in
+// what order they come.
+func downloadParallel(ctx context.Context, session quic.Connection, fileNames []string) []fileResult {
+	groups := splitBatch(fileNames, batchStreams)
+	if len(groups) == 1 {
+		return downloadBatch(ctx, session, groups[0])
+	}
+	batches := make([][]fileResult, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			batches[i] = downloadBatch(ctx, session, group)
+		}()
+	}
+	wg.Wait()
+	// Put the results back in the order the files were asked for.
+	byName := make(map[string]fileResult)
+	for _, batch := range batches {
+		for _, r := range batch {
+			byName[r.name] = r
+		}
+	}
+	var results []fileResult
+	for _, name := range fileNames {
+		if r, ok := byName[name]; ok {
+			results = append(results, r)
+		}
+	}
+	return results
+}
+
+// splitBatch deals fileNames, which must not repeat, out over at most n
+// groups, keeping their order within each group.
+func splitBatch(fileNames []string, n int) [][]string {
+	n = max(1, min(n, len(fileNames)))
+	groups := make([][]string, n)
+	for i, name := range fileNames {
+		groups[i%n] = append(groups[i%n], name)
+	}
+	return groups
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// flatDownloads is set by -flat: downloads go straight into
+// downloadedFiles, without the directories of their remote names.
+var flatDownloads bool
+
+// flatNames maps the remote names of the current command to their file
+// names under -flat, see assignFlatNames.
+var flatNames map[string]string
+
+// assignFlatNames picks the local names of a command's fileNames under
+// -flat. Each file keeps its base name, except that when several share one
+// the first listed keeps it and the others get -2, -3, ... before the
+// extension: a/x.txt and b/x.txt become x.txt and x-2.txt. Only files of the
+// same command are told apart; one already in downloadedFiles is replaced,
+// as without -flat.
+func assignFlatNames(fileNames []string) {
+	flatNames = nil
+	if !flatDownloads {
+		return
+	}
+	flatNames = make(map[string]string, len(fileNames))
+	taken := make(map[string]bool)
+	for _, fileName := range fileNames {
+		base := filepath.Base(filepath.FromSlash(fileName))
+		ext := filepath.Ext(base)
+		local := base
+		for n := 2; taken[local]; n++ {
+			local = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(base, ext), n, ext)
+		}
+		taken[local] = true
+		flatNames[fileName] = local
+	}
+}
+
+// localPath is where a download of the remote fileName ends up: the same
+// path under downloadedFiles, subdirectories included, or with -flat its
+// name from assignFlatNames. Names the server takes from its root
+// ("/sub/file.txt") land in the same place as relative ones, and a name
+// that climbs out of the remote working directory ("../file.txt") cannot
+// climb out of downloadedFiles, it keeps only its last element.
+func localPath(fileName string) string {
+	rel := filepath.Clean(strings.TrimLeft(filepath.FromSlash(fileName), string(filepath.Separator)))
+	if flatDownloads {
+		if local, ok := flatNames[fileName]; ok {
+			return filepath.Join("downloadedFiles", local)
+		}
+		rel = filepath.Base(rel)
+	}
+	if !filepath.IsLocal(rel) {
+		rel = filepath.Base(rel)
+	}
+	return filepath.Join("downloadedFiles", rel)
+}
+
+// partialPath is where a download of fileName is written until it is known
+// to be complete: a hidden file next to its final path under
+// downloadedFiles. Nothing is ever written to the final path directly, so a
+// file found there is always a whole one.
+func partialPath(fileName string) string {
+	final := localPath(fileName)
+	return filepath.Join(filepath.Dir(final), "."+filepath.Base(final)+".part")
+}
+
+// finishDownload moves the completed partial file of fileName into place,
+// replacing any earlier copy.
+func finishDownload(fileName string) error {
+	partial := partialPath(fileName)
+	forgetPartial(fileName)
+	if err := os.Rename(partial, localPath(fileName)); err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("could not save %s: %v", fileName, err)
+	}
+	return nil
+}
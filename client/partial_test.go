@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	for _, tc := range []struct {
+		remote string
+		flat   bool
+		want   string
+	}{
+		{"c.bin", false, "c.bin"},
+		{"a/b/c.bin", false, "a/b/c.bin"},
+		{"/a/b/c.bin", false, "a/b/c.bin"},
+		{"a//b/./c.bin", false, "a/b/c.bin"},
+		{"../c.bin", false, "c.bin"},
+		{"a/../../c.bin", false, "c.bin"},
+		{"a/../b/c.bin", false, "b/c.bin"},
+		{"a/b/c.bin", true, "c.bin"},
+		{"/a/b/c.bin", true, "c.bin"},
+	} {
+		flatDownloads = tc.flat
+		assignFlatNames([]string{tc.remote})
+		if got, want := localPath(tc.remote), filepath.Join("downloadedFiles", filepath.FromSlash(tc.want)); got != want {
+			t.Errorf("localPath(%q) with -flat=%t = %s, want %s", tc.remote, tc.flat, got, want)
+		}
+	}
+	flatDownloads, flatNames = false, nil
+}
+
+// TestDownloadNestedPath downloads a/b/c.bin into working directories that
+// hold none, some or a blocking part of the local directories it needs.
+func TestDownloadNestedPath(t *testing.T) {
+	storage := startServer(t)
+	content := []byte("nested content")
+	os.MkdirAll(filepath.Join(storage, "a", "b"), 0o755)
+	os.WriteFile(filepath.Join(storage, "a", "b", "c.bin"), content, 0o644)
+	t.Cleanup(func() { flatDownloads, remoteCwd = false, "/" })
+
+	for _, tc := range []struct {
+		name    string
+		prepare func() // run in the fresh working directory
+		cwd     string // remote directory to download from
+		remote  string
+		flat    bool
+		local   string // where the file must land, "" if nowhere
+	}{
+		{"no download directory yet", nil, "", "a/b/c.bin", false, "downloadedFiles/a/b/c.bin"},
+		{"from the server root", nil, "", "/a/b/c.bin", false, "downloadedFiles/a/b/c.bin"},
+		{"only some parents exist", func() { os.MkdirAll(filepath.Join("downloadedFiles", "a"), 0o755) }, "", "a/b/c.bin", false, "downloadedFiles/a/b/c.bin"},
+		{"relative to the remote directory", nil, "a", "b/c.bin", false, "downloadedFiles/b/c.bin"},
+		{"flat", nil, "", "a/b/c.bin", true, "downloadedFiles/c.bin"},
+		{"a file in the way", func() {
+			os.MkdirAll("downloadedFiles", 0o755)
+			os.WriteFile(filepath.Join("downloadedFiles", "a"), []byte("in the way"), 0o644)
+		}, "", "a/b/c.bin", false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			session := connect(t)
+			if tc.prepare != nil {
+				tc.prepare()
+			}
+			flatDownloads = tc.flat
+			remoteCwd = "/"
+			if tc.cwd != "" {
+				captureOutput(t, func() { runCommand(context.Background(), session, nil, "cd "+tc.cwd) })
+			}
+			out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "dwd "+tc.remote) })
+
+			var files []string
+			filepath.WalkDir("downloadedFiles", func(p string, d os.DirEntry, err error) error {
+				if err == nil && d.Type().IsRegular() {
+					files = append(files, filepath.ToSlash(p))
+				}
+				return nil
+			})
+			if tc.local == "" {
+				if !strings.Contains(out, "Downloaded 0/1") {
+					t.Errorf("the download did not fail:\n%s", out)
+				}
+				if len(files) != 1 || files[0] != "downloadedFiles/a" {
+					t.Errorf("downloadedFiles holds %v, want only the file in the way", files)
+				}
+				return
+			}
+			if len(files) != 1 || files[0] != tc.local {
+				t.Errorf("downloadedFiles holds %v, want only %s:\n%s", files, tc.local, out)
+			}
+			if data, err := os.ReadFile(filepath.FromSlash(tc.local)); err != nil || !bytes.Equal(data, content) {
+				t.Errorf("%s holds %q, %v; want %q", tc.local, data, err, content)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// persistPath is set by -persist: where commands are read from, "-" for
+// stdin, when the connection is to outlive any one batch of commands.
+var persistPath string
+
+// reopeningReader reads path, and opens it again each time it runs dry. For
+// a FIFO the open waits for the next writer, so one process after another
+// can send commands over the same connection; a regular file ends at its
+// first EOF.
+type reopeningReader struct {
+	path string
+	file *os.File
+}
+
+func (r *reopeningReader) Read(p []byte) (int, error) {
+	for {
+		if r.file == nil {
+			file, err := os.Open(r.path)
+			if err != nil {
+				return 0, err
+			}
+			r.file = file
+		}
+		n, err := r.file.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		info, statErr := r.file.Stat()
+		r.file.Close()
+		r.file = nil
+		if statErr != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			return n, io.EOF
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// newPersistentReader reads commands from persistPath. Neither stdin nor a
+// FIFO is edited as a terminal line, so there is no history or completion.
+func newPersistentReader() (*commandReader, error) {
+	if persistPath == "-" {
+		return &commandReader{stdin: bufio.NewReader(os.Stdin)}, nil
+	}
+	info, err := os.Stat(persistPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", persistPath)
+	}
+	return &commandReader{stdin: bufio.NewReader(&reopeningReader{path: persistPath})}, nil
+}
+
+// closeOnTerm calls onExit on SIGTERM, so that a -persist client stopped by
+// whatever started it still closes the connection rather than leaving the
+// server to time it out.
+func closeOnTerm(onExit func()) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		onExit()
+	}()
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// preflightDownloads is set by -preflight.
+var preflightDownloads = true
+
+var errNotOnServer = errors.New("not on the server")
+
+// checkRemote looks fileNames up in one listing of the remote working
+// directory before a download starts, so that a mistyped name is reported
+// up front rather than somewhere in the middle of the batch. It returns the
+// files to download and a failed result for each one that the listing
+// shows is missing. Names in other directories, which the listing does not
+// cover, are passed on unchecked, and so is everything if the listing
+// cannot be fetched.
+func checkRemote(ctx context.Context, session quic.Connection, fileNames []string) ([]string, []fileResult) {
+	remote := remoteSet(ctx, session)
+	if remote == nil {
+		return fileNames, nil
+	}
+	var found []string
+	var missing []fileResult
+	for _, fileName := range fileNames {
+		base, _, _ := strings.Cut(fileName, "@") // a version of the file
+		// A directory is left for the server to refuse, with its own reason.
+		if strings.Contains(fileName, "/") || remote[fileName] || remote[base] || remote[fileName+"/"] {
+			found = append(found, fileName)
+			continue
+		}
+		fmt.Printf("Warning: %s is not on the server, skipping it\n", fileName)
+		missing = append(missing, fileResult{name: fileName, err: errNotOnServer})
+	}
+	return found, missing
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progressMode is set by -progress: "bar" redraws a progress bar on stdout,
+// "json" writes progress events to stderr for frontends to read instead.
+var progressMode = "bar"
+
+// progressWidth is how many segments the progress bar has, set by
+// -progress-width or from the terminal's width.
+var progressWidth = defaultBarWidth
+
+const (
+	defaultBarWidth = 10 // when the terminal's width is unknown
+	maxBarWidth     = 50
+)
+
+// terminalBarWidth sizes the bar to a third of the terminal, which leaves
+// room for the file name and byte counts on the same line, within
+// defaultBarWidth and maxBarWidth. Output that is not a terminal gets
+// defaultBarWidth.
+func terminalBarWidth() int {
+	cols, _, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || cols <= 0 {
+		return defaultBarWidth
+	}
+	return max(defaultBarWidth, min(cols/3, maxBarWidth))
+}
+
+// jsonEventInterval is how often a transfer reports progress in json mode;
+// the first and last update of each file are always reported.
+const jsonEventInterval = 100 * time.Millisecond
+
+// progressEvent is one line of -progress=json output. Bytes counts from the
+// start of the file, bytes a resumed transfer already had included; Rate is
+// the average in bytes per second of those sent since it started this time.
+type progressEvent struct {
+	File    string `json:"file"`
+	Bytes   int64  `json:"bytes"`
+	Total   int64  `json:"total"`
+	Percent int    `json:"percent"`
+	Rate    int64  `json:"rate"`
+}
+
+// progressEvents encodes the events of every transfer, which may run on
+// several streams at once, one whole line at a time.
+var progressEvents = struct {
+	sync.Mutex
+	enc *json.Encoder
+}{enc: json.NewEncoder(os.Stderr)}
+
+// validateProgressMode checks a -progress value.
+func validateProgressMode(mode string) error {
+	switch mode {
+	case "bar", "json":
+		return nil
+	}
+	return fmt.Errorf("unknown progress mode %q, want bar or json", mode)
+}
+
+// stdoutIsTerminal decides how bar mode draws: redrawn in place on a
+// terminal, or once a file is complete when the output is a log or a pipe,
+// where every redraw would be a line of its own.
+var stdoutIsTerminal = term.IsTerminal(int(os.Stdout.Fd()))
+
+// barLines tracks the terminal lines reserved by newBarLine for transfers
+// that run at once, such as the streams of a parallel download. The cursor
+// is kept at the start of the last of them, so each bar can be redrawn by
+// moving up to its line and back without disturbing the others.
+var barLines struct {
+	sync.Mutex
+	count int // since the last endBarLines
+}
+
+// barLine is one of the lines in barLines.
+type barLine struct {
+	index int
+}
+
+// newBarLine reserves the next terminal line for a transfer's bars. It
+// returns nil, meaning no bar, unless bar mode is drawing on a terminal.
+func newBarLine() *barLine {
+	if progressMode != "bar" || !stdoutIsTerminal {
+		return nil
+	}
+	barLines.Lock()
+	defer barLines.Unlock()
+	if barLines.count > 0 {
+		fmt.Print("\n")
+	}
+	barLines.count++
+	return &barLine{index: barLines.count - 1}
+}
+
+func (l *barLine) draw(text string) {
+	barLines.Lock()
+	defer barLines.Unlock()
+	if up := barLines.count - 1 - l.index; up > 0 {
+		fmt.Printf("\x1b[%dA\r\x1b[K%s\x1b[%dB\r", up, text, up)
+	} else {
+		fmt.Print("\r\x1b[K" + text + "\r")
+	}
+}
+
+// printLine prints msg on a line of its own, below the reserved bar lines
+// if there are any.
+func printLine(msg string) {
+	if !printBelowBars(msg) {
+		fmt.Println(msg)
+	}
+}
+
+// printBelowBars prints msg below the reserved bar lines, which then count
+// it as one of theirs so that they can still be found, and reports whether
+// there were any.
+func printBelowBars(msg string) bool {
+	barLines.Lock()
+	defer barLines.Unlock()
+	if barLines.count == 0 {
+		return false
+	}
+	fmt.Print("\n" + msg + "\r")
+	barLines.count++
+	return true
+}
+
+// endBarLines moves the cursor below the reserved bar lines once their
+// transfers are over, so that what follows is printed after them.
+func endBarLines() {
+	barLines.Lock()
+	defer barLines.Unlock()
+	if barLines.count > 0 {
+		fmt.Print("\n")
+		barLines.count = 0
+	}
+}
+
+// progress reports how far the transfer of one file of total bytes got.
+type progress struct {
+	file  string
+	total int64
+	from  int64    // where a resumed transfer picked up, 0 for a new one
+	bar   bool     // whether bar mode draws it
+	line  *barLine // where, if it runs alongside others; nil for the current line
+	shown bool     // whether the completed bar was printed, off a terminal
+	start time.Time
+	last  time.Time // of the latest json event
+}
+
+// newProgress starts reporting a transfer of file that begins at offset
+// from, showing the bytes before it as done already.
+func newProgress(file string, from, total int64, bar bool) *progress {
+	p := &progress{file: file, total: total, from: from, bar: bar, start: time.Now()}
+	if from > 0 {
+		p.update(from)
+	}
+	return p
+}
+
+// update reports that done bytes of the file have been transferred.
+func (p *progress) update(done int64) {
+	percent := int(done * 100 / max(p.total, 1))
+	if progressMode != "json" {
+		if p.bar {
+			p.draw(fmt.Sprintf("  - %s: %s (%d/%d bytes)", p.file, generateProgressBar(percent), done, p.total), done)
+		}
+		return
+	}
+	now := time.Now()
+	if !p.last.IsZero() && done < p.total && now.Sub(p.last) < jsonEventInterval {
+		return
+	}
+	p.last = now
+	var rate int64
+	if elapsed := now.Sub(p.start).Seconds(); elapsed > 0 {
+		rate = int64(float64(done-p.from) / elapsed)
+	}
+	progressEvents.Lock()
+	progressEvents.enc.Encode(progressEvent{File: p.file, Bytes: done, Total: p.total, Percent: percent, Rate: rate})
+	progressEvents.Unlock()
+}
+
+// draw shows the bar text for done bytes.
+func (p *progress) draw(text string, done int64) {
+	switch {
+	case p.line != nil:
+		p.line.draw(text)
+	case stdoutIsTerminal:
+		fmt.Print("\r" + text)
+	case done >= p.total && !p.shown:
+		p.shown = true
+		fmt.Print(text)
+	}
+}
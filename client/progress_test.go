@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// reportingWriter counts what is written to it onto done and reports each
+// write to p, as a transfer loop does.
+type reportingWriter struct {
+	p    *progress
+	done int64
+}
+
+func (w *reportingWriter) Write(b []byte) (int, error) {
+	w.done += int64(len(b))
+	w.p.update(w.done)
+	return len(b), nil
+}
+
+// resumeTransfer runs a transfer of total bytes picked up at from, written
+// in uneven pieces, through a progress.
+func resumeTransfer(from, total int64) {
+	w := &reportingWriter{p: newProgress("file.bin", from, total, true), done: from}
+	io.CopyBuffer(w, io.LimitReader(zeroReader{}, total-from), make([]byte, 777))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
+
+// TestResumedProgress checks that the progress of a transfer resumed part
+// way starts at the resumed offset, never goes backwards, and ends at
+// exactly the total, 100%, in both progress modes.
+func TestResumedProgress(t *testing.T) {
+	const from, total = 30_000, 100_000
+	prevMode, prevTerminal, prevEnc := progressMode, stdoutIsTerminal, progressEvents.enc
+	t.Cleanup(func() { progressMode, stdoutIsTerminal, progressEvents.enc = prevMode, prevTerminal, prevEnc })
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		progressMode, progressEvents.enc = "json", json.NewEncoder(&out)
+		resumeTransfer(from, total)
+
+		var events []progressEvent
+		for dec := json.NewDecoder(&out); ; {
+			var e progressEvent
+			if err := dec.Decode(&e); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, e)
+		}
+		if len(events) < 2 {
+			t.Fatalf("got %d events, want at least the first and the last", len(events))
+		}
+		if first := events[0]; first.Bytes != from || first.Percent != 30 || first.Total != total {
+			t.Errorf("first event %+v, want %d bytes, 30%%", first, from)
+		}
+		if last := events[len(events)-1]; last.Bytes != total || last.Percent != 100 {
+			t.Errorf("last event %+v, want %d bytes, 100%%", last, total)
+		}
+		for i, e := range events {
+			if e.Bytes > total || e.Percent > 100 || e.Rate < 0 || i > 0 && e.Bytes < events[i-1].Bytes {
+				t.Errorf("event %d out of line: %+v", i, e)
+			}
+		}
+	})
+
+	t.Run("bar", func(t *testing.T) {
+		progressMode, stdoutIsTerminal = "bar", true
+		out := captureOutput(t, func() { resumeTransfer(from, total) })
+		draws := regexp.MustCompile(`\] (\d+)% \((\d+)/(\d+) bytes\)`).FindAllStringSubmatch(out, -1)
+		if len(draws) < 2 {
+			t.Fatalf("got %d bars drawn:\n%q", len(draws), out)
+		}
+		number := func(s string) int64 { n, _ := strconv.ParseInt(s, 10, 64); return n }
+		first, last := draws[0], draws[len(draws)-1]
+		if number(first[1]) != 30 || number(first[2]) != from {
+			t.Errorf("first bar at %s%%, %s bytes; want 30%%, %d", first[1], first[2], from)
+		}
+		if number(last[1]) != 100 || number(last[2]) != total {
+			t.Errorf("last bar at %s%%, %s bytes; want 100%%, %d", last[1], last[2], total)
+		}
+		for _, d := range draws {
+			if number(d[1]) > 100 || number(d[2]) > number(d[3]) {
+				t.Errorf("bar overshoots: %s", d[0])
+			}
+		}
+	})
+}
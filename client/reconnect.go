@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// serverAddr is the server the client connects to; "127.0.0.1:4242" for
+// one running locally.
+var serverAddr = "132.235.1.17:4242"
+
+// fallbackPorts are tried in order, set by -fallback-ports, when the server
+// port gets no answer at all.
+var fallbackPorts []string
+
+// initialConnWindow and maxConnWindow, set by -initial-conn-window and
+// -max-conn-window, bound how many bytes the server may have in flight to
+// the client across all of a connection's streams: the window starts at
+// the first and grows up to the second while downloads keep it full.
+var (
+	initialConnWindow int64 = 768 << 10
+	maxConnWindow     int64 = 24 << 20
+)
+
+// noMTUDiscovery, set by -no-mtu-discovery, keeps packets at QUIC's minimum
+// size instead of probing for larger ones, for networks that now and then
+// drop large packets silently and so make transfers stall part way.
+var noMTUDiscovery bool
+
+// parsePorts parses the comma-separated -fallback-ports list.
+func parsePorts(list string) ([]string, error) {
+	var ports []string
+	for _, port := range strings.Split(list, ",") {
+		port = strings.TrimSpace(port)
+		if port == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid port %q", port)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// dialServer opens a connection to the server, trying the fallback ports
+// if the server's own port looks blocked.
+func dialServer() (quic.Connection, error) {
+	tr, err := newTransport()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, MinVersion: tlsMinVersion, CurvePreferences: tlsCurvePreferences}
+	quicConfig := &quic.Config{
+		EnableDatagrams:                true,
+		InitialConnectionReceiveWindow: uint64(initialConnWindow),
+		MaxConnectionReceiveWindow:     uint64(maxConnWindow),
+		DisablePathMTUDiscovery:        noMTUDiscovery,
+	}
+	host, port, _ := net.SplitHostPort(serverAddr)
+	tried := []string{port}
+	session, err := dialAddr(tr, serverAddr, tlsConfig, quicConfig)
+	for _, fallback := range fallbackPorts {
+		if !noAnswer(err) {
+			break
+		}
+		fmt.Printf("No answer from %s; trying port %s...\n", net.JoinHostPort(host, tried[len(tried)-1]), fallback)
+		tried = append(tried, fallback)
+		session, err = dialAddr(tr, net.JoinHostPort(host, fallback), tlsConfig, quicConfig)
+	}
+	if err != nil {
+		tr.Close()
+	} else {
+		useTransport(tr)
+	}
+	if noAnswer(err) {
+		return nil, fmt.Errorf("QUIC/UDP appears blocked on this network: %s sent no reply on UDP port %s (%w). "+
+			"Check that outbound UDP is allowed, or ask the server operator for a port to pass with -fallback-ports",
+			host, strings.Join(tried, ", "), err)
+	}
+	return session, err
+}
+
+// noAnswer reports whether a dial failed without hearing from the server at
+// all, which is what a network that drops UDP looks like.
+func noAnswer(err error) bool {
+	var idle *quic.IdleTimeoutError
+	var handshake *quic.HandshakeTimeoutError
+	return errors.As(err, &idle) || errors.As(err, &handshake)
+}
+
+// setupSession does what every new connection needs before the first
+// command: admin login, codec negotiation, control messages and following
+// the client across network changes.
+func setupSession(session quic.Connection, adminToken string) {
+	if adminToken != "" {
+		authenticate(session, adminToken)
+	}
+	negotiateCodec(context.Background(), session)
+	negotiateDownloadStreams(context.Background(), session)
+	startControl(session)
+	go watchNetwork(session)
+}
+
+// reconnect replaces a connection that has been lost and restores the
+// remote working directory, so the REPL carries on where it was.
+//
+// A change of local address, such as moving from Wi-Fi to cellular, does
+// not end the connection if it can be helped: the server follows a client
+// whose address changed under it, and watchNetwork moves the connection to
+// a new socket when the local addresses change (both need quic-go v0.50 or
+// later). Only when the connection is lost all the same does the client
+// dial again, and transfers that were running then have to be started
+// again.
+func reconnect(old quic.Connection, adminToken string) (quic.Connection, error) {
+	fmt.Printf("Connection lost (%s); reconnecting...\n", closeReason(context.Cause(old.Context())))
+	session, err := dialServer()
+	if err != nil {
+		return old, err
+	}
+	setupSession(session, adminToken)
+	if remoteCwd != "/" {
+		response, err := sendCommand(context.Background(), session, "cd "+remoteCwd)
+		if err != nil || strings.HasPrefix(response, "Error") {
+			fmt.Println(colorError(fmt.Sprintf("Error: could not return to %s; now in /", remoteCwd)))
+			remoteCwd = "/"
+		}
+	}
+	fmt.Println("Reconnected.")
+	return session, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// rebindableConn is a UDP socket that can be swapped for another one, on a
+// new port, under a running quic.Transport, as when a client moves from one
+// network to another.
+type rebindableConn struct {
+	mu   sync.Mutex
+	conn *net.UDPConn
+}
+
+func listenLoopback(t testing.TB) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func (c *rebindableConn) current() *net.UDPConn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn
+}
+
+// rebind moves to a new socket and closes the old one.
+func (c *rebindableConn) rebind(t testing.TB) {
+	next := listenLoopback(t)
+	c.mu.Lock()
+	prev := c.conn
+	c.conn = next
+	c.mu.Unlock()
+	prev.Close()
+}
+
+func (c *rebindableConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		conn := c.current()
+		n, addr, err := conn.ReadFrom(p)
+		if err != nil && conn != c.current() {
+			continue // closed by rebind; read from the new socket
+		}
+		return n, addr, err
+	}
+}
+
+func (c *rebindableConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.current().WriteTo(p, addr)
+}
+
+func (c *rebindableConn) Close() error                       { return c.current().Close() }
+func (c *rebindableConn) LocalAddr() net.Addr                { return c.current().LocalAddr() }
+func (c *rebindableConn) SetDeadline(t time.Time) error      { return c.current().SetDeadline(t) }
+func (c *rebindableConn) SetReadDeadline(t time.Time) error  { return c.current().SetReadDeadline(t) }
+func (c *rebindableConn) SetWriteDeadline(t time.Time) error { return c.current().SetWriteDeadline(t) }
+
+// TestRebindKeepsSession moves the client to a new UDP port in the middle
+// of a session without telling quic-go, as a NAT does when it rebinds. The
+// server follows the new address, and the same connection carries on in
+// the same remote directory.
+func TestRebindKeepsSession(t *testing.T) {
+	storage := startServer(t)
+	os.MkdirAll(filepath.Join(storage, "dir"), 0o755)
+	t.Chdir(t.TempDir())
+	os.Mkdir(sourceDir, 0o755)
+	t.Setenv(bufferWarningEnv, "true")
+	t.Cleanup(func() { remoteCwd = "/" })
+
+	sock := &rebindableConn{conn: listenLoopback(t)}
+	tr := &quic.Transport{Conn: sock}
+	t.Cleanup(func() { tr.Close() })
+	session, err := dialAddr(tr, serverAddr, &tls.Config{InsecureSkipVerify: true, MinVersion: tlsMinVersion}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.CloseWithError(errCodeNone, "test over") })
+	setupSession(session, "")
+	if out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "cd dir") }); remoteCwd != "/dir" {
+		t.Fatalf("cd dir:\n%s", out)
+	}
+
+	before := sock.LocalAddr().String()
+	sock.rebind(t)
+	if after := sock.LocalAddr().String(); after == before {
+		t.Fatalf("still on %s after rebinding", before)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if response, err := sendCommand(ctx, session, "pwd"); err != nil || response != "/dir" {
+		t.Fatalf("pwd after rebinding: %q, %v; want /dir", response, err)
+	}
+	if err := session.Context().Err(); err != nil {
+		t.Errorf("the connection ended: %v", context.Cause(session.Context()))
+	}
+}
+
+// TestReconnectRestoresCwd loses the connection in the middle of a session
+// and reconnects, which must bring the session back in the same remote
+// directory.
+func TestReconnectRestoresCwd(t *testing.T) {
+	storage := startServer(t)
+	os.MkdirAll(filepath.Join(storage, "dir"), 0o755)
+	session := connect(t)
+	t.Cleanup(func() { remoteCwd = "/" })
+	if out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "cd dir") }); remoteCwd != "/dir" {
+		t.Fatalf("cd dir:\n%s", out)
+	}
+
+	session.CloseWithError(errCodeNone, "gone")
+	var err error
+	out := captureOutput(t, func() { session, err = reconnect(session, "") })
+	if err != nil {
+		t.Fatalf("reconnect: %v\n%s", err, out)
+	}
+	t.Cleanup(func() { session.CloseWithError(errCodeNone, "test over") })
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if response, err := sendCommand(ctx, session, "pwd"); err != nil || response != "/dir" || remoteCwd != "/dir" {
+		t.Errorf("after reconnecting: pwd %q, %v, remote cwd %s; want /dir:\n%s", response, err, remoteCwd, out)
+	}
+}
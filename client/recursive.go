@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// patternList is a repeatable flag of filepath.Match patterns.
+type patternList []string
+
+func (p *patternList) String() string { return strings.Join(*p, ",") }
+
+func (p *patternList) Set(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%q: %w", pattern, err)
+	}
+	*p = append(*p, pattern)
+	return nil
+}
+
+// matches reports whether any pattern matches rel, a slash-separated path
+// relative to the directory being uploaded, or its last element. That lets
+// ".git" match at any depth while "docs/*.md" only matches under docs.
+func (p patternList) matches(rel string) bool {
+	for _, pattern := range p {
+		if ok, _ := path.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Filters applied while walking a directory given to upd.
+//
+// Excludes take precedence: a file or directory matching any -exclude is
+// skipped, and an excluded directory is not descended into. When any
+// -include is set, a file must also match one of them to be uploaded.
+// Includes are checked against files only, so a directory never has to match
+// an include for its contents to be considered.
+var includePatterns, excludePatterns patternList
+
+// selected reports whether the filters let the file at rel, relative to the
+// directory being uploaded, through. It gives the same answer as the walk in
+// expandUploads, including for files under an excluded directory.
+func selected(rel string) bool {
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		if excludePatterns.matches(dir) {
+			return false
+		}
+	}
+	if excludePatterns.matches(rel) {
+		return false
+	}
+	return len(includePatterns) == 0 || includePatterns.matches(rel)
+}
+
+// Symlink policies for -symlinks.
+const (
+	symlinksSkip   = "skip"   // leave links out of the upload
+	symlinksFollow = "follow" // upload whatever the link points to
+	symlinksCopy   = "copy"   // recreate the link itself on the server
+)
+
+// symlinkPolicy is the -symlinks flag. It only affects links found while
+// walking a directory; a link named directly on the command line is always
+// followed.
+//
+// "follow" uploads the content of the link's target even when it lies
+// outside the directory being uploaded, so a stray link to a private file
+// or to / sends far more than intended. Use it only on trees you trust.
+// Directory links are descended into once; loops are detected and skipped.
+type symlinkPolicy string
+
+var symlinkMode = symlinkPolicy(symlinksSkip)
+
+func (p *symlinkPolicy) String() string { return string(*p) }
+
+func (p *symlinkPolicy) Set(value string) error {
+	switch value {
+	case symlinksSkip, symlinksFollow, symlinksCopy:
+		*p = symlinkPolicy(value)
+		return nil
+	}
+	return fmt.Errorf("must be %s, %s or %s", symlinksSkip, symlinksFollow, symlinksCopy)
+}
+
+// localLink is a symlink to recreate on the server under -symlinks=copy.
+type localLink struct {
+	Name   string // remote path of the link
+	Target string // the link's contents, as read from disk
+}
+
+// expandUploads turns the arguments of upd, see parseUploadArg, into the
+// remote names of the files to send, replacing every directory with the
+// files found beneath it. Each file keeps its path below the directory, so
+// the tree is recreated on the server under the directory's remote name.
+// A remoteDir other than "" is put in front of every remote name. Files
+// read from anywhere but their remote name in sourceDir are recorded in
+// uploadPaths. Under -symlinks=copy the links found are returned
+// separately.
+func expandUploads(args []string, remoteDir string) ([]string, []localLink) {
+	uploadPaths = make(map[string]string)
+	var files []string
+	var links []localLink
+	taken := make(map[string]string, len(args))
+	for _, arg := range args {
+		root, fileName, _ := parseUploadArg(arg)
+		inSource := root == filepath.Join(sourceDir, fileName) && remoteDir == ""
+		if remoteDir != "" {
+			fileName = path.Join(remoteDir, fileName)
+		}
+		if other, ok := taken[fileName]; ok {
+			fmt.Printf("Warning: %s would be uploaded as %s like %s, skipping it; use %s:<name> to rename it\n", arg, fileName, other, arg)
+			continue
+		}
+		taken[fileName] = arg
+		info, err := os.Stat(root)
+		if err != nil || !info.IsDir() {
+			if !inSource {
+				uploadPaths[fileName] = root
+			}
+			files = append(files, fileName)
+			continue
+		}
+		w := &uploadWalker{prefix: path.Clean(filepath.ToSlash(fileName)), visited: make(map[string]bool), own: ownPaths()}
+		w.walk(root, "")
+		if !inSource {
+			for _, file := range w.files {
+				rel := strings.TrimPrefix(file, w.prefix+"/")
+				uploadPaths[file] = filepath.Join(root, filepath.FromSlash(rel))
+			}
+		}
+		files = append(files, w.files...)
+		links = append(links, w.links...)
+		fmt.Printf("Found %d files to upload in %s\n", len(w.files)+len(w.links), arg)
+	}
+	return files, links
+}
+
+// uploadWalker collects the entries of one directory given to upd.
+type uploadWalker struct {
+	prefix  string          // remote path of the directory
+	visited map[string]bool // real paths of directories already walked
+	own     map[string]bool // real paths of the client's own output
+	files   []string
+	links   []localLink
+}
+
+// walk adds the entries below dir, whose path relative to the top of the
+// upload is base ("" for the top itself).
+func (w *uploadWalker) walk(dir, base string) {
+	// WalkDir does not descend into a root that is itself a link, so walk
+	// the real path; remote names are built from base either way.
+	if real, err := realPath(dir); err == nil {
+		if w.own[real] {
+			fmt.Printf("Skipping %s: written by this client\n", dir)
+			return
+		}
+		if w.visited[real] {
+			fmt.Printf("Skipping %s: symlink loop\n", dir)
+			return
+		}
+		w.visited[real] = true
+		dir = real
+	}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", p, err)
+			return nil
+		}
+		if p == dir {
+			return nil
+		}
+		if w.isOwn(p) {
+			fmt.Printf("Skipping %s: written by this client\n", p)
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(dir, p)
+		rel = path.Join(base, filepath.ToSlash(rel))
+		if excludePatterns.matches(rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			w.addLink(p, rel)
+			return nil
+		}
+		if d.Type().IsRegular() && (len(includePatterns) == 0 || includePatterns.matches(rel)) {
+			w.files = append(w.files, path.Join(w.prefix, rel))
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Printf("Error walking %s: %v\n", dir, err)
+	}
+}
+
+// ownPaths returns the real paths the client itself writes to: the download
+// directory, its own executable and its resume state. Uploading a tree that
+// contains them would send back what the client just fetched, or keep
+// growing as it runs.
+func ownPaths() map[string]bool {
+	own := make(map[string]bool)
+	candidates := []string{"downloadedFiles", transferStateFile, downloadStateFile}
+	if exe, err := os.Executable(); err == nil {
+		candidates = append(candidates, exe)
+	}
+	for _, candidate := range candidates {
+		if real, err := realPath(candidate); err == nil {
+			own[real] = true
+		}
+	}
+	return own
+}
+
+// realPath resolves p to an absolute path without symlinks.
+func realPath(p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Abs(real)
+}
+
+func (w *uploadWalker) isOwn(p string) bool {
+	real, err := realPath(p)
+	return err == nil && w.own[real]
+}
+
+// addLink applies symlinkMode to the link at p.
+func (w *uploadWalker) addLink(p, rel string) {
+	switch symlinkMode {
+	case symlinksCopy:
+		target, err := os.Readlink(p)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", p, err)
+			return
+		}
+		if len(includePatterns) == 0 || includePatterns.matches(rel) {
+			w.links = append(w.links, localLink{Name: path.Join(w.prefix, rel), Target: filepath.ToSlash(target)})
+		}
+	case symlinksFollow:
+		info, err := os.Stat(p)
+		if err != nil {
+			fmt.Printf("Skipping %s: %v\n", p, err)
+			return
+		}
+		if w.isOwn(p) {
+			fmt.Printf("Skipping %s: written by this client\n", p)
+			return
+		}
+		if info.IsDir() {
+			w.walk(p, rel)
+		} else if info.Mode().IsRegular() && (len(includePatterns) == 0 || includePatterns.matches(rel)) {
+			w.files = append(w.files, path.Join(w.prefix, rel))
+		}
+	}
+}
+
+// createLinks recreates links on the server. The server refuses any link
+// whose target would resolve outside storage.
+func createLinks(ctx context.Context, session quic.Connection, links []localLink) {
+	for _, link := range links {
+		if ctx.Err() != nil {
+			fmt.Println("Remaining links skipped.")
+			return
+		}
+		response, err := sendCommand(ctx, session, fmt.Sprintf("symlink %s %s", link.Name, link.Target))
+		if err != nil {
+			log.Printf("Error creating link %s: %v\n", link.Name, err)
+			continue
+		}
+		if strings.HasPrefix(response, "Error") {
+			fmt.Println(colorError(response))
+			continue
+		}
+		fmt.Printf("Linked %s -> %s\n", link.Name, link.Target)
+	}
+}
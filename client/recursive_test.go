@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// setPatterns sets the -include and -exclude filters for the rest of the
+// test.
+func setPatterns(t *testing.T, include, exclude []string) {
+	t.Helper()
+	prevInclude, prevExclude := includePatterns, excludePatterns
+	t.Cleanup(func() { includePatterns, excludePatterns = prevInclude, prevExclude })
+	includePatterns, excludePatterns = nil, nil
+	for _, pattern := range include {
+		if err := includePatterns.Set(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, pattern := range exclude {
+		if err := excludePatterns.Set(pattern); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSelected(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		include, exclude []string
+		rel              string
+		want             bool
+	}{
+		{"no filters", nil, nil, "a/b/c.txt", true},
+		{"excluded by name", nil, []string{"*.log"}, "app.log", false},
+		{"excluded by name, nested", nil, []string{"*.log"}, "a/b/app.log", false},
+		{"excluded directory", nil, []string{".git"}, ".git/config", false},
+		{"excluded directory, nested", nil, []string{".git"}, "a/b/.git/objects/x", false},
+		{"excluded name only as a prefix", nil, []string{".git"}, "a/.github/workflow.yml", true},
+		{"excluded full path", nil, []string{"docs/*.md"}, "docs/readme.md", false},
+		{"full path elsewhere", nil, []string{"docs/*.md"}, "src/docs/readme.md", true},
+		{"excluded path of a directory", nil, []string{"a/b"}, "a/b/c/d.txt", false},
+		{"included by name", []string{"*.go"}, nil, "main.go", true},
+		{"included by name, nested", []string{"*.go"}, nil, "cmd/tool/main.go", true},
+		{"not included", []string{"*.go"}, nil, "cmd/tool/README", false},
+		{"directory never has to match", []string{"*.go"}, nil, "vendor/pkg/x.go", true},
+		{"any include", []string{"*.go", "*.mod"}, nil, "sub/go.mod", true},
+		{"exclude beats include", []string{"*.go"}, []string{"*_test.go"}, "pkg/x_test.go", false},
+		{"excluded directory beats include", []string{"*.go"}, []string{"vendor"}, "a/vendor/pkg/x.go", false},
+		{"include of the full path", []string{"src/*.c"}, nil, "src/main.c", true},
+		{"include of the full path elsewhere", []string{"src/*.c"}, nil, "lib/src/main.c", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setPatterns(t, tc.include, tc.exclude)
+			if got := selected(tc.rel); got != tc.want {
+				t.Errorf("selected(%q) with -include %v -exclude %v = %t, want %t", tc.rel, tc.include, tc.exclude, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPatternListRejectsBadPattern(t *testing.T) {
+	var p patternList
+	if err := p.Set("[a-"); err == nil {
+		t.Error("a malformed pattern was accepted")
+	}
+	if len(p) != 0 {
+		t.Errorf("the malformed pattern was kept: %v", p)
+	}
+}
+
+// TestRecursiveRoundTrip uploads a nested tree with filters set, checks that
+// the server stored exactly the files selected, and downloads them back.
+func TestRecursiveRoundTrip(t *testing.T) {
+	storage := startServer(t)
+	session := connect(t)
+	setPatterns(t, []string{"*.txt", "*.go"}, []string{".git", "*.tmp", "skip/*"})
+
+	tree := map[string]string{
+		"tree/top.txt":            "top",
+		"tree/a/one.txt":          "one",
+		"tree/a/b/two.go":         "package two",
+		"tree/a/b/c/three.txt":    "three",
+		"tree/a/b/c/notes.md":     "not included",
+		"tree/a/.git/HEAD.txt":    "in an excluded directory",
+		"tree/a/b/scratch.tmp":    "excluded by name",
+		"tree/skip/gone.txt":      "excluded by path",
+		"tree/a/skip/kept.txt":    "kept: skip/* only matches at the top",
+		"tree/empty/deeper/x.txt": "x",
+	}
+	var want []string
+	for name, content := range tree {
+		path := filepath.Join(sourceDir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if selected(strings.TrimPrefix(name, "tree/")) {
+			want = append(want, name)
+		}
+	}
+	slices.Sort(want)
+
+	out := captureOutput(t, func() { runCommand(context.Background(), session, nil, "upd tree") })
+	if strings.Contains(out, "Error") {
+		t.Fatalf("upd tree:\n%s", out)
+	}
+	var stored []string
+	filepath.WalkDir(storage, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(storage, path)
+			stored = append(stored, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	slices.Sort(stored)
+	if !slices.Equal(stored, want) {
+		t.Fatalf("stored %v, want %v", stored, want)
+	}
+
+	out = captureOutput(t, func() { runCommand(context.Background(), session, nil, "dwd "+strings.Join(want, " ")) })
+	if strings.Contains(out, "Error") {
+		t.Fatalf("dwd:\n%s", out)
+	}
+	for _, name := range want {
+		data, err := os.ReadFile(localPath(name))
+		if err != nil || string(data) != tree[name] {
+			t.Errorf("%s came back as %q, %v; want %q", name, data, err, tree[name])
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chzyer/readline"
+	"github.com/quic-go/quic-go"
+	"golang.org/x/term"
+)
+
+// completionTimeout bounds the "ls" round trip behind a Tab press, so a slow
+// server never leaves the prompt hanging.
+const completionTimeout = 2 * time.Second
+
+// errPromptInterrupted is returned by readCommand when Ctrl-C is pressed at
+// an idle prompt.
+var errPromptInterrupted = errors.New("interrupted at prompt")
+
+// historyFileName is kept in the user's home directory.
+const historyFileName = ".quicscp_history"
+
+// replCommands are the command names offered when completing the first word.
+var replCommands = []string{"admin", "bench", "cd", "dwd", "exit", "find", "ls", "manifest", "mirror", "pwd", "rm", "upd", "versions", "volumes"}
+
+// remoteArgCommands take remote file names as arguments.
+var remoteArgCommands = map[string]bool{"dwd": true, "rm": true, "stat": true}
+
+// commandReader reads REPL commands. On a terminal it uses a line editor
+// with tab completion; otherwise it reads plain lines from stdin.
+type commandReader struct {
+	editor *readline.Instance // nil when stdin is not a terminal
+	stdin  *bufio.Reader
+}
+
+// lineEditor is set while the line editor owns the prompt, which it redraws
+// on its own.
+var lineEditor *readline.Instance
+
+// newCommandReader sets up the REPL input. Commands are saved to and loaded
+// from historyFile unless it is empty.
+func newCommandReader(session func() quic.Connection, historyFile string) *commandReader {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return &commandReader{stdin: bufio.NewReader(os.Stdin)}
+	}
+	editor, err := readline.NewEx(&readline.Config{
+		Prompt:       promptText(),
+		AutoComplete: &completer{session: session},
+		HistoryFile:  historyFile,
+	})
+	if err != nil {
+		fmt.Printf("Line editing unavailable: %v\n", err)
+		return &commandReader{stdin: bufio.NewReader(os.Stdin)}
+	}
+	lineEditor = editor
+	return &commandReader{editor: editor}
+}
+
+// readCommand prompts for and returns the next command line.
+func (r *commandReader) readCommand() (string, error) {
+	if r.editor == nil {
+		printPrompt()
+		line, err := r.stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimSpace(line), nil
+	}
+	r.editor.SetPrompt(promptText())
+	line, err := r.editor.Readline()
+	if errors.Is(err, readline.ErrInterrupt) {
+		return "", errPromptInterrupted
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+func (r *commandReader) close() {
+	if r.editor != nil {
+		r.editor.Close()
+		lineEditor = nil
+	}
+}
+
+// historyPath returns the history file to use, creating it readable only by
+// the user so file names typed on a shared machine stay private. It returns
+// "" when no home directory is available.
+func historyPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(home, historyFileName)
+	if file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err == nil {
+		file.Close()
+	}
+	return path
+}
+
+func promptText() string {
+	return fmt.Sprintf("Enter command [%s]: ", remoteCwd)
+}
+
+// completer suggests command names for the first word, remote names after
+// commands that take them, remote directories after "cd" and local files
+// after "upd".
+type completer struct {
+	session func() quic.Connection // the current connection
+}
+
+func (c *completer) Do(line []rune, pos int) ([][]rune, int) {
+	text := string(line[:pos])
+	command, rest, found := strings.Cut(strings.TrimLeft(text, " "), " ")
+	if !found {
+		return suffixes(replCommands, command), len([]rune(command))
+	}
+	word := rest[strings.LastIndex(rest, " ")+1:]
+
+	var candidates []string
+	switch {
+	case remoteArgCommands[command]:
+		candidates = c.remoteNames(false)
+	case command == "cd":
+		candidates = c.remoteNames(true)
+	case command == "upd" || command == "mirror":
+		candidates = localNames(sourceDir)
+	}
+	return suffixes(candidates, word), len([]rune(word))
+}
+
+// remoteNames lists the remote working directory. Directory names keep the
+// trailing "/" that "ls" gives them.
+func (c *completer) remoteNames(dirsOnly bool) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), completionTimeout)
+	defer cancel()
+	entries, err := remoteEntries(ctx, c.session())
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, name := range entries {
+		if dirsOnly && !strings.HasSuffix(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// localNames lists the regular files and directories in dir.
+func localNames(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name()+"/")
+		} else if entry.Type().IsRegular() {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// suffixes returns what each candidate starting with prefix would add to it,
+// in the form readline expects. Names ending in "/" are left open so the
+// user can keep typing; everything else is followed by a space.
+func suffixes(candidates []string, prefix string) [][]rune {
+	sort.Strings(candidates)
+	var out [][]rune
+	for _, candidate := range candidates {
+		if !strings.HasPrefix(candidate, prefix) {
+			continue
+		}
+		suffix := candidate[len(prefix):]
+		if !strings.HasSuffix(candidate, "/") {
+			suffix += " "
+		}
+		out = append(out, []rune(suffix))
+	}
+	return out
+}
+
+// confirm asks a yes/no question on the terminal and reports whether the
+// answer was yes. Answers are kept out of the command history.
+func (r *commandReader) confirm(question string) bool {
+	var line string
+	var err error
+	if r.editor == nil {
+		fmt.Print(question)
+		line, err = r.stdin.ReadString('\n')
+	} else {
+		r.editor.HistoryDisable()
+		r.editor.SetPrompt(question)
+		line, err = r.editor.Readline()
+		r.editor.HistoryEnable()
+	}
+	if err != nil && line == "" {
+		return false
+	}
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
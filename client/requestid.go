@@ -0,0 +1,27 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// requestID identifies the REPL command being run. Every stream the command
+// opens sends it ahead of the command line, and the server puts it on each
+// log line for that stream; errors shown to the user carry it too, so a
+// failure can be looked up in the server log.
+var requestID string
+
+// newRequestID returns a short random ID.
+func newRequestID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// tagged prefixes command with the current request ID, if any.
+func tagged(command string) string {
+	if requestID == "" {
+		return command
+	}
+	return "#" + requestID + " " + command
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// errTimedOut marks a transfer that abortIfTimedOut gave up on.
+var errTimedOut = errors.New("transfer timed out")
+
+// errNotAttempted marks the files of a batch that were still to come when
+// its stream broke.
+var errNotAttempted = errors.New("not attempted")
+
+// streamBroken wraps an error that leaves a batch's stream unusable, such as
+// a reset, a timeout or a file cut short, as opposed to one that only cost
+// the file it happened on: none of the files after it can arrive.
+type streamBroken struct{ err error }
+
+func (b *streamBroken) Error() string { return b.err.Error() }
+func (b *streamBroken) Unwrap() error { return b.err }
+
+// brokenStream marks err as having broken the stream it happened on.
+func brokenStream(err error) error {
+	return &streamBroken{err}
+}
+
+// isStreamBroken reports whether err broke the stream it happened on.
+func isStreamBroken(err error) bool {
+	var b *streamBroken
+	return errors.As(err, &b)
+}
+
+// fileResult is what became of one file of a download or upload batch.
+type fileResult struct {
+	name string
+	size int64 // as announced by the server, or sent for an upload; 0 if never known
+	err  error
+}
+
+// failAll records the same failure for every file in fileNames.
+func failAll(fileNames []string, err error) []fileResult {
+	results := make([]fileResult, len(fileNames))
+	for i, name := range fileNames {
+		results[i] = fileResult{name: name, err: err}
+	}
+	return results
+}
+
+// readFileStatus reads the status line the server sends ahead of each file
+// of a dwd batch and returns the announced size and modification time, in
+// Unix nanoseconds:
+//
+//	OK <size> <name> <mtime> the file's bytes follow
+//	Error: <name>: <reason>  nothing follows for this file
+//
+// A status for another file than fileName means the stream is out of step
+// with the batch, so it is abandoned.
+func readFileStatus(stream quic.Stream, reader *bufio.Reader, fileName string) (size, modTime int64, err error) {
+	extendDeadline(stream)
+	line, err := reader.ReadString('\n')
+	if abortIfTimedOut(stream, fileName, err) {
+		return 0, 0, brokenStream(errTimedOut)
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		if err == nil || err == io.EOF {
+			err = errors.New("connection closed")
+		}
+		return 0, 0, brokenStream(fmt.Errorf("no status from the server: %v", err))
+	}
+	if reason, ok := strings.CutPrefix(line, "Error: "); ok {
+		if rest, ok := strings.CutPrefix(reason, fileName+": "); ok {
+			reason = rest
+		}
+		return 0, 0, errors.New(reason)
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 4 || fields[0] != "OK" {
+		stream.CancelRead(streamCancelled)
+		return 0, 0, brokenStream(fmt.Errorf("unexpected response: %s", line))
+	}
+	size, perr := strconv.ParseInt(fields[1], 10, 64)
+	modTime, merr := strconv.ParseInt(fields[3], 10, 64)
+	if perr != nil || merr != nil || size < 0 {
+		stream.CancelRead(streamCancelled)
+		return 0, 0, brokenStream(fmt.Errorf("unexpected response: %s", line))
+	}
+	if fields[2] != fileName {
+		stream.CancelRead(streamCancelled)
+		return 0, 0, brokenStream(fmt.Errorf("server sent %s in its place", fields[2]))
+	}
+	return size, modTime, nil
+}
+
+// skipFile reads past the n bytes that remain of a file that could not be
+// saved, so that the next one in the batch can still be read, and returns
+// err. If they do not arrive the stream is broken as well.
+func skipFile(reader *bufio.Reader, n int64, err error) error {
+	if _, cerr := io.CopyN(io.Discard, reader, n); cerr != nil {
+		return brokenStream(err)
+	}
+	return err
+}
+
+// printResults prints one line per file of a batch of total files, then
+// how many were transferred, verb being "Downloaded" or "Uploaded". Files
+// that are missing from results were never tried.
+func printResults(results []fileResult, total int, verb string) {
+	width := 0
+	for _, r := range results {
+		width = max(width, len(r.name))
+	}
+	done := 0
+	for _, r := range results {
+		switch {
+		case r.err == nil:
+			done++
+			fmt.Printf("  %s  %-*s  %d bytes\n", colorSuccess("ok    "), width, r.name, r.size)
+		case errors.Is(r.err, errNotAttempted):
+			fmt.Printf("  %s  %-*s  %v\n", "skip  ", width, r.name, r.err)
+		default:
+			fmt.Printf("  %s  %-*s  %v\n", colorize(ansiRed, "failed"), width, r.name, r.err)
+		}
+	}
+	summary := fmt.Sprintf("%s %d/%d successfully.", verb, done, total)
+	if done == total {
+		fmt.Println(colorSuccess(summary))
+	} else {
+		fmt.Println(colorError(summary))
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// transferStateFile remembers the server-issued IDs of unfinished resumable
+// uploads so a restarted client can pick up where it left off.
+const transferStateFile = ".quicscp-transfers.json"
+
+// resumableUploads is set by -resumable.
+var resumableUploads bool
+
+// pendingTransfer identifies an unfinished upload. It is only reused while
+// the local file still has the same size and modification time.
+type pendingTransfer struct {
+	ID      string    `json:"id"`
+	Remote  string    `json:"remote"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// stateMu serializes access to the state files, so that parallel download
+// batches updating downloadStateFile at once do not lose each other's
+// entries.
+var stateMu sync.Mutex
+
+// loadState reads a state file such as transferStateFile, a JSON object
+// keyed by local path. A missing file is an empty one.
+func loadState[T any](path string) map[string]T {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return readState[T](path)
+}
+
+func readState[T any](path string) map[string]T {
+	pending := make(map[string]T)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading %s: %v\n", path, err)
+		}
+		return pending
+	}
+	if err := json.Unmarshal(data, &pending); err != nil {
+		log.Printf("Ignoring corrupt %s: %v\n", path, err)
+	}
+	return pending
+}
+
+// updateState sets the entry for key in the state file at path, or removes
+// it if entry is nil. The file goes away with its last entry.
+func updateState[T any](path, key string, entry *T) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	pending := readState[T](path)
+	if entry == nil {
+		delete(pending, key)
+	} else {
+		pending[key] = *entry
+	}
+	if len(pending) == 0 {
+		os.Remove(path)
+		return
+	}
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path, data, 0o600)
+	}
+	if err != nil {
+		log.Printf("Error saving %s: %v\n", path, err)
+	}
+}
+
+func loadPendingTransfers() map[string]pendingTransfer {
+	return loadState[pendingTransfer](transferStateFile)
+}
+
+func updatePendingTransfer(localPath string, transfer *pendingTransfer) {
+	updateState(transferStateFile, localPath, transfer)
+}
+
+// uploadResumable uploads file through a server-side transfer ID. If an
+// earlier attempt at the same file was interrupted, even in a previous run of
+// the client, only the missing tail is sent.
+func uploadResumable(ctx context.Context, session quic.Connection, file *os.File, localPath, fileName string, info os.FileInfo) {
+	fileSize := info.Size()
+	transfer, ok := loadPendingTransfers()[localPath]
+	if !ok || transfer.Remote != fileName || transfer.Size != fileSize || !transfer.ModTime.Equal(info.ModTime()) {
+		response, err := sendCommand(ctx, session, fmt.Sprintf("begin-upload %s %d", fileName, fileSize))
+		if err != nil {
+			log.Printf("Error starting upload of %s: %v\n", fileName, err)
+			return
+		}
+		id, ok := strings.CutPrefix(response, "OK ")
+		if !ok {
+			fmt.Println(colorReply(response))
+			return
+		}
+		transfer = pendingTransfer{ID: id, Remote: fileName, Size: fileSize, ModTime: info.ModTime()}
+		updatePendingTransfer(localPath, &transfer)
+	}
+
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		log.Printf("Error opening stream: %v\n", err)
+		return
+	}
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+
+	if _, err := stream.Write([]byte(tagged("resume-upload " + transfer.ID + "\n"))); err != nil {
+		log.Printf("Error writing upload header: %v\n", err)
+		return
+	}
+	reply, err := bufio.NewReader(stream).ReadString('\n')
+	reply = strings.TrimSpace(reply)
+	if strings.HasPrefix(reply, "Error:") {
+		fmt.Println(colorError(reply))
+		// Unless another stream still has it, the server no longer knows
+		// this ID; the next attempt starts over.
+		if !strings.Contains(reply, "already in progress") {
+			updatePendingTransfer(localPath, nil)
+		}
+		return
+	}
+	if err != nil {
+		log.Printf("Error reading resume offset: %v\n", err)
+		return
+	}
+	offset, err := strconv.ParseInt(strings.TrimPrefix(reply, "OK "), 10, 64)
+	if err != nil || offset < 0 || offset > fileSize {
+		log.Printf("Unexpected resume reply %q\n", reply)
+		return
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		log.Printf("Error seeking in %s: %v\n", fileName, err)
+		return
+	}
+
+	if offset > 0 {
+		fmt.Printf("Resuming upload of %s at byte %d of %d\n", fileName, offset, fileSize)
+	} else {
+		fmt.Printf("Uploading file: %s (%d bytes)\n", fileName, fileSize)
+	}
+	if sendFileBody(ctx, stream, file, fileName, "", offset, fileSize) {
+		updatePendingTransfer(localPath, nil)
+		fmt.Println("\n" + colorSuccess("Upload completed successfully!"))
+	}
+}
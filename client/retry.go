@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/quic-go/quic-go"
+)
+
+// downloadRetries is set by -retries: how many more times a download that
+// fails verification is requested before giving up.
+var downloadRetries int
+
+// fetchVerified downloads fileName with fetch and checks the copy against
+// the manifest, requesting it again while it does not match and retries are
+// left. fetch is told which attempt it is making, starting at 0, and returns
+// the file's size and whether the transfer itself failed; transfer failures
+// are not retried here. fetch leaves the file at its partialPath, and only a
+// copy that verified is moved to its final name.
+func fetchVerified(fileName string, fetch func(attempt int) (int64, error)) (int64, error) {
+	for attempt := 0; ; attempt++ {
+		size, err := fetch(attempt)
+		if err != nil {
+			return size, err
+		}
+		err = checkManifest(fileName, partialPath(fileName))
+		if err == nil {
+			return size, finishDownload(fileName)
+		}
+		os.Remove(partialPath(fileName))
+		if attempt >= downloadRetries {
+			manifestFailures.Add(1)
+			return size, err
+		}
+		printLine(colorError(fmt.Sprintf("Error: %v; downloading it again (retry %d/%d)", err, attempt+1, downloadRetries)))
+	}
+}
+
+// redownloadFile requests fileName again on a stream of its own.
+func redownloadFile(ctx context.Context, session quic.Connection, fileName string) (int64, error) {
+	stream, err := session.OpenStreamSync(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open stream for download: %w", err)
+	}
+	defer stream.Close()
+	stop := resetOnCancel(ctx, stream)
+	defer stop()
+	if _, err := stream.Write([]byte(tagged("dwd " + fileName + "\n"))); err != nil {
+		return 0, fmt.Errorf("failed to request %s: %w", fileName, err)
+	}
+	return downloadFile(stream, bufio.NewReader(stream), fileName, nil)
+}
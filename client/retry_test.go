@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+// corruptingConn flips one byte, at offset at of the data that follows the
+// status line, in the first download it carries, and leaves every other
+// stream alone.
+type corruptingConn struct {
+	quic.Connection
+	at   int
+	once sync.Once
+}
+
+func (c *corruptingConn) OpenStreamSync(ctx context.Context) (quic.Stream, error) {
+	stream, err := c.Connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &corruptStream{Stream: stream, conn: c, at: -1}, nil
+}
+
+type corruptStream struct {
+	quic.Stream
+	conn   *corruptingConn
+	at     int  // body offset still to corrupt, or -1
+	header bool // the status line has been read
+}
+
+func (s *corruptStream) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "dwd ") {
+		s.conn.once.Do(func() { s.at = s.conn.at })
+	}
+	return s.Stream.Write(p)
+}
+
+func (s *corruptStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if s.at < 0 {
+		return n, err
+	}
+	body := p[:n]
+	if !s.header {
+		i := bytes.IndexByte(body, '\n')
+		if i < 0 {
+			return n, err
+		}
+		s.header = true
+		body = body[i+1:]
+	}
+	if s.at < len(body) {
+		body[s.at] ^= 0xff
+		s.at = -1
+	} else {
+		s.at -= len(body)
+	}
+	return n, err
+}
+
+// TestRetryAfterCorruption corrupts the first attempt at a download, caught
+// by the manifest or by the chunk MACs, and checks that the retry brings the
+// right contents, or that without retries the download fails.
+func TestRetryAfterCorruption(t *testing.T) {
+	storage := startServer(t)
+	content := make([]byte, 300_000)
+	rand.Read(content)
+	os.WriteFile(filepath.Join(storage, "file.bin"), content, 0o644)
+	sum := sha256.Sum256(content)
+
+	prevRetries, prevChunks, prevHashes := downloadRetries, verifyChunks, expectedHashes
+	t.Cleanup(func() { downloadRetries, verifyChunks, expectedHashes = prevRetries, prevChunks, prevHashes })
+	for _, tc := range []struct {
+		name    string
+		chunks  bool
+		retries int
+		caught  string // what reports the corruption
+		retried string
+	}{
+		{"manifest", false, 2, "does not match the manifest", "downloading it again (retry 1/2)"},
+		{"manifest, no retries", false, 0, "does not match the manifest", ""},
+		{"chunks", true, 2, "chunk at offset 196608 failed verification", "requesting it again (retry 1/2)"},
+		{"chunks, no retries", true, 0, "failed verification", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			session := connect(t)
+			downloadRetries, verifyChunks = tc.retries, tc.chunks
+			expectedHashes = map[string]string{"file.bin": hex.EncodeToString(sum[:])}
+			if tc.chunks {
+				expectedHashes = nil // the MACs alone must catch it
+			}
+			failuresBefore := manifestFailures.Load()
+
+			conn := &corruptingConn{Connection: session, at: 200_000}
+			out := captureOutput(t, func() { runCommand(context.Background(), conn, nil, "dwd file.bin") })
+			if !strings.Contains(out, tc.caught) {
+				t.Errorf("the corruption was not reported (%q):\n%s", tc.caught, out)
+			}
+			data, err := os.ReadFile(localPath("file.bin"))
+			if tc.retries == 0 {
+				if err == nil {
+					t.Errorf("with no retries, the corrupt download was kept")
+				}
+				if !strings.Contains(out, "Downloaded 0/1") {
+					t.Errorf("with no retries, the download did not fail:\n%s", out)
+				}
+				return
+			}
+			if !strings.Contains(out, tc.retried) || !strings.Contains(out, "Downloaded 1/1") {
+				t.Errorf("want one retry and the download to succeed:\n%s", out)
+			}
+			if err != nil || !bytes.Equal(data, content) {
+				t.Errorf("after the retry: got %d bytes, %v; want the %d stored", len(data), err, len(content))
+			}
+			if got := manifestFailures.Load() - failuresBefore; got != 0 {
+				t.Errorf("%d manifest failures counted for a download that was retried", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// sourceDir is set by -src: the local directory that upd and mirror take
+// file names relative to.
+var sourceDir = "filesToUpload"
+
+// checkSourceDir reports whether sourceDir is a directory. If not, it says
+// so once, rather than leaving every file of the command to fail to open.
+func checkSourceDir() bool {
+	info, err := os.Stat(sourceDir)
+	switch {
+	case os.IsNotExist(err):
+		fmt.Println(colorError(fmt.Sprintf("Error: source directory '%s' not found; use -src to set it", sourceDir)))
+	case err != nil:
+		fmt.Println(colorError(fmt.Sprintf("Error: source directory '%s': %v", sourceDir, err)))
+	case !info.IsDir():
+		fmt.Println(colorError(fmt.Sprintf("Error: source '%s' is not a directory; use -src to set it", sourceDir)))
+	default:
+		return true
+	}
+	return false
+}
+
+// uploadPaths maps the remote names of the current upload to the local
+// files they are read from, for every file that is not simply its remote
+// name under sourceDir. expandUploads fills it in.
+var uploadPaths map[string]string
+
+// sourcePath is the local file that the upload of the remote fileName
+// reads.
+func sourcePath(fileName string) string {
+	if local, ok := uploadPaths[fileName]; ok {
+		return local
+	}
+	return filepath.Join(sourceDir, fileName)
+}
+
+// parseUploadArg splits an argument of upd into the local file or directory
+// it names and the remote name it is uploaded as. A name found in sourceDir
+// is taken from there under the same name, as always. Otherwise an absolute
+// path, or a relative one that exists, is read from where it is and
+// uploaded under its base name. Either can be followed by ":<remote name>"
+// to upload it under another one; the colon is only taken as that when the
+// part before it exists, so remote names such as vol:media/x and Windows
+// drive letters still work. fromSource reports whether the file is read
+// from sourceDir.
+func parseUploadArg(arg string) (local, remote string, fromSource bool) {
+	for i := strings.Index(arg, ":"); i > 0; {
+		if name := arg[i+1:]; name != "" {
+			if local, fromSource := locateUpload(arg[:i]); localExists(local) {
+				return local, name, fromSource
+			}
+		}
+		next := strings.Index(arg[i+1:], ":")
+		if next < 0 {
+			break
+		}
+		i += next + 1
+	}
+	local, fromSource = locateUpload(arg)
+	if fromSource {
+		return local, arg, true
+	}
+	return local, filepath.ToSlash(filepath.Base(local)), false
+}
+
+// locateUpload finds the local file or directory name stands for: name in
+// sourceDir if it is there, or else name itself if it is absolute or
+// exists. A name found nowhere is looked for in sourceDir, so the error
+// says the file is missing from there.
+func locateUpload(name string) (local string, fromSource bool) {
+	inSource := filepath.Join(sourceDir, name)
+	if filepath.IsAbs(name) {
+		return name, false
+	}
+	if localExists(inSource) {
+		return inSource, true
+	}
+	if localExists(name) {
+		return name, false
+	}
+	return inSource, true
+}
+
+func localExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// transferTimeout is set by -transfer-timeout; zero disables it.
+var transferTimeout time.Duration
+
+// extendDeadline gives stream another transferTimeout to make progress.
+// Transfer loops call it before every read and write, so only a transfer
+// that stalls completely is aborted.
+func extendDeadline(stream quic.Stream) {
+	if transferTimeout > 0 {
+		stream.SetDeadline(time.Now().Add(transferTimeout))
+	}
+}
+
+// abortIfTimedOut reports whether err is a stalled-transfer timeout, and if
+// so resets the stream so the server discards the transfer too.
+func abortIfTimedOut(stream quic.Stream, fileName string, err error) bool {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return false
+	}
+	stream.CancelWrite(streamCancelled)
+	stream.CancelRead(streamCancelled)
+	// A bar of its own is still on the line, unless it is on a reserved one
+	if msg := colorError(fmt.Sprintf("Error: transfer of %s timed out", fileName)); !printBelowBars(msg) {
+		fmt.Println("\n" + msg)
+	}
+	return true
+}
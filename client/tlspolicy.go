@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsMinVersion and tlsCurvePreferences are the handshake policy set by
+// -tls-min-version and -tls-curves.
+var (
+	tlsMinVersion       uint16 = tls.VersionTLS13
+	tlsCurvePreferences []tls.CurveID
+)
+
+// tlsVersions are the values -tls-min-version accepts. QUIC is only defined
+// over TLS 1.3, and quic-go refuses to negotiate anything older, so there is
+// nothing lower to allow.
+var tlsVersions = map[string]uint16{"1.3": tls.VersionTLS13}
+
+// tlsCurves are the key exchange groups -tls-curves can name.
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"p256":           tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p521":           tls.CurveP521,
+}
+
+// parseTLSVersion maps a -tls-min-version value onto its crypto/tls
+// constant.
+func parseTLSVersion(version string) (uint16, error) {
+	v, ok := tlsVersions[version]
+	if !ok {
+		return 0, fmt.Errorf("unsupported TLS version %q: QUIC requires 1.3", version)
+	}
+	return v, nil
+}
+
+// parseTLSCurves maps a comma-separated -tls-curves list, most preferred
+// first, onto crypto/tls curve IDs. An empty list leaves the choice to
+// crypto/tls.
+func parseTLSCurves(list string) ([]tls.CurveID, error) {
+	var curves []tls.CurveID
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		curve, ok := tlsCurves[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown curve %q, want X25519, X25519MLKEM768, P256, P384 or P521", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
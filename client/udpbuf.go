@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/quic-go/quic-go"
+)
+
+// minUDPBuffer is the socket buffer size quic-go itself asks for. It raises
+// a smaller buffer to this anyway, so -udp-buffer may only ask for more.
+const minUDPBuffer = 7 << 20
+
+// bufferWarningEnv silences quic-go's own warning about small UDP buffers,
+// which is replaced by reportUDPBuffers unless -verbose is set.
+const bufferWarningEnv = "QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING"
+
+var (
+	// udpBuffer, set by -udp-buffer, is the receive and send buffer size
+	// asked for on the client's UDP socket.
+	udpBuffer int64 = minUDPBuffer
+	// verbose, set by -verbose, reports the buffer sizes obtained even when
+	// they are large enough, and lets quic-go's own warning through.
+	verbose bool
+)
+
+// transport is the UDP socket the current connection runs on. Each dial
+// gets a socket of its own, as quic.DialAddr would give it, and the old one
+// is closed once a new connection is up.
+var transport *quic.Transport
+
+// newTransport opens a UDP socket for dialling the server, its buffers
+// first asked to hold udpBuffer bytes.
+func newTransport() (*quic.Transport, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(int(udpBuffer))
+	conn.SetWriteBuffer(int(udpBuffer))
+	if _, set := os.LookupEnv(bufferWarningEnv); !set && !verbose {
+		os.Setenv(bufferWarningEnv, "true")
+	}
+	return &quic.Transport{Conn: conn}, nil
+}
+
+// dialAddr dials addr like quic.DialAddr, but over tr.
+func dialAddr(tr *quic.Transport, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (quic.Connection, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return tr.Dial(context.Background(), udpAddr, tlsConfig, quicConfig)
+}
+
+// useTransport makes tr the socket of the current connection and closes
+// the previous one. The first time, when quic-go has had its own try at
+// the buffers, it reports how large they came out.
+func useTransport(tr *quic.Transport) {
+	if transport == nil {
+		reportUDPBuffers(tr.Conn.(*net.UDPConn), int(udpBuffer))
+	} else {
+		transport.Close()
+	}
+	transport = tr
+}
+
+// reportUDPBuffers prints, in one line, the buffers of conn when either is
+// smaller than want bytes, or with -verbose whatever they are.
+func reportUDPBuffers(conn *net.UDPConn, want int) {
+	receive, send, err := udpBuffers(conn)
+	switch {
+	case err != nil:
+		if verbose {
+			fmt.Printf("Could not read the UDP buffer sizes: %v\n", err)
+		}
+	case receive < want || send < want:
+		fmt.Printf("Warning: UDP buffers are smaller than asked for (receive %d KiB, send %d KiB, wanted %d KiB), which limits throughput; %s\n",
+			receive>>10, send>>10, want>>10, raiseBufferHint(want))
+	case verbose:
+		fmt.Printf("UDP buffers: receive %d KiB, send %d KiB\n", receive>>10, send>>10)
+	}
+}
+
+// raiseBufferHint says how to let sockets have buffers of size bytes on
+// this system.
+func raiseBufferHint(size int) string {
+	switch runtime.GOOS {
+	case "linux":
+		return fmt.Sprintf("to fix, run: sysctl -w net.core.rmem_max=%d net.core.wmem_max=%d", size, size)
+	case "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		// the limit counts the kernel's bookkeeping too, an eighth on top
+		return fmt.Sprintf("to fix, run: sysctl -w kern.ipc.maxsockbuf=%d", size+size/8)
+	}
+	return fmt.Sprintf("to fix, raise the system's limit on UDP socket buffers to %d bytes", size)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// commandUsage is the syntax of each REPL command that takes arguments,
+// keyed by the words that select it, shown when it is typed without the
+// arguments it needs or with ones it cannot use.
+var commandUsage = map[string]string{
+	"upd":        "upd [-d <remote dir>] <file|dir|path>[:<remote name>]...",
+	"dwd":        "dwd <file>...",
+	"dwd --move": "dwd --move <file>...",
+	"rm":         "rm <file>...",
+	"mirror":     "mirror [-delete] [-yes] <dir>",
+	"ls":         "ls [--sort=name|size|mtime] [--reverse] [--filter=<glob>] [--page=N] [--size=N]",
+	"find":       "find <pattern>",
+	"manifest":   "manifest [-o <file>] [dir]",
+	"versions":   "versions <file>",
+	"bench":      "bench [-size <bytes>] [-up] [-down]",
+	"admin":      "admin clients | admin info | admin kick <addr> [<reason>]",
+	"admin kick": "admin kick <addr> [<reason>]",
+}
+
+// needsArguments are the commands that do nothing useful without any.
+var needsArguments = map[string]bool{"upd": true, "dwd": true, "dwd --move": true, "rm": true, "admin": true, "admin kick": true}
+
+// printUsage prints the usage of the command name.
+func printUsage(name string) {
+	fmt.Println("Usage: " + commandUsage[name])
+}
+
+// usageOf finds the command that the REPL line command names, the longest
+// match first. ok is false for a line that names no command.
+func usageOf(command string) (name string, ok bool) {
+	words := strings.Fields(command)
+	for n := min(len(words), 2); n > 0; n-- {
+		name = strings.Join(words[:n], " ")
+		if _, ok := commandUsage[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,23 @@
+// Package echo adds the echo command, which sends its text back, to the
+// server it is linked into. Besides checking that commands get through, it
+// is the smallest example of a command added with registry.Handle.
+package echo
+
+import (
+	"context"
+
+	"quic-test/server/registry"
+)
+
+func init() {
+	registry.Handle("echo", serve, registry.Usage("echo <text>"))
+}
+
+// serve sends the text back on a line of its own.
+func serve(_ context.Context, req *registry.Request) {
+	if req.Args == "" {
+		req.WriteUsage()
+		return
+	}
+	req.Stream.Write([]byte(req.Args + "\n"))
+}
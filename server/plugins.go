@@ -0,0 +1,9 @@
+package main
+
+// The example commands are linked into the quic-scp binary here. A build
+// with commands of its own needs no change to this package: its own main
+// package imports the packages adding them alongside quic-test/server/scp
+// and calls scp.Main.
+import (
+	_ "quic-test/server/echo"
+)
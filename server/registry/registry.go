@@ -0,0 +1,147 @@
+// Package registry holds the commands added to the server on top of its
+// built-in ones. A package that calls Handle, typically from an init
+// function, and is imported by the main package that runs the server (see
+// package scp) gets its commands dispatched, permission-checked, described
+// in usage replies and listed by help like the built-in ones.
+//
+// Commands may also be added while the server is running; they are served
+// from the next command line that names them.
+package registry
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Level is what a session needs to run a command. Each level includes the
+// ones below it, and they match the permissions of the server's -tokens-file.
+type Level int
+
+const (
+	None  Level = iota // any session, logged in or not
+	Read               // sessions that may list and download (the default)
+	Write              // sessions that may also change files
+	Admin              // admin sessions only
+)
+
+// Request is one use of a registered command.
+type Request struct {
+	Args       string        // the command line after the command's name, trimmed
+	Body       *bufio.Reader // whatever the client sent after the command line
+	Stream     quic.Stream   // the reply goes here; the server closes it after the handler returns
+	Addr       string        // the client's address
+	Permission Level         // what the client's session may do
+
+	usage string
+}
+
+// WriteUsage replies with the command's usage, as the server does for a
+// malformed use of one of its own commands.
+func (r *Request) WriteUsage() {
+	r.Stream.Write([]byte("Error: usage: " + r.usage + "\n"))
+}
+
+// CommandHandler serves a registered command. It is called once the
+// session's permission has been checked, with a context that ends when the
+// command times out or the connection closes.
+type CommandHandler func(ctx context.Context, req *Request)
+
+// Command is a registered command and what is known about it.
+type Command struct {
+	Name       string
+	Usage      string // the syntax, such as "echo <text>"; the name alone if not given
+	Permission Level
+	Handler    CommandHandler
+}
+
+// Option sets something about a command being registered.
+type Option func(*Command)
+
+// Usage sets the syntax of a command, which is what a malformed use of it
+// is answered with and what help lists.
+func Usage(syntax string) Option {
+	return func(c *Command) { c.Usage = syntax }
+}
+
+// Permission sets the level a session needs to run a command; without it a
+// command needs Read.
+func Permission(level Level) Option {
+	return func(c *Command) { c.Permission = level }
+}
+
+var (
+	mu       sync.RWMutex
+	commands = map[string]Command{}
+	reserved = map[string]bool{}
+)
+
+// Handle registers the command name, a single word, to be served by h.
+// Registering a name twice, or one of the server's built-in commands,
+// panics.
+func Handle(name string, h CommandHandler, opts ...Option) {
+	if name == "" || strings.ContainsAny(name, " \t\r\n") {
+		panic(fmt.Sprintf("registry: invalid command name %q", name))
+	}
+	if h == nil {
+		panic("registry: nil handler for " + name)
+	}
+	c := Command{Name: name, Usage: name, Permission: Read, Handler: h}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if reserved[name] {
+		panic("registry: " + name + " is a built-in command")
+	}
+	if _, ok := commands[name]; ok {
+		panic("registry: " + name + " is already registered")
+	}
+	commands[name] = c
+}
+
+// Reserve keeps names for the server's built-in commands, so that Handle
+// refuses them. It panics if one was registered already.
+func Reserve(names ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, name := range names {
+		if _, ok := commands[name]; ok {
+			panic("registry: " + name + " is a built-in command")
+		}
+		reserved[name] = true
+	}
+}
+
+// Lookup returns the registered command name.
+func Lookup(name string) (Command, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := commands[name]
+	return c, ok
+}
+
+// Commands returns every registered command, sorted by name.
+func Commands() []Command {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]Command, 0, len(commands))
+	for _, c := range commands {
+		list = append(list, c)
+	}
+	slices.SortFunc(list, func(a, b Command) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// Serve runs the command c on req, filling in what the handler needs to
+// know about c.
+func (c Command) Serve(ctx context.Context, req *Request) {
+	req.usage = c.Usage
+	c.Handler(ctx, req)
+}
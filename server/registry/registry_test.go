@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func nop(context.Context, *Request) {}
+
+// fresh empties the registry for the rest of the test.
+func fresh(t *testing.T) {
+	mu.Lock()
+	prevCommands, prevReserved := commands, reserved
+	commands, reserved = map[string]Command{}, map[string]bool{}
+	mu.Unlock()
+	t.Cleanup(func() {
+		mu.Lock()
+		commands, reserved = prevCommands, prevReserved
+		mu.Unlock()
+	})
+}
+
+// panics reports whether fn panics.
+func panics(fn func()) (panicked bool) {
+	defer func() { panicked = recover() != nil }()
+	fn()
+	return false
+}
+
+func TestHandle(t *testing.T) {
+	fresh(t)
+	Handle("plain", nop)
+	Handle("custom", nop, Usage("custom <arg>"), Permission(Admin))
+	for _, tc := range []struct {
+		name, usage string
+		perm        Level
+	}{
+		{"plain", "plain", Read},
+		{"custom", "custom <arg>", Admin},
+	} {
+		c, ok := Lookup(tc.name)
+		if !ok {
+			t.Errorf("%s was not registered", tc.name)
+			continue
+		}
+		if c.Name != tc.name || c.Usage != tc.usage || c.Permission != tc.perm || c.Handler == nil {
+			t.Errorf("%s registered as %+v, want usage %q and level %d", tc.name, c, tc.usage, tc.perm)
+		}
+	}
+	if _, ok := Lookup("missing"); ok {
+		t.Error("Lookup found a command that was never registered")
+	}
+	var names []string
+	for _, c := range Commands() {
+		names = append(names, c.Name)
+	}
+	if !slices.IsSorted(names) || !slices.Contains(names, "plain") || !slices.Contains(names, "custom") {
+		t.Errorf("Commands() = %v", names)
+	}
+}
+
+func TestHandleRefuses(t *testing.T) {
+	fresh(t)
+	Handle("taken", nop)
+	Reserve("builtin")
+	for _, tc := range []struct {
+		what string
+		fn   func()
+	}{
+		{"a name registered twice", func() { Handle("taken", nop) }},
+		{"a reserved name", func() { Handle("builtin", nop) }},
+		{"reserving a registered name", func() { Reserve("taken") }},
+		{"an empty name", func() { Handle("", nop) }},
+		{"a name of two words", func() { Handle("two words", nop) }},
+		{"a name with a newline", func() { Handle("line\n", nop) }},
+		{"a nil handler", func() { Handle("nil-handler", nil) }},
+	} {
+		if !panics(tc.fn) {
+			t.Errorf("%s was accepted", tc.what)
+		}
+	}
+	if _, ok := Lookup("builtin"); ok {
+		t.Error("a reserved name was registered")
+	}
+}
+
+func TestServe(t *testing.T) {
+	fresh(t)
+	var got *Request
+	Handle("serve", func(_ context.Context, req *Request) { got = req }, Usage("serve <x>"))
+	c, _ := Lookup("serve")
+	c.Serve(context.Background(), &Request{Args: "x"})
+	if got == nil || got.Args != "x" || got.usage != "serve <x>" {
+		t.Errorf("the handler got %+v", got)
+	}
+}
@@ -0,0 +1,59 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// maxAcceptDelay caps the backoff between accept attempts after errors.
+const maxAcceptDelay = time.Second
+
+// acceptSessions hands every connection from listener to handleSession
+// until the listener is closed, with workers goroutines accepting at once so
+// that a burst of new clients is taken off the listener's queue quickly.
+// The session registry and the counters are safe to update from any of
+// them. It returns the error that stopped the first worker; the listener
+// stops them all.
+func acceptSessions(listener *quic.Listener, workers int) error {
+	stopped := make(chan error, workers)
+	for range workers {
+		go func() { stopped <- acceptLoop(listener) }()
+	}
+	return <-stopped
+}
+
+// acceptLoop is one accept worker. A connection from an address over
+// -conn-rate is closed straight away (see admitSession). Accept errors
+// other than a closed listener are retried after a delay that starts at 5ms
+// and doubles up to maxAcceptDelay while they repeat, so a listener in a
+// bad state cannot make the loop spin, the same way net/http's accept loop
+// does it.
+func acceptLoop(listener *quic.Listener) error {
+	var delay time.Duration
+	for {
+		session, err := listener.Accept(context.Background())
+		if err != nil {
+			if errors.Is(err, quic.ErrServerClosed) || errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else {
+				delay = min(2*delay, maxAcceptDelay)
+			}
+			log.Printf("Error accepting session, retrying in %s: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		if !admitSession(session) {
+			continue
+		}
+		go handleSession(session)
+	}
+}
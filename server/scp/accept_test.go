@@ -0,0 +1,41 @@
+package scp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// BenchmarkConnect opens connections to the server over loopback, many at
+// a time, each running one ping before it is closed, with one accept worker
+// and with several.
+func BenchmarkConnect(b *testing.B) {
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg := testSettings(b)
+			cfg.AcceptWorkers = workers
+			addr := startServer(b, cfg)
+			b.SetParallelism(8)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+					conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true}, nil)
+					cancel()
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					if reply, err := tryExchange(conn, "ping", nil); err != nil || reply != "pong\n" {
+						b.Errorf("ping: %q, %v", reply, err)
+					}
+					conn.CloseWithError(errCodeNone, "")
+				}
+			})
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "conns/s")
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package scp
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+
+	"quic-test/server/registry"
+)
+
+// permission is what a session may do. Each level includes the ones below
+// it.
+type permission int
+
+const (
+	permNone  permission = iota // nothing but log in
+	permRead                    // list and download
+	permWrite                   // also upload, remove, link and move files
+	permAdmin                   // also the admin commands
+)
+
+var permissionNames = []string{"none", "read-only", "read-write", "admin"}
+
+func (p permission) String() string {
+	if p < 0 || int(p) >= len(permissionNames) {
+		return fmt.Sprintf("permission(%d)", int(p))
+	}
+	return permissionNames[p]
+}
+
+func (p *permission) Set(s string) error {
+	for i, name := range permissionNames {
+		if s == name {
+			*p = permission(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("%q is not one of %s", s, strings.Join(permissionNames, ", "))
+}
+
+func (p *permission) UnmarshalText(text []byte) error { return p.Set(string(text)) }
+
+func (p permission) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+// accessToken is one token a client can log in with, what it grants, and
+// the storage subdirectory, if any, that it confines the session to.
+type accessToken struct {
+	token string
+	perm  permission
+	home  string // relative to storageDir, "" for all of storage
+}
+
+// readTokens reads the -tokens-file at path. Each line is a token, then
+// optionally the permission it grants (admin when left out) and a storage
+// subdirectory to confine its sessions to:
+//
+//	<token> [read-only|read-write|admin [<dir>]]
+//
+// Blank lines and lines starting with '#' are skipped. A file with no
+// tokens is an error rather than a quiet way of turning logins off.
+func readTokens(path string) ([]accessToken, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("tokens_file: %w", err)
+	}
+	var tokens []accessToken
+	for i, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("tokens_file: %s:%d: want <token> [<permission> [<dir>]]", path, i+1)
+		}
+		t := accessToken{token: fields[0], perm: permAdmin}
+		if len(fields) > 1 {
+			if err := t.perm.Set(fields[1]); err != nil || t.perm == permNone {
+				return nil, fmt.Errorf("tokens_file: %s:%d: permission must be read-only, read-write or admin", path, i+1)
+			}
+		}
+		if len(fields) > 2 {
+			if t.home, err = homeDir(fields[2]); err != nil {
+				return nil, fmt.Errorf("tokens_file: %s:%d: %v", path, i+1, err)
+			}
+		}
+		tokens = append(tokens, t)
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("tokens_file: %s holds no tokens", path)
+	}
+	return tokens, nil
+}
+
+// homeDir checks the subdirectory dir that a token confines its sessions
+// to and returns it relative to storageDir, or "" for dir "/".
+func homeDir(dir string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.Trim(dir, "/")))
+	switch {
+	case rel == ".":
+		return "", nil
+	case !filepath.IsLocal(rel) || strings.HasPrefix(rel, volumePrefix):
+		return "", fmt.Errorf("directory %q must be inside the default storage", dir)
+	case isReserved(rel):
+		return "", fmt.Errorf("directory %q: %v", dir, errReservedPath)
+	}
+	return rel, nil
+}
+
+// lookupToken finds token among -admin-token, which grants admin on all of
+// storage, and the tokens in -tokens-file. Every candidate is compared, in
+// constant time, so the time taken does not tell which one came close.
+func lookupToken(cfg *settings, token string) (accessToken, bool) {
+	var found accessToken
+	match := 0
+	for _, t := range append([]accessToken{{token: cfg.AdminToken, perm: permAdmin}}, cfg.tokens...) {
+		if t.token == "" {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 && match == 0 {
+			found, match = t, 1
+		}
+	}
+	return found, match == 1
+}
+
+// commandPermissions is the permission each command needs beyond permRead,
+// keyed like commandUsage by the words that select its handler.
+var commandPermissions = map[string]permission{
+	"auth":             permNone,
+	"ping":             permNone,
+	"help":             permNone,
+	"codecs":           permNone,
+	"download-streams": permNone,
+	"upd":              permWrite,
+	"upd-batch":        permWrite,
+	"dwd --move":       permWrite,
+	"symlink":          permWrite,
+	"rm":               permWrite,
+	"begin-upload":     permWrite,
+	"resume-upload":    permWrite,
+	"clients":          permAdmin,
+	"info":             permAdmin,
+	"kick":             permAdmin,
+}
+
+// commandPermission returns the permission needed for command, matching
+// its longest prefix of words in commandPermissions, then the commands
+// added with registry.Handle. Anything else, such as a listing or a
+// download, needs permRead.
+func commandPermission(command string) permission {
+	words := strings.Fields(command)
+	for n := min(len(words), 2); n > 0; n-- {
+		if perm, ok := commandPermissions[strings.Join(words[:n], " ")]; ok {
+			return perm
+		}
+	}
+	if len(words) > 0 {
+		if c, ok := registry.Lookup(words[0]); ok {
+			return permission(c.Permission)
+		}
+	}
+	return permRead
+}
+
+// requirePermission reports whether sess has at least need, telling the
+// client off if not. The rest of the stream is not read, so a refused
+// upload does not have to be sent in full first.
+func requirePermission(sess *clientSession, stream quic.Stream, need permission) bool {
+	if sess.permission() >= need {
+		return true
+	}
+	var reason string
+	switch need {
+	case permAdmin:
+		reason = "admin access required"
+	case permWrite:
+		reason = "write access required"
+	default:
+		reason = "login required"
+	}
+	rejectUpload(stream, reason)
+	return false
+}
@@ -0,0 +1,143 @@
+package scp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadTokens(t *testing.T) {
+	for _, tc := range []struct {
+		name, file string
+		want       []accessToken
+		err        string // part of the error, "" for none
+	}{
+		{"default is admin", "secret\n", []accessToken{{token: "secret", perm: permAdmin}}, ""},
+		{"every class", "r read-only\nw read-write\na admin\n",
+			[]accessToken{{"r", permRead, ""}, {"w", permWrite, ""}, {"a", permAdmin, ""}}, ""},
+		{"home", "t read-write users/ann\n", []accessToken{{"t", permWrite, filepath.FromSlash("users/ann")}}, ""},
+		{"home with slashes", "t read-only /users/ann/\n", []accessToken{{"t", permRead, filepath.FromSlash("users/ann")}}, ""},
+		{"root home", "t admin /\n", []accessToken{{"t", permAdmin, ""}}, ""},
+		{"comments and blanks", "# tokens\n\n  \nt read-only\n", []accessToken{{"t", permRead, ""}}, ""},
+		{"empty", "# nothing\n", nil, "holds no tokens"},
+		{"unknown permission", "t superuser\n", nil, ":1: permission must be"},
+		{"none is not a grant", "t none\n", nil, "permission must be"},
+		{"too many fields", "a admin\nt admin dir extra\n", nil, ":2: want <token>"},
+		{"home escapes", "t read-write ../elsewhere\n", nil, "must be inside the default storage"},
+		{"home in a volume", "t read-write vol:media/x\n", nil, "must be inside the default storage"},
+		{"home reserved", "t read-write .transfers\n", nil, "reserved"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens")
+			os.WriteFile(path, []byte(tc.file), 0o600)
+			got, err := readTokens(path)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got %v, want an error containing %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("token %d: got %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCommandPermission(t *testing.T) {
+	for command, want := range map[string]permission{
+		"auth secret":      permNone,
+		"ping":             permNone,
+		"ls":               permRead,
+		"ls --page=2":      permRead,
+		"dwd file":         permRead,
+		"dwd --move file":  permWrite,
+		"dwd --chunks f 0": permRead,
+		"upd file 10":      permWrite,
+		"rm file":          permWrite,
+		"resume-upload id": permWrite,
+		"kick 1.2.3.4:5":   permAdmin,
+		"clients":          permAdmin,
+		"":                 permRead,
+	} {
+		if got := commandPermission(command); got != want {
+			t.Errorf("commandPermission(%q) = %s, want %s", command, got, want)
+		}
+	}
+}
+
+// TestPermissionClasses logs in with a token of each class and checks what
+// it may read, write and administer.
+func TestPermissionClasses(t *testing.T) {
+	cfg := testSettings(t)
+	cfg.Anonymous = permNone
+	cfg.tokens = []accessToken{
+		{"ro", permRead, ""},
+		{"rw", permWrite, ""},
+		{"adm", permAdmin, ""},
+		{"ann", permWrite, filepath.FromSlash("users/ann")},
+	}
+	addr := startServer(t, cfg)
+	os.WriteFile(filepath.Join(cfg.Storage, "shared.txt"), []byte("shared"), 0o644)
+
+	type outcome struct{ read, write, admin bool }
+	for _, tc := range []struct {
+		token string // "" to stay anonymous
+		want  outcome
+	}{
+		{"", outcome{false, false, false}},
+		{"ro", outcome{true, false, false}},
+		{"rw", outcome{true, true, false}},
+		{"adm", outcome{true, true, true}},
+	} {
+		t.Run("token="+tc.token, func(t *testing.T) {
+			conn := dialTest(t, addr)
+			if tc.token != "" {
+				if reply := exchange(t, conn, "auth "+tc.token, nil); !strings.HasPrefix(reply, "OK ") {
+					t.Fatalf("auth: %q", reply)
+				}
+			}
+			_, errLine := download(t, conn, "shared.txt")
+			got := outcome{
+				read:  errLine == "",
+				write: upload(t, conn, "new-"+tc.token, []byte("x")) == "",
+				admin: !strings.HasPrefix(exchange(t, conn, "clients", nil), "Error"),
+			}
+			if got != tc.want {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+			_, err := os.Stat(filepath.Join(cfg.Storage, "new-"+tc.token))
+			if (err == nil) != tc.want.write {
+				t.Errorf("upload stored: %t, want %t", err == nil, tc.want.write)
+			}
+		})
+	}
+
+	t.Run("home", func(t *testing.T) {
+		conn := dialTest(t, addr)
+		if reply := exchange(t, conn, "auth ann", nil); reply != "OK read-write\n" {
+			t.Fatalf("auth: %q", reply)
+		}
+		if reply := upload(t, conn, "mine.txt", []byte("x")); reply != "" {
+			t.Fatalf("upd inside the home: %q", reply)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.Storage, "users", "ann", "mine.txt")); err != nil {
+			t.Errorf("upload inside the home was not stored there: %v", err)
+		}
+		if _, errLine := download(t, conn, "../../shared.txt"); errLine == "" {
+			t.Error("a home session downloaded a file outside its home")
+		}
+		if _, errLine := download(t, conn, "/shared.txt"); errLine == "" {
+			t.Error("a home session reached the storage root through /")
+		}
+	})
+}
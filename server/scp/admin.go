@@ -0,0 +1,95 @@
+package scp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// redactCommand hides secrets before a command line is logged or shown to
+// other clients.
+func redactCommand(command string) string {
+	if strings.HasPrefix(command, "auth ") {
+		return "auth ***"
+	}
+	return command
+}
+
+// handleAuth gives the session the permission of token, and moves it into
+// the token's storage subdirectory if it has one, creating it if need be.
+// The reply names the permission granted: "OK <permission>".
+func handleAuth(sess *clientSession, stream quic.Stream, token string) {
+	cfg := currentSettings()
+	if cfg.AdminToken == "" && len(cfg.tokens) == 0 {
+		stream.Write([]byte("Error: login disabled\n"))
+		return
+	}
+	t, ok := lookupToken(cfg, token)
+	if !ok {
+		logf(stream, "Rejected token from %s", sess.addr())
+		stream.Write([]byte("Error: invalid token\n"))
+		return
+	}
+	if t.home != "" {
+		if err := storageRoots[""].MkdirAll(t.home, cfg.DirMode.perm()); err != nil {
+			logf(stream, "Error creating %s for %s: %v", displayPath(t.home), sess.addr(), err)
+			stream.Write([]byte("Error: " + storageReason(err, "could not create home directory") + "\n"))
+			return
+		}
+	}
+	sess.grant(t.perm, t.home)
+	where := "all of storage"
+	if t.home != "" {
+		where = displayPath(t.home)
+	}
+	logf(stream, "Granted %s access to %s, in %s", t.perm, sess.addr(), where)
+	auditLog.Printf("%s login from %s, in %s", t.perm, sess.addr(), where)
+	stream.Write([]byte("OK " + t.perm.String() + "\n"))
+}
+
+// handleClients lists every connected session, one per line.
+func handleClients(stream quic.Stream) {
+	var lines []string
+	for _, s := range activeSessions.list() {
+		active := strings.Join(s.activeCommands(), ", ")
+		if active == "" {
+			active = "-"
+		}
+		lines = append(lines, fmt.Sprintf("%s  %s  connected %s (%s)  %d bytes  active: %s",
+			s.addr(),
+			s.permission(),
+			s.connectedAt.Format(time.RFC3339),
+			time.Since(s.connectedAt).Round(time.Second),
+			s.bytes.Load(),
+			active))
+	}
+	stream.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// handleKick disconnects the client at the given remote address. Anything
+// after the address is passed on to that client as the close reason.
+func handleKick(sess *clientSession, stream quic.Stream, args string) {
+	addr, reason, _ := strings.Cut(args, " ")
+	reason = strings.TrimSpace(reason)
+	if reason == "" {
+		reason = "disconnected by administrator"
+	}
+
+	var target *clientSession
+	for _, s := range activeSessions.list() {
+		if s.addr() == addr {
+			target = s
+			break
+		}
+	}
+	if target == nil {
+		stream.Write([]byte("Error: no such client\n"))
+		return
+	}
+
+	auditLog.Printf("%s kicked %s: %s", sess.addr(), addr, reason)
+	stream.Write([]byte("OK\n"))
+	target.conn.CloseWithError(errCodeKicked, reason)
+}
@@ -0,0 +1,298 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// storageKey seals stored files when -storage-key-file is set; nil keeps
+// them in plaintext. Clients never notice either way.
+//
+// The key file holds 32 bytes, raw or as 64 hex digits. It is meant to live
+// somewhere other than the storage disk (a separate volume, a secrets mount)
+// and be readable only by the server. There is no key rotation: files
+// sealed under one key cannot be read with another, and a lost key means
+// the stored data is lost with it. Files stored before a key was configured
+// are still served as they are.
+var storageKey cipher.AEAD
+
+// A sealed file is a header followed by AES-256-GCM chunks:
+//
+//	magic (8) | nonce prefix (7) | chunk 0 | chunk 1 | ... | final chunk
+//
+// Every chunk holds restChunkSize bytes of plaintext plus a tag, except the
+// final one, which is shorter (possibly empty) and sealed with the
+// last-chunk flag set in its nonce. The nonce is the prefix, the chunk's
+// big-endian index and that flag, so chunks cannot be reordered or the file
+// truncated unnoticed. The plaintext size follows from the file size alone.
+const (
+	restMagic       = "QSCPREST"
+	restPrefixSize  = 7
+	restHeaderSize  = len(restMagic) + restPrefixSize
+	restChunkSize   = 64 * 1024
+	restTagSize     = 16
+	restSealedChunk = restChunkSize + restTagSize
+)
+
+var errTruncatedSeal = errors.New("sealed file is truncated")
+
+// loadStorageKey reads the key for sealing stored files.
+func loadStorageKey(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		log.Printf("Warning: storage key file %s is accessible by other users (mode %v)", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	key := data
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 64 {
+		if key, err = hex.DecodeString(string(trimmed)); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	if len(key) != 32 {
+		return fmt.Errorf("%s: want a 32-byte key, raw or hex-encoded", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	storageKey, err = cipher.NewGCM(block)
+	return err
+}
+
+// sealedSize is the size on disk of plain bytes once sealed.
+func sealedSize(plain int64) int64 {
+	return int64(restHeaderSize) + plain + (plain/restChunkSize+1)*restTagSize
+}
+
+// sealedPrefix is the size on disk of the first plain bytes of a file that
+// is still being written, plain being a multiple of restChunkSize.
+func sealedPrefix(plain int64) int64 {
+	return int64(restHeaderSize) + plain/restChunkSize*restSealedChunk
+}
+
+// logicalSize is the inverse of sealedSize.
+func logicalSize(sealed int64) (int64, error) {
+	body := sealed - int64(restHeaderSize)
+	last := body % restSealedChunk
+	if body < restTagSize || last < restTagSize {
+		return 0, errTruncatedSeal
+	}
+	return body/restSealedChunk*restChunkSize + last - restTagSize, nil
+}
+
+func restNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, 0, restPrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, index)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// sealWriter seals the plaintext written to it onto w. Full chunks are
+// written as soon as they fill up; Close writes the final chunk.
+type sealWriter struct {
+	w      io.Writer
+	prefix []byte
+	index  uint32
+	buf    []byte
+}
+
+// newSealWriter starts a sealed file on w, writing its header right away.
+func newSealWriter(w io.Writer) (*sealWriter, error) {
+	prefix := make([]byte, restPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(append([]byte(restMagic), prefix...)); err != nil {
+		return nil, err
+	}
+	return resumeSealWriter(w, prefix, 0), nil
+}
+
+// resumeSealWriter continues a sealed file whose header carried prefix and
+// which already holds the first plain bytes, a multiple of restChunkSize.
+func resumeSealWriter(w io.Writer, prefix []byte, plain int64) *sealWriter {
+	return &sealWriter{w: w, prefix: prefix, index: uint32(plain / restChunkSize), buf: make([]byte, 0, restChunkSize)}
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(s.buf[len(s.buf):restChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+n]
+		p = p[n:]
+		written += n
+		if len(s.buf) == restChunkSize {
+			if err := s.seal(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// buffered is how many written bytes are still waiting for their chunk to
+// fill up, and so are not on w yet.
+func (s *sealWriter) buffered() int {
+	return len(s.buf)
+}
+
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+func (s *sealWriter) seal(last bool) error {
+	out := storageKey.Seal(nil, restNonce(s.prefix, s.index, last), s.buf, nil)
+	s.index++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(out)
+	return err
+}
+
+// readSealPrefix returns the nonce prefix from the header of a sealed file.
+func readSealPrefix(f *os.File) ([]byte, error) {
+	header := make([]byte, restHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(header, []byte(restMagic)) {
+		return nil, errors.New("not a sealed file")
+	}
+	return header[len(restMagic):], nil
+}
+
+// openReader yields the plaintext of a sealed file, one authenticated chunk
+// at a time.
+type openReader struct {
+	r      *bufio.Reader
+	prefix []byte
+	index  uint32
+	chunk  []byte
+	plain  []byte
+	done   bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.chunk)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		last = true
+	case err == io.EOF:
+		return errTruncatedSeal
+	case err != nil:
+		return err
+	default:
+		// The final chunk is always short, so a full one must be followed
+		// by more.
+		if _, err := o.r.Peek(1); err == io.EOF {
+			return errTruncatedSeal
+		} else if err != nil {
+			return err
+		}
+	}
+	plain, err := storageKey.Open(o.chunk[:0], restNonce(o.prefix, o.index, last), o.chunk[:n], nil)
+	if err != nil {
+		return fmt.Errorf("chunk %d of sealed file failed authentication", o.index)
+	}
+	o.index++
+	o.plain = plain
+	o.done = last
+	return nil
+}
+
+// storedFile is an open stored file that reads as its plaintext.
+type storedFile struct {
+	io.Reader
+	file *os.File
+	info os.FileInfo
+	size int64 // how many bytes reading it yields
+}
+
+func (f *storedFile) Close() error {
+	return f.file.Close()
+}
+
+// seekable reports whether reading can start anywhere in the file. Sealed
+// files can only be read from the start, since each chunk is checked as it
+// is opened.
+func (f *storedFile) seekable() bool {
+	return f.Reader == io.Reader(f.file)
+}
+
+// skip moves past the first n bytes of plaintext, reading up to there if
+// the file is not seekable.
+func (f *storedFile) skip(n int64) error {
+	if f.seekable() {
+		_, err := f.file.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, f, n)
+	return err
+}
+
+// openStored opens the stored file rel, unsealing it if needed.
+func openStored(rel string) (*storedFile, error) {
+	root, inside := rootOf(rel)
+	file, err := root.Open(inside)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	stored := &storedFile{Reader: file, file: file, info: info, size: info.Size()}
+	if storageKey == nil || !info.Mode().IsRegular() {
+		return stored, nil
+	}
+	prefix, err := readSealPrefix(file)
+	if err != nil {
+		// Stored before a key was configured.
+		return stored, nil
+	}
+	if stored.size, err = logicalSize(info.Size()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(int64(restHeaderSize), io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	stored.Reader = &openReader{r: bufio.NewReaderSize(file, restSealedChunk), prefix: prefix, chunk: make([]byte, restSealedChunk)}
+	return stored, nil
+}
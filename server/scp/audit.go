@@ -0,0 +1,19 @@
+package scp
+
+import (
+	"log"
+	"os"
+)
+
+// auditLog records admin actions. It writes to the file given by -audit-log,
+// or to the regular server log when that flag is unset.
+var auditLog = log.New(os.Stderr, "AUDIT ", log.LstdFlags)
+
+func openAuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	auditLog = log.New(file, "", log.LstdFlags)
+	return nil
+}
@@ -0,0 +1,188 @@
+package scp
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// backupSuffix ends the name of a backup, which is the original name, a
+// UTC timestamp and the suffix: "report.pdf.20240501T101500.000.bak".
+// Timestamps sort in the order they were taken.
+const (
+	backupSuffix     = ".bak"
+	backupTimeFormat = "20060102T150405.000"
+)
+
+// backupExisting renames the file about to be replaced at dest, inside
+// root, to a timestamped backup next to it, and then prunes the oldest
+// backups of dest beyond keep (0 keeps them all). A missing dest is not an
+// error.
+func backupExisting(root *os.Root, dest string, keep int) error {
+	info, err := root.Lstat(dest)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	backup := dest + "." + time.Now().UTC().Format(backupTimeFormat) + backupSuffix
+	if err := root.Rename(dest, backup); err != nil {
+		return fmt.Errorf("backing up %s: %w", filepath.Base(dest), err)
+	}
+	if keep == 0 {
+		return nil
+	}
+	backups, err := backupsOf(root, dest)
+	if err != nil {
+		return nil // the backup exists; pruning can wait for the next one
+	}
+	for _, old := range backups[:max(len(backups)-keep, 0)] {
+		root.Remove(filepath.Join(filepath.Dir(dest), old))
+	}
+	return nil
+}
+
+// backupsOf lists the backups of dest, oldest first, by name.
+func backupsOf(root *os.Root, dest string) ([]string, error) {
+	entries, err := fs.ReadDir(root.FS(), filepath.ToSlash(filepath.Dir(dest)))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(dest) + "."
+	var backups []string
+	for _, entry := range entries {
+		name := entry.Name()
+		stamp, ok := strings.CutPrefix(name, prefix)
+		if !ok || !strings.HasSuffix(stamp, backupSuffix) || !entry.Type().IsRegular() {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(stamp, backupSuffix)); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	slices.Sort(backups)
+	return backups, nil
+}
+
+// versionSuffix precedes the number of a kept version: "report.pdf.v3".
+const versionSuffix = ".v"
+
+// keepVersion renames the file about to be replaced at dest, inside root,
+// to the next version number and removes the lowest versions beyond keep.
+// A missing dest is not an error.
+func keepVersion(root *os.Root, dest string, keep int) error {
+	info, err := root.Lstat(dest)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil
+	}
+	versions, err := versionsOf(root, dest)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1] + 1
+	}
+	if err := root.Rename(dest, versionPath(dest, next)); err != nil {
+		return fmt.Errorf("keeping version %d of %s: %w", next, filepath.Base(dest), err)
+	}
+	versions = append(versions, next)
+	for _, old := range versions[:max(len(versions)-keep, 0)] {
+		root.Remove(versionPath(dest, old))
+	}
+	return nil
+}
+
+func versionPath(dest string, version int) string {
+	return dest + versionSuffix + strconv.Itoa(version)
+}
+
+// versionsOf returns the numbers of the kept versions of dest, lowest
+// first.
+func versionsOf(root *os.Root, dest string) ([]int, error) {
+	entries, err := fs.ReadDir(root.FS(), filepath.ToSlash(filepath.Dir(dest)))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(dest) + versionSuffix
+	var versions []int
+	for _, entry := range entries {
+		digits, ok := strings.CutPrefix(entry.Name(), prefix)
+		if !ok || !entry.Type().IsRegular() {
+			continue
+		}
+		if n, err := strconv.Atoi(digits); err == nil && n > 0 && strconv.Itoa(n) == digits {
+			versions = append(versions, n)
+		}
+	}
+	slices.Sort(versions)
+	return versions, nil
+}
+
+// resolveVersion resolves a name that may end in "@<version>", as taken by
+// dwd, to the stored path of that version. A file whose name really ends
+// that way is still found under its own name.
+func resolveVersion(sess *clientSession, name string) (string, error) {
+	rel, err := sess.resolve(name)
+	if err != nil {
+		return "", err
+	}
+	base, digits, found := strings.Cut(name, "@")
+	if !found || strings.Contains(digits, "@") {
+		return rel, nil
+	}
+	version, err := strconv.Atoi(digits)
+	if err != nil || version < 1 {
+		return rel, nil
+	}
+	root, inside := rootOf(rel)
+	if _, err := root.Lstat(inside); err == nil {
+		return rel, nil
+	}
+	baseRel, err := sess.resolve(base)
+	if err != nil {
+		return "", err
+	}
+	return versionPath(baseRel, version), nil
+}
+
+// handleVersions lists the kept versions of a file, newest first, with
+// their sizes and when they were uploaded.
+func handleVersions(sess *clientSession, stream quic.Stream, name string) {
+	if name == "" {
+		writeUsage(stream, "versions")
+		return
+	}
+	rel, err := sess.resolve(name)
+	if err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: %v\n", name, err)))
+		return
+	}
+	unlock := fileLocks.rlock(rel)
+	defer unlock()
+	root, inside := rootOf(rel)
+	versions, err := versionsOf(root, inside)
+	if err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: %v\n", name, err)))
+		return
+	}
+	if len(versions) == 0 {
+		stream.Write([]byte(fmt.Sprintf("No versions of %s.\n", name)))
+		return
+	}
+	var lines []string
+	for _, version := range slices.Backward(versions) {
+		file, err := openStored(versionPath(rel, version))
+		if err != nil {
+			continue
+		}
+		file.Close()
+		lines = append(lines, fmt.Sprintf("%s@%d  %d bytes  %s", name, version, file.size, file.info.ModTime().UTC().Format(time.RFC3339)))
+	}
+	stream.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
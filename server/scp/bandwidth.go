@@ -0,0 +1,97 @@
+package scp
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// bandwidthQuantum is the largest slice of the budget a transfer may reserve
+// at once. Keeping it small relative to the rate is what makes sharing fair.
+const bandwidthQuantum = 32 * 1024
+
+// bandwidthScheduler shares one global byte rate between every active
+// transfer. Each transfer reserves at most bandwidthQuantum bytes of link
+// time per turn and must sleep through its reservation before asking again,
+// so transfers that are all busy end up taking turns and each gets an equal
+// share. Idle time is not banked, so nobody can save up a burst.
+type bandwidthScheduler struct {
+	rate int64 // bytes per second
+
+	mu   sync.Mutex
+	next time.Time // when the current reservations run out
+}
+
+func newBandwidthScheduler(rate int64) *bandwidthScheduler {
+	return &bandwidthScheduler{rate: rate}
+}
+
+// wait blocks until n bytes' worth of bandwidth has been granted to the caller.
+func (b *bandwidthScheduler) wait(n int) {
+	b.mu.Lock()
+	now := time.Now()
+	if b.next.Before(now) {
+		b.next = now
+	}
+	b.next = b.next.Add(time.Duration(int64(n) * int64(time.Second) / b.rate))
+	end := b.next
+	b.mu.Unlock()
+
+	time.Sleep(time.Until(end))
+}
+
+type throttledReader struct {
+	r     io.Reader
+	sched *bandwidthScheduler
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > bandwidthQuantum {
+		p = p[:bandwidthQuantum]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.sched.wait(n)
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	w     io.Writer
+	sched *bandwidthScheduler
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > bandwidthQuantum {
+			chunk = chunk[:bandwidthQuantum]
+		}
+		t.sched.wait(len(chunk))
+		n, err := t.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// reader returns r limited by the scheduler's budget. A nil scheduler means
+// no limit, and r is returned unchanged.
+func (b *bandwidthScheduler) reader(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &throttledReader{r: r, sched: b}
+}
+
+// writer is the io.Writer counterpart of reader.
+func (b *bandwidthScheduler) writer(w io.Writer) io.Writer {
+	if b == nil {
+		return w
+	}
+	return &throttledWriter{w: w, sched: b}
+}
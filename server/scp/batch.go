@@ -0,0 +1,123 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// batchFileStream is the part of an upd-batch stream that carries one file,
+// handed to handleUpload as if the file had a stream of its own. Reads end
+// with the file. What handleUpload writes back is kept as the file's reply,
+// and stopping reading, as it does to refuse a file, only skips the rest of
+// that file rather than the rest of the batch.
+type batchFileStream struct {
+	quic.Stream
+	body  *io.LimitedReader
+	reply bytes.Buffer
+}
+
+func (f *batchFileStream) Read(p []byte) (int, error) {
+	return f.body.Read(p)
+}
+
+func (f *batchFileStream) Write(p []byte) (int, error) {
+	return f.reply.Write(p)
+}
+
+func (f *batchFileStream) CancelRead(quic.StreamErrorCode) {}
+
+func (f *batchFileStream) Close() error {
+	return nil
+}
+
+// handleBatchUpload stores count files sent back to back on one stream,
+// each behind a header line with its name and length:
+//
+//	upd-batch <count>
+//	<name> <size>     followed by exactly size bytes, count times
+//
+// Every file is stored like a single upd, and answered as soon as it is,
+// with "OK <name>" or "Error: <name>: <reason>". A refused file is read
+// past, so the files after it still arrive; a header that cannot be parsed
+// ends the batch, since the stream is then out of step.
+func handleBatchUpload(sess *clientSession, stream quic.Stream, reader *bufio.Reader, args []string) {
+	count := 0
+	if len(args) == 1 {
+		count, _ = strconv.Atoi(args[0])
+	}
+	if count < 1 {
+		writeUsage(stream, "upd-batch")
+		return
+	}
+	limit := currentSettings().MaxCommandLength
+	stored := 0
+	for i := range count {
+		line, err := readCommand(stream, reader, limit)
+		if err != nil {
+			logf(stream, "Batch upload ended after %d of %d files: %v", i, count, err)
+			rejectUpload(stream, fmt.Sprintf("batch ended after %d of %d files", i, count))
+			return
+		}
+		fields := strings.Fields(line)
+		size := int64(-1)
+		if len(fields) == 2 {
+			if n, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+				size = n
+			}
+		}
+		if size < 0 {
+			logf(stream, "Batch upload ended at malformed header %q", strings.TrimSpace(line))
+			rejectUpload(stream, "usage: "+commandUsage["upd-batch"])
+			return
+		}
+		fileName := fields[0]
+
+		file := &batchFileStream{Stream: stream, body: &io.LimitedReader{R: reader, N: size}}
+		var fileStream quic.Stream = file
+		if r, ok := stream.(*requestStream); ok {
+			fileStream = &requestStream{Stream: file, id: r.id}
+		}
+		ok := handleUpload(sess, fileStream, file.body, fileName, size, "")
+		if file.body.N > 0 {
+			// Refused before the end: skip what is left of the file. A client
+			// that stops sending it gets as long as it gets for a command.
+			stream.SetReadDeadline(time.Now().Add(commandReadTimeout))
+			_, err := io.Copy(io.Discard, file.body)
+			stream.SetReadDeadline(time.Time{})
+			if err != nil || file.body.N > 0 {
+				logf(stream, "Batch upload ended inside %s: %v", fileName, err)
+				stream.CancelRead(streamRejected)
+				stream.Write([]byte(batchReply(fileName, ok, file.reply.String())))
+				return
+			}
+		}
+		stream.Write([]byte(batchReply(fileName, ok, file.reply.String())))
+		if ok {
+			stored++
+		}
+	}
+	printf(stream, "Stored %d/%d files of the batch\n", stored, count)
+}
+
+// batchReply is the status line for one file of a batch, given whether
+// handleUpload stored it and what it replied.
+func batchReply(fileName string, ok bool, reply string) string {
+	if ok {
+		return "OK " + fileName + "\n"
+	}
+	reason := "could not store file"
+	for _, line := range strings.Split(reply, "\n") {
+		if r, found := strings.CutPrefix(line, "Error: "); found {
+			reason = r
+			break
+		}
+	}
+	return fmt.Sprintf("Error: %s: %s\n", fileName, reason)
+}
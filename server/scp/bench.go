@@ -0,0 +1,84 @@
+package scp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// benchBlock is the data "bench down" sends over and over. It is random so
+// nothing along the path can make it smaller.
+var benchBlock = func() []byte {
+	b := make([]byte, 32*1024)
+	rand.Read(b)
+	return b
+}()
+
+// handleBench sinks or sources generated data so that a client can measure
+// the link without any disk or stored file being involved:
+//
+//	bench up <n>    the client sends n bytes, answered with "OK <n>" once all arrived
+//	bench down <n>  answered with "OK <n>", then n bytes
+//
+// n may not exceed bench_max_bytes. server_rate and transfer_timeout apply
+// as they do to file transfers.
+func handleBench(sess *clientSession, stream quic.Stream, reader *bufio.Reader, args []string) {
+	cfg := currentSettings()
+	if cfg.BenchMaxBytes == 0 {
+		rejectUpload(stream, "bench is disabled on this server")
+		return
+	}
+	if len(args) != 2 || (args[0] != "up" && args[0] != "down") {
+		rejectUpload(stream, "usage: "+commandUsage["bench"])
+		return
+	}
+	n, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || n < 0 {
+		rejectUpload(stream, fmt.Sprintf("invalid byte count %q", args[1]))
+		return
+	}
+	if n > cfg.BenchMaxBytes {
+		rejectUpload(stream, fmt.Sprintf("bench is limited to %d bytes", cfg.BenchMaxBytes))
+		return
+	}
+
+	timeout := time.Duration(cfg.TransferTimeout)
+	var moved int64
+	if args[0] == "up" {
+		src := cfg.bandwidth.reader(withReadTimeout(reader, stream, timeout))
+		moved, err = io.CopyN(io.Discard, src, n)
+		if err == nil {
+			stream.Write([]byte(fmt.Sprintf("OK %d\n", moved)))
+		} else if !isTimeout(err) {
+			stream.Write([]byte(fmt.Sprintf("Error: received %d of %d bytes\n", moved, n)))
+		}
+	} else {
+		stream.Write([]byte(fmt.Sprintf("OK %d\n", n)))
+		dst := cfg.bandwidth.writer(withWriteTimeout(stream, stream, timeout))
+		for moved < n && err == nil {
+			var written int
+			written, err = dst.Write(benchBlock[:min(int64(len(benchBlock)), n-moved)])
+			moved += int64(written)
+		}
+	}
+	if args[0] == "up" {
+		sess.received(moved)
+	} else {
+		sess.sent(moved)
+	}
+	if isTimeout(err) {
+		logf(stream, "Bench %s timed out after %d bytes", args[0], moved)
+		stream.CancelWrite(streamTimedOut)
+		return
+	}
+	if err != nil {
+		logf(stream, "Bench %s stopped after %d of %d bytes: %v", args[0], moved, n, err)
+		return
+	}
+	printf(stream, "Bench %s of %d bytes done\n", args[0], moved)
+}
@@ -0,0 +1,179 @@
+package scp
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// delayedPacket is a datagram held back until at.
+type delayedPacket struct {
+	data []byte
+	addr net.Addr
+	at   time.Time
+}
+
+// delayedConn is a UDP socket that holds every datagram back by delay in
+// each direction, so that a connection over loopback has the round trip of
+// a long path. Datagrams keep their order; once too many are in flight,
+// more are dropped, as a router's full queue would.
+type delayedConn struct {
+	net.PacketConn
+	delay     time.Duration
+	in, out   chan delayedPacket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newDelayedConn(tb testing.TB, delay time.Duration) *delayedConn {
+	tb.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	c := &delayedConn{
+		PacketConn: udp,
+		delay:      delay,
+		in:         make(chan delayedPacket, 1<<14),
+		out:        make(chan delayedPacket, 1<<14),
+		done:       make(chan struct{}),
+	}
+	go c.receive()
+	go c.send()
+	return c
+}
+
+// receive queues what arrives on the socket for ReadFrom.
+func (c *delayedConn) receive() {
+	for {
+		buf := make([]byte, 2048)
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case c.in <- delayedPacket{buf[:n], addr, time.Now().Add(c.delay)}:
+		default:
+		}
+	}
+}
+
+// send writes out what WriteTo queued once its time has come.
+func (c *delayedConn) send() {
+	for {
+		select {
+		case p := <-c.out:
+			time.Sleep(time.Until(p.at))
+			c.PacketConn.WriteTo(p.data, p.addr)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *delayedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.in:
+		time.Sleep(time.Until(p.at))
+		return copy(b, p.data), p.addr, nil
+	case <-c.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *delayedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case c.out <- delayedPacket{append([]byte(nil), b...), addr, time.Now().Add(c.delay)}:
+	case <-c.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return len(b), nil
+}
+
+func (c *delayedConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.PacketConn.Close()
+}
+
+// BenchmarkWindowsHighLatency moves data through bench over a 50 ms round
+// trip, with both ends' connection windows held at 1 MiB and with the
+// defaults, which let the windows grow far enough to keep such a path full.
+func BenchmarkWindowsHighLatency(b *testing.B) {
+	const size = 16 << 20
+	defaults := testSettings(b)
+	for _, windows := range []struct {
+		name             string
+		initial, maximum int64
+	}{
+		{"1MiB", 1 << 20, 1 << 20},
+		{"default", defaults.InitialConnWindow, defaults.MaxConnWindow},
+	} {
+		for _, direction := range []string{"up", "down"} {
+			b.Run(windows.name+"/"+direction, func(b *testing.B) {
+				cfg := testSettings(b)
+				cfg.BenchMaxBytes = size
+				cfg.InitialConnWindow, cfg.MaxConnWindow = windows.initial, windows.maximum
+				addr, err := net.ResolveUDPAddr("udp", startServer(b, cfg))
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				udp := newDelayedConn(b, 25*time.Millisecond)
+				tr := &quic.Transport{Conn: udp}
+				b.Cleanup(func() {
+					udp.Close()
+					tr.Close()
+				})
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				conn, err := tr.Dial(ctx, addr, &tls.Config{InsecureSkipVerify: true}, &quic.Config{
+					InitialConnectionReceiveWindow: uint64(windows.initial),
+					MaxConnectionReceiveWindow:     uint64(windows.maximum),
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() { conn.CloseWithError(errCodeNone, "") })
+
+				body := make([]byte, size)
+				b.SetBytes(size)
+				b.ResetTimer()
+				for range b.N {
+					stream, err := conn.OpenStreamSync(context.Background())
+					if err != nil {
+						b.Fatal(err)
+					}
+					stream.SetDeadline(time.Now().Add(time.Minute))
+					command := fmt.Sprintf("bench %s %d\n", direction, size)
+					reader := bufio.NewReader(stream)
+					if direction == "up" {
+						stream.Write(append([]byte(command), body...))
+						stream.Close()
+						if status, _ := reader.ReadString('\n'); strings.TrimSpace(status) != fmt.Sprintf("OK %d", size) {
+							b.Fatalf("bench up: %q", status)
+						}
+						continue
+					}
+					stream.Write([]byte(command))
+					stream.Close()
+					if status, _ := reader.ReadString('\n'); strings.TrimSpace(status) != fmt.Sprintf("OK %d", size) {
+						b.Fatalf("bench down: %q", status)
+					}
+					if n, err := io.Copy(io.Discard, reader); err != nil || n != size {
+						b.Fatalf("bench down: received %d of %d bytes: %v", n, size, err)
+					}
+				}
+			})
+		}
+	}
+}
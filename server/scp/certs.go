@@ -0,0 +1,32 @@
+package scp
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+)
+
+// certificateStore serves the current TLS certificate and lets it be
+// replaced without restarting the listener.
+type certificateStore struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+func newCertificateStore(certFile, keyFile string) *certificateStore {
+	return &certificateStore{certFile: certFile, keyFile: keyFile}
+}
+
+// reload reads the key pair from disk. On error the previous certificate
+// stays in use.
+func (c *certificateStore) reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certificateStore) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
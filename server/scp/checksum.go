@@ -0,0 +1,215 @@
+package scp
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// maxChecksumEntries bounds the checksum cache. Beyond it the least
+// recently used digest is forgotten.
+const maxChecksumEntries = 10000
+
+// checksumSaveInterval is how often a changed cache is written to the
+// -checksum-cache file.
+const checksumSaveInterval = time.Minute
+
+// checksumEntry is a digest together with the file state it was taken from.
+type checksumEntry struct {
+	Path    string    `json:"path"` // relative to storageDir
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Sum     string    `json:"sha256"`
+}
+
+// checksumCache remembers the SHA-256 of stored files, least recently used
+// first out. An entry is only used while the file's size and modification
+// time are unchanged, and writers drop it explicitly as well (see
+// fileLockMap.lock), so a rewrite within the timestamp granularity is not
+// missed either.
+type checksumCache struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element // of *checksumEntry
+	order   *list.List               // front is most recently used
+	dirty   bool
+}
+
+var checksums = newChecksumCache()
+
+func newChecksumCache() *checksumCache {
+	return &checksumCache{entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func (c *checksumCache) lookup(rel string, info os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[rel]
+	if !ok {
+		return "", false
+	}
+	entry := el.Value.(*checksumEntry)
+	if entry.Size != info.Size() || !entry.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	return entry.Sum, true
+}
+
+func (c *checksumCache) store(entry *checksumEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[entry.Path]; ok {
+		el.Value = entry
+		c.order.MoveToFront(el)
+	} else {
+		c.entries[entry.Path] = c.order.PushFront(entry)
+	}
+	for c.order.Len() > maxChecksumEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*checksumEntry).Path)
+	}
+	c.dirty = true
+}
+
+// forget drops the digest of rel, if any.
+func (c *checksumCache) forget(rel string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[rel]; ok {
+		c.order.Remove(el)
+		delete(c.entries, rel)
+		c.dirty = true
+	}
+}
+
+// sum returns the hex SHA-256 of the file at the storage-relative path rel,
+// hashing it only if it changed since it was last seen. Sealed files are
+// hashed by their plaintext. The caller should hold at least a read lock
+// on rel.
+func (c *checksumCache) sum(ctx context.Context, rel string) (string, error) {
+	root, inside := rootOf(rel)
+	info, err := root.Stat(inside)
+	if err != nil {
+		return "", err
+	}
+	if sum, ok := c.lookup(rel, info); ok {
+		return sum, nil
+	}
+
+	f, err := openStored(rel)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := copyWithContext(ctx, h, f, make([]byte, copyBufferSize)); err != nil {
+		return "", err
+	}
+	entry := &checksumEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), Sum: hex.EncodeToString(h.Sum(nil))}
+	c.store(entry)
+	return entry.Sum, nil
+}
+
+// load fills the cache from a file written by save. Entries for files that
+// have since changed are harmless; lookup rejects them.
+func (c *checksumCache) load(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*checksumEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	// The file lists the most recently used entry first.
+	for i := len(entries) - 1; i >= 0; i-- {
+		c.store(entries[i])
+	}
+	c.mu.Lock()
+	c.dirty = false
+	c.mu.Unlock()
+	return nil
+}
+
+// save writes the cache to path if it changed since the last save.
+func (c *checksumCache) save(path string) error {
+	c.mu.Lock()
+	if !c.dirty {
+		c.mu.Unlock()
+		return nil
+	}
+	entries := make([]*checksumEntry, 0, c.order.Len())
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		entries = append(entries, el.Value.(*checksumEntry))
+	}
+	c.dirty = false
+	c.mu.Unlock()
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// persistChecksums loads the on-disk cache at path and keeps it up to date
+// in the background.
+func persistChecksums(path string) {
+	if err := checksums.load(path); err != nil {
+		log.Printf("Ignoring checksum cache: %v", err)
+	}
+	go func() {
+		for range time.Tick(checksumSaveInterval) {
+			if err := checksums.save(path); err != nil {
+				log.Printf("Error saving checksum cache: %v", err)
+			}
+		}
+	}()
+}
+
+// handleManifest writes one "<sha256>  <name>" line, in sha256sum format,
+// for every file below dir (default: the working directory). Lines are sent
+// as each file is hashed.
+func handleManifest(ctx context.Context, sess *clientSession, stream quic.Stream, dir string) {
+	files := 0
+	err := walkStoredFiles(ctx, sess, dir, func(name, rel string) error {
+		unlock := fileLocks.rlock(rel)
+		sum, err := checksums.sum(ctx, rel)
+		unlock()
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err != nil {
+			logf(stream, "Manifest: skipping %s: %v", name, err)
+			return nil
+		}
+		files++
+		_, err = stream.Write([]byte(sum + "  " + name + "\n"))
+		return err
+	})
+	if err != nil {
+		logf(stream, "Manifest of %q stopped: %v", dir, err)
+		stream.Write([]byte("Error: " + storageReason(err, err.Error()) + "\n"))
+		return
+	}
+	printf(stream, "Sent manifest of %d files\n", files)
+}
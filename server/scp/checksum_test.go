@@ -0,0 +1,44 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// BenchmarkManifestCached runs manifest over 32 files of 1 MiB, with the
+// checksum cache warm as it is for repeated calls, and with it emptied
+// before every call so each one hashes every file again.
+func BenchmarkManifestCached(b *testing.B) {
+	const files, size = 32, 1 << 20
+	cfg := testSettings(b)
+	for i := range files {
+		if err := os.WriteFile(filepath.Join(cfg.Storage, fmt.Sprintf("file%02d.bin", i)), randomBytes(b, size), 0o644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	conn := dialTest(b, startServer(b, cfg))
+	manifest := func(b *testing.B) {
+		if reply := exchange(b, conn, "manifest", nil); strings.Count(reply, "\n") != files {
+			b.Fatalf("manifest: %q", reply)
+		}
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		manifest(b)
+		b.SetBytes(files * size)
+		b.ResetTimer()
+		for range b.N {
+			manifest(b)
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.SetBytes(files * size)
+		for range b.N {
+			checksums = newChecksumCache()
+			manifest(b)
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package scp
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Application error codes a connection is closed with, so that the client
+// can tell, from the *quic.ApplicationError it gets, why it was
+// disconnected. The client keeps the same table:
+//
+//	code  name              meaning
+//	0     errCodeNone       closed normally, by whichever side was done
+//	1     errCodeKicked     an admin disconnected the client; the message is
+//	                        the reason they gave
+//	2     errCodeShutdown   the server is shutting down
+//	3     errCodeThrottled  the client's address opened more connections
+//	                        than -conn-rate allows
+//
+// Codes are never reused for a different meaning; new ones are added at the
+// end.
+const (
+	errCodeNone      quic.ApplicationErrorCode = 0
+	errCodeKicked    quic.ApplicationErrorCode = 1
+	errCodeShutdown  quic.ApplicationErrorCode = 2
+	errCodeThrottled quic.ApplicationErrorCode = 3
+)
+
+// shutdownOnSignal closes s when the server gets SIGINT or SIGTERM.
+func shutdownOnSignal(s *Server) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		log.Printf("Received %v, shutting down", sig)
+		s.Close()
+	}()
+}
@@ -0,0 +1,54 @@
+package scp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// commandReadTimeout is how long a client has to send the command line
+// that starts a stream, however many packets it arrives in.
+const commandReadTimeout = 10 * time.Second
+
+// minCommandLength is the smallest max_command_length allowed, which still
+// fits any single-file command.
+const minCommandLength = 1024
+
+var (
+	errCommandTooLong    = errors.New("command too long")
+	errCommandIncomplete = errors.New("stream closed before the end of the command line")
+)
+
+// readCommand reads the newline-terminated command line from reader, which
+// reads stream. It gives up after commandReadTimeout or once the line is
+// longer than limit bytes, newline included, so a client cannot make the
+// server buffer an endless one. A stream that ends part way through a line
+// is an error rather than a short command, and one closed before sending
+// anything returns io.EOF. The read deadline is cleared again before
+// returning, so that it does not carry over into the transfer that follows.
+func readCommand(stream quic.Stream, reader *bufio.Reader, limit int) (string, error) {
+	stream.SetReadDeadline(time.Now().Add(commandReadTimeout))
+	defer stream.SetReadDeadline(time.Time{})
+
+	var line []byte
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > limit {
+			return "", errCommandTooLong
+		}
+		switch {
+		case err == nil:
+			return string(line), nil
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case errors.Is(err, io.EOF) && len(line) > 0:
+			return "", errCommandIncomplete
+		default:
+			return "", err
+		}
+	}
+}
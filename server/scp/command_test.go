@@ -0,0 +1,77 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestCommandLengthLimit(t *testing.T) {
+	cfg := testSettings(t)
+	cfg.MaxCommandLength = minCommandLength
+	conn := dialTest(t, startServer(t, cfg))
+	for _, tc := range []struct {
+		name    string
+		command string
+		want    string // prefix of the reply
+	}{
+		// "ls --filter=" and the newline take 13 of the limit
+		{"at the limit", "ls --filter=" + strings.Repeat("x", minCommandLength-13), "No files available."},
+		{"one byte over", "ls --filter=" + strings.Repeat("x", minCommandLength-12), "Error: command too long"},
+		{"far over", "ls --filter=" + strings.Repeat("x", 100*minCommandLength), "Error: command too long"},
+		{"incomplete", "", "Error: incomplete command"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			line := tc.command + "\n"
+			if tc.command == "" {
+				line = "ls"
+			}
+			stream := openTestStream(t, conn)
+			stream.Write([]byte(line))
+			stream.Close()
+			reply, _ := io.ReadAll(stream)
+			if !strings.HasPrefix(string(reply), tc.want) {
+				t.Errorf("%d bytes: got %.60q, want %q", len(line), reply, tc.want)
+			}
+		})
+	}
+}
+
+// TestEndlessCommandRejected streams a command line that never ends. The
+// server must refuse it as soon as it passes the limit and stop reading,
+// rather than buffer it all.
+func TestEndlessCommandRejected(t *testing.T) {
+	cfg := testSettings(t)
+	conn := dialTest(t, startServer(t, cfg))
+	stream := openTestStream(t, conn)
+
+	const budget = 1 << 30
+	sent := make(chan int64, 1)
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 64<<10)
+		var n int64
+		for n < budget {
+			if _, err := stream.Write(chunk); err != nil {
+				break
+			}
+			n += int64(len(chunk))
+		}
+		sent <- n
+	}()
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	if string(reply) != "Error: command too long\n" {
+		t.Errorf("got %.60q, want the command refused as too long", reply)
+	}
+	n := <-sent
+	var streamErr *quic.StreamError
+	if _, err := stream.Write([]byte("x")); !errors.As(err, &streamErr) || n >= budget {
+		t.Errorf("the server was still reading after %d bytes", n)
+	}
+}
@@ -0,0 +1,40 @@
+package scp
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/quic-go/quic-go"
+)
+
+// supportedCodecs lists the upload compression algorithms the server can
+// decode, in order of preference. Clients ask for it with "codecs".
+var supportedCodecs = []string{"zstd", "gzip"}
+
+// handleCodecs answers the client's capability query.
+func handleCodecs(stream quic.Stream) {
+	stream.Write([]byte(strings.Join(supportedCodecs, " ") + "\n"))
+}
+
+// newDecoder wraps r, an upload body sent with the codec named in its
+// header, so that reading it yields the original file. An empty codec means
+// the body was sent as is. The decoder must be closed once the upload is
+// done with it.
+func newDecoder(codec string, r io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case "":
+		return io.NopCloser(r), nil
+	case "gzip":
+		return gzip.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", codec)
+}
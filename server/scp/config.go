@@ -0,0 +1,528 @@
+package scp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// settings holds every server option. Each one can be set by a flag or in
+// the -config file; flags given explicitly on the command line win.
+//
+// The active value is replaced wholesale on SIGHUP. Handlers load it once
+// when a command starts, so an in-flight transfer finishes under the settings
+// it began with. The settings in startupOnly are only read at startup; the
+// certificate files are re-read on SIGHUP from the paths the server started
+// with.
+type settings struct {
+	Addr     string `json:"addr" yaml:"addr"`
+	Storage  string `json:"storage" yaml:"storage"`
+	CertFile string `json:"cert" yaml:"cert"`
+	KeyFile  string `json:"key" yaml:"key"`
+	AuditLog string `json:"audit_log" yaml:"audit_log"`
+
+	MaxFileSize int64    `json:"max_file_size" yaml:"max_file_size"`
+	ServerRate  int64    `json:"server_rate" yaml:"server_rate"`
+	AdminToken  string   `json:"admin_token" yaml:"admin_token"`
+	TokensFile  string   `json:"tokens_file" yaml:"tokens_file"`
+	TransferTTL duration `json:"transfer_ttl" yaml:"transfer_ttl"`
+
+	// Anonymous is what a client may do before it logs in with a token:
+	// read-write by default, as before tokens carried permissions, or
+	// read-only or none to make the tokens the only way in.
+	Anonymous permission `json:"anonymous" yaml:"anonymous"`
+
+	TransferTimeout duration `json:"transfer_timeout" yaml:"transfer_timeout"`
+	CommandTimeout  duration `json:"command_timeout" yaml:"command_timeout"`
+	WriteRetries    int      `json:"write_retries" yaml:"write_retries"`
+	ScanCmd         string   `json:"scan_cmd" yaml:"scan_cmd"`
+	TempDir         string   `json:"temp_dir" yaml:"temp_dir"`
+	ChecksumCache   string   `json:"checksum_cache" yaml:"checksum_cache"`
+	StorageKeyFile  string   `json:"storage_key_file" yaml:"storage_key_file"`
+	FindMaxDepth    int      `json:"find_max_depth" yaml:"find_max_depth"`
+	FindMaxResults  int      `json:"find_max_results" yaml:"find_max_results"`
+	Backup          bool     `json:"backup" yaml:"backup"`
+	BackupKeep      int      `json:"backup_keep" yaml:"backup_keep"`
+	Versions        int      `json:"versions" yaml:"versions"`
+	BenchMaxBytes   int64    `json:"bench_max_bytes" yaml:"bench_max_bytes"`
+	DownloadStreams int      `json:"download_streams" yaml:"download_streams"`
+
+	MaxCommandLength int `json:"max_command_length" yaml:"max_command_length"`
+
+	// FileMode and DirMode are the permissions stored files and the
+	// directories holding them are created with, before the process umask.
+	// Uploads come from remote clients, so by default only the server's
+	// own user may change them: other local users who could write to
+	// storage could replace what the next client downloads.
+	FileMode fileMode `json:"file_mode" yaml:"file_mode"`
+	DirMode  fileMode `json:"dir_mode" yaml:"dir_mode"`
+
+	// TLSMinVersion and TLSCurves constrain the handshake: the lowest TLS
+	// version accepted, and the key exchange groups offered, most
+	// preferred first, empty for crypto/tls's defaults.
+	TLSMinVersion string `json:"tls_min_version" yaml:"tls_min_version"`
+	TLSCurves     string `json:"tls_curves" yaml:"tls_curves"`
+
+	// MaxIncomingStreams caps the streams one connection may have open at
+	// once; it bounds the handler goroutines a client can start. A client
+	// past the limit is not refused, its next stream simply waits until one
+	// of the open ones ends. MaxIncomingUniStreams does the same for
+	// unidirectional streams, which no command uses, so 0 refuses them.
+	MaxIncomingStreams    int `json:"max_incoming_streams" yaml:"max_incoming_streams"`
+	MaxIncomingUniStreams int `json:"max_incoming_uni_streams" yaml:"max_incoming_uni_streams"`
+
+	// InitialConnWindow and MaxConnWindow bound how many bytes a client may
+	// have in flight to the server across all of a connection's streams.
+	// quic-go starts the window at the initial size and grows it, up to the
+	// maximum, as the connection keeps it full. On a link with a large
+	// bandwidth-delay product a small maximum, not the bandwidth, is what
+	// limits an upload; the default leaves room for -download-streams
+	// streams each using their full stream window of 6 MiB.
+	InitialConnWindow int64 `json:"initial_conn_window" yaml:"initial_conn_window"`
+	MaxConnWindow     int64 `json:"max_conn_window" yaml:"max_conn_window"`
+
+	// NoMTUDiscovery keeps packets at QUIC's minimum size of about 1200
+	// bytes instead of probing for the largest the path carries. On some
+	// networks, often through VPNs or tunnels, larger packets get through
+	// for a while and then are dropped without any error; that shows as
+	// transfers that stall or crawl after a good start.
+	NoMTUDiscovery bool `json:"no_mtu_discovery" yaml:"no_mtu_discovery"`
+
+	// UDPBuffer is the receive and send buffer size asked for on the UDP
+	// socket. The system may allow less, and buffers too small for the
+	// link's bandwidth lose packets in bursts; the server then logs the
+	// command that raises the limit. Verbose logs the sizes obtained even
+	// when they are large enough, and quic-go's own warning besides.
+	UDPBuffer int64 `json:"udp_buffer" yaml:"udp_buffer"`
+	Verbose   bool  `json:"verbose" yaml:"verbose"`
+
+	AcceptWorkers int `json:"accept_workers" yaml:"accept_workers"`
+
+	// ConnRate is how many new connections a minute one source IP may
+	// open, after a burst of up to ConnBurst; 0 turns the limit off.
+	ConnRate  int `json:"conn_rate" yaml:"conn_rate"`
+	ConnBurst int `json:"conn_burst" yaml:"conn_burst"`
+
+	Volumes volumeMap `json:"volumes" yaml:"volumes"`
+
+	bandwidth *bandwidthScheduler // nil when ServerRate is 0
+	tokens    []accessToken       // read from TokensFile with the rest of the settings
+}
+
+func (s *settings) String() string {
+	token := "unset"
+	if s.AdminToken != "" {
+		token = "set"
+	}
+	return fmt.Sprintf("addr=%s storage=%s cert=%s key=%s audit-log=%q max-file-size=%d server-rate=%d admin-token=%s tokens-file=%q anonymous=%s transfer-ttl=%s transfer-timeout=%s command-timeout=%s write-retries=%d scan-cmd=%q temp-dir=%q checksum-cache=%q storage-key-file=%q find-max-depth=%d find-max-results=%d backup=%t backup-keep=%d versions=%d bench-max-bytes=%d download-streams=%d max-command-length=%d file-mode=%s dir-mode=%s tls-min-version=%s tls-curves=%q max-incoming-streams=%d max-incoming-uni-streams=%d initial-conn-window=%d max-conn-window=%d no-mtu-discovery=%t udp-buffer=%d verbose=%t accept-workers=%d conn-rate=%d conn-burst=%d volumes=%s",
+		s.Addr, s.Storage, s.CertFile, s.KeyFile, s.AuditLog, s.MaxFileSize, s.ServerRate, token, s.TokensFile, s.Anonymous, &s.TransferTTL, &s.TransferTimeout, &s.CommandTimeout, s.WriteRetries, s.ScanCmd, s.TempDir, s.ChecksumCache, s.StorageKeyFile, s.FindMaxDepth, s.FindMaxResults, s.Backup, s.BackupKeep, s.Versions, s.BenchMaxBytes, s.DownloadStreams, s.MaxCommandLength, &s.FileMode, &s.DirMode, s.TLSMinVersion, s.TLSCurves, s.MaxIncomingStreams, s.MaxIncomingUniStreams, s.InitialConnWindow, s.MaxConnWindow, s.NoMTUDiscovery, s.UDPBuffer, s.Verbose, s.AcceptWorkers, s.ConnRate, s.ConnBurst, &s.Volumes)
+}
+
+// validate reports the first setting that cannot work.
+func (s *settings) validate() error {
+	if _, _, err := net.SplitHostPort(s.Addr); err != nil {
+		return fmt.Errorf("addr %q: %v", s.Addr, err)
+	}
+	if s.Storage == "" {
+		return errors.New("storage must not be empty")
+	}
+	for name, dir := range s.Volumes {
+		if !validVolumeName(name) {
+			return fmt.Errorf("volume name %q must be a single path element without ':'", name)
+		}
+		if dir == "" {
+			return fmt.Errorf("volume %s needs a directory", name)
+		}
+	}
+	if s.CertFile == "" || s.KeyFile == "" {
+		return errors.New("cert and key must both be set")
+	}
+	if _, err := parseTLSVersion(s.TLSMinVersion); err != nil {
+		return fmt.Errorf("tls_min_version: %v", err)
+	}
+	if _, err := parseTLSCurves(s.TLSCurves); err != nil {
+		return fmt.Errorf("tls_curves: %v", err)
+	}
+	if s.MaxFileSize < 0 {
+		return fmt.Errorf("max_file_size must not be negative, got %d", s.MaxFileSize)
+	}
+	if s.ServerRate < 0 {
+		return fmt.Errorf("server_rate must not be negative, got %d", s.ServerRate)
+	}
+	// The server itself has to be able to rewrite what it stores and create
+	// files in the directories it makes.
+	if s.FileMode&0o600 != 0o600 {
+		return fmt.Errorf("file_mode %s must let the owner read and write", &s.FileMode)
+	}
+	if s.DirMode&0o700 != 0o700 {
+		return fmt.Errorf("dir_mode %s must give the owner full access", &s.DirMode)
+	}
+	if s.TransferTTL <= 0 {
+		return fmt.Errorf("transfer_ttl must be positive, got %s", &s.TransferTTL)
+	}
+	if s.ScanCmd != "" && strings.TrimSpace(s.ScanCmd) == "" {
+		return errors.New("scan_cmd must name a command")
+	}
+	if s.ScanCmd != "" && (s.StorageKeyFile != "" || storageKey != nil) {
+		// The scanner would only ever see ciphertext. The loaded key counts
+		// too, since a reload cannot drop it.
+		return errors.New("scan_cmd cannot be combined with storage_key_file")
+	}
+	if s.TransferTimeout < 0 {
+		return fmt.Errorf("transfer_timeout must not be negative, got %s", &s.TransferTimeout)
+	}
+	if s.CommandTimeout < 0 {
+		return fmt.Errorf("command_timeout must not be negative, got %s", &s.CommandTimeout)
+	}
+	if s.WriteRetries < 0 {
+		return fmt.Errorf("write_retries must not be negative, got %d", s.WriteRetries)
+	}
+	if s.FindMaxDepth < 0 {
+		return fmt.Errorf("find_max_depth must not be negative, got %d", s.FindMaxDepth)
+	}
+	if s.FindMaxResults < 1 {
+		return fmt.Errorf("find_max_results must be at least 1, got %d", s.FindMaxResults)
+	}
+	if s.BackupKeep < 0 {
+		return fmt.Errorf("backup_keep must not be negative, got %d", s.BackupKeep)
+	}
+	if s.Versions < 0 {
+		return fmt.Errorf("versions must not be negative, got %d", s.Versions)
+	}
+	if s.BenchMaxBytes < 0 {
+		return fmt.Errorf("bench_max_bytes must not be negative, got %d", s.BenchMaxBytes)
+	}
+	if s.DownloadStreams < 1 {
+		return fmt.Errorf("download_streams must be at least 1, got %d", s.DownloadStreams)
+	}
+	if s.MaxIncomingStreams < 1 {
+		return fmt.Errorf("max_incoming_streams must be at least 1, got %d", s.MaxIncomingStreams)
+	}
+	if s.DownloadStreams > s.MaxIncomingStreams {
+		// A parallel batch would wait on its own streams.
+		return fmt.Errorf("download_streams (%d) must not exceed max_incoming_streams (%d)", s.DownloadStreams, s.MaxIncomingStreams)
+	}
+	if s.MaxIncomingUniStreams < 0 {
+		return fmt.Errorf("max_incoming_uni_streams must not be negative, got %d", s.MaxIncomingUniStreams)
+	}
+	if s.InitialConnWindow < 1 {
+		return fmt.Errorf("initial_conn_window must be at least 1, got %d", s.InitialConnWindow)
+	}
+	if s.MaxConnWindow < s.InitialConnWindow {
+		return fmt.Errorf("max_conn_window must be at least initial_conn_window (%d), got %d", s.InitialConnWindow, s.MaxConnWindow)
+	}
+	if s.UDPBuffer < minUDPBuffer {
+		return fmt.Errorf("udp_buffer must be at least %d, what quic-go asks for itself, got %d", minUDPBuffer, s.UDPBuffer)
+	}
+	if s.AcceptWorkers < 1 {
+		return fmt.Errorf("accept_workers must be at least 1, got %d", s.AcceptWorkers)
+	}
+	if s.Anonymous == permAdmin {
+		return errors.New("anonymous cannot be admin")
+	}
+	if s.ConnRate < 0 {
+		return fmt.Errorf("conn_rate must not be negative, got %d", s.ConnRate)
+	}
+	if s.ConnRate > 0 && s.ConnBurst < 1 {
+		return fmt.Errorf("conn_burst must be at least 1, got %d", s.ConnBurst)
+	}
+	if s.MaxCommandLength < minCommandLength {
+		return fmt.Errorf("max_command_length must be at least %d, got %d", minCommandLength, s.MaxCommandLength)
+	}
+	if s.Backup && s.Versions > 0 {
+		return errors.New("backup and versions cannot both be enabled")
+	}
+	return nil
+}
+
+// duration is a time.Duration that config files and flags spell like "24h".
+type duration time.Duration
+
+func (d *duration) String() string { return time.Duration(*d).String() }
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalText(text []byte) error { return d.Set(string(text)) }
+
+func (d duration) MarshalText() ([]byte, error) { return []byte(time.Duration(d).String()), nil }
+
+// fileMode is a set of permission bits that config files and flags spell in
+// octal, like "0644".
+type fileMode os.FileMode
+
+func (m *fileMode) String() string { return fmt.Sprintf("%04o", uint32(*m)) }
+
+func (m *fileMode) Set(s string) error {
+	v, err := strconv.ParseUint(strings.TrimPrefix(s, "0o"), 8, 32)
+	if err != nil || v > uint64(os.ModePerm) {
+		return fmt.Errorf("%q is not an octal permission mode such as 0644", s)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
+func (m *fileMode) UnmarshalText(text []byte) error { return m.Set(string(text)) }
+
+func (m fileMode) MarshalText() ([]byte, error) { return []byte(m.String()), nil }
+
+func (m fileMode) perm() os.FileMode { return os.FileMode(m) }
+
+var (
+	// flagSettings receives the command-line values.
+	flagSettings settings
+	// configPath is the optional YAML or JSON file re-read on SIGHUP.
+	configPath string
+
+	activeSettings atomic.Pointer[settings]
+)
+
+// settingFlags copies each flag's value from src to dst, keyed by flag name,
+// so flags given on the command line can be laid over the config file.
+var settingFlags = map[string]func(dst, src *settings){
+	"addr":                     func(dst, src *settings) { dst.Addr = src.Addr },
+	"storage":                  func(dst, src *settings) { dst.Storage = src.Storage },
+	"volume":                   func(dst, src *settings) { dst.Volumes = src.Volumes },
+	"cert":                     func(dst, src *settings) { dst.CertFile = src.CertFile },
+	"key":                      func(dst, src *settings) { dst.KeyFile = src.KeyFile },
+	"audit-log":                func(dst, src *settings) { dst.AuditLog = src.AuditLog },
+	"max-file-size":            func(dst, src *settings) { dst.MaxFileSize = src.MaxFileSize },
+	"server-rate":              func(dst, src *settings) { dst.ServerRate = src.ServerRate },
+	"admin-token":              func(dst, src *settings) { dst.AdminToken = src.AdminToken },
+	"tokens-file":              func(dst, src *settings) { dst.TokensFile = src.TokensFile },
+	"anonymous":                func(dst, src *settings) { dst.Anonymous = src.Anonymous },
+	"transfer-ttl":             func(dst, src *settings) { dst.TransferTTL = src.TransferTTL },
+	"transfer-timeout":         func(dst, src *settings) { dst.TransferTimeout = src.TransferTimeout },
+	"command-timeout":          func(dst, src *settings) { dst.CommandTimeout = src.CommandTimeout },
+	"write-retries":            func(dst, src *settings) { dst.WriteRetries = src.WriteRetries },
+	"scan-cmd":                 func(dst, src *settings) { dst.ScanCmd = src.ScanCmd },
+	"temp-dir":                 func(dst, src *settings) { dst.TempDir = src.TempDir },
+	"checksum-cache":           func(dst, src *settings) { dst.ChecksumCache = src.ChecksumCache },
+	"storage-key-file":         func(dst, src *settings) { dst.StorageKeyFile = src.StorageKeyFile },
+	"find-max-depth":           func(dst, src *settings) { dst.FindMaxDepth = src.FindMaxDepth },
+	"find-max-results":         func(dst, src *settings) { dst.FindMaxResults = src.FindMaxResults },
+	"backup":                   func(dst, src *settings) { dst.Backup = src.Backup },
+	"backup-keep":              func(dst, src *settings) { dst.BackupKeep = src.BackupKeep },
+	"versions":                 func(dst, src *settings) { dst.Versions = src.Versions },
+	"bench-max-bytes":          func(dst, src *settings) { dst.BenchMaxBytes = src.BenchMaxBytes },
+	"download-streams":         func(dst, src *settings) { dst.DownloadStreams = src.DownloadStreams },
+	"max-command-length":       func(dst, src *settings) { dst.MaxCommandLength = src.MaxCommandLength },
+	"file-mode":                func(dst, src *settings) { dst.FileMode = src.FileMode },
+	"dir-mode":                 func(dst, src *settings) { dst.DirMode = src.DirMode },
+	"tls-min-version":          func(dst, src *settings) { dst.TLSMinVersion = src.TLSMinVersion },
+	"tls-curves":               func(dst, src *settings) { dst.TLSCurves = src.TLSCurves },
+	"max-incoming-streams":     func(dst, src *settings) { dst.MaxIncomingStreams = src.MaxIncomingStreams },
+	"max-incoming-uni-streams": func(dst, src *settings) { dst.MaxIncomingUniStreams = src.MaxIncomingUniStreams },
+	"initial-conn-window":      func(dst, src *settings) { dst.InitialConnWindow = src.InitialConnWindow },
+	"max-conn-window":          func(dst, src *settings) { dst.MaxConnWindow = src.MaxConnWindow },
+	"no-mtu-discovery":         func(dst, src *settings) { dst.NoMTUDiscovery = src.NoMTUDiscovery },
+	"udp-buffer":               func(dst, src *settings) { dst.UDPBuffer = src.UDPBuffer },
+	"verbose":                  func(dst, src *settings) { dst.Verbose = src.Verbose },
+	"accept-workers":           func(dst, src *settings) { dst.AcceptWorkers = src.AcceptWorkers },
+	"conn-rate":                func(dst, src *settings) { dst.ConnRate = src.ConnRate },
+	"conn-burst":               func(dst, src *settings) { dst.ConnBurst = src.ConnBurst },
+}
+
+func registerSettingFlags() {
+	flag.StringVar(&flagSettings.Addr, "addr", "0.0.0.0:4242", "UDP address to listen on")
+	flag.StringVar(&flagSettings.Storage, "storage", filepath.Join(".", "storage"), "directory files are stored in")
+	flag.Var(&flagSettings.Volumes, "volume", "additional storage root as name=path, addressed by clients as vol:name/ (repeatable)")
+	flag.StringVar(&flagSettings.CertFile, "cert", "cert.pem", "TLS certificate file")
+	flag.StringVar(&flagSettings.KeyFile, "key", "key.pem", "TLS private key file")
+	flag.StringVar(&flagSettings.AuditLog, "audit-log", "", "file that admin actions are appended to (default: server log)")
+	flag.Int64Var(&flagSettings.MaxFileSize, "max-file-size", 0, "maximum size of an uploaded file in bytes (0 = unlimited)")
+	flag.Int64Var(&flagSettings.ServerRate, "server-rate", 0, "total bandwidth shared by all transfers in bytes per second (0 = unlimited)")
+	flag.StringVar(&flagSettings.AdminToken, "admin-token", "", "token that grants access to admin commands (empty disables them)")
+	flag.StringVar(&flagSettings.TokensFile, "tokens-file", "", "file of login tokens, one per line as <token> [read-only|read-write|admin [<dir>]], re-read on SIGHUP; keeps them out of the process list")
+	flagSettings.Anonymous = permWrite
+	flag.Var(&flagSettings.Anonymous, "anonymous", "what clients that have not logged in may do: none, read-only or read-write")
+	flagSettings.TransferTTL = duration(24 * time.Hour)
+	flag.Var(&flagSettings.TransferTTL, "transfer-ttl", "how long an unfinished resumable upload is kept without activity")
+	flag.Var(&flagSettings.TransferTimeout, "transfer-timeout", "abort a transfer that makes no progress for this long (0 = never)")
+	flagSettings.CommandTimeout = duration(5 * time.Minute)
+	flag.IntVar(&flagSettings.WriteRetries, "write-retries", 1, "how many times a download that hit -transfer-timeout keeps going from where it stalled before giving up (not for -storage-key-file sealed files)")
+	flag.Var(&flagSettings.CommandTimeout, "command-timeout", "abort a listing, find or manifest that runs for longer than this (0 = never); transfers use -transfer-timeout")
+	flag.StringVar(&flagSettings.ScanCmd, "scan-cmd", "", "command run on each upload before it becomes visible; the file path is appended and a non-zero exit rejects the upload")
+	flag.StringVar(&flagSettings.TempDir, "temp-dir", "", "directory uploads are staged in before being moved into storage (default: inside storage)")
+	flag.StringVar(&flagSettings.ChecksumCache, "checksum-cache", "", "file the server's checksum cache is kept in across restarts (default: memory only)")
+	flag.StringVar(&flagSettings.StorageKeyFile, "storage-key-file", "", "file holding a 32-byte key (raw or hex) that stored files are encrypted with; keep it off the storage disk")
+	flag.IntVar(&flagSettings.FindMaxDepth, "find-max-depth", 16, "how many directory levels below the working directory find descends into")
+	flag.IntVar(&flagSettings.FindMaxResults, "find-max-results", 10000, "how many matches find returns before stopping")
+	flag.BoolVar(&flagSettings.Backup, "backup", false, "keep a file that an upload replaces as <name>.<timestamp>.bak")
+	flag.IntVar(&flagSettings.BackupKeep, "backup-keep", 0, "with -backup, how many backups of each file to keep, pruning the oldest (0 = all)")
+	flag.IntVar(&flagSettings.Versions, "versions", 0, "keep up to this many earlier versions of each file as <name>.v1, .v2, ... (0 = off)")
+	flag.Int64Var(&flagSettings.BenchMaxBytes, "bench-max-bytes", 1<<30, "largest transfer a client's bench command may ask for, in bytes (0 = bench disabled)")
+	flag.IntVar(&flagSettings.DownloadStreams, "download-streams", 4, "how many streams a client may split one download batch across")
+	flag.IntVar(&flagSettings.MaxCommandLength, "max-command-length", 64*1024, "longest command line a client may send, in bytes; longer ones are refused")
+	flagSettings.FileMode = 0o644
+	flag.Var(&flagSettings.FileMode, "file-mode", "permissions, in octal, that uploaded files are created with, before the umask")
+	flagSettings.DirMode = 0o755
+	flag.Var(&flagSettings.DirMode, "dir-mode", "permissions, in octal, that the storage directory and directories for uploads are created with, before the umask")
+	flag.StringVar(&flagSettings.TLSMinVersion, "tls-min-version", "1.3", "lowest TLS version a client may connect with (QUIC requires 1.3)")
+	flag.StringVar(&flagSettings.TLSCurves, "tls-curves", "", "comma-separated key exchange groups to offer, most preferred first: X25519, X25519MLKEM768, P256, P384, P521 (default: Go's)")
+	flag.IntVar(&flagSettings.MaxIncomingStreams, "max-incoming-streams", 100, "how many streams one client may have open at once; further ones wait until one ends")
+	flag.IntVar(&flagSettings.MaxIncomingUniStreams, "max-incoming-uni-streams", 0, "how many unidirectional streams one client may have open at once (0 = none, no command uses them)")
+	flag.Int64Var(&flagSettings.InitialConnWindow, "initial-conn-window", 768<<10, "bytes a client may have in flight to the server across a connection before the server lets it send more, at first")
+	flag.Int64Var(&flagSettings.MaxConnWindow, "max-conn-window", 24<<20, "bytes the connection flow control window may grow to; raise it for uploads over fast links with a long round trip")
+	flag.BoolVar(&flagSettings.NoMTUDiscovery, "no-mtu-discovery", false, "do not probe for packets larger than QUIC's minimum; try it if transfers stall on some networks")
+	flag.Int64Var(&flagSettings.UDPBuffer, "udp-buffer", minUDPBuffer, "receive and send buffer size, in bytes, to ask for on the UDP socket; a warning says how to raise the system limit if it is lower")
+	flag.BoolVar(&flagSettings.Verbose, "verbose", false, "log the UDP buffer sizes obtained at startup, and quic-go's own warnings about them")
+	flag.IntVar(&flagSettings.AcceptWorkers, "accept-workers", 1, "how many goroutines accept new connections at once")
+	flag.IntVar(&flagSettings.ConnRate, "conn-rate", 60, "new connections a minute one IP address may open before further ones are refused (0 for no limit)")
+	flag.IntVar(&flagSettings.ConnBurst, "conn-burst", 20, "how many connections one IP address may open at once before -conn-rate applies")
+	flag.StringVar(&configPath, "config", "", "YAML (.yaml, .yml) or JSON file with server settings, re-read on SIGHUP")
+}
+
+func currentSettings() *settings {
+	return activeSettings.Load()
+}
+
+// loadSettings builds the effective settings: flag defaults, then the config
+// file, then any flags set explicitly on the command line.
+func loadSettings() (*settings, error) {
+	cfg := flagSettings
+	// Decoding a map fills in the one already there, which would be the
+	// flags' own and, through volumes, the running server's.
+	cfg.Volumes = maps.Clone(flagSettings.Volumes)
+	if configPath != "" {
+		if err := decodeConfigFile(configPath, &cfg); err != nil {
+			return nil, err
+		}
+		flag.Visit(func(f *flag.Flag) {
+			if apply, ok := settingFlags[f.Name]; ok {
+				apply(&cfg, &flagSettings)
+			}
+		})
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid settings: %w", err)
+	}
+	if cfg.TokensFile != "" {
+		tokens, err := readTokens(cfg.TokensFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.tokens = tokens
+	}
+
+	// Keep the running scheduler if the rate is unchanged, so the transfers
+	// already sharing it stay in one queue.
+	if prev := currentSettings(); prev != nil && prev.ServerRate == cfg.ServerRate {
+		cfg.bandwidth = prev.bandwidth
+	} else if cfg.ServerRate > 0 {
+		cfg.bandwidth = newBandwidthScheduler(cfg.ServerRate)
+	}
+	return &cfg, nil
+}
+
+// decodeConfigFile overlays the settings in path onto cfg. Only the keys
+// present in the file are changed; unknown keys are an error.
+func decodeConfigFile(path string, cfg *settings) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		err = dec.Decode(cfg)
+		if errors.Is(err, io.EOF) {
+			err = nil // empty file
+		}
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(cfg)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// reloadOnHangup re-reads the settings and the TLS certificate every time
+// the process receives SIGHUP.
+func reloadOnHangup(certs *certificateStore) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			if cfg, err := loadSettings(); err != nil {
+				log.Printf("Config reload failed, keeping previous settings: %v", err)
+			} else {
+				warnStartupOnly(currentSettings(), cfg)
+				activeSettings.Store(cfg)
+				log.Printf("Config reloaded: %s", cfg)
+			}
+			if err := certs.reload(); err != nil {
+				log.Printf("Certificate reload failed, keeping previous certificate: %v", err)
+			} else {
+				log.Printf("Certificate reloaded")
+			}
+		}
+	}()
+}
+
+// startupOnly are the settings, by their config file names, that a reload
+// cannot apply: they set up the listener, the storage and the state kept
+// beside it, which only happen once.
+var startupOnly = []struct {
+	name    string
+	changed func(prev, next *settings) bool
+}{
+	{"addr", func(prev, next *settings) bool { return prev.Addr != next.Addr }},
+	{"storage", func(prev, next *settings) bool { return prev.Storage != next.Storage }},
+	{"volumes", func(prev, next *settings) bool { return !maps.Equal(prev.Volumes, next.Volumes) }},
+	{"audit_log", func(prev, next *settings) bool { return prev.AuditLog != next.AuditLog }},
+	{"temp_dir", func(prev, next *settings) bool { return prev.TempDir != next.TempDir }},
+	{"checksum_cache", func(prev, next *settings) bool { return prev.ChecksumCache != next.ChecksumCache }},
+	{"storage_key_file", func(prev, next *settings) bool { return prev.StorageKeyFile != next.StorageKeyFile }},
+	{"max_incoming_streams", func(prev, next *settings) bool { return prev.MaxIncomingStreams != next.MaxIncomingStreams }},
+	{"max_incoming_uni_streams", func(prev, next *settings) bool { return prev.MaxIncomingUniStreams != next.MaxIncomingUniStreams }},
+	{"initial_conn_window", func(prev, next *settings) bool { return prev.InitialConnWindow != next.InitialConnWindow }},
+	{"max_conn_window", func(prev, next *settings) bool { return prev.MaxConnWindow != next.MaxConnWindow }},
+	{"no_mtu_discovery", func(prev, next *settings) bool { return prev.NoMTUDiscovery != next.NoMTUDiscovery }},
+	{"udp_buffer", func(prev, next *settings) bool { return prev.UDPBuffer != next.UDPBuffer }},
+	{"verbose", func(prev, next *settings) bool { return prev.Verbose != next.Verbose }},
+	{"accept_workers", func(prev, next *settings) bool { return prev.AcceptWorkers != next.AcceptWorkers }},
+	{"tls_min_version", func(prev, next *settings) bool { return prev.TLSMinVersion != next.TLSMinVersion }},
+	{"tls_curves", func(prev, next *settings) bool { return prev.TLSCurves != next.TLSCurves }},
+	{"cert", func(prev, next *settings) bool { return prev.CertFile != next.CertFile }},
+	{"key", func(prev, next *settings) bool { return prev.KeyFile != next.KeyFile }},
+}
+
+// warnStartupOnly logs the changed settings that a reload cannot apply.
+func warnStartupOnly(prev, next *settings) {
+	var changed []string
+	for _, s := range startupOnly {
+		if s.changed(prev, next) {
+			changed = append(changed, s.name)
+		}
+	}
+	if len(changed) > 0 {
+		log.Printf("%s: changes take effect after a restart", strings.Join(changed, ", "))
+	}
+}
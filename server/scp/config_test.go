@@ -0,0 +1,54 @@
+package scp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestStartupOnlyNames checks that every entry of startupOnly names a
+// config file key, once, and reports a change to that setting alone.
+func TestStartupOnlyNames(t *testing.T) {
+	fields := make(map[string]int) // field index by json key
+	typ := reflect.TypeFor[settings]()
+	for i := range typ.NumField() {
+		if key, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ","); key != "" && key != "-" {
+			fields[key] = i
+		}
+	}
+	seen := make(map[string]bool)
+	for _, s := range startupOnly {
+		i, ok := fields[s.name]
+		if !ok {
+			t.Errorf("%s is not a config file key", s.name)
+			continue
+		}
+		if seen[s.name] {
+			t.Errorf("%s is listed twice", s.name)
+		}
+		seen[s.name] = true
+
+		prev, next := testSettings(t), testSettings(t)
+		next.CertFile, next.KeyFile, next.Storage = prev.CertFile, prev.KeyFile, prev.Storage
+		changeField(reflect.ValueOf(next).Elem().Field(i))
+		for _, other := range startupOnly {
+			if got := other.changed(prev, next); got != (other.name == s.name) {
+				t.Errorf("changing %s: %s reports changed %t", s.name, other.name, got)
+			}
+		}
+	}
+}
+
+// changeField sets v to a value other than the one it has.
+func changeField(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(v.String() + "x")
+	case reflect.Bool:
+		v.SetBool(!v.Bool())
+	case reflect.Int, reflect.Int64:
+		v.SetInt(v.Int() + 1)
+	case reflect.Map:
+		v.Set(reflect.ValueOf(volumeMap{"changed": "/elsewhere"}))
+	}
+}
@@ -0,0 +1,101 @@
+package scp
+
+import (
+	"container/list"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// maxConnBuckets bounds how many source addresses the connection limiter
+// remembers. Beyond it the least recently seen address is forgotten, and
+// starts again with a full bucket if it comes back.
+const maxConnBuckets = 10000
+
+// connBucket is the token bucket of one source address. It holds up to
+// -conn-burst tokens and gains -conn-rate of them a minute; every new
+// connection takes one.
+type connBucket struct {
+	ip      string
+	tokens  float64
+	last    time.Time // when tokens was last brought up to date
+	refused int       // connections refused since the address was throttled
+}
+
+// connLimiter limits how often each source address may connect, so that one
+// host cannot keep the server busy with handshakes and sessions it opens
+// and abandons.
+type connLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*list.Element // of *connBucket
+	order   *list.List               // front is most recently seen
+}
+
+var connLimits = newConnLimiter()
+
+func newConnLimiter() *connLimiter {
+	return &connLimiter{buckets: make(map[string]*list.Element), order: list.New()}
+}
+
+// allow takes a token from ip's bucket, reporting whether there was one.
+// refused is how many connections from ip had been refused before this
+// one: on a refusal 0 means the address has just been throttled, and on an
+// allowed connection more than 0 means it no longer is.
+func (l *connLimiter) allow(ip string, perMinute, burst int) (ok bool, refused int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	var b *connBucket
+	if el, found := l.buckets[ip]; found {
+		b = el.Value.(*connBucket)
+		l.order.MoveToFront(el)
+		b.tokens = min(float64(burst), b.tokens+now.Sub(b.last).Minutes()*float64(perMinute))
+	} else {
+		b = &connBucket{ip: ip, tokens: float64(burst)}
+		l.buckets[ip] = l.order.PushFront(b)
+		for l.order.Len() > maxConnBuckets {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.buckets, oldest.Value.(*connBucket).ip)
+		}
+	}
+	b.last = now
+	refused = b.refused
+	if b.tokens < 1 {
+		b.refused++
+		return false, refused
+	}
+	b.tokens--
+	b.refused = 0
+	return true, refused
+}
+
+// admitSession reports whether session's source address is still within
+// -conn-rate, and closes the session with errCodeThrottled if it is not.
+// quic-go hands over a connection only once its handshake is done, so this
+// cannot save the cost of the handshake itself, only that of everything
+// the session would have gone on to do.
+func admitSession(session quic.Connection) bool {
+	cfg := currentSettings()
+	if cfg.ConnRate == 0 {
+		return true
+	}
+	ip := session.RemoteAddr().String()
+	if addr, ok := session.RemoteAddr().(*net.UDPAddr); ok {
+		ip = addr.IP.String()
+	}
+	ok, refused := connLimits.allow(ip, cfg.ConnRate, cfg.ConnBurst)
+	switch {
+	case !ok && refused == 0:
+		log.Printf("Throttling connections from %s: more than %d a minute", ip, cfg.ConnRate)
+	case ok && refused > 0:
+		log.Printf("No longer throttling %s; refused %d connections", ip, refused)
+	}
+	if !ok {
+		session.CloseWithError(errCodeThrottled, "too many connections from this address, try again later")
+	}
+	return ok
+}
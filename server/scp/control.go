@@ -0,0 +1,52 @@
+package scp
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// streamCancelled is the stream error code clients reset a stream with when
+// the user aborts a transfer; the server uses it too when a cancel arrives
+// as a datagram.
+const streamCancelled quic.StreamErrorCode = 1
+
+// serveControl answers the control datagrams of one session until it ends.
+// Datagrams are unreliable and fit in a single packet, so they carry only
+// short text messages whose loss is harmless:
+//
+//	ping <token>     answered with "pong <token>"
+//	cancel <stream>  aborts the command on that stream, like a reset
+//
+// Without datagram support the client falls back to the "ping" command and
+// to resetting streams.
+func serveControl(sess *clientSession) {
+	if !sess.conn.ConnectionState().SupportsDatagrams {
+		return
+	}
+	ctx := sess.conn.Context()
+	for {
+		msg, err := sess.conn.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(strings.TrimSpace(string(msg)), " ")
+		switch verb {
+		case "ping":
+			sess.conn.SendDatagram([]byte(strings.TrimSpace("pong " + arg)))
+		case "cancel":
+			id, err := strconv.ParseInt(arg, 10, 64)
+			if err != nil {
+				continue
+			}
+			if sess.cancelStream(quic.StreamID(id)) {
+				fmt.Printf("Cancelled stream %d from %s on request\n", id, sess.addr())
+			}
+		default:
+			log.Printf("Ignoring control datagram %q from %s", msg, sess.addr())
+		}
+	}
+}
@@ -0,0 +1,4 @@
+package scp
+
+// WriteTestCert is writeTestCert for the tests of package scp_test.
+var WriteTestCert = writeTestCert
@@ -0,0 +1,54 @@
+package scp
+
+import (
+	"errors"
+	"strings"
+)
+
+var errInvalidFileName = errors.New("invalid filename")
+
+// windowsReserved are the device names Windows refuses as a file name, with
+// or without an extension, in any case.
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// validateFileName rejects a name a client wants a file or link created
+// under if any of its slash-separated elements could not be stored, or
+// copied back out, on every platform the client and server run on:
+//
+//   - "." and "..", which name directories rather than files
+//   - names containing a NUL byte or another control character
+//   - Windows device names such as CON, PRN, AUX, NUL, COM1 and LPT1, also
+//     with an extension ("con.txt") and in any case
+//   - names ending in a space or a dot, which Windows silently strips
+//
+// Empty elements, from a leading "/" or a doubled one, are allowed; resolve
+// takes care of those. This is independent of resolve's check that the
+// name stays inside storage, which still applies.
+func validateFileName(name string) error {
+	if name == "" {
+		return errInvalidFileName
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" {
+			continue
+		}
+		if elem == "." || elem == ".." {
+			return errInvalidFileName
+		}
+		if strings.ContainsFunc(elem, func(r rune) bool { return r < 0x20 || r == 0x7f }) {
+			return errInvalidFileName
+		}
+		if strings.HasSuffix(elem, " ") || strings.HasSuffix(elem, ".") {
+			return errInvalidFileName
+		}
+		base, _, _ := strings.Cut(elem, ".")
+		if windowsReserved[strings.ToUpper(strings.TrimRight(base, " "))] {
+			return errInvalidFileName
+		}
+	}
+	return nil
+}
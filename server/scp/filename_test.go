@@ -0,0 +1,100 @@
+package scp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateFileName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		// Ordinary names, nested or not
+		{"file.txt", true},
+		{"dir/sub/file.txt", true},
+		{".hidden", true},
+		{"..hidden", true},
+		{"a..b", true},
+		{"name with spaces.txt", true},
+		{" leading space", true},
+		{"ünïcödé.txt", true},
+		{"日本語", true},
+		{strings.Repeat("x", 255), true},
+
+		// Empty elements are left to resolve
+		{"/file.txt", true},
+		{"dir//file.txt", true},
+		{"dir/", true},
+		{"", false},
+
+		// Directory names
+		{".", false},
+		{"..", false},
+		{"dir/.", false},
+		{"dir/../file", false},
+		{"../file", false},
+		{"./file", false},
+
+		// Control characters
+		{"nul\x00byte", false},
+		{"dir/\x00", false},
+		{"tab\tname", false},
+		{"new\nline", false},
+		{"carriage\rreturn", false},
+		{"escape\x1b[0m", false},
+		{"delete\x7f", false},
+
+		// Windows device names, any case, with an extension or not
+		{"CON", false},
+		{"con", false},
+		{"Con", false},
+		{"PRN", false},
+		{"AUX", false},
+		{"NUL", false},
+		{"COM1", false},
+		{"com9", false},
+		{"LPT1", false},
+		{"lpt9", false},
+		{"con.txt", false},
+		{"NUL.tar.gz", false},
+		{"dir/aux.c", false},
+		{"CON .txt", false},
+		{"CONSOLE", true},
+		{"COM", true},
+		{"COM0", true},
+		{"COM10", true},
+		{"LPT", true},
+		{"xcon", true},
+		{"my.con", true},
+		{"dir.con/file", true},
+
+		// Trailing spaces and dots
+		{"trailing ", false},
+		{"trailing.", false},
+		{"dir./file", false},
+		{"dir /file", false},
+		{"file...", false},
+	} {
+		err := validateFileName(tc.name)
+		if tc.ok && err != nil {
+			t.Errorf("validateFileName(%q) = %v, want it allowed", tc.name, err)
+		}
+		if !tc.ok && err != errInvalidFileName {
+			t.Errorf("validateFileName(%q) = %v, want %v", tc.name, err, errInvalidFileName)
+		}
+	}
+}
+
+func TestUploadRejectsInvalidFileName(t *testing.T) {
+	cfg := testSettings(t)
+	conn := dialTest(t, startServer(t, cfg))
+	for _, name := range []string{"CON", "dir/nul.txt", "trailing.", "bell\x07"} {
+		if reply := upload(t, conn, name, []byte("data")); reply != "Error: invalid filename\n" {
+			t.Errorf("upd %q: got %q, want it rejected", name, reply)
+		}
+	}
+	if files := storedFiles(t, cfg.Storage); len(files) != 0 {
+		t.Errorf("rejected uploads left %q behind", files)
+	}
+}
@@ -0,0 +1,283 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// handleRecursiveLS lists every file below dir, which is resolved like any
+// other path, as slash-separated paths relative to it, sending each one as
+// the walk finds it. Directories are not listed on their own.
+func handleRecursiveLS(ctx context.Context, sess *clientSession, stream quic.Stream, dir string) {
+	out := newListingWriter(stream)
+	err := walkStoredFiles(ctx, sess, dir, func(name, rel string) error {
+		return out.line(name)
+	})
+	if err != nil {
+		logf(stream, "Listing of %q stopped after %d files: %v", dir, out.lines, err)
+		out.line("Error: " + storageReason(err, err.Error()))
+		out.flush()
+		return
+	}
+	if out.lines == 0 {
+		out.line("No files available.")
+	}
+	out.flush()
+}
+
+// handleFind lists the files below the working directory whose path
+// contains pattern or, if it has glob characters, whose name or relative
+// path matches it, sending each match as it is found. The search stops
+// find_max_depth levels down and after find_max_results matches, saying so
+// in a last line.
+func handleFind(ctx context.Context, sess *clientSession, stream quic.Stream, pattern string) {
+	if pattern == "" {
+		writeUsage(stream, "find")
+		return
+	}
+	glob := strings.ContainsAny(pattern, "*?[")
+	if _, err := path.Match(pattern, ""); glob && err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: invalid pattern %q\n", pattern)))
+		return
+	}
+	cfg := currentSettings()
+	out := newListingWriter(stream)
+	truncated := false
+	err := walkStored(ctx, sess.getCwd(), func(name string, d fs.DirEntry) error {
+		if d.IsDir() {
+			if name != "." && strings.Count(name, "/")+1 > cfg.FindMaxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		var matched bool
+		if glob {
+			byName, _ := path.Match(pattern, d.Name())
+			byPath, _ := path.Match(pattern, name)
+			matched = byName || byPath
+		} else {
+			matched = strings.Contains(name, pattern)
+		}
+		if !matched {
+			return nil
+		}
+		if out.lines == cfg.FindMaxResults {
+			truncated = true
+			return fs.SkipAll
+		}
+		return out.line(name)
+	})
+	switch {
+	case err != nil:
+		logf(stream, "Find of %q stopped after %d matches: %v", pattern, out.lines, err)
+		out.line("Error: " + storageReason(err, err.Error()))
+	case out.lines == 0:
+		out.line("No matching files.")
+	case truncated:
+		out.line(fmt.Sprintf("(stopped after the first %d matches)", cfg.FindMaxResults))
+	}
+	out.flush()
+}
+
+// walkStoredFiles calls fn for every regular file below dir, resolved from
+// the session's working directory, skipping the server's reserved
+// directories. name is the file's slash-separated path relative to dir and
+// rel its path relative to storageDir. The walk stops once ctx is done.
+func walkStoredFiles(ctx context.Context, sess *clientSession, dir string, fn func(name, rel string) error) error {
+	if dir == "" {
+		dir = "."
+	}
+	base, err := sess.resolve(dir)
+	if err != nil {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	root, inside := rootOf(base)
+	info, err := root.Stat(inside)
+	if storageFailure(err) {
+		return fmt.Errorf("%s: %w", dir, err)
+	}
+	if err != nil || !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	return walkStored(ctx, base, func(name string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return fn(name, filepath.Join(base, filepath.FromSlash(name)))
+	})
+}
+
+// handleRemove deletes one stored file. Directories are refused.
+func handleRemove(sess *clientSession, stream quic.Stream, name string) {
+	if name == "" {
+		writeUsage(stream, "rm")
+		return
+	}
+	rel, err := sess.resolve(name)
+	if err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: %v\n", name, err)))
+		return
+	}
+	unlock := fileLocks.lock(rel)
+	defer unlock()
+	root, inside := rootOf(rel)
+	info, err := root.Lstat(inside)
+	if errors.Is(err, fs.ErrNotExist) {
+		stream.Write([]byte(fmt.Sprintf("Error: %s does not exist\n", name)))
+		return
+	}
+	if err == nil && info.IsDir() {
+		stream.Write([]byte(fmt.Sprintf("Error: %s is a directory\n", name)))
+		return
+	}
+	if leadsOut(root, inside) {
+		logf(stream, "Refused to remove %s: a symlink out of storage", name)
+		stream.Write([]byte(fmt.Sprintf("Error: could not remove %s\n", name)))
+		return
+	}
+	if err == nil {
+		err = root.Remove(inside)
+	}
+	if err != nil {
+		logf(stream, "Error removing %s: %v", name, err)
+		stream.Write([]byte("Error: " + storageReason(err, "could not remove "+name) + "\n"))
+		return
+	}
+	printf(stream, "Removed file %s\n", displayPath(rel))
+	stream.Write([]byte("OK\n"))
+}
+
+// handleSymlink creates the link name pointing at target, as sent by a
+// client uploading a tree with -symlinks=copy. The target is resolved from
+// the link's real parent directory and must land inside storage, so no link
+// can expose files outside it. An existing file at name is replaced.
+func handleSymlink(sess *clientSession, stream quic.Stream, args []string) {
+	if len(args) != 2 {
+		writeUsage(stream, "symlink")
+		return
+	}
+	name, target := args[0], filepath.FromSlash(args[1])
+	if err := validateFileName(name); err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+		return
+	}
+	rel, err := sess.resolve(name)
+	if err != nil || rel == "." {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: invalid link name\n", name)))
+		return
+	}
+	if filepath.IsAbs(target) {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: absolute link targets are not allowed\n", name)))
+		return
+	}
+
+	unlock := fileLocks.lock(rel)
+	defer unlock()
+	root, inside := rootOf(rel)
+	if err := root.MkdirAll(filepath.Dir(inside), currentSettings().DirMode.perm()); err != nil {
+		logf(stream, "Error creating directory for link %s: %v", name, err)
+		stream.Write([]byte("Error: " + storageReason(err, "could not create "+name) + "\n"))
+		return
+	}
+	if !linkStaysInStorage(sess, rel, target) {
+		logf(stream, "Rejected link %s -> %s: target escapes storage", name, args[1])
+		stream.Write([]byte(fmt.Sprintf("Error: %s: link target escapes storage\n", name)))
+		return
+	}
+	if info, err := root.Lstat(inside); err == nil {
+		if info.IsDir() {
+			stream.Write([]byte(fmt.Sprintf("Error: %s is a directory\n", name)))
+			return
+		}
+		root.Remove(inside)
+	}
+	if err := root.Symlink(target, inside); err != nil {
+		logf(stream, "Error creating link %s: %v", name, err)
+		stream.Write([]byte("Error: " + storageReason(err, "could not create "+name) + "\n"))
+		return
+	}
+	printf(stream, "Created link %s -> %s\n", displayPath(rel), args[1])
+	stream.Write([]byte("OK\n"))
+}
+
+// linkStaysInStorage reports whether a link stored as rel with the relative
+// target would point inside the link's volume, or the session's home if it
+// has one, and outside the reserved directories. The target is followed
+// through the volume's root the way the system would follow it, symlinks
+// and all, since a ".." after a symlink leads out of wherever the symlink
+// really points.
+func linkStaysInStorage(sess *clientSession, rel, target string) bool {
+	_, _, inVolume := splitVolume(rel)
+	root, inside := rootOf(rel)
+	dest, ok := resolveLink(root, filepath.Dir(inside), target)
+	if !ok {
+		return false
+	}
+	if home := sess.getHome(); home != "" {
+		return dest == home || strings.HasPrefix(dest, home+string(filepath.Separator))
+	}
+	return inVolume || !isReserved(dest)
+}
+
+// maxLinkHops is how many symlinks resolveLink follows before giving up,
+// as the system does with a loop.
+const maxLinkHops = 40
+
+// resolveLink returns where target leads, read from the directory dir, both
+// inside root, following every symlink on the way. It fails if the path
+// would leave root at any point, or runs into an absolute link. Components
+// that do not exist are taken as they are, since there is nothing there to
+// follow.
+func resolveLink(root *os.Root, dir, target string) (string, bool) {
+	var resolved []string // real directories from root, none of them a symlink
+	pending := append(splitPath(dir), splitPath(target)...)
+	hops := 0
+	for len(pending) > 0 {
+		c := pending[0]
+		pending = pending[1:]
+		switch c {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", false
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		p := filepath.Join(append(resolved, c)...)
+		info, err := root.Lstat(p)
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, c)
+			continue
+		}
+		if hops++; hops > maxLinkHops {
+			return "", false
+		}
+		link, err := root.Readlink(p)
+		if err != nil || filepath.IsAbs(link) {
+			return "", false
+		}
+		pending = append(splitPath(link), pending...)
+	}
+	if len(resolved) == 0 {
+		return ".", true
+	}
+	return filepath.Join(resolved...), true
+}
+
+// splitPath splits a relative path into its components.
+func splitPath(p string) []string {
+	return strings.Split(filepath.ToSlash(p), "/")
+}
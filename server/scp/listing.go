@@ -0,0 +1,40 @@
+package scp
+
+import (
+	"bufio"
+	"io"
+)
+
+// listingBufferSize bounds how much of a listing is held before it goes out
+// on the stream.
+const listingBufferSize = 32 * 1024
+
+// listingWriter sends a listing one entry per line as the entries are
+// found, holding at most listingBufferSize bytes of it, so that a directory
+// with millions of entries is never built up in memory as one reply.
+// Because the start of a listing may already be on its way by the time
+// something goes wrong, an "Error:" line can follow entries, not only stand
+// alone.
+type listingWriter struct {
+	w     *bufio.Writer
+	lines int
+}
+
+func newListingWriter(w io.Writer) *listingWriter {
+	return &listingWriter{w: bufio.NewWriterSize(w, listingBufferSize)}
+}
+
+// line sends one entry. The error is the stream's, as when the client has
+// stopped reading, and means the listing should stop.
+func (l *listingWriter) line(entry string) error {
+	l.lines++
+	if _, err := l.w.WriteString(entry); err != nil {
+		return err
+	}
+	return l.w.WriteByte('\n')
+}
+
+// flush writes out whatever is still buffered.
+func (l *listingWriter) flush() error {
+	return l.w.Flush()
+}
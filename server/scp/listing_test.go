@@ -0,0 +1,92 @@
+package scp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// writeSizes records the size of every write it is given.
+type writeSizes []int
+
+func (w *writeSizes) Write(p []byte) (int, error) {
+	*w = append(*w, len(p))
+	return len(p), nil
+}
+
+func TestListingWriterIsBounded(t *testing.T) {
+	var writes writeSizes
+	out := newListingWriter(&writes)
+	entry := strings.Repeat("x", 99)
+	for range 10_000 {
+		if err := out.line(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(writes) == 0 {
+		t.Fatal("nothing was sent before the listing was flushed")
+	}
+	out.flush()
+	total := 0
+	for _, n := range writes {
+		if n > listingBufferSize {
+			t.Errorf("sent %d bytes in one write, more than the %d buffered", n, listingBufferSize)
+		}
+		total += n
+	}
+	if total != 10_000*100 || out.lines != 10_000 {
+		t.Errorf("sent %d bytes in %d lines, want %d in %d", total, out.lines, 10_000*100, 10_000)
+	}
+}
+
+// TestLargeDirectoryListing lists a directory far bigger than any one
+// buffer with ls, ls -R and find, and checks that every entry arrives.
+func TestLargeDirectoryListing(t *testing.T) {
+	const files = 20_000
+	cfg := testSettings(t)
+	cfg.FindMaxResults = files
+	var want []string
+	for i := range files {
+		name := fmt.Sprintf("entry-%05d-%s", i, strings.Repeat("n", 40))
+		dir := filepath.Join(cfg.Storage, "big", fmt.Sprintf("d%d", i%4))
+		if i < 4 {
+			os.MkdirAll(dir, 0o755)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, fmt.Sprintf("d%d/%s", i%4, name))
+	}
+	conn := dialTest(t, startServer(t, cfg))
+
+	lines := func(reply string) []string {
+		return strings.Split(strings.TrimSuffix(reply, "\n"), "\n")
+	}
+	got := lines(exchange(t, conn, "ls -R big", nil))
+	slices.Sort(got)
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("ls -R: got %d entries, want the %d stored", len(got), len(want))
+	}
+
+	if reply := exchange(t, conn, "cd big/d1", nil); !strings.Contains(reply, "big/d1") {
+		t.Fatalf("cd: %q", reply)
+	}
+	got = lines(exchange(t, conn, "ls", nil))
+	var inD1 []string
+	for _, name := range want {
+		if after, ok := strings.CutPrefix(name, "d1/"); ok {
+			inD1 = append(inD1, after)
+		}
+	}
+	if !slices.Equal(got, inD1) {
+		t.Errorf("ls: got %d entries, want the %d in the directory, in order", len(got), len(inD1))
+	}
+	got = lines(exchange(t, conn, "find entry-", nil))
+	if len(got) != len(inD1) {
+		t.Errorf("find: got %d matches, want %d", len(got), len(inD1))
+	}
+}
@@ -0,0 +1,63 @@
+package scp
+
+import "sync"
+
+// fileLockMap hands out one RWMutex per storage-relative path, so a file is
+// never read while it is being written. Writers (uploads, moves, the final
+// rename of a resumable upload) take it exclusively; downloads share it.
+// Entries are dropped again once nobody holds or waits for them.
+type fileLockMap struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.RWMutex
+	refs int // holders plus waiters, guarded by fileLockMap.mu
+}
+
+var fileLocks = &fileLockMap{locks: make(map[string]*fileLock)}
+
+// acquire returns the entry for rel with a reference taken on it.
+func (m *fileLockMap) acquire(rel string) *fileLock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.locks[rel]
+	if !ok {
+		l = &fileLock{}
+		m.locks[rel] = l
+	}
+	l.refs++
+	return l
+}
+
+func (m *fileLockMap) release(rel string, l *fileLock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l.refs--; l.refs == 0 {
+		delete(m.locks, rel)
+	}
+}
+
+// lock blocks until the caller holds rel exclusively, and returns the func
+// that releases it. Since the holder may have changed the file, its cached
+// checksum is dropped on release.
+func (m *fileLockMap) lock(rel string) func() {
+	l := m.acquire(rel)
+	l.Lock()
+	return func() {
+		checksums.forget(rel)
+		l.Unlock()
+		m.release(rel, l)
+	}
+}
+
+// rlock is the shared counterpart of lock.
+func (m *fileLockMap) rlock(rel string) func() {
+	l := m.acquire(rel)
+	l.RLock()
+	return func() {
+		l.RUnlock()
+		m.release(rel, l)
+	}
+}
@@ -0,0 +1,139 @@
+package scp
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileLockMap(t *testing.T) {
+	// blocks reports whether take is still waiting after giving it a moment
+	// to get through.
+	blocks := func(take func() func()) bool {
+		got := make(chan func())
+		go func() { got <- take() }()
+		select {
+		case unlock := <-got:
+			unlock()
+			return false
+		case <-time.After(50 * time.Millisecond):
+			// Let it through so the goroutine ends with the test.
+			go func() { (<-got)() }()
+			return true
+		}
+	}
+	for _, tc := range []struct {
+		name        string
+		held        func(m *fileLockMap) func() // what is taken first
+		lockBlock   bool                        // whether lock("f") then blocks
+		rlockBlocks bool                        // and rlock("f")
+	}{
+		{"nothing held", func(m *fileLockMap) func() { return func() {} }, false, false},
+		{"shared", func(m *fileLockMap) func() { return m.rlock("f") }, true, false},
+		{"two shared", func(m *fileLockMap) func() {
+			a, b := m.rlock("f"), m.rlock("f")
+			return func() { a(); b() }
+		}, true, false},
+		{"exclusive", func(m *fileLockMap) func() { return m.lock("f") }, true, true},
+		{"another file", func(m *fileLockMap) func() {
+			a, b := m.lock("g"), m.lock("dir/f")
+			return func() { a(); b() }
+		}, false, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &fileLockMap{locks: make(map[string]*fileLock)}
+			unlock := tc.held(m)
+			// A writer left waiting holds up new readers, so try those first
+			if got := blocks(func() func() { return m.rlock("f") }); got != tc.rlockBlocks {
+				t.Errorf("rlock blocked: %t, want %t", got, tc.rlockBlocks)
+			}
+			if got := blocks(func() func() { return m.lock("f") }); got != tc.lockBlock {
+				t.Errorf("lock blocked: %t, want %t", got, tc.lockBlock)
+			}
+			unlock()
+			eventually(t, "every entry is dropped", func() bool {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				return len(m.locks) == 0
+			})
+		})
+	}
+}
+
+func TestFileLockMapDoesNotLeak(t *testing.T) {
+	m := &fileLockMap{locks: make(map[string]*fileLock)}
+	var wg sync.WaitGroup
+	for i := range 1000 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rel := fmt.Sprintf("file%d", i%10)
+			if i%3 == 0 {
+				m.lock(rel)()
+			} else {
+				m.rlock(rel)()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(m.locks) != 0 {
+		t.Errorf("%d entries left after every lock was released", len(m.locks))
+	}
+}
+
+// TestConcurrentUploadDownloadSameName overwrites one file over and over
+// while others download it. Every version is a single byte repeated, of its
+// own length, so a download that mixes two versions or catches one half
+// written is easy to tell.
+func TestConcurrentUploadDownloadSameName(t *testing.T) {
+	cfg := testSettings(t)
+	addr := startServer(t, cfg)
+	version := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i%26)}, 50_000+i*997) }
+	if reply := upload(t, dialTest(t, addr), "shared.bin", version(0)); reply != "" {
+		t.Fatalf("upd: %q", reply)
+	}
+
+	const writers, readers, rounds = 3, 5, 8
+	var wg sync.WaitGroup
+	for w := range writers {
+		conn := dialTest(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rounds {
+				data := version(1 + w*rounds + r)
+				reply, err := tryExchange(conn, fmt.Sprintf("upd shared.bin %d", len(data)), data)
+				if err != nil || reply != "" {
+					t.Errorf("upd: %q, %v", reply, err)
+				}
+			}
+		}()
+	}
+	for range readers {
+		conn := dialTest(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range rounds {
+				reply, err := tryExchange(conn, "dwd shared.bin", nil)
+				status, data, _ := strings.Cut(reply, "\n")
+				if err != nil || !strings.HasPrefix(status, "OK ") {
+					t.Errorf("dwd: %q, %v", status, err)
+					continue
+				}
+				if i := (len(data) - 50_000) / 997; !bytes.Equal([]byte(data), version(i)) {
+					t.Errorf("downloaded %d bytes that are not one whole version", len(data))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	eventually(t, "every lock entry is dropped", func() bool {
+		fileLocks.mu.Lock()
+		defer fileLocks.mu.Unlock()
+		return len(fileLocks.locks) == 0
+	})
+}
@@ -0,0 +1,671 @@
+package scp
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"github.com/quic-go/quic-go"
+)
+var storageDir string
+
+// streamRejected is the stream error code used when the server refuses to
+// read any further data from an upload.
+const streamRejected quic.StreamErrorCode = 2
+
+// newQUICConfig is the transport configuration the settings in cfg ask for.
+func newQUICConfig(cfg *settings) *quic.Config {
+	// quic-go reads a stream limit of 0 as its default and a negative one as none
+	uniStreams := int64(cfg.MaxIncomingUniStreams)
+	if uniStreams == 0 {
+		uniStreams = -1
+	}
+	return &quic.Config{
+		EnableDatagrams:       true,
+		MaxIncomingStreams:    int64(cfg.MaxIncomingStreams),
+		MaxIncomingUniStreams: uniStreams,
+
+		InitialConnectionReceiveWindow: uint64(cfg.InitialConnWindow),
+		MaxConnectionReceiveWindow:     uint64(cfg.MaxConnWindow),
+		DisablePathMTUDiscovery:        cfg.NoMTUDiscovery,
+	}
+}
+
+func handleSession(session quic.Connection){
+	fmt.Println("Client connected")
+	defer session.CloseWithError(errCodeNone, "Session closed")
+	sess := newClientSession(session)
+	activeSessions.add(sess)
+	defer activeSessions.remove(sess)
+	stats.sessions.Add(1)
+	var closeErr error
+	defer func() {
+		stats.sessions.Add(-1)
+		how := "disconnected"
+		if closedCleanly(closeErr) {
+			stats.disconnects.Add(1)
+		} else {
+			stats.lost.Add(1)
+			how = fmt.Sprintf("lost (%v)", closeErr)
+		}
+		log.Printf("Client %s %s after %s, %d bytes; server %s",
+			sess.addr(), how, time.Since(sess.connectedAt).Round(time.Second), sess.bytes.Load(), stats.snapshot())
+	}()
+	go serveControl(sess)
+	for {
+		stream, err := session.AcceptStream(context.Background())
+		if err != nil {
+			// The connection is gone; the deferred summary logs how it ended.
+			closeErr = err
+			return
+		}
+		// Streams are served concurrently and quic-go sends their data
+		// round-robin, without priorities, so an ls or a small download
+		// shares the connection evenly with a large transfer rather than
+		// queueing behind it. Flow control still caps each stream's window.
+		go observeStream(sess, stream, handleStream)
+	}
+}
+
+func handleStream(sess *clientSession, stream quic.Stream){
+    defer stream.Close()
+    reader := bufio.NewReader(stream)
+    limit := currentSettings().MaxCommandLength
+    command, err := readCommand(stream, reader, limit)
+    switch {
+    case errors.Is(err, errCommandTooLong):
+        logf(stream, "Rejected command longer than %d bytes", limit)
+        rejectUpload(stream, "command too long")
+        return
+    case isTimeout(err):
+        logf(stream, "Timed out waiting for a command")
+        stream.CancelRead(streamTimedOut)
+        stream.Write([]byte("Error: timed out waiting for the command\n"))
+        return
+    case errors.Is(err, errCommandIncomplete):
+        logf(stream, "Failed to read command: %v", err)
+        stream.Write([]byte("Error: incomplete command\n"))
+        return
+    case err != nil:
+        logf(stream, "Failed to read from stream: %v", err)
+        return
+    }
+
+    command = strings.TrimSpace(command)
+    if id, rest := splitRequestID(command); id != "" {
+        command = rest
+        stream = &requestStream{Stream: stream, id: id}
+    }
+    printf(stream, "Received command: %s\n", redactCommand(command))
+    defer sess.beginCommand(stream, redactCommand(command))()
+    if !requirePermission(sess, stream, commandPermission(command)) {
+        logf(stream, "Refused %q from %s with %s access", redactCommand(command), sess.addr(), sess.permission())
+        return
+    }
+    ctx, cancel := commandContext(sess)
+    defer cancel()
+
+    if serveRegistered(ctx, sess, stream, reader, command) {
+        return
+    }
+    switch {
+    case strings.HasPrefix(command, "upd "):
+        args := strings.Fields(strings.TrimPrefix(command, "upd "))
+        if len(args) == 0 || len(args) > 3 {
+            writeUsage(stream, "upd")
+            return
+        }
+        size := int64(-1)
+        if len(args) > 1 {
+            if size, err = strconv.ParseInt(args[1], 10, 64); err != nil || size < 0 {
+                stream.Write([]byte("Error: invalid file size\n"))
+                return
+            }
+        }
+        codec := ""
+        if len(args) > 2 {
+            codec = args[2]
+        }
+        handleUpload(sess, stream, reader, args[0], size, codec)
+    case command == "dwd --chunks" || command == "dwd --move":
+        writeUsage(stream, command)
+    case strings.HasPrefix(command, "upd-batch "):
+        handleBatchUpload(sess, stream, reader, strings.Fields(strings.TrimPrefix(command, "upd-batch ")))
+    case strings.HasPrefix(command, "dwd --chunks "):
+        handleChunkedDownload(sess, stream, strings.Fields(strings.TrimPrefix(command, "dwd --chunks ")))
+    case strings.HasPrefix(command, "dwd --move "):
+        handleMoveDownload(sess, stream, reader, strings.TrimSpace(strings.TrimPrefix(command, "dwd --move ")))
+    case strings.HasPrefix(command, "dwd "):
+        fileNames := strings.Fields(strings.TrimPrefix(command, "dwd "))
+        handleMultipleDownloads(sess, stream, fileNames)
+    case command == "ls" || strings.HasPrefix(command, "ls --"):
+        handleLSCommand(ctx, sess, stream, strings.Fields(strings.TrimPrefix(command, "ls")))
+    case command == "ls -R" || strings.HasPrefix(command, "ls -R "):
+        handleRecursiveLS(ctx, sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "ls -R")))
+    case command == "find" || strings.HasPrefix(command, "find "):
+        handleFind(ctx, sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "find")))
+    case command == "manifest" || strings.HasPrefix(command, "manifest "):
+        handleManifest(ctx, sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "manifest")))
+    case strings.HasPrefix(command, "versions "):
+        handleVersions(sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "versions ")))
+    case command == "volumes":
+        handleVolumes(sess, stream)
+    case command == "codecs":
+        handleCodecs(stream)
+    case command == "download-streams":
+        handleDownloadStreams(stream)
+    case command == "help":
+        handleHelp(sess, stream)
+    case command == "ping":
+        stream.Write([]byte("pong\n"))
+    case strings.HasPrefix(command, "bench "):
+        handleBench(sess, stream, reader, strings.Fields(strings.TrimPrefix(command, "bench ")))
+    case strings.HasPrefix(command, "symlink "):
+        handleSymlink(sess, stream, strings.Fields(strings.TrimPrefix(command, "symlink ")))
+    case strings.HasPrefix(command, "rm "):
+        handleRemove(sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "rm ")))
+    case command == "cd" || strings.HasPrefix(command, "cd "):
+        handleCD(sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "cd")))
+    case command == "pwd":
+        stream.Write([]byte(sess.display(sess.getCwd()) + "\n"))
+    case strings.HasPrefix(command, "begin-upload "):
+        handleBeginUpload(sess, stream, strings.Fields(strings.TrimPrefix(command, "begin-upload ")))
+    case strings.HasPrefix(command, "resume-upload "):
+        handleResumeUpload(sess, stream, reader, strings.TrimSpace(strings.TrimPrefix(command, "resume-upload ")))
+    case strings.HasPrefix(command, "auth "):
+        handleAuth(sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "auth ")))
+    case command == "clients":
+        handleClients(stream)
+    case command == "info":
+        handleInfo(stream)
+    case strings.HasPrefix(command, "kick "):
+        handleKick(sess, stream, strings.TrimSpace(strings.TrimPrefix(command, "kick ")))
+    default:
+        // A known command without the arguments it needs, like a bare "upd"
+        if name, ok := usageOf(command); ok {
+            writeUsage(stream, name)
+            return
+        }
+        stream.Write([]byte("Unknown command\n"))
+    }
+}
+
+// handleMultipleDownloads sends fileNames one after another, each preceded
+// by a status line naming it:
+//
+//	OK <size> <name> <mtime> followed by exactly size bytes
+//	Error: <name>: <reason>  followed by nothing
+//
+// mtime is the file's modification time in Unix nanoseconds.
+func handleMultipleDownloads(sess *clientSession, stream quic.Stream, fileNames []string) {
+    totalFiles := len(fileNames)
+    printf(stream, "Sending %d files...\n", totalFiles)
+
+    filesSent := 0
+    for _, fileName := range fileNames {
+        if handleDownload(sess, stream, fileName) {
+            filesSent++
+        }
+    }
+    printf(stream, "Sent %d/%d successfully.\n", filesSent, totalFiles)
+}
+
+// handleDownloadStreams tells the client how many streams it may split a
+// download batch across, each carrying a dwd command of its own for part of
+// the files. Every stream is served like any other, so the client knows
+// which files arrive on which.
+func handleDownloadStreams(stream quic.Stream) {
+    stream.Write([]byte(fmt.Sprintf("%d\n", currentSettings().DownloadStreams)))
+}
+
+
+// uploadWriter is what handleUpload and handleResumeUpload write a file's
+// data through, which tests replace to run out of disk space part way.
+var uploadWriter = func(file *os.File) io.Writer { return file }
+
+// handleUpload stores the rest of the stream as fileName. body must be the
+// reader the command line was read from, since it may already hold the first
+// bytes of the file. size is the length announced by the client, or -1, and
+// codec the compression the body was sent with, or "". It reports whether
+// the file was stored.
+func handleUpload(sess *clientSession, stream quic.Stream, body io.Reader, fileName string, size int64, codec string) bool {
+    if err := validateFileName(fileName); err != nil {
+        logf(stream, "Rejected upload of %q: %v\n", fileName, err)
+        rejectUpload(stream, err.Error())
+        return false
+    }
+    rel, err := sess.resolve(fileName)
+    if err != nil {
+        logf(stream, "Error: Rejected upload of %s: %v\n", fileName, err)
+        rejectUpload(stream, err.Error())
+        return false
+    }
+    cfg := currentSettings()
+    if cfg.MaxFileSize > 0 && size > cfg.MaxFileSize {
+        logf(stream, "Rejected upload of %s: %d bytes exceeds limit of %d\n", fileName, size, cfg.MaxFileSize)
+        rejectUpload(stream, "file too large")
+        return false
+    }
+
+    // Hold the write lock until the file is complete or removed, so no
+    // download sees it half written
+    unlock := fileLocks.lock(rel)
+    defer unlock()
+
+    // Create the file for writing, along with any directories a recursive
+    // upload sends it under
+    root, inside := rootOf(rel)
+    if leadsOut(root, inside) {
+        logf(stream, "Rejected upload of %s: a symlink out of storage\n", fileName)
+        rejectUpload(stream, "could not create file")
+        return false
+    }
+    if err := root.MkdirAll(filepath.Dir(inside), cfg.DirMode.perm()); err != nil {
+        logf(stream, "Error: Could not create directory for %s: %v\n", fileName, err)
+        rejectUpload(stream, storageReason(err, "could not create directory"))
+        return false
+    }
+    // The data never goes straight to the destination, so a failed upload
+    // never costs the file it would have replaced. With a scanner,
+    // -temp-dir, -backup or -versions configured it is staged and only
+    // reaches storage once it is complete (and clean); otherwise it is
+    // written beside the destination and renamed over it at the end
+    staged := cfg.ScanCmd != "" || tempDir != "" || cfg.Backup || cfg.Versions > 0
+    var writePath string
+    remove := root.Remove
+    if staged {
+        writePath, err = stagingPath()
+        remove = os.Remove
+    } else {
+        writePath, err = sidePath(inside)
+    }
+    if err != nil {
+        logf(stream, "Error: Could not stage upload of %s: %v\n", fileName, err)
+        rejectUpload(stream, storageReason(err, "could not store file"))
+        return false
+    }
+    // The file keeps the mode it is created with when it is moved into
+    // place, so it gets the storage file mode
+    var file *os.File
+    flags := os.O_RDWR | os.O_CREATE | os.O_EXCL
+    if staged {
+        file, err = os.OpenFile(writePath, flags, cfg.FileMode.perm())
+    } else {
+        file, err = root.OpenFile(writePath, flags, cfg.FileMode.perm())
+    }
+    if err != nil {
+        logf(stream, "Error: Could not create file %s for upload: %v\n", fileName, err)
+        rejectUpload(stream, storageReason(err, "could not create file"))
+        return false
+    }
+    defer file.Close()
+
+    if size > 0 {
+        reserve := size
+        if storageKey != nil {
+            reserve = sealedSize(size)
+        }
+        if err := preallocate(file, reserve); err != nil {
+            if errors.Is(err, syscall.ENOSPC) {
+                logf(stream, "Rejected upload of %s: no space for %d bytes\n", fileName, size)
+                discardPartial(stream, file, writePath, remove)
+                rejectUpload(stream, "server out of disk space")
+                return false
+            }
+            logf(stream, "Could not preallocate %d bytes for %s: %v\n", size, fileName, err)
+        }
+    }
+
+    // Write the data received from the client. Reading one byte past the
+    // limit is enough to tell an oversized upload from one that fits exactly.
+    // The announced size is held to the same way: the file is complete once
+    // exactly that many bytes have arrived, not merely when the client
+    // half-closes, which a client that gave up early does too. An upload
+    // without a size still ends at the half-close.
+    timeout := time.Duration(cfg.TransferTimeout)
+    decoder, err := newDecoder(codec, cfg.bandwidth.reader(withReadTimeout(body, stream, timeout)))
+    if err != nil {
+        logf(stream, "Rejected upload of %s: %v\n", fileName, err)
+        discardPartial(stream, file, writePath, remove)
+        rejectUpload(stream, err.Error())
+        return false
+    }
+    defer decoder.Close()
+    var src io.Reader = decoder
+    var limited *io.LimitedReader
+    if cfg.MaxFileSize > 0 {
+        limited = &io.LimitedReader{R: src, N: cfg.MaxFileSize + 1}
+        src = limited
+    }
+    if size >= 0 {
+        src = &io.LimitedReader{R: src, N: size + 1}
+    }
+    // With a storage key the data is sealed on its way to disk
+    dst := uploadWriter(file)
+    var sealer *sealWriter
+    if storageKey != nil {
+        if sealer, err = newSealWriter(dst); err != nil {
+            logf(stream, "Error: Could not seal upload of %s: %v\n", fileName, err)
+            discardPartial(stream, file, writePath, remove)
+            rejectUpload(stream, "could not store file")
+            return false
+        }
+        dst = sealer
+    }
+    written, err := copyWithContext(sess.conn.Context(), dst, src, make([]byte, copyBufferSize))
+    if err == nil && sealer != nil {
+        err = sealer.Close()
+    }
+    sess.received(written)
+    if err == nil && limited != nil && limited.N == 0 {
+        logf(stream, "Aborted upload of %s: exceeded limit of %d bytes\n", fileName, cfg.MaxFileSize)
+        discardPartial(stream, file, writePath, remove)
+        rejectUpload(stream, "file too large")
+        return false
+    }
+    if err != nil {
+        var streamErr *quic.StreamError
+        if isTimeout(err) {
+            logf(stream, "Upload of %s timed out after %d bytes\n", fileName, written)
+            clearDeadlines(stream)
+            rejectUpload(stream, "transfer timed out")
+        } else if errors.Is(err, syscall.ENOSPC) {
+            logf(stream, "Upload of %s ran out of disk space after %d bytes\n", fileName, written)
+            rejectUpload(stream, "server out of disk space")
+        } else if storageFailure(err) {
+            logf(stream, "Upload of %s failed after %d bytes, storage unavailable: %v\n", fileName, written, err)
+            rejectUpload(stream, errStorageUnavailable.Error())
+        } else if errors.As(err, &streamErr) && streamErr.Remote {
+            logf(stream, "Upload of %s aborted by client after %d bytes (code %d)\n", fileName, written, streamErr.ErrorCode)
+        } else {
+            logf(stream, "Error during file upload: %v\n", err)
+        }
+        discardPartial(stream, file, writePath, remove)
+        return false
+    }
+    if size >= 0 && written != size {
+        if written > size {
+            logf(stream, "Aborted upload of %s: more than the announced %d bytes\n", fileName, size)
+            rejectUpload(stream, "upload larger than announced size")
+        } else {
+            logf(stream, "Upload of %s ended after %d of %d bytes\n", fileName, written, size)
+            rejectUpload(stream, fmt.Sprintf("upload truncated at %d of %d bytes", written, size))
+        }
+        discardPartial(stream, file, writePath, remove)
+        return false
+    }
+    if staged {
+        file.Close()
+        publish := moveIntoPlace
+        if cfg.ScanCmd != "" {
+            publish = func(src, dest string) error { return publishScanned(cfg.ScanCmd, src, dest, fileName) }
+        }
+        if err := publish(writePath, rel); err != nil {
+            if errors.Is(err, errScanRejected) {
+                logf(stream, "Rejected upload of %s: flagged by scanner\n", fileName)
+                stream.Write([]byte("Error: upload rejected by scanner\n"))
+            } else if errors.Is(err, syscall.ENOSPC) {
+                logf(stream, "Error storing %s: %v\n", fileName, err)
+                stream.Write([]byte("Error: server out of disk space\n"))
+            } else {
+                logf(stream, "Error storing %s: %v\n", fileName, err)
+                stream.Write([]byte("Error: " + storageReason(err, "could not store file") + "\n"))
+            }
+            return false
+        }
+    } else {
+        file.Close()
+        if err := root.Rename(writePath, inside); err != nil {
+            logf(stream, "Error storing %s: %v\n", fileName, err)
+            root.Remove(writePath)
+            stream.Write([]byte("Error: " + storageReason(err, "could not store file") + "\n"))
+            return false
+        }
+    }
+    stats.filesReceived.Add(1)
+    printf(stream, "Uploaded file %s (%d bytes) successfully\n", fileName, written)
+    return true
+}
+
+// rejectUpload stops the client from sending any more data and tells it why.
+func rejectUpload(stream quic.Stream, reason string) {
+    stream.CancelRead(streamRejected)
+    stream.Write([]byte("Error: " + reason + "\n"))
+}
+
+// discardPartial closes and removes the file an upload that did not complete
+// was written to, so a truncated copy never shows up in storage. filePath is
+// always a staging or side file, never the destination itself; remove
+// deletes it from wherever it was created.
+func discardPartial(stream quic.Stream, file *os.File, filePath string, remove func(string) error) {
+    file.Close()
+    if err := remove(filePath); err != nil {
+        logf(stream, "Error removing partial upload %s: %v\n", filePath, err)
+        return
+    }
+    logf(stream, "Removed partial upload %s\n", filePath)
+}
+
+func handleDownload(sess *clientSession, stream quic.Stream, fileName string) bool {
+    rel, err := resolveVersion(sess, fileName)
+    if err != nil {
+        logf(stream, "Rejected download of %s: %v", fileName, err)
+        stream.Write([]byte(fmt.Sprintf("Error: %s: could not open file\n", fileName)))
+        return false
+    }
+    unlock := fileLocks.rlock(rel)
+    defer unlock()
+
+    // Open the file for reading
+    file, err := openStored(rel)
+    if err != nil {
+        logf(stream, "Error opening file %s: %v", fileName, err)
+        stream.Write([]byte(fmt.Sprintf("Error: %s: %s\n", fileName, storageReason(err, "could not open file"))))
+        return false
+    }
+    defer file.Close()
+
+    printf(stream, "Sending file: %s (%d bytes)\n", fileName, file.size)
+    cfg := currentSettings()
+    dst := withWriteTimeout(payloadWriter(stream), stream, time.Duration(cfg.TransferTimeout))
+    // The size lets the client tell a complete file from a cut-off one,
+    // and where this file ends and the next in the batch begins; the name
+    // which file of the batch it is; the modification time, with the size,
+    // lets a download resumed later tell whether the file is still the same
+    stream.Write([]byte(fmt.Sprintf("OK %d %s %d\n", file.size, fileName, file.info.ModTime().UnixNano())))
+    sent, err := copyResuming(sess.conn.Context(), cfg.bandwidth.writer(dst), file, cfg.WriteRetries, func(sent int64) {
+        logf(stream, "Download of %s stalled after %d bytes, retrying", fileName, sent)
+    })
+    sess.sent(sent)
+    if isTimeout(err) {
+        logf(stream, "Download of %s timed out after %d bytes", fileName, sent)
+        stream.CancelWrite(streamTimedOut)
+        return false
+    }
+    if err != nil {
+        logf(stream, "Error sending file %s: %v", fileName, err)
+        return false
+    }
+
+    stats.filesServed.Add(1)
+    return true
+}
+
+// generateTLSConfig serves the certificates in certs under the TLS policy
+// of cfg, which validate has already checked.
+func generateTLSConfig(certs *certificateStore, cfg *settings) *tls.Config {
+	if err := certs.reload(); err != nil {
+		log.Fatalf("Error loading TLS keys: %v", err)
+	}
+	minVersion, _ := parseTLSVersion(cfg.TLSMinVersion)
+	curves, _ := parseTLSCurves(cfg.TLSCurves)
+	return &tls.Config{
+		GetCertificate:   certs.getCertificate,
+		MinVersion:       minVersion,
+		CurvePreferences: curves,
+	}
+}
+
+// defaultPageSize is how many entries a page of "ls --page" holds when
+// --size is not given.
+const defaultPageSize = 1000
+
+
+// handleLSCommand lists the working directory. --filter keeps the entries
+// whose name matches a glob and --sort orders them, before paging. With
+// --page or --size it sends only that page, 1-based, followed by a
+// "/next <page>" line if more entries remain; no entry starts with "/", so
+// the token cannot be mistaken for one.
+func handleLSCommand(ctx context.Context, sess *clientSession, stream quic.Stream, args []string) {
+    opts := flag.NewFlagSet("ls", flag.ContinueOnError)
+    opts.SetOutput(io.Discard)
+    page := opts.Int("page", 0, "")
+    size := opts.Int("size", 0, "")
+    sortBy := opts.String("sort", "name", "")
+    reverse := opts.Bool("reverse", false, "")
+    filter := opts.String("filter", "", "")
+    if err := opts.Parse(args); err != nil || opts.NArg() > 0 || *page < 0 || *size < 0 {
+        writeUsage(stream, "ls")
+        return
+    }
+    if _, err := path.Match(*filter, ""); err != nil {
+        stream.Write([]byte(fmt.Sprintf("Error: invalid filter %q\n", *filter)))
+        return
+    }
+
+    files, err := readStoredDir(sess.getCwd())
+    if err != nil {
+        logf(stream, "Error listing %s: %v", displayPath(sess.getCwd()), err)
+        stream.Write([]byte("Error: " + storageReason(err, "could not list directory") + "\n"))
+        return
+    }
+    if err := sortEntries(files, *sortBy); err != nil {
+        stream.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+        return
+    }
+    // Reading and sorting a huge directory is what may run past the
+    // command timeout; there is no point sending it after that.
+    if ctx.Err() != nil {
+        logf(stream, "Listing stopped: %v", context.Cause(ctx))
+        stream.Write([]byte(fmt.Sprintf("Error: %v\n", context.Cause(ctx))))
+        return
+    }
+    if *reverse {
+        slices.Reverse(files)
+    }
+
+    // Filter in place; sorting needs the entries, but not a second copy of
+    // the listing as strings, which goes out line by line instead
+    listed := files[:0]
+    for _, file := range files {
+        if reservedDirs[file.Name()] && sess.getCwd() == "." {
+            continue
+        }
+        if matched, _ := path.Match(*filter, file.Name()); *filter != "" && !matched {
+            continue
+        }
+        listed = append(listed, file)
+    }
+
+    next := 0
+    if *page > 0 || *size > 0 {
+        listed, next = pageOf(listed, max(*page, 1), cmp.Or(*size, defaultPageSize))
+    }
+
+    out := newListingWriter(stream)
+    for _, file := range listed {
+        name := file.Name()
+        if file.IsDir() {
+            name += "/"
+        }
+        if out.line(name) != nil {
+            return
+        }
+    }
+    if len(listed) == 0 {
+        out.line("No files available.")
+    }
+    if next > 0 {
+        out.line(fmt.Sprintf("/next %d", next))
+    }
+    out.flush()
+}
+
+// sortEntries orders entries by name, size or modification time, smallest
+// or oldest first. Ties, and entries that vanished since they were listed,
+// keep name order.
+func sortEntries(entries []os.DirEntry, by string) error {
+    var key func(os.FileInfo) int64
+    switch by {
+    case "name":
+        return nil // os.ReadDir already sorts by name
+    case "size":
+        key = func(info os.FileInfo) int64 { return info.Size() }
+    case "mtime":
+        key = func(info os.FileInfo) int64 { return info.ModTime().UnixNano() }
+    default:
+        return fmt.Errorf("cannot sort by %q", by)
+    }
+    keys := make(map[string]int64, len(entries))
+    for _, entry := range entries {
+        if info, err := entry.Info(); err == nil {
+            keys[entry.Name()] = key(info)
+        }
+    }
+    slices.SortStableFunc(entries, func(a, b os.DirEntry) int {
+        return cmp.Compare(keys[a.Name()], keys[b.Name()])
+    })
+    return nil
+}
+
+// pageOf returns page of entries, size at a time, and the number of the page
+// after it, or 0 if it is the last.
+func pageOf[T any](entries []T, page, size int) ([]T, int) {
+    if page-1 >= (len(entries)+size-1)/size {
+        return nil, 0
+    }
+    start := (page - 1) * size
+    end := min(start+size, len(entries))
+    if end == len(entries) {
+        return entries[start:end], 0
+    }
+    return entries[start:end], page + 1
+}
+
+// handleCD changes the session's working directory. An empty path returns to
+// the storage root. The new directory is echoed back on success.
+func handleCD(sess *clientSession, stream quic.Stream, dir string) {
+	if dir == "" {
+		dir = "/"
+	}
+	rel, err := sess.resolve(dir)
+	if err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: %v\n", dir, err)))
+		return
+	}
+	root, inside := rootOf(rel)
+	info, err := root.Stat(inside)
+	if storageFailure(err) {
+		logf(stream, "Error changing to %s: %v", dir, err)
+		stream.Write([]byte("Error: " + errStorageUnavailable.Error() + "\n"))
+		return
+	}
+	if err != nil || !info.IsDir() {
+		stream.Write([]byte(fmt.Sprintf("Error: %s is not a directory\n", dir)))
+		return
+	}
+	sess.setCwd(rel)
+	stream.Write([]byte(sess.display(rel) + "\n"))
+}
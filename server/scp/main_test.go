@@ -0,0 +1,560 @@
+package scp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// testSettings returns the defaults the flags give, with storage in a fresh
+// temporary directory, a throwaway certificate and no connection rate
+// limit, for a test to adjust before startServer.
+func testSettings(t testing.TB) *settings {
+	t.Helper()
+	registerFlags.Do(registerSettingFlags)
+	cfg := flagSettings
+	cfg.Volumes = nil
+	cfg.Storage = t.TempDir()
+	cfg.ConnRate = 0
+	cfg.CertFile, cfg.KeyFile = writeTestCert(t)
+	return &cfg
+}
+
+// writeTestCert writes a self-signed certificate for localhost and its key
+// to the test's temporary directory.
+func writeTestCert(t testing.TB) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startServer sets the server up with cfg as main would and serves it on a
+// loopback port until the test ends. It returns the address to dial.
+func startServer(t testing.TB, cfg *settings) string {
+	t.Helper()
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	activeSettings.Store(cfg)
+	storageDir, tempDir, volumes = cfg.Storage, cfg.TempDir, maps.Clone(cfg.Volumes)
+	for _, dir := range volumes {
+		os.MkdirAll(dir, cfg.DirMode.perm())
+	}
+	storageRoots = make(map[string]*os.Root)
+	if err := openStorageRoots(); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStagingDir(); err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := generateTLSConfig(newCertificateStore(cfg.CertFile, cfg.KeyFile), cfg)
+	listener, err := quic.ListenAddr("127.0.0.1:0", tlsConfig, newQUICConfig(cfg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptSessions(listener, cfg.AcceptWorkers)
+	t.Cleanup(func() {
+		for _, s := range activeSessions.list() {
+			s.conn.CloseWithError(errCodeShutdown, "test over")
+		}
+		listener.Close()
+		for _, root := range storageRoots {
+			root.Close()
+		}
+	})
+	return listener.Addr().String()
+}
+
+// dialTest connects to the server at addr, closing the connection when the
+// test ends.
+func dialTest(t testing.TB, addr string) quic.Connection {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(errCodeNone, "test over") })
+	return conn
+}
+
+// exchange sends command and body on a stream of its own, half-closes it
+// and returns everything the server replied.
+func exchange(t testing.TB, conn quic.Connection, command string, body []byte) string {
+	t.Helper()
+	reply, err := tryExchange(conn, command, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+// tryExchange is exchange for goroutines other than the test's own, which
+// must not call t.Fatal.
+func tryExchange(conn quic.Connection, command string, body []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", command, err)
+	}
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	stream.Write(append([]byte(command+"\n"), body...))
+	stream.Close()
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		return "", fmt.Errorf("%s: reading the reply: %w", command, err)
+	}
+	return string(reply), nil
+}
+
+func openTestStream(t testing.TB, conn quic.Connection) quic.Stream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	return stream
+}
+
+// upload stores data as name through an upd with its size announced, and
+// returns the server's reply, "" when it was stored.
+func upload(t testing.TB, conn quic.Connection, name string, data []byte) string {
+	t.Helper()
+	return exchange(t, conn, "upd "+name+" "+strconv.Itoa(len(data)), data)
+}
+
+// download fetches name through a dwd of that one file, returning its bytes
+// or the error line the server sent instead.
+func download(t *testing.T, conn quic.Connection, name string) ([]byte, string) {
+	t.Helper()
+	reply := exchange(t, conn, "dwd "+name, nil)
+	status, data, _ := strings.Cut(reply, "\n")
+	if strings.HasPrefix(status, "Error") {
+		return nil, status
+	}
+	fields := strings.Fields(status)
+	if len(fields) != 4 || fields[0] != "OK" || fields[2] != name || fields[1] != strconv.Itoa(len(data)) {
+		t.Fatalf("dwd %s: unexpected status %q with %d bytes", name, status, len(data))
+	}
+	return []byte(data), ""
+}
+
+// eventually polls cond for up to two seconds, for what the server does
+// after it has already replied.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+func TestUploadDownloadRoundTrip(t *testing.T) {
+	addr := startServer(t, testSettings(t))
+	conn := dialTest(t, addr)
+	files := map[string][]byte{
+		"empty.txt":       {},
+		"small.txt":       []byte("hello\n"),
+		"dir/nested.bin":  randomBytes(t, 200_000),
+		"a/b/c/deep.bin":  randomBytes(t, copyBufferSize+1),
+		"no-newline.data": []byte("no newline at the end"),
+	}
+	for name, data := range files {
+		if reply := upload(t, conn, name, data); reply != "" {
+			t.Fatalf("upd %s: %q", name, reply)
+		}
+	}
+	for name, want := range files {
+		got, errLine := download(t, conn, name)
+		if errLine != "" {
+			t.Fatalf("dwd %s: %s", name, errLine)
+		}
+		if string(got) != string(want) {
+			t.Errorf("dwd %s: got %d bytes, want the %d uploaded", name, len(got), len(want))
+		}
+	}
+}
+
+func randomBytes(t testing.TB, n int) []byte {
+	t.Helper()
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestUploadCancelledMidwayLeavesNoFile(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		staged bool // through the staging directory, as with -backup
+	}{
+		{"beside the destination", false},
+		{"staged", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testSettings(t)
+			cfg.Backup = tc.staged
+			addr := startServer(t, cfg)
+			conn := dialTest(t, addr)
+
+			stream := openTestStream(t, conn)
+			stream.Write([]byte("upd partial.bin 1000000\n"))
+			stream.Write(randomBytes(t, 300_000))
+			// Let the server take in what was sent before the reset
+			eventually(t, "the upload has started", func() bool {
+				return len(storedFiles(t, cfg.Storage)) > 0
+			})
+			stream.CancelWrite(quic.StreamErrorCode(1))
+			stream.CancelRead(quic.StreamErrorCode(1))
+
+			eventually(t, "the partial upload is removed", func() bool {
+				return len(storedFiles(t, cfg.Storage)) == 0
+			})
+			if _, errLine := download(t, conn, "partial.bin"); errLine == "" {
+				t.Error("the cancelled upload can be downloaded")
+			}
+		})
+	}
+}
+
+// TestFailedReuploadKeepsOriginal replaces a stored file with an upload that
+// fails part way, in each way one can, and checks the original is still
+// there, whole, and nothing of the failed upload is left.
+func TestFailedReuploadKeepsOriginal(t *testing.T) {
+	original := []byte("the original contents")
+	for _, tc := range []struct {
+		name string
+		fail func(t *testing.T, conn quic.Connection, storage string)
+	}{
+		{"cancelled", func(t *testing.T, conn quic.Connection, storage string) {
+			stream := openTestStream(t, conn)
+			stream.Write([]byte("upd keep.txt 1000000\n"))
+			stream.Write(randomBytes(t, 300_000))
+			eventually(t, "the upload has started", func() bool {
+				return len(storedFiles(t, storage)) > 1
+			})
+			stream.CancelWrite(quic.StreamErrorCode(1))
+			stream.CancelRead(quic.StreamErrorCode(1))
+			eventually(t, "the partial upload is removed", func() bool {
+				return len(storedFiles(t, storage)) == 1
+			})
+		}},
+		{"truncated", func(t *testing.T, conn quic.Connection, storage string) {
+			if reply := exchange(t, conn, "upd keep.txt 1000000", randomBytes(t, 300_000)); !strings.Contains(reply, "truncated") {
+				t.Errorf("upd: got %q, want it reported truncated", reply)
+			}
+		}},
+		{"out of disk space", func(t *testing.T, conn quic.Connection, storage string) {
+			uploadWriter = func(file *os.File) io.Writer { return &fullDisk{file: file, room: 100_000} }
+			defer func() { uploadWriter = func(file *os.File) io.Writer { return file } }()
+			if reply := upload(t, conn, "keep.txt", randomBytes(t, 300_000)); reply != "Error: server out of disk space\n" {
+				t.Errorf("upd: got %q, want it refused for lack of space", reply)
+			}
+		}},
+	} {
+		for _, staged := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/staged=%t", tc.name, staged), func(t *testing.T) {
+				cfg := testSettings(t)
+				cfg.Backup = staged
+				conn := dialTest(t, startServer(t, cfg))
+				if reply := upload(t, conn, "keep.txt", original); reply != "" {
+					t.Fatalf("first upd: %q", reply)
+				}
+
+				tc.fail(t, conn, cfg.Storage)
+				if data, err := os.ReadFile(filepath.Join(cfg.Storage, "keep.txt")); err != nil || !bytes.Equal(data, original) {
+					t.Errorf("the original holds %q, %v; want %q", data, err, original)
+				}
+				if files := storedFiles(t, cfg.Storage); !slices.Equal(files, []string{"keep.txt"}) {
+					t.Errorf("storage holds %q, want only the original", files)
+				}
+			})
+		}
+	}
+}
+
+// storedFiles lists every regular file under dir, including the staging
+// directory, relative to dir.
+func storedFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	var files []string
+	filepath.WalkDir(dir, func(p string, d os.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			rel, _ := filepath.Rel(dir, p)
+			files = append(files, rel)
+		}
+		return nil
+	})
+	return files
+}
+
+func TestMaxFileSizeBoundary(t *testing.T) {
+	const limit = 1000
+	cfg := testSettings(t)
+	cfg.MaxFileSize = limit
+	addr := startServer(t, cfg)
+	conn := dialTest(t, addr)
+	for _, tc := range []struct {
+		size     int
+		announce bool // send the size with the command, or only count the bytes
+		ok       bool
+	}{
+		{limit - 1, true, true},
+		{limit, true, true},
+		{limit + 1, true, false},
+		{limit - 1, false, true},
+		{limit, false, true},
+		{limit + 1, false, false},
+		{10 * limit, false, false},
+	} {
+		name := fmt.Sprintf("f%d-%t", tc.size, tc.announce)
+		command := "upd " + name
+		if tc.announce {
+			command += " " + strconv.Itoa(tc.size)
+		}
+		reply := exchange(t, conn, command, randomBytes(t, tc.size))
+		_, statErr := os.Stat(filepath.Join(cfg.Storage, name))
+		switch {
+		case tc.ok && (reply != "" || statErr != nil):
+			t.Errorf("%d bytes, announced %t: got %q, want it stored", tc.size, tc.announce, reply)
+		case !tc.ok && reply != "Error: file too large\n":
+			t.Errorf("%d bytes, announced %t: got %q, want it rejected as too large", tc.size, tc.announce, reply)
+		case !tc.ok && statErr == nil:
+			t.Errorf("%d bytes, announced %t: rejected, but the file was kept", tc.size, tc.announce)
+		}
+	}
+}
+
+func TestPageOf(t *testing.T) {
+	entries := []int{1, 2, 3, 4, 5, 6, 7}
+	for _, tc := range []struct {
+		entries    []int
+		page, size int
+		want       []int
+		next       int
+	}{
+		{entries, 1, 3, []int{1, 2, 3}, 2},
+		{entries, 2, 3, []int{4, 5, 6}, 3},
+		{entries, 3, 3, []int{7}, 0},
+		{entries, 4, 3, nil, 0},
+		{entries, 100, 3, nil, 0},
+		{entries, 1, 7, entries, 0},
+		{entries, 1, 8, entries, 0},
+		{entries, 2, 7, nil, 0},
+		{entries, 7, 1, []int{7}, 0},
+		{entries, 6, 1, []int{6}, 7},
+		{entries[:6], 2, 3, []int{4, 5, 6}, 0},
+		{nil, 1, 3, nil, 0},
+		{[]int{}, 1, 3, nil, 0},
+	} {
+		got, next := pageOf(tc.entries, tc.page, tc.size)
+		if !slices.Equal(got, tc.want) || next != tc.next {
+			t.Errorf("pageOf(%d entries, page %d, size %d) = %v, %d; want %v, %d", len(tc.entries), tc.page, tc.size, got, next, tc.want, tc.next)
+		}
+	}
+}
+
+// fullDisk accepts room bytes and then fails every write the way a file
+// on a full filesystem does.
+type fullDisk struct {
+	file *os.File
+	room int
+}
+
+func (d *fullDisk) Write(p []byte) (int, error) {
+	if len(p) > d.room {
+		n, _ := d.file.Write(p[:d.room])
+		d.room = 0
+		return n, &os.PathError{Op: "write", Path: d.file.Name(), Err: syscall.ENOSPC}
+	}
+	d.room -= len(p)
+	return d.file.Write(p)
+}
+
+func TestUploadOutOfDiskSpace(t *testing.T) {
+	uploadWriter = func(file *os.File) io.Writer { return &fullDisk{file: file, room: 100_000} }
+	t.Cleanup(func() { uploadWriter = func(file *os.File) io.Writer { return file } })
+	for _, tc := range []struct {
+		name   string
+		staged bool
+	}{
+		{"direct", false},
+		{"staged", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testSettings(t)
+			cfg.Backup = tc.staged
+			conn := dialTest(t, startServer(t, cfg))
+			if reply := upload(t, conn, "big.bin", randomBytes(t, 300_000)); reply != "Error: server out of disk space\n" {
+				t.Errorf("upd: got %q, want it refused for lack of space", reply)
+			}
+			if reply := exchange(t, conn, "upd unsized.bin", randomBytes(t, 300_000)); reply != "Error: server out of disk space\n" {
+				t.Errorf("upd without a size: got %q, want it refused for lack of space", reply)
+			}
+			if reply := upload(t, conn, "small.bin", []byte("fits")); reply != "" {
+				t.Errorf("upd of a file that fits: %q", reply)
+			}
+			if files := storedFiles(t, cfg.Storage); !slices.Equal(files, []string{"small.bin"}) {
+				t.Errorf("storage holds %q, want only the file that fit", files)
+			}
+		})
+	}
+}
+
+// TestStreamLimit fills a connection's -max-incoming-streams with streams
+// waiting on their command line and checks that one more is held back, not
+// refused, until one of them ends, and that unidirectional streams are
+// refused outright.
+func TestStreamLimit(t *testing.T) {
+	const limit = 3
+	cfg := testSettings(t)
+	cfg.MaxIncomingStreams, cfg.DownloadStreams = limit, 1
+	conn := dialTest(t, startServer(t, cfg))
+
+	var held []quic.Stream
+	for range limit {
+		stream := openTestStream(t, conn)
+		stream.Write([]byte("pi"))
+		held = append(held, stream)
+	}
+	if _, err := conn.OpenStream(); err == nil {
+		t.Fatalf("opened stream %d of a limit of %d without waiting", limit+1, limit)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	_, err := conn.OpenStreamSync(ctx)
+	cancel()
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("stream %d of a limit of %d: got %v, want it to wait", limit+1, limit, err)
+	}
+
+	// Once one ends, the waiting stream opens and is served
+	opened := make(chan string, 1)
+	go func() {
+		reply, err := tryExchange(conn, "ping", nil)
+		if err != nil {
+			reply = err.Error()
+		}
+		opened <- reply
+	}()
+	held[0].Write([]byte("ng\n"))
+	held[0].Close()
+	if reply, _ := io.ReadAll(held[0]); string(reply) != "pong\n" {
+		t.Fatalf("held stream: got %q", reply)
+	}
+	select {
+	case reply := <-opened:
+		if reply != "pong\n" {
+			t.Errorf("stream opened after one ended: got %q", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no stream opened after one of the held ones ended")
+	}
+	for _, stream := range held[1:] {
+		stream.Write([]byte("ng\n"))
+		stream.Close()
+		if reply, _ := io.ReadAll(stream); string(reply) != "pong\n" {
+			t.Errorf("held stream: got %q", reply)
+		}
+	}
+
+	if _, err := conn.OpenUniStream(); err == nil {
+		t.Error("opened a unidirectional stream, want them refused")
+	}
+}
+
+func TestContentStartingWithError(t *testing.T) {
+	conn := dialTest(t, startServer(t, testSettings(t)))
+	files := []struct{ name, data string }{
+		{"a.txt", "Error: this is the file, not a failure\n"},
+		{"b.txt", "Error:"},
+		{"c.txt", "OK 5 c.txt 0\nError: nested status lines\n"},
+	}
+	for _, f := range files {
+		if reply := upload(t, conn, f.name, []byte(f.data)); reply != "" {
+			t.Fatalf("upd %s: %q", f.name, reply)
+		}
+		if got, errLine := download(t, conn, f.name); errLine != "" || string(got) != f.data {
+			t.Errorf("dwd %s: got %q, %q; want %q", f.name, got, errLine, f.data)
+		}
+	}
+
+	// In a batch each file is framed by its status line, error or not
+	reply := []byte(exchange(t, conn, "dwd a.txt missing.txt b.txt c.txt", nil))
+	var got []string
+	for len(reply) > 0 {
+		status, rest, _ := bytes.Cut(reply, []byte("\n"))
+		fields := strings.Fields(string(status))
+		if len(fields) > 0 && fields[0] == "Error:" {
+			got, reply = append(got, string(status)), rest
+			continue
+		}
+		size, err := strconv.Atoi(fields[1])
+		if len(fields) != 4 || fields[0] != "OK" || err != nil || size > len(rest) {
+			t.Fatalf("unexpected status %q", status)
+		}
+		got, reply = append(got, fields[2]+"="+string(rest[:size])), rest[size:]
+	}
+	want := []string{
+		"a.txt=" + files[0].data,
+		"Error: missing.txt: could not open file",
+		"b.txt=" + files[1].data,
+		"c.txt=" + files[2].data,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("batch download:\ngot  %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,161 @@
+package scp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// maxObservedCommand is how much of the first line of a stream is kept for
+// the summary.
+const maxObservedCommand = 1024
+
+// observedStream records what a handler does with its stream, for the
+// summary observeStream logs once the handler returns. It passes every call
+// through unchanged.
+type observedStream struct {
+	quic.Stream
+
+	mu          sync.Mutex
+	command     []byte // first line read from the client
+	commandDone bool
+	in, out     int64
+	reply       string // first error reply sent to the client
+	err         string // first stream error or reset, if any
+}
+
+func (s *observedStream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.in += int64(n)
+	if !s.commandDone {
+		line := p[:n]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i]
+			s.commandDone = true
+		}
+		s.command = append(s.command, line[:min(len(line), maxObservedCommand-len(s.command))]...)
+	}
+	if err != nil && !errors.Is(err, io.EOF) {
+		s.noteLocked(err.Error())
+	}
+	return n, err
+}
+
+func (s *observedStream) Write(p []byte) (int, error) {
+	return s.write(p, true)
+}
+
+// write passes p on and counts it; replies are only looked for in p if it
+// may be one.
+func (s *observedStream) write(p []byte, reply bool) (int, error) {
+	n, err := s.Stream.Write(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.out += int64(n)
+	if err != nil && !isTimeout(err) {
+		// A write that timed out may be retried, and one that is given up
+		// on is reset, which is noted then.
+		s.noteLocked(err.Error())
+	} else if err == nil && reply && s.reply == "" && isErrorReply(p) {
+		s.reply = strings.TrimSpace(strings.TrimPrefix(string(p), "Error: "))
+	}
+	return n, err
+}
+
+// observedPayload writes file data to an observedStream, where it is counted
+// but never taken for an error reply, whatever the file starts with.
+type observedPayload struct{ s *observedStream }
+
+func (p observedPayload) Write(b []byte) (int, error) {
+	return p.s.write(b, false)
+}
+
+// payloadWriter returns the writer a handler sends file data to stream
+// through. Status and errors travel in the line ahead of the data, so none of
+// the data is ever read as a reply.
+func payloadWriter(stream quic.Stream) io.Writer {
+	inner := stream
+	if r, ok := inner.(*requestStream); ok {
+		inner = r.Stream
+	}
+	if obs, ok := inner.(*observedStream); ok {
+		return observedPayload{obs}
+	}
+	return stream
+}
+
+// isErrorReply tells the one-line error replies handlers write apart from
+// the other lines they send.
+func isErrorReply(p []byte) bool {
+	return len(p) <= maxObservedCommand && bytes.HasPrefix(p, []byte("Error: ")) && bytes.IndexByte(p, '\n') == len(p)-1
+}
+
+func (s *observedStream) CancelRead(code quic.StreamErrorCode) {
+	s.note(fmt.Sprintf("stopped reading (code %d)", code))
+	s.Stream.CancelRead(code)
+}
+
+func (s *observedStream) CancelWrite(code quic.StreamErrorCode) {
+	s.note(fmt.Sprintf("reset (code %d)", code))
+	s.Stream.CancelWrite(code)
+}
+
+func (s *observedStream) note(err string) {
+	s.mu.Lock()
+	s.noteLocked(err)
+	s.mu.Unlock()
+}
+
+func (s *observedStream) noteLocked(err string) {
+	if s.err == "" {
+		s.err = err
+	}
+}
+
+// streamDone is the code the server stops reading a stream with once its
+// command has been handled.
+const streamDone quic.StreamErrorCode = 0
+
+// observeStream runs serve on stream and logs when it starts and, in one
+// line, what came of it: the command, how long it took, the bytes read and
+// written and the first error. An error reply explains more than the reset
+// that often accompanies it, so it is preferred.
+func observeStream(sess *clientSession, stream quic.Stream, serve func(*clientSession, quic.Stream)) {
+	obs := &observedStream{Stream: stream}
+	log.Printf("Stream %d from %s: started", stream.StreamID(), sess.addr())
+	start := time.Now()
+	serve(sess, obs)
+	elapsed := time.Since(start)
+	// Handlers read no further than their command needs, and quic-go only
+	// counts a stream against max_incoming_streams as long as either side
+	// of it is open, so stop reading here for it to be released.
+	stream.CancelRead(streamDone)
+
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	id, command := splitRequestID(strings.TrimSpace(string(obs.command)))
+	prefix := ""
+	if id != "" {
+		prefix = "[" + id + "] "
+	}
+	outcome := "ok"
+	if obs.reply != "" {
+		outcome = "error: " + obs.reply
+	} else if obs.err != "" {
+		outcome = "error: " + obs.err
+	}
+	if outcome != "ok" {
+		stats.errors.Add(1)
+	}
+	log.Printf("%sStream %d from %s: %q finished in %s, %d bytes in, %d bytes out, %s",
+		prefix, stream.StreamID(), sess.addr(), redactCommand(command), elapsed.Round(time.Millisecond), obs.in, obs.out, outcome)
+}
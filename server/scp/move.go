@@ -0,0 +1,86 @@
+package scp
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// handleMoveDownload sends one file and deletes it once the client has
+// confirmed that it arrived intact. The exchange is:
+//
+//	client: dwd --move <name>
+//	server: OK <size>, the file's bytes, then its SHA-256 in hex
+//	client: ack
+//	server: OK
+//
+// The file's lock is held from before it is opened until it is removed, so
+// of several clients moving the same file only the first gets it; the rest
+// find it gone. Anything other than an ack leaves the file in place.
+func handleMoveDownload(sess *clientSession, stream quic.Stream, reader *bufio.Reader, fileName string) {
+	if fileName == "" || strings.ContainsAny(fileName, " \t") {
+		writeUsage(stream, "dwd --move")
+		return
+	}
+	rel, err := sess.resolve(fileName)
+	if err != nil {
+		logf(stream, "Rejected move of %s: %v", fileName, err)
+		stream.Write([]byte(fmt.Sprintf("Error: Could not open file %s\n", fileName)))
+		return
+	}
+	unlock := fileLocks.lock(rel)
+	defer unlock()
+
+	file, err := openStored(rel)
+	if err != nil {
+		logf(stream, "Error opening file %s: %v", fileName, err)
+		stream.Write([]byte("Error: " + storageReason(err, "Could not open file "+fileName) + "\n"))
+		return
+	}
+	defer file.Close()
+	if !file.info.Mode().IsRegular() {
+		stream.Write([]byte(fmt.Sprintf("Error: Could not open file %s\n", fileName)))
+		return
+	}
+
+	printf(stream, "Moving file: %s (%d bytes)\n", fileName, file.size)
+	cfg := currentSettings()
+	timeout := time.Duration(cfg.TransferTimeout)
+	stream.Write([]byte(fmt.Sprintf("OK %d\n", file.size)))
+	h := sha256.New()
+	dst := cfg.bandwidth.writer(withWriteTimeout(payloadWriter(stream), stream, timeout))
+	sent, err := io.Copy(io.MultiWriter(dst, h), file)
+	sess.sent(sent)
+	if isTimeout(err) {
+		logf(stream, "Move of %s timed out after %d bytes, keeping the file", fileName, sent)
+		stream.CancelWrite(streamTimedOut)
+		return
+	}
+	if err != nil {
+		logf(stream, "Error sending file %s, keeping it: %v", fileName, err)
+		return
+	}
+	stream.Write([]byte(hex.EncodeToString(h.Sum(nil)) + "\n"))
+
+	ack, err := bufio.NewReader(withReadTimeout(reader, stream, timeout)).ReadString('\n')
+	if strings.TrimSpace(ack) != "ack" {
+		logf(stream, "Move of %s not acknowledged, keeping the file (%v)", fileName, err)
+		return
+	}
+	clearDeadlines(stream)
+	root, inside := rootOf(rel)
+	if err := root.Remove(inside); err != nil {
+		logf(stream, "Error removing moved file %s: %v", fileName, err)
+		stream.Write([]byte("Error: " + storageReason(err, "could not remove "+fileName) + "\n"))
+		return
+	}
+	stats.filesServed.Add(1)
+	printf(stream, "Moved file %s to the client\n", displayPath(rel))
+	stream.Write([]byte("OK\n"))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package scp
+
+import "os"
+
+// preallocate extends file to size bytes so the filesystem can allocate it
+// in one go. This is best effort: where it fails the file simply grows as it
+// is written. The caller truncates the file to the length actually received.
+func preallocate(file *os.File, size int64) error {
+	file.Truncate(size)
+	return nil
+}
@@ -0,0 +1,66 @@
+package scp
+
+import (
+	"bufio"
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+
+	"quic-test/server/registry"
+)
+
+// builtinCommands are the first words of the commands handleStream serves
+// itself, which registry.Handle refuses.
+var builtinCommands = []string{
+	"upd", "upd-batch", "dwd", "ls", "find", "manifest", "versions", "volumes",
+	"codecs", "download-streams", "ping", "bench", "symlink", "rm", "cd", "pwd",
+	"begin-upload", "resume-upload", "auth", "clients", "info", "kick", "help",
+}
+
+func init() {
+	registry.Reserve(builtinCommands...)
+}
+
+// serveRegistered runs command on stream if it names a command added with
+// registry.Handle, and reports whether it did. The session's permission has
+// been checked already, see commandPermission.
+func serveRegistered(ctx context.Context, sess *clientSession, stream quic.Stream, body *bufio.Reader, command string) bool {
+	name, args, _ := strings.Cut(command, " ")
+	c, ok := registry.Lookup(name)
+	if !ok {
+		return false
+	}
+	c.Serve(ctx, &registry.Request{
+		Args:       strings.TrimSpace(args),
+		Body:       body,
+		Stream:     stream,
+		Addr:       sess.addr(),
+		Permission: registry.Level(sess.permission()),
+	})
+	return true
+}
+
+// handleHelp lists the commands sess may run, built-in and registered, one
+// per line with its syntax, sorted by name.
+func handleHelp(sess *clientSession, stream quic.Stream) {
+	lines := make(map[string]string) // syntax by the words that select the command
+	for _, name := range builtinCommands {
+		lines[name] = name
+	}
+	for name, usage := range commandUsage {
+		lines[name] = usage
+	}
+	for _, c := range registry.Commands() {
+		lines[c.Name] = c.Usage
+	}
+	var reply strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(lines)) {
+		if commandPermission(name) <= sess.permission() {
+			reply.WriteString(lines[name] + "\n")
+		}
+	}
+	stream.Write([]byte(reply.String()))
+}
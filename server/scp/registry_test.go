@@ -0,0 +1,111 @@
+package scp
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/quic-go/quic-go"
+
+	"quic-test/server/registry"
+)
+
+func TestRegistryLevels(t *testing.T) {
+	for level, perm := range map[registry.Level]permission{
+		registry.None:  permNone,
+		registry.Read:  permRead,
+		registry.Write: permWrite,
+		registry.Admin: permAdmin,
+	} {
+		if permission(level) != perm {
+			t.Errorf("registry level %d is permission %s, want %s", level, permission(level), perm)
+		}
+	}
+}
+
+func TestBuiltinCommandsReserved(t *testing.T) {
+	for _, name := range builtinCommands {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("registry.Handle(%q) registered a built-in command", name)
+				}
+			}()
+			registry.Handle(name, func(context.Context, *registry.Request) {})
+		}()
+	}
+	for name := range commandUsage {
+		if first, _, _ := strings.Cut(name, " "); !slices.Contains(builtinCommands, first) {
+			t.Errorf("%s has a usage but is missing from builtinCommands", name)
+		}
+	}
+}
+
+var registeredRuns int
+
+// TestRegisteredCommands registers commands on a running server and checks
+// that they are dispatched, permission-checked and listed by help like the
+// built-in ones.
+func TestRegisteredCommands(t *testing.T) {
+	cfg := testSettings(t)
+	cfg.Anonymous = permNone
+	cfg.tokens = []accessToken{{"ro", permRead, ""}, {"rw", permWrite, ""}}
+	addr := startServer(t, cfg)
+	ran := func(_ context.Context, req *registry.Request) {
+		req.Stream.Write([]byte("ran " + req.Args + " as " + permission(req.Permission).String() + "\n"))
+	}
+	// The registry outlives the test, so each run registers names of its own
+	registeredRuns++
+	write, open := fmt.Sprintf("test-write-%d", registeredRuns), fmt.Sprintf("test-open-%d", registeredRuns)
+	registry.Handle(write, ran, registry.Usage(write+" <arg>"), registry.Permission(registry.Write))
+	registry.Handle(open, ran, registry.Permission(registry.None))
+
+	login := func(t *testing.T, token string) quic.Connection {
+		conn := dialTest(t, addr)
+		if token != "" {
+			if reply := exchange(t, conn, "auth "+token, nil); !strings.HasPrefix(reply, "OK ") {
+				t.Fatalf("auth: %q", reply)
+			}
+		}
+		return conn
+	}
+	anonymous, ro, rw := login(t, ""), login(t, "ro"), login(t, "rw")
+
+	for _, tc := range []struct {
+		conn    quic.Connection
+		command string
+		want    string
+	}{
+		{anonymous, open + "  x ", "ran x as none\n"},
+		{ro, write + " x", "Error: write access required\n"},
+		{rw, write + " x", "ran x as read-write\n"},
+	} {
+		if got := exchange(t, tc.conn, tc.command, nil); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.command, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		access           string
+		conn             quic.Connection
+		listed, unlisted []string
+	}{
+		{"no", anonymous, []string{"auth <token>", "ping", open}, []string{"ls", write + " <arg>"}},
+		{"read-only", ro, []string{"dwd <file>...", open}, []string{"rm <file>", write + " <arg>", "clients"}},
+		{"read-write", rw, []string{"rm <file>", write + " <arg>"}, []string{"clients", "kick <addr> [<reason>]"}},
+	} {
+		lines := strings.Split(exchange(t, tc.conn, "help", nil), "\n")
+		for _, line := range tc.listed {
+			if !slices.Contains(lines, line) {
+				t.Errorf("help with %s access does not list %q", tc.access, line)
+			}
+		}
+		for _, line := range tc.unlisted {
+			if slices.Contains(lines, line) {
+				t.Errorf("help with %s access lists %q", tc.access, line)
+			}
+		}
+	}
+}
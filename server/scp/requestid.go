@@ -0,0 +1,53 @@
+package scp
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// maxRequestIDLen bounds the ID a client may tag a command with.
+const maxRequestIDLen = 32
+
+// requestStream is a stream whose command was tagged with a request ID. The
+// client picks the ID and shows it with any error, so one failed command
+// can be found in the server log.
+type requestStream struct {
+	quic.Stream
+	id string
+}
+
+// splitRequestID separates an optional "#<id> " tag from the front of a
+// command line.
+func splitRequestID(command string) (id, rest string) {
+	tag, rest, ok := strings.Cut(command, " ")
+	if !ok || len(tag) < 2 || len(tag) > maxRequestIDLen+1 || tag[0] != '#' {
+		return "", command
+	}
+	for _, c := range tag[1:] {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return "", command
+		}
+	}
+	return tag[1:], rest
+}
+
+// requestPrefix is what log lines for stream start with.
+func requestPrefix(stream quic.Stream) string {
+	if r, ok := stream.(*requestStream); ok {
+		return "[" + r.id + "] "
+	}
+	return ""
+}
+
+// logf is log.Printf for a line about the request on stream.
+func logf(stream quic.Stream, format string, args ...any) {
+	log.Print(requestPrefix(stream) + fmt.Sprintf(format, args...))
+}
+
+// printf is fmt.Printf for a line about the request on stream.
+func printf(stream quic.Stream, format string, args ...any) {
+	fmt.Print(requestPrefix(stream) + fmt.Sprintf(format, args...))
+}
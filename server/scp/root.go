@@ -0,0 +1,162 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+)
+
+// storageRoots holds storageDir, under "", and every volume, opened once at
+// startup. Stored files are opened, created and listed through them rather
+// than by joining paths, so even a name that got past resolve, or a symlink
+// planted in storage, cannot reach anything outside its volume. Symlinks
+// that stay inside still work.
+var storageRoots = make(map[string]*os.Root)
+
+// openStorageRoots opens storageDir and the volumes.
+func openStorageRoots() error {
+	dirs := map[string]string{"": storageDir}
+	for name, dir := range volumes {
+		dirs[name] = dir
+	}
+	for name, dir := range dirs {
+		root, err := os.OpenRoot(dir)
+		if err != nil {
+			return err
+		}
+		storageRoots[name] = root
+	}
+	return nil
+}
+
+// checkStorage makes sure the server can list, create and remove files in
+// storageDir and every volume, so that storage it cannot use stops it at
+// startup rather than failing every command that touches a file.
+func checkStorage() error {
+	probe := fmt.Sprintf(".quicscp-check-%d", os.Getpid())
+	for _, root := range storageRoots {
+		dir, err := root.Open(".")
+		if err == nil {
+			_, err = dir.ReadDir(1)
+			dir.Close()
+		}
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("%s is not readable: %w", root.Name(), err)
+		}
+		f, err := root.OpenFile(probe, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", root.Name(), err)
+		}
+		f.Close()
+		if err := root.Remove(probe); err != nil {
+			return fmt.Errorf("%s: cannot remove files: %w", root.Name(), err)
+		}
+	}
+	return nil
+}
+
+// errStorageUnavailable is the reason a client is given when the server
+// cannot get at its storage at all, as when it has lost permission to the
+// storage directory or the disk behind it fails, rather than a reason about
+// the one file.
+var errStorageUnavailable = errors.New("storage unavailable")
+
+// storageFailure reports whether err, from accessing storage, is such a
+// failure.
+func storageFailure(err error) bool {
+	return errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EIO) || errors.Is(err, syscall.EROFS)
+}
+
+// storageReason is what to tell a client about err, from accessing storage:
+// errStorageUnavailable on a storage failure and reason otherwise, since
+// the underlying error names paths the client should not see.
+func storageReason(err error, reason string) string {
+	if storageFailure(err) {
+		return errStorageUnavailable.Error()
+	}
+	return reason
+}
+
+// rootOf returns the root of rel's volume and rel's path inside it.
+func rootOf(rel string) (*os.Root, string) {
+	if name, inside, ok := splitVolume(rel); ok {
+		return storageRoots[name], inside
+	}
+	return storageRoots[""], rel
+}
+
+// leadsOut reports whether inside, in root, is or lies under a symlink that
+// points out of root. Such a link is neither followed nor replaced or
+// removed, so nothing a client does with it depends on what lies outside
+// storage.
+func leadsOut(root *os.Root, inside string) bool {
+	info, err := root.Lstat(inside)
+	if err != nil {
+		return !errors.Is(err, fs.ErrNotExist)
+	}
+	if info.Mode()&fs.ModeSymlink == 0 {
+		return false
+	}
+	_, err = root.Stat(inside)
+	return err != nil && !errors.Is(err, fs.ErrNotExist)
+}
+
+// readStoredDir lists the stored directory rel, sorted by name like
+// os.ReadDir.
+func readStoredDir(rel string) ([]os.DirEntry, error) {
+	root, inside := rootOf(rel)
+	dir, err := root.Open(inside)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	entries, err := dir.ReadDir(-1)
+	slices.SortFunc(entries, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, err
+}
+
+// walkStored walks the stored directory rel through its volume's root, like
+// fs.WalkDir, skipping the server's reserved directories. fn gets each path
+// relative to rel, slash-separated, with "." for rel itself. The walk stops
+// with the cause of ctx once it is done.
+func walkStored(ctx context.Context, rel string, fn func(name string, d fs.DirEntry) error) error {
+	root, inside := rootOf(rel)
+	_, _, inVolume := splitVolume(rel)
+	start := filepath.ToSlash(inside)
+	return fs.WalkDir(root.FS(), start, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if d.IsDir() && !inVolume && p != "." && path.Dir(p) == "." && reservedDirs[d.Name()] {
+			return fs.SkipDir
+		}
+		name := p
+		if start != "." {
+			name = strings.TrimPrefix(strings.TrimPrefix(p, start), "/")
+			if name == "" {
+				name = "."
+			}
+		}
+		return fn(name, d)
+	})
+}
+
+// inRoot reports whether the server-side path lies inside root, and where.
+func inRoot(root *os.Root, path string) (string, bool) {
+	rel, err := filepath.Rel(root.Name(), path)
+	if err != nil || !filepath.IsLocal(rel) {
+		return "", false
+	}
+	return rel, true
+}
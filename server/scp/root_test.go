@@ -0,0 +1,101 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// moveDownload runs dwd --move on name, acknowledging the file if it is
+// sent, and returns every line the server replied with.
+func moveDownload(t *testing.T, addr string, name string) string {
+	t.Helper()
+	stream := openTestStream(t, dialTest(t, addr))
+	stream.Write([]byte("dwd --move " + name + "\n"))
+	reader := bufio.NewReader(stream)
+	line, _ := reader.ReadString('\n')
+	if !strings.HasPrefix(line, "OK ") {
+		return line
+	}
+	stream.Write([]byte("ack\n"))
+	stream.Close()
+	rest, _ := io.ReadAll(reader)
+	return line + string(rest)
+}
+
+// TestSymlinksOutOfStorage plants links in storage to a file and a
+// directory outside it, by absolute path and through "..", and checks that
+// no command reads, writes or removes anything through them, or removes
+// the links.
+func TestSymlinksOutOfStorage(t *testing.T) {
+	cfg := testSettings(t)
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.MkdirAll(outside, 0o755)
+	secret := bytes.Repeat([]byte("s"), 12345)
+	os.WriteFile(filepath.Join(outside, "secret.txt"), secret, 0o644)
+	rel, err := filepath.Rel(cfg.Storage, outside)
+	if err != nil || !strings.HasPrefix(rel, "..") {
+		t.Fatalf("%s is not outside %s", outside, cfg.Storage)
+	}
+	links := map[string]string{
+		"abs-file": filepath.Join(outside, "secret.txt"),
+		"rel-file": filepath.Join(rel, "secret.txt"),
+		"abs-dir":  outside,
+		"rel-dir":  rel,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(cfg.Storage, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr := startServer(t, cfg)
+	conn := dialTest(t, addr)
+
+	refused := func(what, reply string) {
+		t.Helper()
+		if !strings.HasPrefix(reply, "Error") {
+			t.Errorf("%s: got %q, want it refused", what, reply)
+		}
+	}
+	for _, file := range []string{"abs-file", "rel-file", "abs-dir/secret.txt", "rel-dir/secret.txt"} {
+		data, errLine := download(t, conn, file)
+		refused("dwd "+file, errLine)
+		if len(data) > 0 {
+			t.Errorf("dwd %s: sent %d bytes from outside storage", file, len(data))
+		}
+		refused("upd "+file, upload(t, conn, file, []byte("overwritten")))
+		refused("begin-upload "+file, exchange(t, conn, "begin-upload "+file+" 5", nil))
+		refused("rm "+file, exchange(t, conn, "rm "+file, nil))
+		refused("dwd --move "+file, moveDownload(t, addr, file))
+	}
+	for _, dir := range []string{"abs-dir", "rel-dir"} {
+		refused("upd into "+dir, upload(t, conn, dir+"/new.txt", []byte("planted")))
+		refused("begin-upload into "+dir, exchange(t, conn, "begin-upload "+dir+"/new.txt 5", nil))
+		refused("cd "+dir, exchange(t, conn, "cd "+dir, nil))
+		refused("rm "+dir, exchange(t, conn, "rm "+dir, nil))
+		if reply := exchange(t, conn, "ls -R "+dir, nil); strings.Contains(reply, "secret") {
+			t.Errorf("ls -R %s listed what is outside storage: %q", dir, reply)
+		}
+	}
+	for _, command := range []string{"ls", "ls -R", "find secret", "manifest"} {
+		if reply := exchange(t, conn, command, nil); strings.Contains(reply, "secret") || strings.Contains(reply, "12345") {
+			t.Errorf("%s showed what is outside storage: %q", command, reply)
+		}
+	}
+
+	if data, err := os.ReadFile(filepath.Join(outside, "secret.txt")); err != nil || !bytes.Equal(data, secret) {
+		t.Errorf("the file outside storage was changed: %d bytes, %v", len(data), err)
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("files were written outside storage: %v", entries)
+	}
+	for name, target := range links {
+		if got, err := os.Readlink(filepath.Join(cfg.Storage, name)); err != nil || got != target {
+			t.Errorf("the link %s was replaced or removed: %q, %v", name, got, err)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// scanTimeout bounds a single scanner run. A scanner that hangs rejects the
+// upload rather than holding the file's lock forever.
+const scanTimeout = 5 * time.Minute
+
+var errScanRejected = errors.New("upload rejected by scanner")
+
+// scanFile runs scanCmd with path appended as its last argument. Anything
+// other than a clean exit, including a scanner that cannot be started,
+// returns errScanRejected.
+func scanFile(scanCmd, path, name string) error {
+	args := strings.Fields(scanCmd)
+	ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, args[0], append(args[1:], path)...).CombinedOutput()
+	if err != nil {
+		log.Printf("Scanner rejected %s: %v: %s", name, err, strings.TrimSpace(string(out)))
+		return errScanRejected
+	}
+	return nil
+}
+
+// publishScanned scans the staged file at path and, if it is clean, moves it
+// into storage as rel. A rejected file is removed.
+func publishScanned(scanCmd, path, rel, name string) error {
+	if err := scanFile(scanCmd, path, name); err != nil {
+		os.Remove(path)
+		return err
+	}
+	return moveIntoPlace(path, rel)
+}
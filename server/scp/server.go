@@ -0,0 +1,149 @@
+// Package scp is the quic-scp server. The quic-scp binary is no more than a
+// call to Main; a build of the server with commands of its own calls Main
+// from a main package that also imports the packages adding them with
+// registry.Handle, and needs no change to this one.
+package scp
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Server is a server started by Start.
+type Server struct {
+	listener *quic.Listener
+}
+
+var (
+	// registerFlags registers the settings' flags on flag.CommandLine, the
+	// first time the server is started.
+	registerFlags sync.Once
+	// running is set from Start to Close. The settings, storage and
+	// counters a server uses are the process's own, so there can be only
+	// one at a time.
+	running atomic.Bool
+)
+
+// Main runs the server as os.Args ask, until it is shut down by SIGINT or
+// SIGTERM, and exits if it cannot start.
+func Main() {
+	s, err := Start(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Server listening on %s...\n", s.Addr())
+	shutdownOnSignal(s)
+	if err := s.Serve(); err != nil {
+		log.Fatalf("Listener stopped, no more clients can connect: %v", err)
+	}
+}
+
+// Start parses args, the server's command line without the program name,
+// then opens storage and starts listening, but returns before accepting
+// any client; see Serve. args are parsed on flag.CommandLine, so they may
+// also hold flags a main package defined there. Only one server may run
+// in a process at a time.
+func Start(args []string) (s *Server, err error) {
+	if !running.CompareAndSwap(false, true) {
+		return nil, errors.New("a server is already running in this process")
+	}
+	defer func() {
+		if err != nil {
+			running.Store(false)
+		}
+	}()
+	registerFlags.Do(registerSettingFlags)
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadSettings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load settings: %w", err)
+	}
+	activeSettings.Store(cfg)
+
+	if cfg.AuditLog != "" {
+		if err := openAuditLog(cfg.AuditLog); err != nil {
+			return nil, fmt.Errorf("failed to open audit log: %w", err)
+		}
+	}
+
+	// Initialize storage directory
+	storageDir = cfg.Storage
+	tempDir = cfg.TempDir
+	os.MkdirAll(storageDir, cfg.DirMode.perm())
+	volumes = maps.Clone(cfg.Volumes)
+	for _, dir := range volumes {
+		os.MkdirAll(dir, cfg.DirMode.perm())
+	}
+	if err := openStorageRoots(); err != nil {
+		return nil, fmt.Errorf("failed to open storage: %w", err)
+	}
+	if err := checkStorage(); err != nil {
+		return nil, fmt.Errorf("storage is not usable: %w", err)
+	}
+	if cfg.StorageKeyFile != "" {
+		if err := loadStorageKey(cfg.StorageKeyFile); err != nil {
+			return nil, fmt.Errorf("failed to load storage key: %w", err)
+		}
+	}
+	recoverTransfers()
+	expireTransfersPeriodically()
+	if err := checkStagingDir(); err != nil {
+		return nil, fmt.Errorf("temp directory %s is not usable: %w", stagingDir(), err)
+	}
+	clearStaging()
+	if cfg.ChecksumCache != "" {
+		persistChecksums(cfg.ChecksumCache)
+	}
+
+	// Start QUIC server
+	certs := newCertificateStore(cfg.CertFile, cfg.KeyFile)
+	tlsConfig := generateTLSConfig(certs, cfg)
+	reloadOnHangup(certs)
+	listener, err := listenQUIC(cfg.Addr, tlsConfig, newQUICConfig(cfg), cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start server: %w", err)
+	}
+	return &Server{listener: listener}, nil
+}
+
+// Addr is the address the server listens on.
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Serve accepts clients until Close is called, when it returns nil, or the
+// listener fails.
+func (s *Server) Serve() error {
+	err := acceptSessions(s.listener, currentSettings().AcceptWorkers)
+	if errors.Is(err, quic.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close closes every connection with errCodeShutdown and then the
+// listener, so that clients are told the server went away on purpose
+// instead of timing out. Another server may be started after it.
+func (s *Server) Close() error {
+	for _, sess := range activeSessions.list() {
+		sess.conn.CloseWithError(errCodeShutdown, "server shutting down")
+	}
+	err := s.listener.Close()
+	for _, root := range storageRoots {
+		root.Close()
+	}
+	running.Store(false)
+	return err
+}
@@ -0,0 +1,132 @@
+package scp_test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+
+	_ "quic-test/server/echo"
+	"quic-test/server/registry"
+	"quic-test/server/scp"
+)
+
+// shout is added the way a package of an embedder's adds a command: from
+// init, with neither package scp nor any main naming it.
+func init() {
+	registry.Handle("shout", func(_ context.Context, req *registry.Request) {
+		req.Stream.Write([]byte(strings.ToUpper(req.Args) + "\n"))
+	}, registry.Usage("shout <text>"))
+}
+
+// start runs a server the way a main package does, storing files in a
+// temporary directory, and connects to it. The server is closed when the
+// test ends, which must stop Serve without an error.
+func start(t *testing.T) (*scp.Server, quic.Connection) {
+	t.Helper()
+	certFile, keyFile := scp.WriteTestCert(t)
+	s, err := scp.Start([]string{"-addr", "127.0.0.1:0", "-storage", t.TempDir(), "-cert", certFile, "-key", keyFile, "-conn-rate", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve() }()
+	t.Cleanup(func() {
+		if err := s.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("Serve after Close: %v", err)
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, s.Addr().String(), &tls.Config{InsecureSkipVerify: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, conn
+}
+
+// exchange sends command and body on a stream of its own and returns the
+// reply.
+func exchange(t *testing.T, conn quic.Connection, command string, body []byte) string {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.SetDeadline(time.Now().Add(10 * time.Second))
+	stream.Write(append([]byte(command+"\n"), body...))
+	stream.Close()
+	reply, err := io.ReadAll(stream)
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	return string(reply)
+}
+
+// TestImportedCommands checks that the commands of the packages linked into
+// this one, echo by its import and shout by this file's init, are served
+// and listed by help.
+func TestImportedCommands(t *testing.T) {
+	_, conn := start(t)
+	if _, err := scp.Start(nil); err == nil {
+		t.Error("a second server started while the first was running")
+	}
+	for _, tc := range []struct{ command, want string }{
+		{"echo hello  there", "hello  there\n"},
+		{"echo", "Error: usage: echo <text>\n"},
+		{"shout hello", "HELLO\n"},
+	} {
+		if got := exchange(t, conn, tc.command, nil); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.command, got, tc.want)
+		}
+	}
+	lines := strings.Split(exchange(t, conn, "help", nil), "\n")
+	for _, line := range []string{"echo <text>", "shout <text>"} {
+		if !slices.Contains(lines, line) {
+			t.Errorf("help does not list %q", line)
+		}
+	}
+}
+
+// TestSnapshot checks that what a client does shows up in the counters.
+// They count the whole process, so only the change is compared.
+func TestSnapshot(t *testing.T) {
+	s, conn := start(t)
+	data := []byte("some bytes to count")
+	before := s.Snapshot()
+	if reply := exchange(t, conn, "upd counted.txt "+strconv.Itoa(len(data)), data); reply != "" {
+		t.Fatalf("upd: %q", reply)
+	}
+	if reply := exchange(t, conn, "dwd counted.txt", nil); !strings.HasSuffix(reply, string(data)) {
+		t.Fatalf("dwd: %q", reply)
+	}
+	after := s.Snapshot()
+	for _, c := range []struct {
+		name      string
+		got, want int64
+	}{
+		{"files received", after.FilesReceived - before.FilesReceived, 1},
+		{"files served", after.FilesServed - before.FilesServed, 1},
+		{"bytes in", after.BytesIn - before.BytesIn, int64(len(data))},
+		{"bytes out", after.BytesOut - before.BytesOut, int64(len(data))},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s went up by %d, want %d", c.name, c.got, c.want)
+		}
+	}
+	if after.Sessions < 1 {
+		t.Errorf("%d sessions with a client connected", after.Sessions)
+	}
+}
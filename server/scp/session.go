@@ -0,0 +1,259 @@
+package scp
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+var (
+	errOutsideStorage = errors.New("path escapes storage directory")
+	errReservedPath   = errors.New("path is reserved by the server")
+)
+
+// clientSession holds the state shared by every stream of one client
+// connection.
+type clientSession struct {
+	conn        quic.Connection
+	connectedAt time.Time
+	bytes       atomic.Int64 // payload bytes uploaded and downloaded, see received and sent
+
+	mu      sync.Mutex
+	cwd     string                        // remote working directory, relative to storageDir
+	authed  bool                          // logged in with a token
+	perm    permission                    // what the token grants, when authed
+	home    string                        // the token's subdirectory, "" for all of storage
+	active  map[quic.StreamID]string      // commands currently being served
+	streams map[quic.StreamID]quic.Stream // and the streams they run on
+}
+
+func newClientSession(conn quic.Connection) *clientSession {
+	return &clientSession{
+		conn:        conn,
+		connectedAt: time.Now(),
+		cwd:         ".",
+		active:      make(map[quic.StreamID]string),
+		streams:     make(map[quic.StreamID]quic.Stream),
+	}
+}
+
+func (s *clientSession) addr() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// permission returns what the session may do: what its token grants, or
+// -anonymous until it logs in.
+func (s *clientSession) permission() permission {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.authed {
+		return currentSettings().Anonymous
+	}
+	return s.perm
+}
+
+// grant logs the session in with perm, confined to home, and starts it
+// again at the top of what it can see.
+func (s *clientSession) grant(perm permission, home string) {
+	s.mu.Lock()
+	s.authed, s.perm, s.home = true, perm, home
+	s.cwd = "."
+	if home != "" {
+		s.cwd = home
+	}
+	s.mu.Unlock()
+}
+
+func (s *clientSession) getHome() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.home
+}
+
+// within reports whether the storage-relative path rel is inside the
+// session's home, which everything is when it has none.
+func (s *clientSession) within(rel string) bool {
+	home := s.getHome()
+	if home == "" {
+		return true
+	}
+	inside, err := filepath.Rel(home, rel)
+	return err == nil && (inside == "." || filepath.IsLocal(inside))
+}
+
+// display renders the storage-relative path rel the way this session's
+// client sees it, with its home as "/".
+func (s *clientSession) display(rel string) string {
+	if home := s.getHome(); home != "" {
+		if inside, err := filepath.Rel(home, rel); err == nil {
+			rel = inside
+		}
+	}
+	return displayPath(rel)
+}
+
+// beginCommand records command as running on stream until the returned func
+// is called.
+func (s *clientSession) beginCommand(stream quic.Stream, command string) func() {
+	id := stream.StreamID()
+	s.mu.Lock()
+	s.active[id] = command
+	s.streams[id] = stream
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		delete(s.active, id)
+		delete(s.streams, id)
+		s.mu.Unlock()
+	}
+}
+
+// cancelStream aborts the command running on stream id as if the client
+// had reset the stream, and reports whether there was one.
+func (s *clientSession) cancelStream(id quic.StreamID) bool {
+	s.mu.Lock()
+	stream, ok := s.streams[id]
+	s.mu.Unlock()
+	if ok {
+		stream.CancelRead(streamCancelled)
+		stream.CancelWrite(streamCancelled)
+	}
+	return ok
+}
+
+// activeCommands returns the commands in flight, oldest stream first.
+func (s *clientSession) activeCommands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]quic.StreamID, 0, len(s.active))
+	for id := range s.active {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	commands := make([]string, len(ids))
+	for i, id := range ids {
+		commands[i] = s.active[id]
+	}
+	return commands
+}
+
+func (s *clientSession) getCwd() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cwd
+}
+
+func (s *clientSession) setCwd(dir string) {
+	s.mu.Lock()
+	s.cwd = dir
+	s.mu.Unlock()
+}
+
+// resolve interprets name relative to the session's working directory and
+// returns the resulting path relative to storageDir. Names starting with "/"
+// are taken relative to the storage root, or the session's home if it has
+// one, and names starting with volumePrefix relative to that volume's root.
+// Any name that would climb above the root is rejected, and a session with
+// a home cannot reach the volumes.
+func (s *clientSession) resolve(name string) (string, error) {
+	var rel string
+	if strings.HasPrefix(name, "/") {
+		rel = filepath.Clean(strings.TrimLeft(name, "/"))
+		if rel == "" {
+			rel = "."
+		}
+		if home := s.getHome(); home != "" && (rel == "." || filepath.IsLocal(rel)) {
+			rel = filepath.Join(home, rel)
+		}
+	} else if strings.HasPrefix(name, volumePrefix) {
+		rel = filepath.Clean(name)
+		if s.getHome() != "" {
+			return "", errOutsideStorage
+		}
+	} else {
+		rel = filepath.Clean(filepath.Join(s.getCwd(), name))
+	}
+	if rel != "." && !filepath.IsLocal(rel) || !s.within(rel) {
+		return "", errOutsideStorage
+	}
+	if vol, _, ok := splitVolume(rel); ok && volumes[vol] == "" {
+		return "", errUnknownVolume
+	}
+	if isReserved(rel) {
+		return "", errReservedPath
+	}
+	return rel, nil
+}
+
+// reservedDirs are the server's own directories directly under storageDir.
+// Clients can neither see nor address anything inside them.
+var reservedDirs = map[string]bool{transferDirName: true, quarantineDirName: true}
+
+// isReserved reports whether the storage-relative path rel lies in one of
+// reservedDirs.
+func isReserved(rel string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	return reservedDirs[first]
+}
+
+// storagePath maps a path relative to the storage root onto the filesystem,
+// in whichever volume it names.
+func storagePath(rel string) string {
+	if _, inside, ok := splitVolume(rel); ok {
+		return filepath.Join(volumeRoot(rel), inside)
+	}
+	return filepath.Join(storageDir, rel)
+}
+
+// displayPath renders a storage-relative path the way clients see it.
+func displayPath(rel string) string {
+	if _, _, ok := splitVolume(rel); ok {
+		return filepath.ToSlash(rel)
+	}
+	if rel == "." {
+		return "/"
+	}
+	return "/" + filepath.ToSlash(rel)
+}
+
+// sessionRegistry tracks every connected client by remote address.
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*clientSession
+}
+
+var activeSessions = &sessionRegistry{sessions: make(map[string]*clientSession)}
+
+func (r *sessionRegistry) add(s *clientSession) {
+	r.mu.Lock()
+	r.sessions[s.addr()] = s
+	r.mu.Unlock()
+}
+
+func (r *sessionRegistry) remove(s *clientSession) {
+	r.mu.Lock()
+	if r.sessions[s.addr()] == s {
+		delete(r.sessions, s.addr())
+	}
+	r.mu.Unlock()
+}
+
+// list returns the connected sessions, longest-connected first.
+func (r *sessionRegistry) list() []*clientSession {
+	r.mu.Lock()
+	sessions := make([]*clientSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].connectedAt.Before(sessions[j].connectedAt)
+	})
+	return sessions
+}
@@ -0,0 +1,95 @@
+package scp
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	volumes = map[string]string{"media": t.TempDir()}
+	t.Cleanup(func() { volumes = nil })
+	outside, unknown, reserved := errOutsideStorage, errUnknownVolume, errReservedPath
+	for _, tc := range []struct {
+		cwd, home string
+		name      string
+		want      string // with slashes, "" when err is set
+		err       error
+	}{
+		// From the working directory
+		{".", "", "file", "file", nil},
+		{".", "", "a/b/../c", "a/c", nil},
+		{".", "", ".", ".", nil},
+		{".", "", "", ".", nil},
+		{"a/b", "", "file", "a/b/file", nil},
+		{"a/b", "", "..", "a", nil},
+		{"a/b", "", "../..", ".", nil},
+		{"a/b", "", "../../..", "", outside},
+		{".", "", "..", "", outside},
+		{".", "", "../etc/passwd", "", outside},
+		{".", "", "a/../../x", "", outside},
+
+		// From the storage root
+		{"a/b", "", "/", ".", nil},
+		{"a/b", "", "/file", "file", nil},
+		{"a/b", "", "//x//y/", "x/y", nil},
+		{"a/b", "", "/../x", "", outside},
+
+		// Inside a home
+		{"users/ann", "users/ann", "file", "users/ann/file", nil},
+		{"users/ann", "users/ann", "/", "users/ann", nil},
+		{"users/ann", "users/ann", "/sub/file", "users/ann/sub/file", nil},
+		{"users/ann", "users/ann", "..", "", outside},
+		{"users/ann", "users/ann", "../bob/file", "", outside},
+		{"users/ann", "users/ann", "/../bob", "", outside},
+		{"users/ann/sub", "users/ann", "..", "users/ann", nil},
+		{"users/ann", "users/ann", "vol:media/file", "", outside},
+
+		// Volumes
+		{".", "", "vol:media", "vol:media", nil},
+		{".", "", "vol:media/dir/file", "vol:media/dir/file", nil},
+		{"a", "", "vol:media/x/../y", "vol:media/y", nil},
+		{".", "", "vol:other/file", "", unknown},
+		{"vol:media/dir", "", "file", "vol:media/dir/file", nil},
+
+		// The server's own directories
+		{".", "", ".transfers", "", reserved},
+		{".", "", ".transfers/x.part", "", reserved},
+		{".", "", "/.quarantine/file", "", reserved},
+		{"a", "", "../.quarantine", "", reserved},
+		{".", "", "a/.transfers", "a/.transfers", nil},
+		{".", "", ".transfers-not", ".transfers-not", nil},
+	} {
+		sess := newClientSession(nil)
+		sess.cwd, sess.home = filepath.FromSlash(tc.cwd), filepath.FromSlash(tc.home)
+		got, err := sess.resolve(tc.name)
+		if err != tc.err || filepath.ToSlash(got) != tc.want {
+			t.Errorf("resolve(%q) from %q with home %q = %q, %v; want %q, %v", tc.name, tc.cwd, tc.home, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestWithin(t *testing.T) {
+	for _, tc := range []struct {
+		home, rel string
+		want      bool
+	}{
+		{"", ".", true},
+		{"", "anything/at/all", true},
+		{"users/ann", "users/ann", true},
+		{"users/ann", "users/ann/file", true},
+		{"users/ann", "users/ann/a/b/c", true},
+		{"users/ann", "users", false},
+		{"users/ann", ".", false},
+		{"users/ann", "users/bob", false},
+		{"users/ann", "users/anne", false},
+		{"users/ann", "users/ann2/file", false},
+		{"users/ann", "other/users/ann", false},
+		{"users/ann", "vol:media/users/ann", false},
+	} {
+		sess := newClientSession(nil)
+		sess.home = filepath.FromSlash(tc.home)
+		if got := sess.within(filepath.FromSlash(tc.rel)); got != tc.want {
+			t.Errorf("within(%q) with home %q = %t, want %t", tc.rel, tc.home, got, tc.want)
+		}
+	}
+}
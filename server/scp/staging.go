@@ -0,0 +1,157 @@
+package scp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// quarantineDirName is the directory under storageDir that staged uploads
+// are written to when no -temp-dir is given.
+const quarantineDirName = ".quarantine"
+
+// stagedPrefix and stagedSuffix name files in the staging directory, so
+// that leftovers can be told apart from anything else in a shared -temp-dir.
+const (
+	stagedPrefix = "quicscp-"
+	stagedSuffix = ".part"
+)
+
+// tempDir is the -temp-dir the server started with. Like storageDir it is
+// not changed by a reload.
+var tempDir string
+
+// stagingDir is where uploads are written before they are moved into
+// storage: -temp-dir if given, otherwise the quarantine directory, which is
+// on the same filesystem as the destination.
+func stagingDir() string {
+	if tempDir != "" {
+		return tempDir
+	}
+	return filepath.Join(storageDir, quarantineDirName)
+}
+
+// stagingPath returns a fresh path in the staging directory.
+func stagingPath() (string, error) {
+	dir := stagingDir()
+	if err := os.MkdirAll(dir, currentSettings().DirMode.perm()); err != nil {
+		return "", err
+	}
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, stagedPrefix+hex.EncodeToString(b[:])+stagedSuffix), nil
+}
+
+// sidePath returns a fresh path beside dest, in the same directory of the
+// same root, for data to be written to before it is renamed over dest. The
+// name is hidden and ends in stagedSuffix.
+func sidePath(dest string) (string, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+"."+hex.EncodeToString(b[:])+stagedSuffix), nil
+}
+
+// checkStagingDir makes sure the staging directory exists and is writable.
+func checkStagingDir() error {
+	dir := stagingDir()
+	if err := os.MkdirAll(dir, currentSettings().DirMode.perm()); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(dir, stagedPrefix+"check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// clearStaging removes uploads left staged by a previous run.
+func clearStaging() {
+	dir := stagingDir()
+	entries, _ := os.ReadDir(dir)
+	removed := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, stagedPrefix) && strings.HasSuffix(name, stagedSuffix) {
+			os.Remove(filepath.Join(dir, name))
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("Removed %d unfinished staged uploads from %s", removed, dir)
+	}
+}
+
+// moveIntoPlace moves the staged file src into storage as rel, creating its
+// parent directories. A rename is used when src is in the same volume and
+// on the same filesystem. Otherwise the data is copied next to the
+// destination and renamed over it from there, so the destination never
+// holds a partial file. With -backup or -versions a file already at rel is
+// kept as a backup or version instead of being replaced. src is gone
+// afterwards whether or not the move succeeded.
+func moveIntoPlace(src, rel string) error {
+	defer os.Remove(src)
+	root, dest := rootOf(rel)
+	if leadsOut(root, dest) {
+		return fmt.Errorf("%s is a symlink out of storage", filepath.Base(dest))
+	}
+	cfg := currentSettings()
+	if err := root.MkdirAll(filepath.Dir(dest), cfg.DirMode.perm()); err != nil {
+		return err
+	}
+	if cfg.Backup {
+		if err := backupExisting(root, dest, cfg.BackupKeep); err != nil {
+			return err
+		}
+	} else if cfg.Versions > 0 {
+		if err := keepVersion(root, dest, cfg.Versions); err != nil {
+			return err
+		}
+	}
+	if staged, ok := inRoot(root, src); ok {
+		err := root.Rename(staged, dest)
+		if !errors.Is(err, syscall.EXDEV) {
+			return err
+		}
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp, err := sidePath(dest)
+	if err != nil {
+		return err
+	}
+	out, err := root.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, cfg.FileMode.perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = root.Rename(tmp, dest)
+	}
+	if err != nil {
+		root.Remove(tmp)
+		return fmt.Errorf("copying %s into storage: %w", filepath.Base(dest), err)
+	}
+	return nil
+}
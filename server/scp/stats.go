@@ -0,0 +1,97 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// serverStats counts what the server has done since it started. Every
+// counter is atomic, so handlers update them without any locking; readers
+// take a snapshot.
+type serverStats struct {
+	started       time.Time
+	bytesIn       atomic.Int64 // payload bytes received from clients
+	bytesOut      atomic.Int64 // payload bytes sent to clients
+	filesReceived atomic.Int64
+	filesServed   atomic.Int64
+	errors        atomic.Int64 // streams that ended in an error
+	sessions      atomic.Int64 // clients connected right now
+	disconnects   atomic.Int64 // sessions closed on purpose, by the client or an admin
+	lost          atomic.Int64 // sessions that ended any other way, such as a timeout
+}
+
+var stats = &serverStats{started: time.Now()}
+
+// Stats is a copy of the server's counters taken at one moment.
+type Stats struct {
+	Uptime        time.Duration
+	Sessions      int64 // clients connected at the time
+	BytesIn       int64 // payload bytes received from clients
+	BytesOut      int64 // payload bytes sent to clients
+	FilesReceived int64
+	FilesServed   int64
+	Errors        int64 // streams that ended in an error
+	Disconnects   int64 // sessions closed on purpose, by the client or an admin
+	Lost          int64 // sessions that ended any other way, such as a timeout
+}
+
+// Snapshot returns the counters the info command reports, which count
+// everything the process has served since it started.
+func (s *Server) Snapshot() Stats {
+	return stats.snapshot()
+}
+
+func (s *serverStats) snapshot() Stats {
+	return Stats{
+		Uptime:        time.Since(s.started).Round(time.Second),
+		Sessions:      s.sessions.Load(),
+		BytesIn:       s.bytesIn.Load(),
+		BytesOut:      s.bytesOut.Load(),
+		FilesReceived: s.filesReceived.Load(),
+		FilesServed:   s.filesServed.Load(),
+		Errors:        s.errors.Load(),
+		Disconnects:   s.disconnects.Load(),
+		Lost:          s.lost.Load(),
+	}
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("uptime=%s sessions=%d bytes-in=%d bytes-out=%d files-received=%d files-served=%d errors=%d disconnects=%d lost=%d",
+		s.Uptime, s.Sessions, s.BytesIn, s.BytesOut, s.FilesReceived, s.FilesServed, s.Errors, s.Disconnects, s.Lost)
+}
+
+// received counts n payload bytes from the session's client, both for the
+// session and for the server.
+func (s *clientSession) received(n int64) {
+	s.bytes.Add(n)
+	stats.bytesIn.Add(n)
+}
+
+// sent is the counterpart of received for bytes sent to the client.
+func (s *clientSession) sent(n int64) {
+	s.bytes.Add(n)
+	stats.bytesOut.Add(n)
+}
+
+// closedCleanly reports whether err, which ended a session, means it was
+// closed on purpose: by the client with errCodeNone, as it does on exit,
+// or by the server itself, as when an admin kicks the client. Timeouts,
+// resets and errors the client reports are not clean.
+func closedCleanly(err error) bool {
+	var appErr *quic.ApplicationError
+	if !errors.As(err, &appErr) {
+		return false
+	}
+	return !appErr.Remote || appErr.ErrorCode == errCodeNone
+}
+
+// handleInfo sends the server's counters, one "name value" pair per line.
+func handleInfo(stream quic.Stream) {
+	s := stats.snapshot()
+	stream.Write([]byte(fmt.Sprintf("uptime %s\nsessions %d\nbytes_in %d\nbytes_out %d\nfiles_received %d\nfiles_served %d\nerrors %d\ndisconnects %d\nlost %d\n",
+		s.Uptime, s.Sessions, s.BytesIn, s.BytesOut, s.FilesReceived, s.FilesServed, s.Errors, s.Disconnects, s.Lost)))
+}
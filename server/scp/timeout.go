@@ -0,0 +1,143 @@
+package scp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// streamTimedOut is the stream error code used when a transfer is abandoned
+// because it stopped making progress.
+const streamTimedOut quic.StreamErrorCode = 3
+
+// errOperationTimedOut is the cause of a command context that ran past
+// command_timeout; handlers reply with it like any other error.
+var errOperationTimedOut = errors.New("operation timed out")
+
+// commandContext bounds a command that is not a transfer, such as a
+// listing or a manifest of a huge tree, by command_timeout, and ends it as
+// well if the connection goes away. Transfers do not use it: they may take
+// as long as they keep making progress, so transfer_timeout covers them.
+func commandContext(sess *clientSession) (context.Context, context.CancelFunc) {
+	ctx := sess.conn.Context()
+	timeout := time.Duration(currentSettings().CommandTimeout)
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, timeout, errOperationTimedOut)
+}
+
+// progressReader pushes the stream's read deadline out by timeout before
+// every Read, so it only fires once no data has arrived for that long.
+type progressReader struct {
+	r       io.Reader
+	stream  quic.Stream
+	timeout time.Duration
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	p.stream.SetReadDeadline(time.Now().Add(p.timeout))
+	return p.r.Read(b)
+}
+
+// progressWriter is the write-side counterpart of progressReader.
+type progressWriter struct {
+	w       io.Writer
+	stream  quic.Stream
+	timeout time.Duration
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.stream.SetWriteDeadline(time.Now().Add(p.timeout))
+	return p.w.Write(b)
+}
+
+// withReadTimeout wraps r, which reads from stream, in a progressReader. A
+// zero timeout disables it.
+func withReadTimeout(r io.Reader, stream quic.Stream, timeout time.Duration) io.Reader {
+	if timeout <= 0 {
+		return r
+	}
+	return &progressReader{r: r, stream: stream, timeout: timeout}
+}
+
+// withWriteTimeout wraps w, which writes to stream, in a progressWriter.
+func withWriteTimeout(w io.Writer, stream quic.Stream, timeout time.Duration) io.Writer {
+	if timeout <= 0 {
+		return w
+	}
+	return &progressWriter{w: w, stream: stream, timeout: timeout}
+}
+
+// clearDeadlines lets the reply to a timed-out transfer be written, and
+// stops the deadline from leaking into later use of the stream.
+func clearDeadlines(stream quic.Stream) {
+	stream.SetDeadline(time.Time{})
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// copyBufferSize is the chunk size copyWithContext moves at a time; the
+// context is checked between chunks.
+const copyBufferSize = 32 * 1024
+
+// copyResuming copies file to dst, which writes to a stream under
+// transfer_timeout, like copyWithContext, except that a write that timed out
+// is tried again, up to retries times: a client whose flow-control window
+// stalled for a moment gets another chance rather than losing the whole
+// download. The copy picks up at the first byte the stream did not accept,
+// so nothing is sent twice; QUIC delivers every byte a Write took, and the
+// client sees one unbroken file. Retrying needs a seekable file, so sealed
+// files are not retried, and no other error is: a stream the client reset
+// or a closed connection is final. onRetry is told how far the copy got.
+func copyResuming(ctx context.Context, dst io.Writer, file *storedFile, retries int, onRetry func(sent int64)) (int64, error) {
+	var sent int64
+	buf := make([]byte, copyBufferSize)
+	for attempt := 0; ; attempt++ {
+		n, err := copyWithContext(ctx, dst, file, buf)
+		sent += n
+		if !isTimeout(err) || attempt >= retries || !file.seekable() {
+			return sent, err
+		}
+		if _, serr := file.file.Seek(sent, io.SeekStart); serr != nil {
+			return sent, err
+		}
+		onRetry(sent)
+	}
+}
+
+// copyWithContext is io.Copy through buf that stops, returning ctx's error,
+// as soon as ctx is done. io.Copy only notices once a Read or Write fails,
+// which a closing session or a cancelled stream may never make happen on
+// the side that is not the stream.
+func copyWithContext(ctx context.Context, dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, rerr := src.Read(buf)
+		if n > 0 {
+			w, werr := dst.Write(buf[:n])
+			written += int64(w)
+			if werr != nil {
+				return written, werr
+			}
+			if w != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
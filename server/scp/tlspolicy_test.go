@@ -0,0 +1,99 @@
+package scp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// handshake runs a TLS handshake between the server's configuration for cfg
+// and client over an in-memory connection, and returns the client's error.
+func handshake(t *testing.T, cfg *settings, client *tls.Config) error {
+	t.Helper()
+	serverConf := generateTLSConfig(newCertificateStore(cfg.CertFile, cfg.KeyFile), cfg)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	a.SetDeadline(time.Now().Add(5 * time.Second))
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	go tls.Server(a, serverConf).Handshake()
+	return tls.Client(b, client).Handshake()
+}
+
+func TestTLSPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		curves string // the server's tls_curves
+		client *tls.Config
+		ok     bool
+	}{
+		{"TLS 1.3", "", &tls.Config{}, true},
+		{"TLS 1.2 only", "", &tls.Config{MaxVersion: tls.VersionTLS12}, false},
+		{"TLS 1.1 only", "", &tls.Config{MinVersion: tls.VersionTLS10, MaxVersion: tls.VersionTLS11}, false},
+		{"pinned curve offered", "X25519", &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256, tls.X25519}}, true},
+		{"pinned curve not offered", "X25519", &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256}}, false},
+		{"any listed curve", "P384, p256", &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256}}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := testSettings(t)
+			cfg.TLSCurves = tc.curves
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+			tc.client.InsecureSkipVerify = true
+			err := handshake(t, cfg, tc.client)
+			if tc.ok && err != nil {
+				t.Errorf("handshake failed: %v", err)
+			}
+			if !tc.ok && err == nil {
+				t.Error("handshake succeeded, want it rejected")
+			}
+		})
+	}
+}
+
+// TestTLS12PeerRejectedOverQUIC dials the running server with a client
+// that will not go above TLS 1.2.
+func TestTLS12PeerRejectedOverQUIC(t *testing.T) {
+	addr := startServer(t, testSettings(t))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12}, nil)
+	if err == nil {
+		conn.CloseWithError(errCodeNone, "")
+		t.Fatal("a TLS 1.2 client connected")
+	}
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	for _, version := range []string{"1.0", "1.1", "1.2", "", "13"} {
+		if _, err := parseTLSVersion(version); err == nil {
+			t.Errorf("parseTLSVersion(%q) accepted it", version)
+		}
+	}
+	if v, err := parseTLSVersion("1.3"); err != nil || v != tls.VersionTLS13 {
+		t.Errorf("parseTLSVersion(\"1.3\") = %x, %v", v, err)
+	}
+
+	for list, want := range map[string][]tls.CurveID{
+		"":                       nil,
+		"X25519":                 {tls.X25519},
+		"x25519, P256 ,p384":     {tls.X25519, tls.CurveP256, tls.CurveP384},
+		"X25519MLKEM768,,X25519": {tls.X25519MLKEM768, tls.X25519},
+		"P521":                   {tls.CurveP521},
+	} {
+		if got, err := parseTLSCurves(list); err != nil || !slices.Equal(got, want) {
+			t.Errorf("parseTLSCurves(%q) = %v, %v; want %v", list, got, err, want)
+		}
+	}
+	for _, list := range []string{"P224", "X448", "x25519,secp256k1"} {
+		if _, err := parseTLSCurves(list); err == nil {
+			t.Errorf("parseTLSCurves(%q) accepted it", list)
+		}
+	}
+}
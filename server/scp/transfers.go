@@ -0,0 +1,589 @@
+package scp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// transferDirName is the directory under storageDir that holds resumable
+// uploads in progress. Clients cannot address it directly.
+const transferDirName = ".transfers"
+
+// checkpointBytes is how much data a resume session accepts between two
+// journal checkpoints.
+const checkpointBytes = 16 << 20
+
+// transferMeta is persisted as <id>.meta next to the data received so far in
+// <id>.part, and acts as a journal for it.
+//
+// Recovery guarantees: the metadata is only ever rewritten (atomically, via
+// rename) after the first Received bytes of the .part file have been synced
+// to disk, and Checksum is the SHA-256 of exactly those bytes. A crash can
+// therefore leave the .part file longer than Received, never shorter. At
+// startup recoverTransfers drops any unrecorded tail, verifies the recorded
+// prefix against Checksum, and keeps the transfer resumable only if it
+// matches. Everything else that cannot be verified is removed, so a resumed
+// upload never builds on data the server did not confirm. At most
+// checkpointBytes of an in-progress session are lost to a crash.
+//
+// A Sealed transfer writes its .part in the at-rest format from the start.
+// Received then only ever counts whole chunks, Checksum covers the sealed
+// bytes on disk, and an interrupted session gives up the partial chunk it
+// had buffered.
+type transferMeta struct {
+	Name      string    `json:"name"` // destination relative to storageDir
+	Size      int64     `json:"size"`
+	Received  int64     `json:"received"`
+	Checksum  string    `json:"checksum"`   // SHA-256 of the first Received bytes
+	HashState []byte    `json:"hash_state"` // checksum state to continue hashing from
+	Sealed    bool      `json:"sealed,omitempty"`
+	Updated   time.Time `json:"updated"`
+}
+
+// restoreHash returns a SHA-256 hash that has already consumed the first
+// Received bytes of the transfer.
+func (m *transferMeta) restoreHash() (hash.Hash, error) {
+	h := sha256.New()
+	if len(m.HashState) > 0 {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(m.HashState); err != nil {
+			return nil, err
+		}
+	}
+	return h, nil
+}
+
+// partSize is how long the .part file is once it holds the first Received
+// bytes.
+func (m *transferMeta) partSize() int64 {
+	if m.Sealed {
+		return sealedPrefix(m.Received)
+	}
+	return m.Received
+}
+
+// record stores the hash of the first received bytes in the metadata.
+func (m *transferMeta) record(received int64, h hash.Hash) error {
+	state, err := h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	m.Received = received
+	m.Checksum = hex.EncodeToString(h.Sum(nil))
+	m.HashState = state
+	return nil
+}
+
+var errUnknownTransfer = errors.New("unknown transfer")
+
+// transferClaim is the stream currently resuming a transfer.
+type transferClaim struct {
+	stream quic.Stream
+	done   chan struct{} // closed once that stream has let go
+}
+
+// transfersInUse guards against two streams resuming the same ID at once.
+var transfersInUse = struct {
+	sync.Mutex
+	ids map[string]*transferClaim
+}{ids: make(map[string]*transferClaim)}
+
+// takeoverWait bounds how long a resume waits for the stream it takes a
+// transfer over from to let go of it.
+const takeoverWait = 10 * time.Second
+
+// claimTransfer makes stream the one resuming transfer id, until release is
+// called. A stream that still holds the transfer is most likely on a
+// connection the client has given up on, say because it was killed, which
+// the server only notices once the idle timeout ends it. Only the client
+// that began a transfer knows its ID, so the newer stream takes over: the
+// old one is cancelled, and once it has journaled what it received the new
+// one carries on from there. ok is false if the old one does not let go in
+// time.
+func claimTransfer(id string, stream quic.Stream) (release func(), ok bool) {
+	claim := &transferClaim{stream: stream, done: make(chan struct{})}
+	for {
+		transfersInUse.Lock()
+		old := transfersInUse.ids[id]
+		if old == nil {
+			transfersInUse.ids[id] = claim
+			transfersInUse.Unlock()
+			return func() {
+				transfersInUse.Lock()
+				delete(transfersInUse.ids, id)
+				transfersInUse.Unlock()
+				close(claim.done)
+			}, true
+		}
+		transfersInUse.Unlock()
+		old.stream.CancelRead(streamCancelled)
+		select {
+		case <-old.done:
+		case <-time.After(takeoverWait):
+			return nil, false
+		}
+	}
+}
+
+func transferDir() string {
+	return filepath.Join(storageDir, transferDirName)
+}
+
+func transferPath(id, ext string) string {
+	return filepath.Join(transferDir(), id+ext)
+}
+
+// validTransferID rejects anything that is not an ID we could have issued,
+// which also keeps IDs from being used as paths.
+func validTransferID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+func newTransferID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func readTransferMeta(id string) (*transferMeta, error) {
+	data, err := os.ReadFile(transferPath(id, ".meta"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errUnknownTransfer
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta transferMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("corrupt metadata for transfer %s: %w", id, err)
+	}
+	return &meta, nil
+}
+
+// writeTransferMeta replaces the metadata file atomically so a crash never
+// leaves it half-written. Only the server's own user may read it: it names
+// the upload and holds its hash state, whatever -file-mode lets others see
+// of the file once stored.
+func writeTransferMeta(id string, meta *transferMeta) error {
+	meta.Updated = time.Now()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := transferPath(id, ".meta.tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, transferPath(id, ".meta"))
+}
+
+func removeTransfer(id string) {
+	os.Remove(transferPath(id, ".part"))
+	os.Remove(transferPath(id, ".meta"))
+}
+
+// handleBeginUpload registers a resumable upload of size bytes to fileName
+// and replies with "OK <id>".
+func handleBeginUpload(sess *clientSession, stream quic.Stream, args []string) {
+	if len(args) != 2 {
+		writeUsage(stream, "begin-upload")
+		return
+	}
+	if err := validateFileName(args[0]); err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+		return
+	}
+	rel, err := sess.resolve(args[0])
+	if err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %s: %v\n", args[0], err)))
+		return
+	}
+	if root, inside := rootOf(rel); leadsOut(root, inside) {
+		stream.Write([]byte("Error: could not create file\n"))
+		return
+	}
+	size, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil || size < 0 {
+		stream.Write([]byte("Error: invalid file size\n"))
+		return
+	}
+	if limit := currentSettings().MaxFileSize; limit > 0 && size > limit {
+		stream.Write([]byte("Error: file too large\n"))
+		return
+	}
+
+	id, err := newTransferID()
+	if err == nil {
+		err = os.MkdirAll(transferDir(), currentSettings().DirMode.perm())
+	}
+	if err == nil {
+		var part *os.File
+		// The part file becomes the stored file, mode and all.
+		part, err = os.OpenFile(transferPath(id, ".part"), os.O_RDWR|os.O_CREATE|os.O_TRUNC, currentSettings().FileMode.perm())
+		if err == nil {
+			meta := &transferMeta{Name: rel, Size: size, Sealed: storageKey != nil}
+			h := sha256.New()
+			if meta.Sealed {
+				_, err = newSealWriter(io.MultiWriter(part, h))
+			}
+			if cerr := part.Close(); err == nil {
+				err = cerr
+			}
+			if err == nil {
+				err = meta.record(0, h)
+			}
+			if err == nil {
+				err = writeTransferMeta(id, meta)
+			}
+		}
+	}
+	if err != nil {
+		logf(stream, "Error starting transfer for %s: %v", args[0], err)
+		removeTransfer(id)
+		stream.Write([]byte("Error: " + storageReason(err, "could not start transfer") + "\n"))
+		return
+	}
+	logf(stream, "Started transfer %s for %s (%d bytes)", id, rel, size)
+	stream.Write([]byte("OK " + id + "\n"))
+}
+
+// handleResumeUpload continues transfer id. It replies "OK <offset>", then
+// appends whatever the client sends until it half-closes the stream. Once
+// the recorded size has arrived the file is moved into place.
+func handleResumeUpload(sess *clientSession, stream quic.Stream, body *bufio.Reader, id string) {
+	if !validTransferID(id) {
+		stream.Write([]byte("Error: unknown transfer\n"))
+		return
+	}
+	release, ok := claimTransfer(id, stream)
+	if !ok {
+		stream.Write([]byte("Error: transfer already in progress\n"))
+		return
+	}
+	defer release()
+
+	meta, err := readTransferMeta(id)
+	if err != nil {
+		stream.Write([]byte(fmt.Sprintf("Error: %v\n", err)))
+		return
+	}
+	if !sess.within(meta.Name) {
+		// Another home's transfer is as good as unknown to this session.
+		stream.Write([]byte("Error: unknown transfer\n"))
+		return
+	}
+	h, err := meta.restoreHash()
+	if err != nil {
+		logf(stream, "Error restoring checksum of transfer %s: %v", id, err)
+		stream.Write([]byte("Error: could not read transfer state\n"))
+		return
+	}
+	if meta.Sealed && storageKey == nil {
+		logf(stream, "Cannot resume transfer %s without the storage key", id)
+		stream.Write([]byte("Error: could not read transfer state\n"))
+		return
+	}
+	part, err := os.OpenFile(transferPath(id, ".part"), os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		logf(stream, "Error opening partial data of transfer %s: %v", id, err)
+		stream.Write([]byte("Error: unknown transfer\n"))
+		return
+	}
+	defer part.Close()
+	// Anything past the journaled length was never confirmed; drop it.
+	offset := meta.Received
+	if err := part.Truncate(meta.partSize()); err != nil {
+		logf(stream, "Error truncating transfer %s: %v", id, err)
+		stream.Write([]byte("Error: could not read transfer state\n"))
+		return
+	}
+	out := &hashedWriter{w: uploadWriter(part), h: h}
+	var dst io.Writer = out
+	var sealer *sealWriter
+	if meta.Sealed {
+		prefix, err := readSealPrefix(part)
+		if err != nil {
+			logf(stream, "Error reading header of transfer %s: %v", id, err)
+			stream.Write([]byte("Error: could not read transfer state\n"))
+			return
+		}
+		sealer = resumeSealWriter(dst, prefix, offset)
+		dst = sealer
+	}
+	if _, err := stream.Write([]byte(fmt.Sprintf("OK %d\n", offset))); err != nil {
+		return
+	}
+
+	// Never accept more than the announced size; one extra byte is enough
+	// to notice a client that overruns it.
+	cfg := currentSettings()
+	src := cfg.bandwidth.reader(withReadTimeout(body, stream, time.Duration(cfg.TransferTimeout)))
+	limited := &io.LimitedReader{R: src, N: meta.Size - offset + 1}
+	received := offset
+	var copyErr error
+	for copyErr == nil {
+		var n int64
+		n, copyErr = io.CopyN(dst, limited, checkpointBytes)
+		received += n
+		sess.received(n)
+		if errors.Is(copyErr, io.EOF) {
+			copyErr = nil
+			break
+		}
+		if received <= meta.Size && (sealer == nil || out.err == nil) {
+			durable := received
+			if sealer != nil {
+				durable -= int64(sealer.buffered())
+			}
+			if err := checkpointTransfer(id, meta, part, durable, h); err != nil {
+				logf(stream, "Error saving progress of transfer %s: %v", id, err)
+			}
+		}
+	}
+	if sealer != nil && received <= meta.Size {
+		pending := int64(sealer.buffered())
+		if copyErr == nil && received == meta.Size {
+			copyErr = sealer.Close()
+		}
+		if copyErr != nil || received < meta.Size {
+			// The partial chunk never reached the disk; the client sends
+			// it again.
+			received -= pending
+		}
+	}
+	if sealer != nil && out.err != nil {
+		// Part of a sealed chunk may have reached the disk, which no
+		// checkpoint can describe; go back to the last one.
+		received = meta.Received
+		if err := part.Truncate(meta.partSize()); err != nil {
+			logf(stream, "Error truncating transfer %s: %v", id, err)
+		}
+	}
+	meta.Received = received
+
+	switch {
+	case meta.Received > meta.Size:
+		logf(stream, "Transfer %s overran its size of %d bytes; discarding it", id, meta.Size)
+		part.Close()
+		removeTransfer(id)
+		rejectUpload(stream, "upload larger than announced size")
+	case meta.Received == meta.Size:
+		part.Close()
+		unlock := fileLocks.lock(meta.Name)
+		var err error
+		if scanCmd := currentSettings().ScanCmd; scanCmd != "" {
+			err = publishScanned(scanCmd, transferPath(id, ".part"), meta.Name, meta.Name)
+		} else {
+			err = moveIntoPlace(transferPath(id, ".part"), meta.Name)
+		}
+		unlock()
+		if errors.Is(err, errScanRejected) {
+			logf(stream, "Rejected transfer %s for %s: flagged by scanner", id, meta.Name)
+			os.Remove(transferPath(id, ".meta"))
+			stream.Write([]byte("Error: upload rejected by scanner\n"))
+			return
+		}
+		if err != nil {
+			logf(stream, "Error completing transfer %s: %v", id, err)
+			stream.Write([]byte("Error: " + storageReason(err, "could not store file") + "\n"))
+			return
+		}
+		os.Remove(transferPath(id, ".meta"))
+		stats.filesReceived.Add(1)
+		printf(stream, "Uploaded file %s (%d bytes) successfully via transfer %s\n", meta.Name, meta.Size, id)
+	default:
+		if sealer == nil || out.err == nil {
+			if err := checkpointTransfer(id, meta, part, received, h); err != nil {
+				logf(stream, "Error saving progress of transfer %s: %v", id, err)
+			}
+		}
+		// A stalled transfer keeps its data; the client may resume it.
+		if isTimeout(copyErr) {
+			logf(stream, "Transfer %s timed out at %d/%d bytes", id, meta.Received, meta.Size)
+			clearDeadlines(stream)
+			rejectUpload(stream, "transfer timed out")
+			return
+		}
+		// So does one that filled the disk, once space has been freed.
+		if errors.Is(copyErr, syscall.ENOSPC) {
+			logf(stream, "Transfer %s ran out of disk space at %d/%d bytes", id, meta.Received, meta.Size)
+			rejectUpload(stream, "server out of disk space")
+			return
+		}
+		if copyErr != nil {
+			logf(stream, "Transfer %s interrupted at %d/%d bytes: %v", id, meta.Received, meta.Size, copyErr)
+			return
+		}
+		stream.Write([]byte(fmt.Sprintf("Error: incomplete upload, %d/%d bytes received\n", meta.Received, meta.Size)))
+	}
+}
+
+// hashedWriter writes to w and hashes exactly the bytes w took, so that
+// after a short write the hash still covers what is in the file. err is
+// the first write that failed.
+type hashedWriter struct {
+	w   io.Writer
+	h   hash.Hash
+	err error
+}
+
+func (hw *hashedWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	hw.h.Write(p[:n])
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	if err != nil && hw.err == nil {
+		hw.err = err
+	}
+	return n, err
+}
+
+// checkpointTransfer makes the first received bytes of part durable and then
+// journals them, in that order.
+func checkpointTransfer(id string, meta *transferMeta, part *os.File, received int64, h hash.Hash) error {
+	if err := part.Sync(); err != nil {
+		return err
+	}
+	if err := meta.record(received, h); err != nil {
+		return err
+	}
+	return writeTransferMeta(id, meta)
+}
+
+// recoverTransfers checks every transfer left behind by a previous run, as
+// described on transferMeta. It runs once at startup, before any client can
+// resume.
+func recoverTransfers() {
+	entries, err := os.ReadDir(transferDir())
+	if err != nil {
+		return
+	}
+	ids := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".meta.tmp") {
+			os.Remove(filepath.Join(transferDir(), name))
+			continue
+		}
+		id := strings.TrimSuffix(strings.TrimSuffix(name, ".meta"), ".part")
+		if !validTransferID(id) {
+			log.Printf("Recovery: ignoring unexpected file %s", name)
+			continue
+		}
+		ids[id] = true
+	}
+
+	for id := range ids {
+		if err := recoverTransfer(id); err != nil {
+			log.Printf("Recovery: removing transfer %s: %v", id, err)
+			removeTransfer(id)
+		}
+	}
+}
+
+// recoverTransfer validates one transfer and trims it to its journaled
+// length. Any error means the transfer cannot be trusted.
+func recoverTransfer(id string) error {
+	meta, err := readTransferMeta(id)
+	if err != nil {
+		return err
+	}
+	part, err := os.OpenFile(transferPath(id, ".part"), os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	info, err := part.Stat()
+	if err != nil {
+		return err
+	}
+	if meta.Received > meta.Size || info.Size() < meta.partSize() {
+		return fmt.Errorf("has %d bytes on disk but %d journaled", info.Size(), meta.partSize())
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, part, meta.partSize()); err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != meta.Checksum {
+		return errors.New("checksum of received data does not match journal")
+	}
+	if info.Size() > meta.partSize() {
+		if err := part.Truncate(meta.partSize()); err != nil {
+			return err
+		}
+		log.Printf("Recovery: dropped %d unjournaled bytes from transfer %s", info.Size()-meta.partSize(), id)
+	}
+	log.Printf("Recovery: transfer %s for %s is resumable at %d/%d bytes", id, meta.Name, meta.Received, meta.Size)
+	return nil
+}
+
+// expireTransfers removes every transfer that has seen no activity for ttl.
+func expireTransfers(ttl time.Duration) {
+	entries, err := os.ReadDir(transferDir())
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".meta")
+		if !ok || !validTransferID(id) {
+			continue
+		}
+		meta, err := readTransferMeta(id)
+		if err != nil || time.Since(meta.Updated) < ttl {
+			continue
+		}
+		transfersInUse.Lock()
+		busy := transfersInUse.ids[id] != nil
+		transfersInUse.Unlock()
+		if busy {
+			continue
+		}
+		removeTransfer(id)
+		log.Printf("Expired abandoned transfer %s for %s", id, meta.Name)
+	}
+}
+
+// expireTransfersPeriodically runs expireTransfers in the background with
+// the TTL from the current settings.
+func expireTransfersPeriodically() {
+	go func() {
+		for {
+			ttl := time.Duration(currentSettings().TransferTTL)
+			interval := ttl / 4
+			if interval > time.Hour {
+				interval = time.Hour
+			}
+			if interval < time.Minute {
+				interval = time.Minute
+			}
+			time.Sleep(interval)
+			expireTransfers(time.Duration(currentSettings().TransferTTL))
+		}
+	}()
+}
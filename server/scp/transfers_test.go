@@ -0,0 +1,360 @@
+package scp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// journal writes a transfer whose .part holds part and whose metadata
+// records the first received bytes of journaled, as checkpointTransfer would.
+func journal(t *testing.T, id string, size int64, journaled, part []byte) {
+	t.Helper()
+	if err := os.MkdirAll(transferDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(transferPath(id, ".part"), part, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := sha256.New()
+	h.Write(journaled)
+	meta := &transferMeta{Name: "file.bin", Size: size}
+	if err := meta.record(int64(len(journaled)), h); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeTransferMeta(id, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverTransfers(t *testing.T) {
+	data := []byte("the quick brown fox jumps over the lazy dog")
+	corrupt := bytes.Clone(data)
+	corrupt[3] ^= 1
+	for _, tc := range []struct {
+		name    string
+		setup   func(t *testing.T, id string)
+		kept    bool
+		partLen int // length of the .part file after recovery, if kept
+	}{
+		{"complete journal", func(t *testing.T, id string) {
+			journal(t, id, 100, data, data)
+		}, true, len(data)},
+		{"unjournaled tail is dropped", func(t *testing.T, id string) {
+			journal(t, id, 100, data[:10], data)
+		}, true, 10},
+		{"nothing received yet", func(t *testing.T, id string) {
+			journal(t, id, 100, nil, nil)
+		}, true, 0},
+		{"part shorter than journal", func(t *testing.T, id string) {
+			journal(t, id, 100, data, data[:10])
+		}, false, 0},
+		{"checksum mismatch", func(t *testing.T, id string) {
+			journal(t, id, 100, data, corrupt)
+		}, false, 0},
+		{"received past the size", func(t *testing.T, id string) {
+			journal(t, id, 10, data, data)
+		}, false, 0},
+		{"part without metadata", func(t *testing.T, id string) {
+			journal(t, id, 100, data, data)
+			os.Remove(transferPath(id, ".meta"))
+		}, false, 0},
+		{"metadata without part", func(t *testing.T, id string) {
+			journal(t, id, 100, data, data)
+			os.Remove(transferPath(id, ".part"))
+		}, false, 0},
+		{"corrupt metadata", func(t *testing.T, id string) {
+			journal(t, id, 100, data, data)
+			os.WriteFile(transferPath(id, ".meta"), []byte("{\"name\":"), 0o644)
+		}, false, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			storageDir = t.TempDir()
+			id, err := newTransferID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			tc.setup(t, id)
+			// Left mid-rename by a crash; always removed
+			os.WriteFile(transferPath(id, ".meta.tmp"), []byte("{}"), 0o644)
+
+			recoverTransfers()
+
+			if _, err := os.Stat(transferPath(id, ".meta.tmp")); err == nil {
+				t.Error("the temporary metadata file was kept")
+			}
+			info, partErr := os.Stat(transferPath(id, ".part"))
+			_, metaErr := os.Stat(transferPath(id, ".meta"))
+			if !tc.kept {
+				if partErr == nil || metaErr == nil {
+					t.Error("the transfer was kept, want it removed")
+				}
+				return
+			}
+			if partErr != nil || metaErr != nil {
+				t.Fatalf("the transfer was removed, want it resumable: %v, %v", partErr, metaErr)
+			}
+			if info.Size() != int64(tc.partLen) {
+				t.Errorf("part file has %d bytes, want %d", info.Size(), tc.partLen)
+			}
+		})
+	}
+}
+
+// dialKillable connects to addr over a UDP socket of its own and returns a
+// kill function that closes that socket. The server hears nothing, as when
+// the client process dies, and only notices when its idle timeout ends the
+// connection.
+func dialKillable(t *testing.T, addr string) (conn quic.Connection, kill func()) {
+	t.Helper()
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &quic.Transport{Conn: udp}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err = tr.Dial(ctx, raddr, &tls.Config{InsecureSkipVerify: true}, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kill = func() {
+		udp.Close()
+		tr.Close()
+	}
+	t.Cleanup(kill)
+	return conn, kill
+}
+
+// replyLine sends command on a stream of its own and returns the first line
+// of the reply, with the stream still open for the rest of the exchange.
+func replyLine(t *testing.T, conn quic.Connection, command string) (quic.Stream, *bufio.Reader, string) {
+	t.Helper()
+	stream := openTestStream(t, conn)
+	if _, err := stream.Write([]byte(command + "\n")); err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	reader := bufio.NewReader(stream)
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Fatalf("%s: reading the reply: %v", command, err)
+	}
+	return stream, reader, strings.TrimSpace(line)
+}
+
+// okOffset parses the offset out of an "OK <offset>" reply.
+func okOffset(t *testing.T, line string) int64 {
+	t.Helper()
+	offset, err := strconv.ParseInt(strings.TrimPrefix(line, "OK "), 10, 64)
+	if !strings.HasPrefix(line, "OK ") || err != nil {
+		t.Fatalf("unexpected reply %q", line)
+	}
+	return offset
+}
+
+func TestTransferMetaMode(t *testing.T) {
+	cfg := testSettings(t)
+	cfg.FileMode = 0o644
+	conn := dialTest(t, startServer(t, cfg))
+	_, _, line := replyLine(t, conn, "begin-upload file.bin 10")
+	id, ok := strings.CutPrefix(line, "OK ")
+	if !ok {
+		t.Fatalf("begin-upload: %q", line)
+	}
+	info, err := os.Stat(transferPath(id, ".meta"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("transfer metadata has mode %v, want -rw-------", mode)
+	}
+}
+
+func TestResumeAfterRedial(t *testing.T) {
+	cfg := testSettings(t)
+	addr := startServer(t, cfg)
+	data := randomBytes(t, 1<<20)
+
+	// Begin the upload and send part of it, then kill the connection
+	conn, kill := dialKillable(t, addr)
+	_, _, line := replyLine(t, conn, fmt.Sprintf("begin-upload big.bin %d", len(data)))
+	id, ok := strings.CutPrefix(line, "OK ")
+	if !ok {
+		t.Fatalf("begin-upload: %q", line)
+	}
+	stream, _, line := replyLine(t, conn, "resume-upload "+id)
+	if okOffset(t, line) != 0 {
+		t.Fatalf("resume-upload of a new transfer: %q", line)
+	}
+	stream.Write(data[:len(data)/2])
+	eventually(t, "the server has part of the upload", func() bool {
+		info, err := os.Stat(transferPath(id, ".part"))
+		return err == nil && info.Size() > 0
+	})
+	kill()
+
+	// The same transfer continues over a new connection, from wherever the
+	// server got to
+	conn = dialTest(t, addr)
+	stream, reader, line := replyLine(t, conn, "resume-upload "+id)
+	offset := okOffset(t, line)
+	if offset == 0 || offset > int64(len(data)/2) {
+		t.Fatalf("resumed at %d, want somewhere in the first %d bytes sent", offset, len(data)/2)
+	}
+	stream.Write(data[offset:])
+	stream.Close()
+	if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+		t.Fatalf("completing the upload: %q, %v", rest, err)
+	}
+	stored, err := os.ReadFile(filepath.Join(cfg.Storage, "big.bin"))
+	if err != nil || !bytes.Equal(stored, data) {
+		t.Fatalf("stored %d bytes (%v), want the %d uploaded", len(stored), err, len(data))
+	}
+
+	// A download picks up from an offset over yet another connection
+	conn, kill = dialKillable(t, addr)
+	got := downloadChunksFrom(t, conn, "big.bin", 0, int64(len(data)/3))
+	kill()
+	conn = dialTest(t, addr)
+	got = append(got, downloadChunksFrom(t, conn, "big.bin", int64(len(got)), -1)...)
+	if !bytes.Equal(got, data) {
+		t.Errorf("downloaded %d bytes over two connections, not the %d stored", len(got), len(data))
+	}
+}
+
+// TestResumeAfterShortWrite runs out of disk space part way through a
+// resumed transfer, in the middle of a write, and checks that the journal
+// still describes what is in the part file, so the transfer resumes from
+// it and completes intact.
+func TestResumeAfterShortWrite(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		sealed bool
+	}{
+		{"plain", false},
+		{"sealed", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.sealed {
+				block, err := aes.NewCipher(randomBytes(t, 32))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if storageKey, err = cipher.NewGCM(block); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { storageKey = nil })
+			}
+			cfg := testSettings(t)
+			addr := startServer(t, cfg)
+			data := randomBytes(t, 300_000)
+			conn := dialTest(t, addr)
+			_, _, line := replyLine(t, conn, fmt.Sprintf("begin-upload big.bin %d", len(data)))
+			id, ok := strings.CutPrefix(line, "OK ")
+			if !ok {
+				t.Fatalf("begin-upload: %q", line)
+			}
+
+			uploadWriter = func(file *os.File) io.Writer { return &fullDisk{file: file, room: 100_000} }
+			stream, reader, line := replyLine(t, conn, "resume-upload "+id)
+			uploadWriter = func(file *os.File) io.Writer { return file }
+			if okOffset(t, line) != 0 {
+				t.Fatalf("resume-upload of a new transfer: %q", line)
+			}
+			stream.Write(data)
+			stream.Close()
+			if rest, _ := io.ReadAll(reader); string(rest) != "Error: server out of disk space\n" {
+				t.Fatalf("upload onto a full disk: %q", rest)
+			}
+
+			meta, err := readTransferMeta(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			part, err := os.ReadFile(transferPath(id, ".part"))
+			if err != nil || int64(len(part)) < meta.partSize() {
+				t.Fatalf("part file of %d bytes (%v), journaled as %d", len(part), err, meta.partSize())
+			}
+			if sum := sha256.Sum256(part[:meta.partSize()]); hex.EncodeToString(sum[:]) != meta.Checksum {
+				t.Fatalf("the journal's checksum does not match the first %d bytes of the part file", meta.partSize())
+			}
+
+			stream, reader, line = replyLine(t, conn, "resume-upload "+id)
+			if offset := okOffset(t, line); offset != meta.Received {
+				t.Fatalf("resumed at %d, want the journaled %d", offset, meta.Received)
+			}
+			stream.Write(data[meta.Received:])
+			stream.Close()
+			if rest, err := io.ReadAll(reader); err != nil || len(rest) != 0 {
+				t.Fatalf("completing the upload: %q, %v", rest, err)
+			}
+			if got, errLine := download(t, conn, "big.bin"); errLine != "" || !bytes.Equal(got, data) {
+				t.Errorf("downloaded %d bytes (%s), want the %d uploaded", len(got), errLine, len(data))
+			}
+		})
+	}
+}
+
+// downloadChunksFrom reads name through "dwd --chunks" from offset, checking
+// every frame's MAC. It stops after limit bytes unless limit is negative, in
+// which case the transfer must run to its end.
+func downloadChunksFrom(t *testing.T, conn quic.Connection, name string, offset, limit int64) []byte {
+	t.Helper()
+	key, err := chunkMACKey(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, reader, line := replyLine(t, conn, fmt.Sprintf("dwd --chunks %s %d", name, offset))
+	defer stream.CancelRead(streamCancelled)
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "OK" {
+		t.Fatalf("dwd --chunks %s %d: %q", name, offset, line)
+	}
+	size, _ := strconv.ParseInt(fields[1], 10, 64)
+	var got []byte
+	for limit < 0 || int64(len(got)) < limit {
+		var length [4]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			t.Fatalf("reading frame at %d: %v", offset, err)
+		}
+		frame := make([]byte, binary.BigEndian.Uint32(length[:])+sha256.Size)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			t.Fatalf("reading frame at %d: %v", offset, err)
+		}
+		payload, tag := frame[:len(frame)-sha256.Size], frame[len(frame)-sha256.Size:]
+		if !hmac.Equal(tag, chunkMAC(key, offset, payload)) {
+			t.Fatalf("frame at %d failed verification", offset)
+		}
+		if len(payload) == 0 {
+			if offset != size {
+				t.Fatalf("transfer ended at %d of %d bytes", offset, size)
+			}
+			break
+		}
+		got = append(got, payload...)
+		offset += int64(len(payload))
+	}
+	return got
+}
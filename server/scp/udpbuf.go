@@ -0,0 +1,78 @@
+package scp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"runtime"
+
+	"github.com/quic-go/quic-go"
+)
+
+// minUDPBuffer is the socket buffer size quic-go itself asks for. It raises
+// a smaller buffer to this anyway, so -udp-buffer may only ask for more.
+const minUDPBuffer = 7 << 20
+
+// bufferWarningEnv silences quic-go's own warning about small UDP buffers,
+// which is replaced by reportUDPBuffers unless -verbose is set.
+const bufferWarningEnv = "QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING"
+
+// listenQUIC listens on addr like quic.ListenAddr, but on a UDP socket whose
+// receive and send buffers are first asked to hold cfg.UDPBuffer bytes.
+// When the system holds them to less, which caps the throughput of every
+// connection, the log says so once, with the command that raises the limit.
+func listenQUIC(addr string, tlsConfig *tls.Config, quicConfig *quic.Config, cfg *settings) (*quic.Listener, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(int(cfg.UDPBuffer))
+	conn.SetWriteBuffer(int(cfg.UDPBuffer))
+	if _, set := os.LookupEnv(bufferWarningEnv); !set && !cfg.Verbose {
+		os.Setenv(bufferWarningEnv, "true")
+	}
+	listener, err := (&quic.Transport{Conn: conn}).Listen(tlsConfig, quicConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// quic-go has had its own try at the buffers by now; report what came of both
+	reportUDPBuffers(conn, int(cfg.UDPBuffer), cfg.Verbose)
+	return listener, nil
+}
+
+// reportUDPBuffers logs, in one line, the buffers of conn when either is
+// smaller than want bytes, or with verbose whatever they are.
+func reportUDPBuffers(conn *net.UDPConn, want int, verbose bool) {
+	receive, send, err := udpBuffers(conn)
+	switch {
+	case err != nil:
+		if verbose {
+			log.Printf("Could not read the UDP buffer sizes: %v", err)
+		}
+	case receive < want || send < want:
+		log.Printf("UDP buffers are smaller than asked for (receive %d KiB, send %d KiB, wanted %d KiB), which limits throughput; %s",
+			receive>>10, send>>10, want>>10, raiseBufferHint(want))
+	case verbose:
+		log.Printf("UDP buffers: receive %d KiB, send %d KiB", receive>>10, send>>10)
+	}
+}
+
+// raiseBufferHint says how to let sockets have buffers of size bytes on
+// this system.
+func raiseBufferHint(size int) string {
+	switch runtime.GOOS {
+	case "linux":
+		return fmt.Sprintf("to fix, run: sysctl -w net.core.rmem_max=%d net.core.wmem_max=%d", size, size)
+	case "darwin", "freebsd", "netbsd", "openbsd", "dragonfly":
+		// the limit counts the kernel's bookkeeping too, an eighth on top
+		return fmt.Sprintf("to fix, run: sysctl -w kern.ipc.maxsockbuf=%d", size+size/8)
+	}
+	return fmt.Sprintf("to fix, raise the system's limit on UDP socket buffers to %d bytes", size)
+}
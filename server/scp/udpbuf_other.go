@@ -0,0 +1,14 @@
+//go:build !unix
+
+package scp
+
+import (
+	"errors"
+	"net"
+)
+
+// udpBuffers returns the sizes of conn's receive and send buffers, which
+// cannot be read on this system.
+func udpBuffers(*net.UDPConn) (receive, send int, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
@@ -0,0 +1,33 @@
+//go:build unix
+
+package scp
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// udpBuffers returns the sizes of conn's receive and send buffers.
+func udpBuffers(conn *net.UDPConn) (receive, send int, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		receive, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if sockErr == nil {
+			send, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		}
+	})
+	if err == nil {
+		err = sockErr
+	}
+	if runtime.GOOS == "linux" {
+		// Linux reports twice the size that was set, the rest being its
+		// bookkeeping
+		receive, send = receive/2, send/2
+	}
+	return receive, send, err
+}
@@ -0,0 +1,52 @@
+package scp
+
+import (
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// commandUsage is the syntax of each command that takes arguments, keyed by
+// the words that select its handler. A command sent without the arguments
+// it needs, or with ones its handler cannot use, is answered with it.
+var commandUsage = map[string]string{
+	"upd":           "upd <file> [<size> [<codec>]]",
+	"upd-batch":     "upd-batch <count>, then <name> <size> and the file's bytes for each file",
+	"dwd":           "dwd <file>...",
+	"dwd --move":    "dwd --move <file>",
+	"dwd --chunks":  "dwd --chunks <name> <offset>",
+	"ls":            "ls [--sort=name|size|mtime] [--reverse] [--filter=<glob>] [--page=N] [--size=N]",
+	"find":          "find <pattern>",
+	"versions":      "versions <file>",
+	"bench":         "bench up|down <bytes>",
+	"symlink":       "symlink <name> <target>",
+	"rm":            "rm <file>",
+	"begin-upload":  "begin-upload <name> <size>",
+	"resume-upload": "resume-upload <id>",
+	"auth":          "auth <token>",
+	"kick":          "kick <addr> [<reason>]",
+}
+
+// usageError is the reply to a malformed use of the command name.
+func usageError(name string) string {
+	return "Error: usage: " + commandUsage[name] + "\n"
+}
+
+// writeUsage replies on stream with the usage of the command name.
+func writeUsage(stream quic.Stream, name string) {
+	stream.Write([]byte(usageError(name)))
+}
+
+// usageOf finds the command that an unrecognized command line names, the
+// longest match first, so that a bare "dwd --move" is told about moves
+// rather than downloads. ok is false for a line that names no command.
+func usageOf(command string) (name string, ok bool) {
+	words := strings.Fields(command)
+	for n := min(len(words), 2); n > 0; n-- {
+		name = strings.Join(words[:n], " ")
+		if _, ok := commandUsage[name]; ok {
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+package scp
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// volumePrefix starts the first element of a path in a named volume, as in
+// "vol:archive/2024/logs.tar". Everything else lives in storageDir, the
+// default volume.
+const volumePrefix = "vol:"
+
+// volumes maps each -volume name to its directory. Like storageDir it is
+// set once at startup.
+var volumes map[string]string
+
+var errUnknownVolume = errors.New("no such volume")
+
+// volumeMap holds the volume setting. As a flag it takes name=path and can
+// be repeated.
+type volumeMap map[string]string
+
+func (v *volumeMap) String() string {
+	if v == nil {
+		return ""
+	}
+	var pairs []string
+	for name, dir := range *v {
+		pairs = append(pairs, name+"="+dir)
+	}
+	slices.Sort(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (v *volumeMap) Set(s string) error {
+	name, dir, ok := strings.Cut(s, "=")
+	if !ok || dir == "" {
+		return fmt.Errorf("want name=path, got %q", s)
+	}
+	if *v == nil {
+		*v = make(volumeMap)
+	}
+	(*v)[name] = dir
+	return nil
+}
+
+// validVolumeName reports whether name can be written after volumePrefix
+// as one path element.
+func validVolumeName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `/\:`) && name != "." && name != ".."
+}
+
+// splitVolume splits a storage-relative path into the name of its volume
+// and the path inside it. ok is false for paths in the default volume.
+func splitVolume(rel string) (name, inside string, ok bool) {
+	first, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	name, ok = strings.CutPrefix(first, volumePrefix)
+	if !ok {
+		return "", rel, false
+	}
+	if rest == "" {
+		rest = "."
+	}
+	return name, filepath.FromSlash(rest), true
+}
+
+// volumeRoot is the directory rel's volume is stored in.
+func volumeRoot(rel string) string {
+	if name, _, ok := splitVolume(rel); ok {
+		return volumes[name]
+	}
+	return storageDir
+}
+
+// handleVolumes lists the volumes a client can address: the default one
+// and every named volume, by name only. A session confined to a home
+// directory only has the default one.
+func handleVolumes(sess *clientSession, stream quic.Stream) {
+	lines := []string{"/ (default)"}
+	for name := range volumes {
+		if sess.getHome() == "" {
+			lines = append(lines, volumePrefix+name+"/")
+		}
+	}
+	slices.Sort(lines[1:])
+	stream.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
@@ -5,32 +5,56 @@ import (
     "crypto/rsa"
     "crypto/x509"
     "encoding/pem"
+    "flag"
+    "log"
     "os"
+    "path/filepath"
 )
 
-func generateKeys() {
+// generateKeys writes a new RSA key pair: the private key to keyPath and
+// the public key to pubPath, creating their directories if need be.
+func generateKeys(keyPath, pubPath string) error {
     // Generate private key
     privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
     if err != nil {
-        panic(err)
+        return err
     }
 
     // Save private key
-    privateKeyFile, _ := os.Create("private_key.pem")
-    defer privateKeyFile.Close()
     privateKeyBytes := x509.MarshalPKCS1PrivateKey(privateKey)
-    pem.Encode(privateKeyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: privateKeyBytes})
+    if err := writePEM(keyPath, 0o600, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: privateKeyBytes}); err != nil {
+        return err
+    }
 
     // Generate public key
     publicKey := privateKey.PublicKey
     publicKeyBytes, _ := x509.MarshalPKIXPublicKey(&publicKey)
 
     // Save public key
-    publicKeyFile, _ := os.Create("public_key.pem")
-    defer publicKeyFile.Close()
-    pem.Encode(publicKeyFile, &pem.Block{Type: "RSA PUBLIC KEY", Bytes: publicKeyBytes})
+    return writePEM(pubPath, 0o644, &pem.Block{Type: "RSA PUBLIC KEY", Bytes: publicKeyBytes})
+}
+
+// writePEM writes block to path with permissions perm.
+func writePEM(path string, perm os.FileMode, block *pem.Block) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+        return err
+    }
+    file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+    if err != nil {
+        return err
+    }
+    if err := pem.Encode(file, block); err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
 }
 
 func main() {
-    generateKeys()
+    keyPath := flag.String("key", "private_key.pem", "file the private key is written to")
+    pubPath := flag.String("pub", "public_key.pem", "file the public key is written to")
+    flag.Parse()
+    if err := generateKeys(*keyPath, *pubPath); err != nil {
+        log.Fatalf("Failed to generate keys: %v", err)
+    }
 }